@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"time"
 
+	"bearlysocial-backend/api/problem"
 	"bearlysocial-backend/util"
 
 	"go.mongodb.org/mongo-driver/bson"
@@ -13,9 +14,9 @@ import (
 )
 
 func Benchmark(w http.ResponseWriter, r *http.Request) {
-	_, err := util.GenerateToken("john_doe@example.com")
+	_, err := util.GenerateToken()
 	if err != nil {
-		util.ReturnMessage(w, http.StatusInternalServerError, "Failed to generate token.")
+		problem.Write(w, problem.Internal, "Failed to generate token.")
 		return
 	}
 
@@ -30,14 +31,14 @@ func Benchmark(w http.ResponseWriter, r *http.Request) {
 	opts := options.Update().SetUpsert(true)
 	_, err = util.MongoCollection.UpdateOne(ctx, bson.M{"_id": "benchmark_data"}, bson.M{"$set": doc}, opts)
 	if err != nil {
-		util.ReturnMessage(w, http.StatusInternalServerError, "Failed to insert/update data.")
+		problem.Write(w, problem.Internal, "Failed to insert/update data.")
 		return
 	}
 
 	var result bson.M
 	err = util.MongoCollection.FindOne(ctx, bson.M{"_id": "benchmark_data"}).Decode(&result)
 	if err != nil {
-		util.ReturnMessage(w, http.StatusInternalServerError, "Failed to retrieve data.")
+		problem.Write(w, problem.Internal, "Failed to retrieve data.")
 		return
 	}
 
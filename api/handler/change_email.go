@@ -0,0 +1,220 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"bearlysocial-backend/api/middleware"
+	"bearlysocial-backend/api/model"
+	"bearlysocial-backend/api/problem"
+	"bearlysocial-backend/api/repository"
+	"bearlysocial-backend/emailaddr"
+	"bearlysocial-backend/emails"
+	"bearlysocial-backend/i18n"
+	"bearlysocial-backend/util"
+)
+
+// The value the codes of an email change are hashed under in place of the bare ID. It includes the address, so
+// the code sent to one address is no good for the other.
+func emailChangeOTPKey(uid, address string) string {
+	return uid + "\x00" + address
+}
+
+// Handles the first step of changing the signed-in account's email address: sends a code to the current
+// address and another to the new one. Both go to ConfirmEmailChange, so neither a stolen session nor a mistyped
+// address is enough to move the account.
+func (h *Handler) BeginEmailChange(w http.ResponseWriter, r *http.Request) {
+	// Retrieve user data from context.
+	user_acc, ok := r.Context().Value(middleware.USER_ACCOUNT).(model.UserAccount)
+	if !ok {
+		problem.Write(w, problem.Internal, "Failed to retrieve user session.")
+		return
+	}
+
+	// Parse request body.
+	var req model.BeginEmailChange
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		problem.Write(w, problem.InvalidRequest, "Invalid request format.")
+		return
+	}
+
+	addr, err := emailaddr.Parse(req.NewEmailAddress)
+	if err != nil {
+		problem.InvalidField.New("Invalid email format.").InField("new_email_address").Write(w)
+		return
+	}
+	newEmail := addr.String()
+	if h.BlockedDomains.Blocked(addr) {
+		problem.Write(w, problem.EmailBlocked, "Please use a permanent email address.")
+		return
+	}
+	if newEmail == user_acc.Email {
+		problem.Write(w, problem.EmailUnchanged, "This is already your email address.")
+		return
+	}
+
+	// Create a context with a timeout to prevent long-running database operations.
+	ctx, cancel := context.WithTimeout(context.Background(), 8 * time.Second)
+	defer cancel()
+
+	// Every request sends two emails, so it counts against the same limits as an OTP request, for both addresses.
+	limits := h.OTPRequestLimits
+	rateLimits := []rateLimit{
+		{"otp:ip:" + util.ClientIP(r, h.ClientIPHeader), limits.PerIP},
+		{emailRateLimitKey(user_acc.Email), limits.PerEmail},
+		{emailRateLimitKey(newEmail), limits.PerEmail},
+		{"otp:global", limits.Global},
+	}
+	if !h.allow(ctx, w, rateLimits...) {
+		return
+	}
+
+	_, err = h.Users.FindByEmail(ctx, newEmail)
+	if err == nil {
+		problem.Write(w, problem.EmailInUse, "This email address is already in use.")
+		return
+	}
+	if err != repository.ErrNotFound {
+		log.Printf("DATABASE ERROR: %v\n", err)
+		problem.Write(w, problem.Internal, "Database error.")
+		return
+	}
+
+	oldOTP, err1 := h.OTPPolicy.Generate()
+	newOTP, err2 := h.OTPPolicy.Generate()
+	if err1 != nil || err2 != nil {
+		log.Printf("ERROR GENERATING OTP: %v %v\n", err1, err2)
+		problem.Write(w, problem.Internal, "Failed to generate OTP.")
+		return
+	}
+
+	// Starting over replaces any pending change, and with it the codes sent for it.
+	oldOTPHash := util.HashOTP(h.OTPSecret, emailChangeOTPKey(user_acc.ID, user_acc.Email), oldOTP)
+	err = h.Users.BeginEmailChange(ctx, user_acc.ID, model.EmailChange{
+		NewEmail: newEmail,
+		OldOTP: oldOTPHash,
+		NewOTP: util.HashOTP(h.OTPSecret, emailChangeOTPKey(user_acc.ID, newEmail), newOTP),
+		AttemptCount: 0,
+		ExpiryTime: time.Now().Add(h.OTPPolicy.TTL).UnixMilli(),
+	})
+	if err != nil {
+		log.Printf("DATABASE ERROR: %v\n", err)
+		problem.Write(w, problem.Internal, "Failed to start email change.")
+		return
+	}
+
+	tag := i18n.Negotiate(r.Header.Get("Accept-Language"), user_acc.Langs)
+	ttl := i18n.Duration(h.OTPPolicy.TTL)
+	err = h.sendEmail(tag, user_acc.Email, emails.EmailChange{Code: oldOTP, TTL: ttl, NewAddress: newEmail, ToCurrent: true})
+	if err == nil {
+		err = h.sendEmail(tag, newEmail, emails.EmailChange{Code: newOTP, TTL: ttl, NewAddress: newEmail})
+	}
+	if err != nil {
+		log.Printf("ERROR SENDING EMAIL: %v\n", err)
+
+		// The change cannot be confirmed without both codes, so the one that did go out must not stay valid.
+		// Drop the change and give the tokens back, so the client can simply try again.
+		if err := h.Users.DiscardEmailChange(ctx, user_acc.ID, oldOTPHash); err != nil {
+			log.Printf("DATABASE ERROR: %v\n", err)
+		}
+		h.refund(ctx, rateLimits...)
+		problem.Write(w, problem.Internal, "Failed to send confirmation email.")
+		return
+	}
+
+	util.ReturnMessage(w, http.StatusOK, "Confirmation codes sent.")
+}
+
+// Handles the second step of changing the signed-in account's email address: checks both codes, moves the
+// account to the new address and signs out every other session. Responds with the updated account.
+func (h *Handler) ConfirmEmailChange(w http.ResponseWriter, r *http.Request) {
+	// Retrieve user and session data from context.
+	user_acc, ok := r.Context().Value(middleware.USER_ACCOUNT).(model.UserAccount)
+	current, ok2 := r.Context().Value(middleware.SESSION).(model.Session)
+	if !ok || !ok2 {
+		problem.Write(w, problem.Internal, "Failed to retrieve user session.")
+		return
+	}
+
+	// Parse request body.
+	var req model.ConfirmEmailChange
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		problem.Write(w, problem.InvalidRequest, "Invalid request format.")
+		return
+	}
+
+	oldOTP := strings.TrimSpace(req.OldOTP)
+	newOTP := strings.TrimSpace(req.NewOTP)
+	if !h.OTPPolicy.Valid(oldOTP) || !h.OTPPolicy.Valid(newOTP) {
+		problem.Write(w, problem.InvalidField, "Invalid OTP format.")
+		return
+	}
+
+	// Create a context with a timeout to prevent long-running database operations.
+	ctx, cancel := context.WithTimeout(context.Background(), 8 * time.Second)
+	defer cancel()
+
+	// Count the attempt before checking the codes, as ValidateOTP does.
+	policy := h.OTPPolicy
+	user_acc, err := h.Users.ReserveEmailChangeAttempt(ctx, user_acc.ID, time.Now().UnixMilli(), policy.MaxAttempts)
+	if err == repository.ErrNotFound {
+		problem.Write(w, problem.EmailChangeExpired, "Email change expired or invalid. Please start again.")
+		return
+	}
+	if err != nil {
+		log.Printf("DATABASE ERROR: %v\n", err)
+		problem.Write(w, problem.Internal, "Database error.")
+		return
+	}
+
+	change := user_acc.EmailChange
+	oldOK := util.MatchOTP(h.OTPSecret, emailChangeOTPKey(user_acc.ID, user_acc.Email), change.OldOTP, oldOTP)
+	newOK := util.MatchOTP(h.OTPSecret, emailChangeOTPKey(user_acc.ID, change.NewEmail), change.NewOTP, newOTP)
+	if !oldOK || !newOK {
+		// That was the last attempt, so the change is of no further use.
+		if change.AttemptCount >= policy.MaxAttempts {
+			if err := h.Users.DiscardEmailChange(ctx, user_acc.ID, change.OldOTP); err != nil {
+				log.Printf("DATABASE ERROR: %v\n", err)
+				problem.Write(w, problem.Internal, "Failed to update attempt count.")
+				return
+			}
+			problem.Write(w, problem.TooManyAttempts, "Too many failed attempts. Please start again.")
+			return
+		}
+
+		problem.Write(w, problem.OTPIncorrect, "The codes you provided are incorrect.")
+		return
+	}
+
+	user_acc, err = h.Users.ChangeEmail(ctx, user_acc.ID, change.OldOTP)
+	if err == repository.ErrNotFound {
+		// A concurrent request replaced or finished the change after this attempt was counted.
+		problem.Write(w, problem.EmailChangeExpired, "Email change expired or invalid. Please start again.")
+		return
+	}
+	if err == repository.ErrDuplicate {
+		// Another account took the address after the codes were sent.
+		problem.Write(w, problem.EmailInUse, "This email address is already in use.")
+		return
+	}
+	if err != nil {
+		log.Printf("DATABASE ERROR: %v\n", err)
+		problem.Write(w, problem.Internal, "Failed to update account.")
+		return
+	}
+
+	// Whoever else was signed in got there through the old address, so only this device stays signed in.
+	if _, err := h.Sessions.DeleteAll(ctx, user_acc.ID, current.ID); err != nil {
+		log.Printf("DATABASE ERROR: %v\n", err)
+		problem.Write(w, problem.Internal, "Failed to revoke sessions.")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(user_acc)
+}
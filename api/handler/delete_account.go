@@ -1 +1,55 @@
-package handler
\ No newline at end of file
+package handler
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"bearlysocial-backend/api/middleware"
+	"bearlysocial-backend/api/model"
+	"bearlysocial-backend/api/problem"
+	"bearlysocial-backend/emails"
+	"bearlysocial-backend/i18n"
+	"bearlysocial-backend/util"
+)
+
+// Handles account deletion request.
+func (h *Handler) DeleteAccount(w http.ResponseWriter, r *http.Request) {
+	// Retrieve user data from context.
+	user_acc, ok := r.Context().Value(middleware.USER_ACCOUNT).(model.UserAccount)
+	if !ok {
+		problem.Write(w, problem.Internal, "Failed to retrieve user session.")
+		return
+	}
+
+	gracePeriod := h.DeletionGracePeriod
+	deletionTime := time.Now().Add(gracePeriod).UnixMilli()
+
+	// Create a context with a timeout to prevent long-running database operations.
+	ctx, cancel := context.WithTimeout(context.Background(), 8 * time.Second)
+	defer cancel()
+
+	// Mark the account for deletion.
+	err := h.Users.ScheduleDeletion(ctx, user_acc.ID, deletionTime)
+	if err != nil {
+		log.Printf("DATABASE ERROR: %v\n", err)
+		problem.Write(w, problem.Internal, "Failed to schedule account deletion.")
+		return
+	}
+
+	// Sign the user out everywhere; signing in again cancels the deletion.
+	if _, err := h.Sessions.DeleteAll(ctx, user_acc.ID, ""); err != nil {
+		log.Printf("DATABASE ERROR: %v\n", err)
+		problem.Write(w, problem.Internal, "Failed to revoke sessions.")
+		return
+	}
+
+	// The deletion already stands, so a confirmation that cannot be sent is no reason to fail the request.
+	err = h.sendEmail(i18n.FromHeader(w.Header()), user_acc.Email, emails.AccountDeletion{GracePeriod: i18n.Duration(gracePeriod)})
+	if err != nil {
+		log.Printf("ERROR SENDING EMAIL: %v\n", err)
+	}
+
+	util.ReturnMessage(w, http.StatusOK, "Your account will be deleted in %s. Sign in again to cancel.", i18n.Duration(gracePeriod))
+}
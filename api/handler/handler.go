@@ -0,0 +1,82 @@
+package handler
+
+import (
+	"time"
+
+	"bearlysocial-backend/api/repository"
+	"bearlysocial-backend/emailaddr"
+	"bearlysocial-backend/mailer"
+	"bearlysocial-backend/oidc"
+	"bearlysocial-backend/util"
+	"bearlysocial-backend/webauthn"
+)
+
+// Holds the dependencies shared by the HTTP handlers.
+type Handler struct {
+	Users    repository.UserAccounts
+	Sessions repository.Sessions
+	Mailer   mailer.Mailer
+
+	// Token buckets that limit how often OTP emails are sent.
+	RateLimits       repository.RateLimits
+	OTPRequestLimits OTPRequestLimits
+
+	// Single-use challenges for passkey ceremonies.
+	Challenges repository.Challenges
+
+	// The relying party passkeys are registered with, or nil if passkeys are disabled.
+	WebAuthn *webauthn.Config
+
+	// OpenID Connect providers users can sign in with, keyed by name, and where they redirect back to.
+	OIDCProviders   map[string]*oidc.Provider
+	OIDCRedirectURL string
+
+	// Domains new accounts may not use, such as disposable mailbox services, or nil to allow every domain.
+	BlockedDomains *emailaddr.Blocklist
+
+	// Header a trusted reverse proxy puts the client address in, or "" to use the connection's address.
+	ClientIPHeader string
+
+	// Server-side key for the HMAC under which OTPs are stored.
+	OTPSecret []byte
+
+	// Shape, lifetime and attempt limits of OTPs.
+	OTPPolicy util.OTPPolicy
+
+	// Name authenticator apps show next to the account.
+	TOTPIssuer string
+
+	// Token bucket, per account, that limits attempts at second-factor codes.
+	SecondFactorLimit repository.Bucket
+
+	// Token bucket, per client IP, that limits how often sign-ins with a passkey or a provider are started.
+	// Each one stores a challenge, so unlimited requests would fill the database.
+	SignInLimit repository.Bucket
+
+	// Where emailed magic links point, typically a universal link or app scheme that opens the app. The token
+	// is appended as the "token" query parameter. Empty disables magic links.
+	MagicLinkURL string
+
+	// How long a session, and with it its refresh token, stays valid after sign-in, however active it is.
+	SessionLifetime time.Duration
+
+	// How long a session may go unused before it expires. Zero disables the idle timeout.
+	IdleTimeout time.Duration
+
+	// How long an access token stays valid before it has to be refreshed.
+	AccessTokenLifetime time.Duration
+
+	// How long the previous token pair of a session is still accepted after a refresh.
+	RotationGrace time.Duration
+
+	// How long a user has to change their mind, by signing in again, before a deleted account is removed for good.
+	DeletionGracePeriod time.Duration
+}
+
+// The time limits the session store applies whenever a session is used.
+func (h *Handler) SessionLimits() repository.SessionLimits {
+	return repository.SessionLimits{
+		RotationGrace: h.RotationGrace.Milliseconds(),
+		IdleTimeout:   h.IdleTimeout.Milliseconds(),
+	}
+}
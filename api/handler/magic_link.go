@@ -0,0 +1,97 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"bearlysocial-backend/api/model"
+	"bearlysocial-backend/api/problem"
+	"bearlysocial-backend/api/repository"
+	"bearlysocial-backend/util"
+)
+
+// Builds the magic link for an OTP that was just issued, or returns "" if magic links are disabled.
+func (h *Handler) magicLink(uid, otpHash string, expiryTime int64) string {
+	if h.MagicLinkURL == "" {
+		return ""
+	}
+
+	link, err := url.Parse(h.MagicLinkURL)
+	if err != nil {
+		log.Printf("INVALID MAGIC LINK URL: %v\n", err)
+		return ""
+	}
+	query := link.Query()
+	query.Set("token", util.SignMagicLink(h.OTPSecret, uid, otpHash, expiryTime))
+	link.RawQuery = query.Encode()
+	return link.String()
+}
+
+// Handles magic-link confirmation. The link itself only opens the app, which posts its token here; opening
+// the link never signs anyone in, since mail scanners fetch links on their own and would otherwise use it up.
+func (h *Handler) ConfirmMagicLink(w http.ResponseWriter, r *http.Request) {
+	// Parse request body.
+	var req model.ConfirmMagicLink
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		problem.Write(w, problem.InvalidRequest, "Invalid request format.")
+		return
+	}
+
+	uid, expiryTime, sig, ok := util.ParseMagicLink(strings.TrimSpace(req.Token))
+	if !ok {
+		problem.Write(w, problem.LinkInvalid, "Invalid sign-in link.")
+		return
+	}
+
+	deviceLabel := strings.TrimSpace(req.DeviceLabel)
+	if !util.ValidDeviceLabel(deviceLabel) {
+		problem.InvalidField.New("Invalid device label.").InField("device_label").Write(w)
+		return
+	}
+
+	now := time.Now().UnixMilli()
+	if expiryTime <= now {
+		problem.Write(w, problem.LinkExpired, "This sign-in link has expired. Please request a new one.")
+		return
+	}
+
+	// Create a context with a timeout to prevent long-running database operations.
+	ctx, cancel := context.WithTimeout(context.Background(), 8 * time.Second)
+	defer cancel()
+
+	user_acc, err := h.Users.Find(ctx, uid)
+	if err != nil && err != repository.ErrNotFound {
+		log.Printf("DATABASE ERROR: %v\n", err)
+		problem.Write(w, problem.Internal, "Database error.")
+		return
+	}
+
+	// The link is only good for the OTP it was sent with, while that OTP is pending and the account is not in
+	// cooldown. Every failure looks the same, so the response reveals nothing about the account.
+	valid := err == nil && user_acc.OTP != nil && user_acc.OTP_ExpiryTime != nil &&
+		*user_acc.OTP_ExpiryTime == expiryTime &&
+		(user_acc.CooldownTime == nil || *user_acc.CooldownTime <= now) &&
+		util.MatchMagicLink(h.OTPSecret, uid, *user_acc.OTP, expiryTime, sig)
+	if !valid {
+		problem.Write(w, problem.LinkInvalid, "This sign-in link is no longer valid. Please request a new one.")
+		return
+	}
+
+	// Consuming the OTP makes the link single-use, and fails if the OTP was used or replaced since it was read.
+	user_acc, err = h.Users.CompleteOTP(ctx, uid, *user_acc.OTP)
+	if err == repository.ErrNotFound {
+		problem.Write(w, problem.LinkInvalid, "This sign-in link is no longer valid. Please request a new one.")
+		return
+	}
+	if err != nil {
+		problem.Write(w, problem.Internal, "Failed to update account.")
+		return
+	}
+
+	h.completeFirstFactor(ctx, w, r, user_acc, deviceLabel, nil)
+}
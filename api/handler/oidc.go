@@ -0,0 +1,207 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"bearlysocial-backend/api/model"
+	"bearlysocial-backend/api/problem"
+	"bearlysocial-backend/api/repository"
+	"bearlysocial-backend/emailaddr"
+	"bearlysocial-backend/oidc"
+	"bearlysocial-backend/util"
+)
+
+const (
+	oidcLoginPurpose = "oidc-login"
+
+	// How long the user may take at the provider before the sign-in has to start over.
+	oidcLoginLifetime = 10 * time.Minute
+)
+
+// Handles the first step of signing in with an OpenID Connect provider: responds with the URL to send the user
+// to. The provider redirects back to the app with a code and state, which go to FinishOIDCLogin.
+func (h *Handler) BeginOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	// Parse request body.
+	var req model.BeginOIDCLogin
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		problem.Write(w, problem.InvalidRequest, "Invalid request format.")
+		return
+	}
+
+	provider, ok := h.OIDCProviders[strings.ToLower(strings.TrimSpace(req.Provider))]
+	if !ok {
+		problem.Write(w, problem.ProviderUnknown, "Unknown sign-in provider.")
+		return
+	}
+
+	// Create a context with a timeout to prevent long-running database operations.
+	ctx, cancel := context.WithTimeout(context.Background(), 8 * time.Second)
+	defer cancel()
+
+	// Anyone can start a sign-in, and every one stores a challenge and calls the provider, so limit them per client.
+	if !h.allow(ctx, w, rateLimit{"oidc:ip:" + util.ClientIP(r, h.ClientIPHeader), h.SignInLimit}) {
+		return
+	}
+
+	state, err1 := util.GenerateToken()
+	nonce, err2 := util.GenerateToken()
+	verifier, challenge, err3 := oidc.NewPKCE()
+	if err1 != nil || err2 != nil || err3 != nil {
+		problem.Write(w, problem.Internal, "Failed to generate token.")
+		return
+	}
+
+	// Talking to the provider can take longer than a database round trip, so it gets its own timeout.
+	providerCtx, cancelProvider := context.WithTimeout(context.Background(), 16 * time.Second)
+	defer cancelProvider()
+
+	authURL, err := provider.AuthCodeURL(providerCtx, h.OIDCRedirectURL, state, nonce, challenge)
+	if err != nil {
+		log.Printf("OIDC PROVIDER ERROR: %v\n", err)
+		problem.Write(w, problem.ProviderUnavailable, "Sign-in provider unavailable. Please try again later.")
+		return
+	}
+
+	// The state travels through the browser, so only its digest is stored, like every other bearer token.
+	err = h.Challenges.Create(ctx, model.Challenge{
+		ID: util.HashToken(state),
+		Purpose: oidcLoginPurpose,
+		Provider: provider.Name,
+		Nonce: nonce,
+		CodeVerifier: verifier,
+		ExpiryTime: time.Now().Add(oidcLoginLifetime).UnixMilli(),
+	})
+	if err != nil {
+		log.Printf("DATABASE ERROR: %v\n", err)
+		problem.Write(w, problem.Internal, "Failed to start sign-in.")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(model.OIDCAuthorization{AuthorizationURL: authURL})
+}
+
+// Handles the second step of signing in with an OpenID Connect provider: exchanges the code, verifies the ID
+// token, and signs in to the account linked to that identity or, failing that, the account of its verified
+// email address, which is created if need be. Responds like ValidateOTP.
+func (h *Handler) FinishOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	// Parse request body.
+	var req model.FinishOIDCLogin
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		problem.Write(w, problem.InvalidRequest, "Invalid request format.")
+		return
+	}
+
+	state := strings.ToLower(strings.TrimSpace(req.State))
+	code := strings.TrimSpace(req.Code)
+	if !util.ValidHashpass(state) || code == "" {
+		problem.Write(w, problem.InvalidRequest, "Invalid request format.")
+		return
+	}
+
+	deviceLabel := strings.TrimSpace(req.DeviceLabel)
+	if !util.ValidDeviceLabel(deviceLabel) {
+		problem.InvalidField.New("Invalid device label.").InField("device_label").Write(w)
+		return
+	}
+
+	// Create a context with a timeout to prevent long-running database operations.
+	ctx, cancel := context.WithTimeout(context.Background(), 8 * time.Second)
+	defer cancel()
+
+	// Consuming the state makes every sign-in single-use, whatever happens next.
+	challenge, err := h.Challenges.Consume(ctx, util.HashToken(state), oidcLoginPurpose, time.Now().UnixMilli())
+	if err == repository.ErrNotFound {
+		problem.Write(w, problem.SignInExpired, "Sign-in expired or invalid. Please try again.")
+		return
+	}
+	if err != nil {
+		log.Printf("DATABASE ERROR: %v\n", err)
+		problem.Write(w, problem.Internal, "Database error.")
+		return
+	}
+	provider, ok := h.OIDCProviders[challenge.Provider]
+	if !ok {
+		problem.Write(w, problem.ProviderUnknown, "Unknown sign-in provider.")
+		return
+	}
+
+	// Talking to the provider can take longer than a database round trip, so it gets its own timeout.
+	providerCtx, cancelProvider := context.WithTimeout(context.Background(), 16 * time.Second)
+	defer cancelProvider()
+
+	rawIDToken, err := provider.Exchange(providerCtx, code, challenge.CodeVerifier, h.OIDCRedirectURL)
+	var claims oidc.Claims
+	if err == nil {
+		claims, err = provider.VerifyIDToken(providerCtx, rawIDToken, challenge.Nonce, time.Now())
+	}
+	if errors.Is(err, oidc.ErrVerification) {
+		log.Printf("OIDC SIGN-IN REJECTED: %v\n", err)
+		problem.Write(w, problem.SignInUnverified, "Sign-in could not be verified. Please try again.")
+		return
+	}
+	if err != nil {
+		log.Printf("OIDC PROVIDER ERROR: %v\n", err)
+		problem.Write(w, problem.ProviderUnavailable, "Sign-in provider unavailable. Please try again later.")
+		return
+	}
+
+	identity := model.Identity{
+		ID: provider.Name + ":" + claims.Subject,
+		Provider: provider.Name,
+		Subject: claims.Subject,
+		Email: claims.Email,
+		LinkedAt: time.Now().UnixMilli(),
+	}
+
+	// An identity that was linked before keeps its account, even if the address at the provider changed since.
+	user_acc, err := h.Users.FindByIdentity(ctx, identity.ID)
+	if err == repository.ErrNotFound {
+		// Otherwise the address decides, which is only safe if the provider has checked it belongs to the user.
+		addr, parseErr := emailaddr.Parse(claims.Email)
+		if !claims.EmailVerified || parseErr != nil {
+			problem.Write(w, problem.EmailUnverified, "Your account with this provider has no verified email address.")
+			return
+		}
+
+		user_acc, err = h.findOrCreateAccount(ctx, addr)
+	}
+	if err == errBlockedDomain {
+		problem.Write(w, problem.EmailBlocked, "Please use a permanent email address.")
+		return
+	}
+	if err != nil {
+		log.Printf("DATABASE ERROR: %v\n", err)
+		problem.Write(w, problem.Internal, "Database error.")
+		return
+	}
+
+	// A provider sign-in stands in for the emailed OTP, so an authenticator app is still asked for. Until it
+	// has been, the account is only read: the identity is linked, and a pending deletion cancelled, once every
+	// factor is checked.
+	h.completeFirstFactor(ctx, w, r, user_acc, deviceLabel, &identity)
+}
+
+// Records a provider sign-in whose every factor has been checked: links the identity to the account and cancels
+// any pending deletion. Writes the problem and returns false if that fails.
+func (h *Handler) useIdentity(ctx context.Context, w http.ResponseWriter, user_acc model.UserAccount, identity model.Identity) (model.UserAccount, bool) {
+	user_acc, err := h.Users.UseIdentity(ctx, user_acc.ID, identity)
+	if err == repository.ErrDuplicate || err == repository.ErrNotFound {
+		// A concurrent sign-in linked the identity to another account first, or the account went away.
+		problem.Write(w, problem.SignInExpired, "Sign-in expired or invalid. Please try again.")
+		return model.UserAccount{}, false
+	}
+	if err != nil {
+		log.Printf("DATABASE ERROR: %v\n", err)
+		problem.Write(w, problem.Internal, "Failed to update account.")
+		return model.UserAccount{}, false
+	}
+	return user_acc, true
+}
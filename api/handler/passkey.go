@@ -0,0 +1,383 @@
+package handler
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"bearlysocial-backend/api/middleware"
+	"bearlysocial-backend/api/model"
+	"bearlysocial-backend/api/problem"
+	"bearlysocial-backend/api/repository"
+	"bearlysocial-backend/emailaddr"
+	"bearlysocial-backend/util"
+	"bearlysocial-backend/webauthn"
+)
+
+const (
+	passkeyRegistrationPurpose = "passkey-registration"
+	passkeyLoginPurpose        = "passkey-login"
+
+	// How long a ceremony may take, slightly longer than the timeout the client is given.
+	passkeyChallengeLifetime = 6 * time.Minute
+
+	// Most passkeys a single account can hold.
+	maxPasskeys = 16
+)
+
+// Decodes base64url, with or without padding, as browsers and native passkey APIs differ on that.
+func decodeBase64URL(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(strings.TrimSpace(s), "="))
+}
+
+// Creates and stores a fresh challenge for a passkey ceremony.
+func (h *Handler) newChallenge(ctx context.Context, purpose, userID string) ([]byte, error) {
+	challenge := make([]byte, 32)
+	if _, err := rand.Read(challenge); err != nil {
+		return nil, err
+	}
+
+	err := h.Challenges.Create(ctx, model.Challenge{
+		ID: base64.RawURLEncoding.EncodeToString(challenge),
+		Purpose: purpose,
+		UserID: userID,
+		ExpiryTime: time.Now().Add(passkeyChallengeLifetime).UnixMilli(),
+	})
+	return challenge, err
+}
+
+// Consumes the stored challenge the client data answers. Whatever happens next, the challenge cannot be used
+// again, so a captured response is worthless.
+func (h *Handler) consumeChallenge(ctx context.Context, purpose string, clientDataJSON []byte) ([]byte, model.Challenge, error) {
+	challenge, err := webauthn.ClientChallenge(clientDataJSON)
+	if err != nil {
+		return nil, model.Challenge{}, err
+	}
+	stored, err := h.Challenges.Consume(ctx, base64.RawURLEncoding.EncodeToString(challenge), purpose, time.Now().UnixMilli())
+	return challenge, stored, err
+}
+
+// The WebAuthn user handle for an account. It must not reveal the email address, so it is a digest of the ID.
+func passkeyUserHandle(uid string) []byte {
+	handle := sha256.Sum256([]byte(uid))
+	return handle[:]
+}
+
+// Handles the first step of adding a passkey to the signed-in account.
+func (h *Handler) BeginPasskeyRegistration(w http.ResponseWriter, r *http.Request) {
+	// Retrieve user data from context.
+	user_acc, ok := r.Context().Value(middleware.USER_ACCOUNT).(model.UserAccount)
+	if !ok {
+		problem.Write(w, problem.Internal, "Failed to retrieve user session.")
+		return
+	}
+
+	if len(user_acc.Passkeys) >= maxPasskeys {
+		problem.Write(w, problem.PasskeyLimitReached, "You cannot add more passkeys. Please remove one first.")
+		return
+	}
+
+	// Create a context with a timeout to prevent long-running database operations.
+	ctx, cancel := context.WithTimeout(context.Background(), 8 * time.Second)
+	defer cancel()
+
+	challenge, err := h.newChallenge(ctx, passkeyRegistrationPurpose, user_acc.ID)
+	if err != nil {
+		log.Printf("DATABASE ERROR: %v\n", err)
+		problem.Write(w, problem.Internal, "Failed to start passkey registration.")
+		return
+	}
+
+	// Existing passkeys are excluded so the same authenticator is not registered twice.
+	var exclude [][]byte
+	for _, passkey := range user_acc.Passkeys {
+		if id, err := decodeBase64URL(passkey.ID); err == nil {
+			exclude = append(exclude, id)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(h.WebAuthn.CreationOptions(challenge, passkeyUserHandle(user_acc.ID), user_acc.Email, exclude))
+}
+
+// Handles the second step of adding a passkey: verifies the new credential and attaches it to the account.
+func (h *Handler) FinishPasskeyRegistration(w http.ResponseWriter, r *http.Request) {
+	// Retrieve user data from context.
+	user_acc, ok := r.Context().Value(middleware.USER_ACCOUNT).(model.UserAccount)
+	if !ok {
+		problem.Write(w, problem.Internal, "Failed to retrieve user session.")
+		return
+	}
+
+	// Parse request body.
+	var req model.FinishPasskeyRegistration
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		problem.Write(w, problem.InvalidRequest, "Invalid request format.")
+		return
+	}
+	clientDataJSON, err1 := decodeBase64URL(req.ClientDataJSON)
+	attestationObject, err2 := decodeBase64URL(req.AttestationObject)
+	if err1 != nil || err2 != nil {
+		problem.Write(w, problem.InvalidRequest, "Invalid request format.")
+		return
+	}
+
+	name := strings.TrimSpace(req.Name)
+	if !util.ValidDeviceLabel(name) {
+		problem.InvalidField.New("Invalid passkey name.").InField("name").Write(w)
+		return
+	}
+	if name == "" {
+		name = "Passkey"
+	}
+
+	// Create a context with a timeout to prevent long-running database operations.
+	ctx, cancel := context.WithTimeout(context.Background(), 8 * time.Second)
+	defer cancel()
+
+	challenge, stored, err := h.consumeChallenge(ctx, passkeyRegistrationPurpose, clientDataJSON)
+	if err != nil && err != repository.ErrNotFound && !isVerificationError(err) {
+		log.Printf("DATABASE ERROR: %v\n", err)
+		problem.Write(w, problem.Internal, "Database error.")
+		return
+	}
+	if err != nil || stored.UserID != user_acc.ID {
+		problem.Write(w, problem.PasskeyChallengeExpired, "Passkey registration expired or invalid. Please try again.")
+		return
+	}
+
+	cred, err := h.WebAuthn.VerifyRegistration(challenge, clientDataJSON, attestationObject)
+	if err != nil {
+		log.Printf("PASSKEY REGISTRATION REJECTED: %v\n", err)
+		problem.Write(w, problem.PasskeyFailed, "Passkey verification failed.")
+		return
+	}
+
+	now := time.Now().UnixMilli()
+	passkey := model.Passkey{
+		ID: base64.RawURLEncoding.EncodeToString(cred.ID),
+		PublicKey: cred.PublicKey,
+		SignCount: int64(cred.SignCount),
+		Name: name,
+		CreatedAt: now,
+		LastUsedAt: now,
+	}
+
+	// Checked again here, as another registration may have finished since this one began.
+	err = h.Users.AddPasskey(ctx, user_acc.ID, passkey, maxPasskeys)
+	if err == repository.ErrDuplicate {
+		problem.Write(w, problem.PasskeyExists, "This passkey is already registered.")
+		return
+	}
+	if err == repository.ErrLimitReached {
+		problem.Write(w, problem.PasskeyLimitReached, "You cannot add more passkeys. Please remove one first.")
+		return
+	}
+	if err != nil {
+		log.Printf("DATABASE ERROR: %v\n", err)
+		problem.Write(w, problem.Internal, "Failed to save passkey.")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(passkey)
+}
+
+// Handles listing the signed-in user's passkeys.
+func (h *Handler) ListPasskeys(w http.ResponseWriter, r *http.Request) {
+	// Retrieve user data from context.
+	user_acc, ok := r.Context().Value(middleware.USER_ACCOUNT).(model.UserAccount)
+	if !ok {
+		problem.Write(w, problem.Internal, "Failed to retrieve user session.")
+		return
+	}
+
+	passkeys := user_acc.Passkeys
+	if passkeys == nil {
+		passkeys = []model.Passkey{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(passkeys)
+}
+
+// Handles removing one of the signed-in user's passkeys, named by its credential ID in the path. The passkey
+// can no longer be used to sign in, so this is also how a lost authenticator is revoked.
+func (h *Handler) RemovePasskey(w http.ResponseWriter, r *http.Request) {
+	// Retrieve user data from context.
+	user_acc, ok := r.Context().Value(middleware.USER_ACCOUNT).(model.UserAccount)
+	if !ok {
+		problem.Write(w, problem.Internal, "Failed to retrieve user session.")
+		return
+	}
+
+	credentialID := r.PathValue("id")
+	if credentialID == "" {
+		problem.Write(w, problem.InvalidRequest, "Invalid request format.")
+		return
+	}
+
+	// Create a context with a timeout to prevent long-running database operations.
+	ctx, cancel := context.WithTimeout(context.Background(), 8 * time.Second)
+	defer cancel()
+
+	// Passkeys are removed from the user's own account, so one user can never remove another user's passkey.
+	err := h.Users.RemovePasskey(ctx, user_acc.ID, credentialID)
+	if err == repository.ErrNotFound {
+		problem.Write(w, problem.PasskeyNotFound, "Passkey not found.")
+		return
+	}
+	if err != nil {
+		log.Printf("DATABASE ERROR: %v\n", err)
+		problem.Write(w, problem.Internal, "Failed to remove passkey.")
+		return
+	}
+
+	util.ReturnMessage(w, http.StatusOK, "Passkey removed.")
+}
+
+// Handles the first step of signing in with a passkey.
+func (h *Handler) BeginPasskeyLogin(w http.ResponseWriter, r *http.Request) {
+	// Parse request body.
+	var req model.BeginPasskeyLogin
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		problem.Write(w, problem.InvalidRequest, "Invalid request format.")
+		return
+	}
+
+	// Create a context with a timeout to prevent long-running database operations.
+	ctx, cancel := context.WithTimeout(context.Background(), 8 * time.Second)
+	defer cancel()
+
+	// Anyone can start a sign-in, and every one stores a challenge, so limit them per client.
+	if !h.allow(ctx, w, rateLimit{"passkey:ip:" + util.ClientIP(r, h.ClientIPHeader), h.SignInLimit}) {
+		return
+	}
+
+	// With an address, offer only that account's passkeys. An unknown address gets the same response as no
+	// address at all, so this reveals nothing about which accounts exist.
+	var allow [][]byte
+	if userEmail, err := emailaddr.Normalize(req.EmailAddress); err == nil {
+		user_acc, err := h.Users.FindByEmail(ctx, userEmail)
+		if err != nil && err != repository.ErrNotFound {
+			log.Printf("DATABASE ERROR: %v\n", err)
+			problem.Write(w, problem.Internal, "Database error.")
+			return
+		}
+		for _, passkey := range user_acc.Passkeys {
+			if id, err := decodeBase64URL(passkey.ID); err == nil {
+				allow = append(allow, id)
+			}
+		}
+	}
+
+	challenge, err := h.newChallenge(ctx, passkeyLoginPurpose, "")
+	if err != nil {
+		log.Printf("DATABASE ERROR: %v\n", err)
+		problem.Write(w, problem.Internal, "Failed to start passkey sign-in.")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(h.WebAuthn.RequestOptions(challenge, allow))
+}
+
+// Handles the second step of signing in with a passkey. Responds like ValidateOTP.
+func (h *Handler) FinishPasskeyLogin(w http.ResponseWriter, r *http.Request) {
+	// Parse request body.
+	var req model.FinishPasskeyLogin
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		problem.Write(w, problem.InvalidRequest, "Invalid request format.")
+		return
+	}
+	credentialID, err1 := decodeBase64URL(req.CredentialID)
+	clientDataJSON, err2 := decodeBase64URL(req.ClientDataJSON)
+	authenticatorData, err3 := decodeBase64URL(req.AuthenticatorData)
+	signature, err4 := decodeBase64URL(req.Signature)
+	if err1 != nil || err2 != nil || err3 != nil || err4 != nil || len(credentialID) == 0 {
+		problem.Write(w, problem.InvalidRequest, "Invalid request format.")
+		return
+	}
+
+	deviceLabel := strings.TrimSpace(req.DeviceLabel)
+	if !util.ValidDeviceLabel(deviceLabel) {
+		problem.InvalidField.New("Invalid device label.").InField("device_label").Write(w)
+		return
+	}
+
+	// Create a context with a timeout to prevent long-running database operations.
+	ctx, cancel := context.WithTimeout(context.Background(), 8 * time.Second)
+	defer cancel()
+
+	challenge, _, err := h.consumeChallenge(ctx, passkeyLoginPurpose, clientDataJSON)
+	if err != nil && err != repository.ErrNotFound && !isVerificationError(err) {
+		log.Printf("DATABASE ERROR: %v\n", err)
+		problem.Write(w, problem.Internal, "Database error.")
+		return
+	}
+	if err != nil {
+		problem.Write(w, problem.PasskeyChallengeExpired, "Passkey sign-in expired or invalid. Please try again.")
+		return
+	}
+
+	// Every failure from here on gets the same answer, so nothing is revealed about which passkeys exist.
+	id := base64.RawURLEncoding.EncodeToString(credentialID)
+	user_acc, err := h.Users.FindByPasskey(ctx, id)
+	if err != nil && err != repository.ErrNotFound {
+		log.Printf("DATABASE ERROR: %v\n", err)
+		problem.Write(w, problem.Internal, "Database error.")
+		return
+	}
+	var passkey model.Passkey
+	for _, p := range user_acc.Passkeys {
+		if p.ID == id {
+			passkey = p
+		}
+	}
+	if passkey.ID == "" {
+		problem.Write(w, problem.PasskeyFailed, "Passkey verification failed.")
+		return
+	}
+
+	signCount, err := h.WebAuthn.VerifyAssertion(challenge, webauthn.Credential{
+		ID: credentialID,
+		PublicKey: passkey.PublicKey,
+		SignCount: uint32(passkey.SignCount),
+	}, clientDataJSON, authenticatorData, signature)
+	if err != nil {
+		log.Printf("PASSKEY SIGN-IN REJECTED: %v\n", err)
+		problem.Write(w, problem.PasskeyFailed, "Passkey verification failed.")
+		return
+	}
+
+	// Signing in again also cancels a pending account deletion. A passkey that verified the user is already
+	// two factors, so no authenticator-app code is asked for.
+	user_acc, err = h.Users.UsePasskey(ctx, user_acc.ID, id, passkey.SignCount, int64(signCount), time.Now().UnixMilli())
+	if err == repository.ErrNotFound {
+		// The counter moved on, or the passkey went away, since it was read.
+		problem.Write(w, problem.PasskeyFailed, "Passkey verification failed.")
+		return
+	}
+	if err != nil {
+		log.Printf("DATABASE ERROR: %v\n", err)
+		problem.Write(w, problem.Internal, "Failed to update account.")
+		return
+	}
+
+	h.signIn(ctx, w, r, user_acc, deviceLabel)
+}
+
+func isVerificationError(err error) bool {
+	return errors.Is(err, webauthn.ErrVerification)
+}
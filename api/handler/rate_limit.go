@@ -0,0 +1,69 @@
+package handler
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"bearlysocial-backend/api/problem"
+	"bearlysocial-backend/api/repository"
+	"bearlysocial-backend/i18n"
+)
+
+// Limits on sending OTP emails. Every request draws from all three buckets: one per client IP, one per target
+// address, and one shared by everybody that caps how much mail the server sends overall.
+type OTPRequestLimits struct {
+	PerIP    repository.Bucket
+	PerEmail repository.Bucket
+	Global   repository.Bucket
+}
+
+// A bucket together with the key it is stored under.
+type rateLimit struct {
+	key    string
+	bucket repository.Bucket
+}
+
+// Takes a token from each limit in turn, so callers should list the ones most likely to refuse first. If one is
+// exhausted, the tokens already taken from the others are given back, so a refused request costs nothing; it then
+// responds with 429 Too Many Requests and a Retry-After header and returns false, and the caller must stop
+// handling the request.
+func (h *Handler) allow(ctx context.Context, w http.ResponseWriter, limits ...rateLimit) bool {
+	now := time.Now().UnixMilli()
+
+	for i, limit := range limits {
+		retryAfter, err := h.RateLimits.Take(ctx, limit.key, limit.bucket, now)
+		if err == nil && retryAfter == 0 {
+			continue
+		}
+
+		// The request is not going ahead, so it must not count against the limits that let it through.
+		h.refund(ctx, limits[:i]...)
+
+		if err != nil {
+			log.Printf("DATABASE ERROR: %v\n", err)
+			problem.Write(w, problem.Internal, "Database error.")
+			return false
+		}
+
+		// Round up so the client never retries early.
+		wait := time.Duration(retryAfter) * time.Millisecond
+		wait = (wait + time.Second - 1).Truncate(time.Second)
+
+		problem.RateLimited.New("Too many requests. Please wait %s before trying again.", i18n.Duration(wait)).RetryAfter(wait).Write(w)
+		return false
+	}
+	return true
+}
+
+// Gives back the tokens allow took, for a request that failed before doing what the limits guard, such as
+// sending an email. Failures are only logged, as the request has already failed for another reason.
+func (h *Handler) refund(ctx context.Context, limits ...rateLimit) {
+	now := time.Now().UnixMilli()
+	for _, limit := range limits {
+		if err := h.RateLimits.Refund(ctx, limit.key, limit.bucket, now); err != nil {
+			log.Printf("DATABASE ERROR: %v\n", err)
+		}
+	}
+}
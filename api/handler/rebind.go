@@ -0,0 +1,33 @@
+package handler
+
+import (
+	"bearlysocial-backend/api/model"
+	"bearlysocial-backend/util"
+)
+
+// Rewrites what an account has bound to its ID when the account moves from its email address to a generated ID.
+// user_acc already carries the new ID. Used with UserAccounts.MoveToGeneratedIDs.
+func RebindAccount(otpSecret []byte, oldID string, user_acc *model.UserAccount) error {
+	// OTP hashes cannot be recomputed without the code, so a pending OTP, the magic link signed for it and a
+	// pending email change are dropped; the user asks for new ones. A running cooldown stays in place.
+	user_acc.OTP = nil
+	user_acc.OTP_AttemptCount = 0
+	user_acc.OTP_ExpiryTime = nil
+	user_acc.EmailChange = nil
+
+	if user_acc.TOTP != nil {
+		secret, err := util.OpenTOTPSecret(otpSecret, oldID, user_acc.TOTP.Secret)
+		if err != nil {
+			return err
+		}
+		if user_acc.TOTP.Secret, err = util.SealTOTPSecret(otpSecret, user_acc.ID, secret); err != nil {
+			return err
+		}
+		// The recovery codes the user holds keep working under the old ID until they are regenerated.
+		user_acc.TOTP.RecoveryCodesUID = user_acc.TOTP.RecoveryCodeUID(oldID)
+	}
+
+	// Passkeys are found by credential ID, so the user handle authenticators keep, a digest of the old ID,
+	// does not need to match; passkeys registered from now on get one for the new ID.
+	return nil
+}
@@ -2,195 +2,149 @@ package handler
 
 import (
 	"context"
-	"crypto/rand"
 	"encoding/json"
-	"fmt"
+	"errors"
 	"log"
 	"net/http"
-	"net/smtp"
-	"os"
-	"strings"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/mongo"
 
 	"bearlysocial-backend/api/model"
+	"bearlysocial-backend/api/problem"
+	"bearlysocial-backend/api/repository"
+	"bearlysocial-backend/emailaddr"
+	"bearlysocial-backend/emails"
+	"bearlysocial-backend/i18n"
 	"bearlysocial-backend/util"
 )
 
-var (
-	senderEmail string
-	emailPasskey string
-	smtpHost string
-	smtpPort string
-)
-
-// Generates a 6-character alphanumeric OTP (A-Z, 0-9).
-func generateOTP() string {
-	const charset = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZ"
-	b := make([]byte, 6)
-
-	// Fill b with random bytes from the system's secure random generator.
-	if _, err := rand.Read(b); err != nil {
-		// Use time-based indexing in case of error.
-		for i := range b {
-			b[i] = charset[time.Now().UnixNano()%int64(len(charset))]
-		}
-	} else {
-		// Map random bytes to the allowed characters.
-		for i, v := range b {
-			b[i] = charset[int(v)%len(charset)]
-		}
+// Returns the key under which emails to an address are rate limited. Addresses are counted in canonical form, so
+// "a.b+1@gmail.com" and "ab+2@gmail.com" share a bucket, and stored as a digest so the rate-limit store holds
+// no email addresses.
+func emailRateLimitKey(email string) string {
+	if addr, err := emailaddr.Parse(email); err == nil {
+		email = emailaddr.Canonical(addr)
 	}
-	return string(b) // Convert byte slice to a string and return as OTP.
+	return "otp:email:" + util.HashToken(email)
 }
 
-// Sends the OTP using standard net/smtp package.
-func sendOTP(to, otp string) error {
-	// Create an SMTP authentication object using the sender's email, password, and SMTP host.
-	// This is necessary to authenticate with the SMTP server before sending an email. 
-	// It ensures that the server knows the sender is authorized to send emails from this account.
-	auth := smtp.PlainAuth("", senderEmail, emailPasskey, smtpHost)
-
-	headers := map[string]string{
-		"From":         fmt.Sprintf("BearlySocial <%s>", senderEmail),
-		"To":           to,
-		"Subject":      "Your One-Time Password (OTP)",
-		"MIME-Version": "1.0",
-		"Content-Type": "text/html; charset=UTF-8",
-	}
+// Returned by findOrCreateAccount when there is no account yet and the address is at a blocked domain.
+var errBlockedDomain = errors.New("email domain blocked for new accounts")
 
-	body := fmt.Sprintf(`<p style="font-size: 18px;">Your One-time Password (OTP) is:</p>
-		<p style="font-size: 24px; font-weight: bold;">%s</p>
-		<p style="font-size: 18px">The OTP is valid for only <span style="font-weight: bold;">8 minutes</span>.</p>`, otp)
+// Returns the account of the email address, creating it if there is none yet. Accounts that already exist keep
+// working even if their domain has been blocked since.
+func (h *Handler) findOrCreateAccount(ctx context.Context, addr emailaddr.Address) (model.UserAccount, error) {
+	userEmail := addr.String()
+	user_acc, err := h.Users.FindByEmail(ctx, userEmail)
+	if err != repository.ErrNotFound {
+		return user_acc, err
+	}
+	if h.BlockedDomains.Blocked(addr) {
+		return model.UserAccount{}, errBlockedDomain
+	}
 
-	var msg strings.Builder
-	for k, v := range headers {
-		msg.WriteString(fmt.Sprintf("%s: %s\r\n", k, v))
+	id, err := util.GenerateUserID()
+	if err != nil {
+		return model.UserAccount{}, err
+	}
+	err = h.Users.Create(ctx, model.UserAccount{
+		ID: id,
+		Email: userEmail,
+		CreatedAt: time.Now(),
+		Schedule: bson.M{},
+	})
+	if err != nil && err != repository.ErrDuplicate {
+		return model.UserAccount{}, err
 	}
-	msg.WriteString("\r\n" + body)
-
-	return smtp.SendMail(
-		smtpHost+":"+smtpPort,
-		auth,
-		senderEmail,
-		[]string{to},
-		[]byte(msg.String()),
-	)
+	// On ErrDuplicate a concurrent request created the account first, which is the one to use.
+	return h.Users.FindByEmail(ctx, userEmail)
 }
 
 // Handles OTP request.
-func RequestOTP(w http.ResponseWriter, r *http.Request) {
-	senderEmail = os.Getenv("SENDER_EMAIL")
-	emailPasskey = os.Getenv("EMAIL_PASSKEY")
-	smtpHost = os.Getenv("SMTP_HOST")
-	smtpPort = os.Getenv("SMTP_PORT")
-
-	if r.Method != http.MethodGet {
-		util.ReturnMessage(w, http.StatusBadRequest, "Method not allowed.")
-		return
-	}
-
+func (h *Handler) RequestOTP(w http.ResponseWriter, r *http.Request) {
 	// Parse request body.
 	var req model.RequestOTP
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		util.ReturnMessage(w, http.StatusBadRequest, "Invalid request format.")
+		problem.Write(w, problem.InvalidRequest, "Invalid request format.")
 		return
 	}
 
-	userEmail := strings.ToLower(strings.TrimSpace(req.EmailAddress))
-	if !util.ValidEmail(userEmail) {
-		util.ReturnMessage(w, http.StatusBadRequest, "Invalid email format.")
+	addr, err := emailaddr.Parse(req.EmailAddress)
+	if err != nil {
+		problem.InvalidField.New("Invalid email format.").InField("email_address").Write(w)
 		return
 	}
-
-	otp := generateOTP()
+	userEmail := addr.String()
 
 	// Create a context with a timeout to prevent long-running database operations.
 	ctx, cancel := context.WithTimeout(context.Background(), 8 * time.Second)
 	defer cancel()
 
+	// Every request sends an email, so limit them per client, per recipient and overall.
+	limits := h.OTPRequestLimits
+	rateLimits := []rateLimit{
+		{"otp:ip:" + util.ClientIP(r, h.ClientIPHeader), limits.PerIP},
+		{emailRateLimitKey(userEmail), limits.PerEmail},
+		{"otp:global", limits.Global},
+	}
+	if !h.allow(ctx, w, rateLimits...) {
+		return
+	}
+
+	otp, err := h.OTPPolicy.Generate()
+	if err != nil {
+		log.Printf("ERROR GENERATING OTP: %v\n", err)
+		problem.Write(w, problem.Internal, "Failed to generate OTP.")
+		return
+	}
+
+	// If the account does not exist, create a new one.
+	user_acc, err := h.findOrCreateAccount(ctx, addr)
+	if err == errBlockedDomain {
+		problem.Write(w, problem.EmailBlocked, "Please use a permanent email address.")
+		return
+	}
+	if err != nil {
+		log.Printf("DATABASE ERROR: %v\n", err)
+		problem.Write(w, problem.Internal, "Failed to issue OTP.")
+		return
+	}
+
+	// Only a keyed hash of the OTP is stored, so reading the database is not enough to sign in.
+	otpHash := util.HashOTP(h.OTPSecret, user_acc.ID, otp)
+
 	now := time.Now()
-	currentTimeMillis := now.UnixMilli()
-
-	// Define a variable to store the retrieved user account.
-	var user_acc model.UserAccount
-
-	// Define a filter to find the account by email.
-	filter := bson.M{"_id": userEmail}
-
-	// Attempt to find the user account in the database.
-	err := util.MongoCollection.FindOne(ctx, filter).Decode(&user_acc)
-
-	if err == mongo.ErrNoDocuments {
-		// If the account does not exist, create a new one.
-		user_acc := model.UserAccount{
-			ID: userEmail,
-			OTP: &otp,
-			OTP_AttemptCount: 0,
-			OTP_ExpiryTime: util.RefInt64(now.Add(8 * time.Minute).UnixMilli()),
-			CreatedAt: now,
-			Schedule: bson.M{},
-		}
-
-		// Insert the new account into the database.
-		_, err = util.MongoCollection.InsertOne(ctx, user_acc)
-		if err != nil {
-			util.ReturnMessage(w, http.StatusInternalServerError, "Failed to create account.")
-			return
-		}
-	} else if err != nil {
+	expiryTime := now.Add(h.OTPPolicy.TTL).UnixMilli()
+
+	// Store the OTP in a single conditional write, which also lifts an expired cooldown.
+	user_acc, err = h.Users.IssueOTP(ctx, user_acc.ID, otpHash, expiryTime, now.UnixMilli())
+
+	if err == repository.ErrCooldown {
+		// If still in cooldown, calculate the remaining time before retry is allowed.
+		remainingTime := time.Until(time.UnixMilli(*user_acc.CooldownTime))
+		problem.OTPCooldown.New("Please wait %s before trying again.", i18n.Duration(remainingTime)).RetryAfter(remainingTime).Write(w)
+		return
+	}
+	if err != nil {
 		// Handle any other database errors.
 		log.Printf("DATABASE ERROR: %v\n", err)
-		util.ReturnMessage(w, http.StatusInternalServerError, "Database error.")
+		problem.Write(w, problem.Internal, "Failed to issue OTP.")
 		return
-	} else {
-		// If the account exists and the user has attempted OTP requests less than 4 times.
-		if user_acc.OTP_AttemptCount < 4 {
-			update := bson.M{
-				"$set": bson.M{
-					"otp": otp,
-					"otp_expiry_time": currentTimeMillis + 8*60*1000, // Extend expiry time.
-				},
-			}
-			_, err = util.MongoCollection.UpdateOne(ctx, filter, update)
-			if err != nil {
-				util.ReturnMessage(w, http.StatusInternalServerError, "Failed to update OTP.")
-				return
-			}
-		} else {
-			// If the user exceeded OTP attempts, check if the cooldown period has expired.
-			if *user_acc.CooldownTime <= currentTimeMillis {
-				update := bson.M{
-					"$set": bson.M{
-						"otp": otp,
-						"otp_attempt_count": 0, // Reset attempt count.
-						"otp_expiry_time": currentTimeMillis + 8*60*1000, // Reset expiry time.
-						"cooldown_time": nil, // Remove cooldown restriction.
-					},
-				}
-				_, err = util.MongoCollection.UpdateOne(ctx, filter, update)
-				if err != nil {
-					util.ReturnMessage(w, http.StatusInternalServerError, "Failed to reset OTP attempts.")
-					return
-				}
-			} else {
-				// If still in cooldown, calculate the remaining time before retry is allowed.
-				cooldownTime := time.UnixMilli(*user_acc.CooldownTime)
-				remainingTime := time.Until(cooldownTime)
-				message := fmt.Sprintf("Please wait %s before trying again.", util.HumanReadableDuration(remainingTime))
-
-				util.ReturnMessage(w, http.StatusBadRequest, message)
-				return				
-			}
-		}
 	}
 
-	// Send the OTP to the user's email.
-	if err := sendOTP(userEmail, otp); err != nil {
+	// Send the OTP to the user's email, along with a link that signs in without typing it.
+	// The email goes out in the language the request asked for, or else in the account's.
+	tag := i18n.Negotiate(r.Header.Get("Accept-Language"), user_acc.Langs)
+	err = h.sendEmail(tag, userEmail, emails.OTP{
+		Code: otp,
+		TTL: i18n.Duration(h.OTPPolicy.TTL),
+		Link: h.magicLink(user_acc.ID, otpHash, expiryTime),
+	})
+	if err != nil {
 		log.Printf("ERROR SENDING EMAIL: %v\n", err)
-		util.ReturnMessage(w, http.StatusInternalServerError, "Failed to send OTP email.")
+		h.refund(ctx, rateLimits...) // No email went out, so the client may try again.
+		problem.Write(w, problem.Internal, "Failed to send OTP email.")
 		return
 	}
 
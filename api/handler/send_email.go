@@ -0,0 +1,25 @@
+package handler
+
+import (
+	"context"
+	"time"
+
+	"golang.org/x/text/language"
+
+	"bearlysocial-backend/emails"
+)
+
+// Renders an email from its template, in the given language, and sends it through the configured mailer.
+func (h *Handler) sendEmail(tag language.Tag, to string, data emails.Data) error {
+	msg, err := emails.Render(tag, data)
+	if err != nil {
+		return err
+	}
+	msg.To = to
+
+	// Sending mail can take longer than a database round trip, so it gets its own timeout.
+	ctx, cancel := context.WithTimeout(context.Background(), 16 * time.Second)
+	defer cancel()
+
+	return h.Mailer.Send(ctx, msg)
+}
@@ -0,0 +1,276 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"bearlysocial-backend/api/middleware"
+	"bearlysocial-backend/api/model"
+	"bearlysocial-backend/api/problem"
+	"bearlysocial-backend/api/repository"
+	"bearlysocial-backend/util"
+)
+
+// Generates a new access/refresh token pair. The returned rotation holds only what gets stored: digests and
+// the access token's expiry.
+func (h *Handler) newTokenPair(now time.Time) (model.TokenResponse, repository.Rotation, error) {
+	accessToken, err := util.GenerateToken()
+	if err != nil {
+		return model.TokenResponse{}, repository.Rotation{}, err
+	}
+	refreshToken, err := util.GenerateToken()
+	if err != nil {
+		return model.TokenResponse{}, repository.Rotation{}, err
+	}
+
+	accessExpiryTime := now.Add(h.AccessTokenLifetime).UnixMilli()
+	tokens := model.TokenResponse{
+		Token: accessToken,
+		RefreshToken: refreshToken,
+		TokenExpiryTime: accessExpiryTime,
+	}
+	rotation := repository.Rotation{
+		AccessTokenHash: util.HashToken(accessToken),
+		AccessExpiryTime: accessExpiryTime,
+		RefreshTokenHash: util.HashToken(refreshToken),
+	}
+	return tokens, rotation, nil
+}
+
+// Returns the user agent of the request as sessions store it.
+func sessionUserAgent(r *http.Request) string {
+	userAgent := r.UserAgent()
+	if len(userAgent) > 256 {
+		userAgent = userAgent[:256]
+	}
+	return userAgent
+}
+
+// Starts a new session for the user on the device making the request and returns its token pair.
+func (h *Handler) createSession(ctx context.Context, r *http.Request, userID, deviceLabel string) (model.TokenResponse, error) {
+	now := time.Now()
+	tokens, rotation, err := h.newTokenPair(now)
+	if err != nil {
+		return model.TokenResponse{}, err
+	}
+	sessionID, err := util.GenerateID()
+	if err != nil {
+		return model.TokenResponse{}, err
+	}
+
+	userAgent := sessionUserAgent(r)
+	if deviceLabel == "" {
+		deviceLabel = "Unknown device"
+	}
+
+	session := model.Session{
+		ID: sessionID,
+		UserID: userID,
+		AccessTokenHash: rotation.AccessTokenHash, // Only digests are stored.
+		AccessExpiryTime: rotation.AccessExpiryTime,
+		RefreshTokenHash: rotation.RefreshTokenHash,
+		DeviceLabel: deviceLabel,
+		UserAgent: userAgent,
+		CreatedAt: now.UnixMilli(),
+		LastSeenAt: now.UnixMilli(),
+		ExpiryTime: now.Add(h.SessionLifetime).UnixMilli(),
+	}
+
+	if err := h.Sessions.Create(ctx, session); err != nil {
+		return model.TokenResponse{}, err
+	}
+
+	tokens.SessionID = session.ID
+	return tokens, nil
+}
+
+// Handles exchanging a refresh token for a new access/refresh token pair.
+func (h *Handler) RefreshToken(w http.ResponseWriter, r *http.Request) {
+	// Parse request body.
+	var req model.RefreshToken
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		problem.Write(w, problem.InvalidRequest, "Invalid request format.")
+		return
+	}
+
+	refreshToken := strings.ToLower(strings.TrimSpace(req.RefreshToken))
+	if !util.ValidHashpass(refreshToken) {
+		problem.InvalidField.New("Invalid refresh token format.").InField("refresh_token").Write(w)
+		return
+	}
+
+	now := time.Now()
+	tokens, rotation, err := h.newTokenPair(now)
+	if err != nil {
+		problem.Write(w, problem.Internal, "Failed to generate token.")
+		return
+	}
+
+	// Create a context with a timeout to prevent long-running database operations.
+	ctx, cancel := context.WithTimeout(context.Background(), 8 * time.Second)
+	defer cancel()
+
+	session, err := h.Sessions.Refresh(ctx, util.HashToken(refreshToken), rotation, now.UnixMilli(), h.SessionLimits())
+	if err != nil {
+		switch err {
+		case repository.ErrTokenReused:
+			log.Printf("REFRESH TOKEN REUSE DETECTED; SESSION REVOKED.\n")
+			problem.Write(w, problem.TokenReused, "This refresh token was already used. Please sign in again.")
+		case repository.ErrSessionExpired:
+			problem.Write(w, problem.SessionExpired, "Session expired. Please sign in again.")
+		case repository.ErrNotFound:
+			problem.Write(w, problem.TokenInvalid, "Authorization failed.")
+		default:
+			log.Printf("DATABASE ERROR: %v\n", err)
+			problem.Write(w, problem.Internal, "Database error.")
+		}
+		return
+	}
+
+	tokens.SessionID = session.ID
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(tokens)
+}
+
+// Handles listing the signed-in user's sessions.
+func (h *Handler) ListSessions(w http.ResponseWriter, r *http.Request) {
+	// Retrieve user and session data from context.
+	user_acc, ok := r.Context().Value(middleware.USER_ACCOUNT).(model.UserAccount)
+	current, ok2 := r.Context().Value(middleware.SESSION).(model.Session)
+	if !ok || !ok2 {
+		problem.Write(w, problem.Internal, "Failed to retrieve user session.")
+		return
+	}
+
+	// Create a context with a timeout to prevent long-running database operations.
+	ctx, cancel := context.WithTimeout(context.Background(), 8 * time.Second)
+	defer cancel()
+
+	sessions, err := h.Sessions.List(ctx, user_acc.ID)
+	if err != nil {
+		log.Printf("DATABASE ERROR: %v\n", err)
+		problem.Write(w, problem.Internal, "Failed to list sessions.")
+		return
+	}
+
+	infos := make([]model.SessionInfo, len(sessions))
+	for i, session := range sessions {
+		infos[i] = model.SessionInfo{Session: session, Current: session.ID == current.ID}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(infos)
+}
+
+// Handles revoking one of the signed-in user's sessions.
+func (h *Handler) RevokeSession(w http.ResponseWriter, r *http.Request) {
+	// Retrieve user data from context.
+	user_acc, ok := r.Context().Value(middleware.USER_ACCOUNT).(model.UserAccount)
+	if !ok {
+		problem.Write(w, problem.Internal, "Failed to retrieve user session.")
+		return
+	}
+
+	// Parse request body.
+	var req model.RevokeSession
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.SessionID == "" {
+		problem.Write(w, problem.InvalidRequest, "Invalid request format.")
+		return
+	}
+
+	// Create a context with a timeout to prevent long-running database operations.
+	ctx, cancel := context.WithTimeout(context.Background(), 8 * time.Second)
+	defer cancel()
+
+	// Sessions are scoped to the user, so one user can never revoke another user's session.
+	err := h.Sessions.Delete(ctx, user_acc.ID, req.SessionID)
+	if err == repository.ErrNotFound {
+		problem.Write(w, problem.SessionNotFound, "Session not found.")
+		return
+	}
+	if err != nil {
+		log.Printf("DATABASE ERROR: %v\n", err)
+		problem.Write(w, problem.Internal, "Failed to revoke session.")
+		return
+	}
+
+	util.ReturnMessage(w, http.StatusOK, "Session revoked.")
+}
+
+// Handles revoking every session of the signed-in user except the one making the request.
+func (h *Handler) RevokeOtherSessions(w http.ResponseWriter, r *http.Request) {
+	// Retrieve user and session data from context.
+	user_acc, ok := r.Context().Value(middleware.USER_ACCOUNT).(model.UserAccount)
+	current, ok2 := r.Context().Value(middleware.SESSION).(model.Session)
+	if !ok || !ok2 {
+		problem.Write(w, problem.Internal, "Failed to retrieve user session.")
+		return
+	}
+
+	// Create a context with a timeout to prevent long-running database operations.
+	ctx, cancel := context.WithTimeout(context.Background(), 8 * time.Second)
+	defer cancel()
+
+	if _, err := h.Sessions.DeleteAll(ctx, user_acc.ID, current.ID); err != nil {
+		log.Printf("DATABASE ERROR: %v\n", err)
+		problem.Write(w, problem.Internal, "Failed to revoke sessions.")
+		return
+	}
+
+	util.ReturnMessage(w, http.StatusOK, "Other sessions revoked.")
+}
+
+// Handles signing out of the current session.
+func (h *Handler) Logout(w http.ResponseWriter, r *http.Request) {
+	// Retrieve user and session data from context.
+	user_acc, ok := r.Context().Value(middleware.USER_ACCOUNT).(model.UserAccount)
+	current, ok2 := r.Context().Value(middleware.SESSION).(model.Session)
+	if !ok || !ok2 {
+		problem.Write(w, problem.Internal, "Failed to retrieve user session.")
+		return
+	}
+
+	// Create a context with a timeout to prevent long-running database operations.
+	ctx, cancel := context.WithTimeout(context.Background(), 8 * time.Second)
+	defer cancel()
+
+	// Removing the session revokes its access and refresh tokens, including any still in their grace window.
+	// A concurrent logout may have removed it already, which is just as good.
+	err := h.Sessions.Delete(ctx, user_acc.ID, current.ID)
+	if err != nil && err != repository.ErrNotFound {
+		log.Printf("DATABASE ERROR: %v\n", err)
+		problem.Write(w, problem.Internal, "Failed to sign out.")
+		return
+	}
+
+	util.ReturnMessage(w, http.StatusOK, "Signed out.")
+}
+
+// Handles signing out of every session of the signed-in user, including the current one.
+func (h *Handler) LogoutEverywhere(w http.ResponseWriter, r *http.Request) {
+	// Retrieve user data from context.
+	user_acc, ok := r.Context().Value(middleware.USER_ACCOUNT).(model.UserAccount)
+	if !ok {
+		problem.Write(w, problem.Internal, "Failed to retrieve user session.")
+		return
+	}
+
+	// Create a context with a timeout to prevent long-running database operations.
+	ctx, cancel := context.WithTimeout(context.Background(), 8 * time.Second)
+	defer cancel()
+
+	if _, err := h.Sessions.DeleteAll(ctx, user_acc.ID, ""); err != nil {
+		log.Printf("DATABASE ERROR: %v\n", err)
+		problem.Write(w, problem.Internal, "Failed to sign out.")
+		return
+	}
+
+	util.ReturnMessage(w, http.StatusOK, "Signed out everywhere.")
+}
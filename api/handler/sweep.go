@@ -0,0 +1,101 @@
+package handler
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"bearlysocial-backend/api/repository"
+)
+
+// Periodically hard-deletes accounts whose deletion grace period has passed and purges sessions that
+// expired or sat idle for too long, rate-limit buckets that have refilled and expired challenges. Blocks until
+// ctx is done.
+func (h *Handler) Sweep(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		h.sweepDeletedAccounts()
+		h.sweepExpiredSessions()
+		h.sweepRateLimits()
+		h.sweepChallenges()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (h *Handler) sweepDeletedAccounts() {
+	// Create a context with a timeout to prevent long-running database operations.
+	ctx, cancel := context.WithTimeout(context.Background(), 8 * time.Second)
+	defer cancel()
+
+	now := time.Now().UnixMilli()
+	ids, err := h.Users.ExpiredDeletions(ctx, now)
+	if err != nil {
+		log.Printf("DATABASE ERROR: %v\n", err)
+		return
+	}
+
+	deleted := 0
+	for _, id := range ids {
+		// The user may have signed in since the list was made, which cancels the deletion, so the account is
+		// only removed if it is still due, and what is tied to it only once it is gone.
+		err := h.Users.DeleteIfDue(ctx, id, now)
+		if err == repository.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			log.Printf("DATABASE ERROR: %v\n", err)
+			continue
+		}
+		deleted++
+
+		// Sessions and challenges left behind by a failure here can no longer be used, since the account is
+		// gone, and expire on their own.
+		if _, err := h.Sessions.DeleteAll(ctx, id, ""); err != nil {
+			log.Printf("DATABASE ERROR: %v\n", err)
+		}
+		if _, err := h.Challenges.DeleteAll(ctx, id); err != nil {
+			log.Printf("DATABASE ERROR: %v\n", err)
+		}
+	}
+
+	if deleted > 0 {
+		log.Printf("Deleted %d expired account(s).\n", deleted)
+	}
+}
+
+func (h *Handler) sweepExpiredSessions() {
+	// Create a context with a timeout to prevent long-running database operations.
+	ctx, cancel := context.WithTimeout(context.Background(), 8 * time.Second)
+	defer cancel()
+
+	if _, err := h.Sessions.DeleteExpired(ctx, time.Now().UnixMilli(), h.SessionLimits()); err != nil {
+		log.Printf("DATABASE ERROR: %v\n", err)
+	}
+}
+
+func (h *Handler) sweepRateLimits() {
+	// Create a context with a timeout to prevent long-running database operations.
+	ctx, cancel := context.WithTimeout(context.Background(), 8 * time.Second)
+	defer cancel()
+
+	if _, err := h.RateLimits.DeleteExpired(ctx, time.Now().UnixMilli()); err != nil {
+		log.Printf("DATABASE ERROR: %v\n", err)
+	}
+}
+
+func (h *Handler) sweepChallenges() {
+	// Create a context with a timeout to prevent long-running database operations.
+	ctx, cancel := context.WithTimeout(context.Background(), 8 * time.Second)
+	defer cancel()
+
+	if _, err := h.Challenges.DeleteExpired(ctx, time.Now().UnixMilli()); err != nil {
+		log.Printf("DATABASE ERROR: %v\n", err)
+	}
+}
@@ -0,0 +1,412 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"bearlysocial-backend/api/middleware"
+	"bearlysocial-backend/api/model"
+	"bearlysocial-backend/api/problem"
+	"bearlysocial-backend/api/repository"
+	"bearlysocial-backend/util"
+)
+
+const (
+	mfaPurpose = "mfa"
+
+	// How long the user has to enter a code once the first factor is done.
+	mfaTokenLifetime = 5 * time.Minute
+
+	// Number of recovery codes handed out on enrollment and regeneration.
+	recoveryCodeCount = 10
+)
+
+// Finishes a sign-in whose first factor, the emailed OTP, magic link or a provider sign-in, has been consumed.
+// Accounts with an authenticator app get an MFA token to present with a code at /verify-mfa instead of a session.
+// The identity of a provider sign-in, or nil, is only linked once the second factor has been checked as well.
+func (h *Handler) completeFirstFactor(ctx context.Context, w http.ResponseWriter, r *http.Request, user_acc model.UserAccount, deviceLabel string, identity *model.Identity) {
+	if !user_acc.MFAEnabled() {
+		if identity != nil {
+			var ok bool
+			if user_acc, ok = h.useIdentity(ctx, w, user_acc, *identity); !ok {
+				return
+			}
+		}
+		h.signIn(ctx, w, r, user_acc, deviceLabel)
+		return
+	}
+
+	mfaToken, err := util.GenerateToken()
+	if err != nil {
+		problem.Write(w, problem.Internal, "Failed to generate token.")
+		return
+	}
+
+	// Only the digest is stored, like every other bearer token.
+	expiryTime := time.Now().Add(mfaTokenLifetime).UnixMilli()
+	err = h.Challenges.Create(ctx, model.Challenge{
+		ID: util.HashToken(mfaToken),
+		Purpose: mfaPurpose,
+		UserID: user_acc.ID,
+		DeviceLabel: deviceLabel,
+		Identity: identity,
+		ExpiryTime: expiryTime,
+	})
+	if err != nil {
+		log.Printf("DATABASE ERROR: %v\n", err)
+		problem.Write(w, problem.Internal, "Failed to start second-factor verification.")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(model.MFARequiredResponse{
+		MFARequired: true,
+		MFAToken: mfaToken,
+		MFATokenExpiryTime: expiryTime,
+	})
+}
+
+// Checks a code from the user's authenticator app, or one of their recovery codes, and uses it up. Attempts
+// are rate limited per account, which is what keeps 6-digit codes from being guessed. On failure it responds
+// and returns false; the caller must then stop handling the request.
+func (h *Handler) useSecondFactor(ctx context.Context, w http.ResponseWriter, user_acc model.UserAccount, code string) (model.UserAccount, bool) {
+	if !h.allow(ctx, w, rateLimit{"mfa:" + util.HashToken(user_acc.ID), h.SecondFactorLimit}) {
+		return model.UserAccount{}, false
+	}
+
+	code = strings.TrimSpace(code)
+	var err error
+	if util.ValidTOTPCode(code) {
+		secret, openErr := util.OpenTOTPSecret(h.OTPSecret, user_acc.ID, user_acc.TOTP.Secret)
+		if openErr != nil {
+			log.Printf("ERROR OPENING TOTP SECRET: %v\n", openErr)
+			problem.Write(w, problem.Internal, "Failed to verify code.")
+			return model.UserAccount{}, false
+		}
+
+		step, ok := util.MatchTOTP(secret, code, time.Now())
+		if !ok {
+			problem.Write(w, problem.CodeIncorrect, "The code you provided is incorrect.")
+			return model.UserAccount{}, false
+		}
+
+		user_acc, err = h.Users.UseTOTP(ctx, user_acc.ID, step)
+		if err == repository.ErrNotFound {
+			problem.Write(w, problem.CodeReused, "This code was already used. Please wait for the next one.")
+			return model.UserAccount{}, false
+		}
+	} else {
+		user_acc, err = h.Users.UseRecoveryCode(ctx, user_acc.ID, util.HashRecoveryCode(h.OTPSecret, user_acc.TOTP.RecoveryCodeUID(user_acc.ID), code))
+		if err == repository.ErrNotFound {
+			problem.Write(w, problem.CodeIncorrect, "The code you provided is incorrect.")
+			return model.UserAccount{}, false
+		}
+	}
+	if err != nil {
+		log.Printf("DATABASE ERROR: %v\n", err)
+		problem.Write(w, problem.Internal, "Database error.")
+		return model.UserAccount{}, false
+	}
+	return user_acc, true
+}
+
+// Creates a fresh set of recovery codes, returning them for the user and their hashes for storage.
+func (h *Handler) newRecoveryCodes(uid string) ([]string, []string, error) {
+	codes, err := util.GenerateRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		return nil, nil, err
+	}
+	hashes := make([]string, len(codes))
+	for i, code := range codes {
+		hashes[i] = util.HashRecoveryCode(h.OTPSecret, uid, code)
+	}
+	return codes, hashes, nil
+}
+
+// Handles the second step of signing in to an account with an authenticator app. Responds like ValidateOTP.
+func (h *Handler) VerifyMFA(w http.ResponseWriter, r *http.Request) {
+	// Parse request body.
+	var req model.VerifyMFA
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		problem.Write(w, problem.InvalidRequest, "Invalid request format.")
+		return
+	}
+
+	mfaToken := strings.ToLower(strings.TrimSpace(req.MFAToken))
+	if !util.ValidHashpass(mfaToken) || strings.TrimSpace(req.Code) == "" {
+		problem.Write(w, problem.InvalidRequest, "Invalid request format.")
+		return
+	}
+
+	// Create a context with a timeout to prevent long-running database operations.
+	ctx, cancel := context.WithTimeout(context.Background(), 8 * time.Second)
+	defer cancel()
+
+	// A wrong code leaves the token usable, so a typo does not mean another email; guessing is held back by
+	// the per-account limit instead.
+	tokenHash := util.HashToken(mfaToken)
+	challenge, err := h.Challenges.Find(ctx, tokenHash, mfaPurpose, time.Now().UnixMilli())
+	if err == repository.ErrNotFound {
+		problem.Write(w, problem.MFAExpired, "Verification expired. Please sign in again.")
+		return
+	}
+	if err != nil {
+		log.Printf("DATABASE ERROR: %v\n", err)
+		problem.Write(w, problem.Internal, "Database error.")
+		return
+	}
+
+	user_acc, err := h.Users.Find(ctx, challenge.UserID)
+	if err != nil && err != repository.ErrNotFound {
+		log.Printf("DATABASE ERROR: %v\n", err)
+		problem.Write(w, problem.Internal, "Database error.")
+		return
+	}
+	if err == repository.ErrNotFound || !user_acc.MFAEnabled() {
+		// The account went away, or the app was removed from another session, since the token was issued.
+		problem.Write(w, problem.MFAExpired, "Verification expired. Please sign in again.")
+		return
+	}
+
+	user_acc, ok := h.useSecondFactor(ctx, w, user_acc, req.Code)
+	if !ok {
+		return
+	}
+
+	// Consuming the token makes it single-use, even if two correct codes arrive at once.
+	_, err = h.Challenges.Consume(ctx, tokenHash, mfaPurpose, time.Now().UnixMilli())
+	if err == repository.ErrNotFound {
+		problem.Write(w, problem.MFAExpired, "Verification expired. Please sign in again.")
+		return
+	}
+	if err != nil {
+		log.Printf("DATABASE ERROR: %v\n", err)
+		problem.Write(w, problem.Internal, "Database error.")
+		return
+	}
+
+	if challenge.Identity != nil {
+		if user_acc, ok = h.useIdentity(ctx, w, user_acc, *challenge.Identity); !ok {
+			return
+		}
+	}
+
+	h.signIn(ctx, w, r, user_acc, challenge.DeviceLabel)
+}
+
+// Handles the first step of enrolling an authenticator app: creates a secret and returns it both for typing in
+// and as an otpauth:// URI for a QR code.
+func (h *Handler) BeginTOTPEnrollment(w http.ResponseWriter, r *http.Request) {
+	// Retrieve user data from context.
+	user_acc, ok := r.Context().Value(middleware.USER_ACCOUNT).(model.UserAccount)
+	if !ok {
+		problem.Write(w, problem.Internal, "Failed to retrieve user session.")
+		return
+	}
+
+	if user_acc.MFAEnabled() {
+		problem.Write(w, problem.TOTPAlreadyEnabled, "An authenticator app is already set up. Please remove it first.")
+		return
+	}
+
+	secret, err := util.GenerateTOTPSecret()
+	if err != nil {
+		problem.Write(w, problem.Internal, "Failed to generate secret.")
+		return
+	}
+	sealed, err := util.SealTOTPSecret(h.OTPSecret, user_acc.ID, secret)
+	if err != nil {
+		log.Printf("ERROR SEALING TOTP SECRET: %v\n", err)
+		problem.Write(w, problem.Internal, "Failed to generate secret.")
+		return
+	}
+
+	// Create a context with a timeout to prevent long-running database operations.
+	ctx, cancel := context.WithTimeout(context.Background(), 8 * time.Second)
+	defer cancel()
+
+	err = h.Users.BeginTOTP(ctx, user_acc.ID, model.TOTP{
+		Secret: sealed,
+		CreatedAt: time.Now().UnixMilli(),
+	})
+	if err == repository.ErrDuplicate {
+		problem.Write(w, problem.TOTPAlreadyEnabled, "An authenticator app is already set up. Please remove it first.")
+		return
+	}
+	if err != nil {
+		log.Printf("DATABASE ERROR: %v\n", err)
+		problem.Write(w, problem.Internal, "Failed to start enrollment.")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(model.TOTPEnrollment{
+		Secret: util.EncodeTOTPSecret(secret),
+		URI: util.TOTPProvisioningURI(h.TOTPIssuer, user_acc.Email, secret),
+	})
+}
+
+// Handles the second step of enrolling an authenticator app: a code from the app proves it was set up right.
+// Responds with the recovery codes, which are never shown again.
+func (h *Handler) ConfirmTOTPEnrollment(w http.ResponseWriter, r *http.Request) {
+	// Retrieve user data from context.
+	user_acc, ok := r.Context().Value(middleware.USER_ACCOUNT).(model.UserAccount)
+	if !ok {
+		problem.Write(w, problem.Internal, "Failed to retrieve user session.")
+		return
+	}
+
+	// Parse request body.
+	var req model.SecondFactorCode
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		problem.Write(w, problem.InvalidRequest, "Invalid request format.")
+		return
+	}
+
+	if user_acc.TOTP == nil || user_acc.TOTP.Confirmed {
+		problem.Write(w, problem.TOTPEnrollmentNotStarted, "Please start setting up an authenticator app first.")
+		return
+	}
+
+	// Create a context with a timeout to prevent long-running database operations.
+	ctx, cancel := context.WithTimeout(context.Background(), 8 * time.Second)
+	defer cancel()
+
+	if !h.allow(ctx, w, rateLimit{"mfa:" + util.HashToken(user_acc.ID), h.SecondFactorLimit}) {
+		return
+	}
+
+	secret, err := util.OpenTOTPSecret(h.OTPSecret, user_acc.ID, user_acc.TOTP.Secret)
+	if err != nil {
+		log.Printf("ERROR OPENING TOTP SECRET: %v\n", err)
+		problem.Write(w, problem.Internal, "Failed to verify code.")
+		return
+	}
+	step, ok := util.MatchTOTP(secret, strings.TrimSpace(req.Code), time.Now())
+	if !ok {
+		problem.Write(w, problem.CodeIncorrect, "The code you provided is incorrect.")
+		return
+	}
+
+	codes, hashes, err := h.newRecoveryCodes(user_acc.ID)
+	if err != nil {
+		problem.Write(w, problem.Internal, "Failed to generate recovery codes.")
+		return
+	}
+
+	_, err = h.Users.ConfirmTOTP(ctx, user_acc.ID, user_acc.TOTP.Secret, step, hashes)
+	if err == repository.ErrNotFound {
+		// Enrollment was restarted, or finished, from another request in the meantime.
+		problem.Write(w, problem.TOTPEnrollmentNotStarted, "Please start setting up an authenticator app first.")
+		return
+	}
+	if err != nil {
+		log.Printf("DATABASE ERROR: %v\n", err)
+		problem.Write(w, problem.Internal, "Failed to confirm enrollment.")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(model.RecoveryCodes{RecoveryCodes: codes})
+}
+
+// Handles replacing the recovery codes of the signed-in account. Takes a current code, so a stolen session
+// alone cannot mint new codes.
+func (h *Handler) RegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	// Retrieve user data from context.
+	user_acc, ok := r.Context().Value(middleware.USER_ACCOUNT).(model.UserAccount)
+	if !ok {
+		problem.Write(w, problem.Internal, "Failed to retrieve user session.")
+		return
+	}
+
+	// Parse request body.
+	var req model.SecondFactorCode
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		problem.Write(w, problem.InvalidRequest, "Invalid request format.")
+		return
+	}
+
+	if !user_acc.MFAEnabled() {
+		problem.Write(w, problem.TOTPNotEnabled, "No authenticator app is set up.")
+		return
+	}
+
+	// Create a context with a timeout to prevent long-running database operations.
+	ctx, cancel := context.WithTimeout(context.Background(), 8 * time.Second)
+	defer cancel()
+
+	if _, ok := h.useSecondFactor(ctx, w, user_acc, req.Code); !ok {
+		return
+	}
+
+	codes, hashes, err := h.newRecoveryCodes(user_acc.ID)
+	if err != nil {
+		problem.Write(w, problem.Internal, "Failed to generate recovery codes.")
+		return
+	}
+
+	err = h.Users.ReplaceRecoveryCodes(ctx, user_acc.ID, hashes)
+	if err == repository.ErrNotFound {
+		problem.Write(w, problem.TOTPNotEnabled, "No authenticator app is set up.")
+		return
+	}
+	if err != nil {
+		log.Printf("DATABASE ERROR: %v\n", err)
+		problem.Write(w, problem.Internal, "Failed to save recovery codes.")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(model.RecoveryCodes{RecoveryCodes: codes})
+}
+
+// Handles removing the authenticator app from the signed-in account. A pending enrollment can be dropped
+// freely; a confirmed one takes a current code or a recovery code.
+func (h *Handler) DisableTOTP(w http.ResponseWriter, r *http.Request) {
+	// Retrieve user data from context.
+	user_acc, ok := r.Context().Value(middleware.USER_ACCOUNT).(model.UserAccount)
+	if !ok {
+		problem.Write(w, problem.Internal, "Failed to retrieve user session.")
+		return
+	}
+
+	// Parse request body.
+	var req model.SecondFactorCode
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		problem.Write(w, problem.InvalidRequest, "Invalid request format.")
+		return
+	}
+
+	if user_acc.TOTP == nil {
+		problem.Write(w, problem.TOTPNotEnabled, "No authenticator app is set up.")
+		return
+	}
+
+	// Create a context with a timeout to prevent long-running database operations.
+	ctx, cancel := context.WithTimeout(context.Background(), 8 * time.Second)
+	defer cancel()
+
+	if user_acc.MFAEnabled() {
+		if _, ok := h.useSecondFactor(ctx, w, user_acc, req.Code); !ok {
+			return
+		}
+	}
+
+	err := h.Users.RemoveTOTP(ctx, user_acc.ID)
+	if err != nil && err != repository.ErrNotFound {
+		log.Printf("DATABASE ERROR: %v\n", err)
+		problem.Write(w, problem.Internal, "Failed to remove authenticator app.")
+		return
+	}
+
+	util.ReturnMessage(w, http.StatusOK, "Authenticator app removed.")
+}
@@ -1 +1,168 @@
-package handler
\ No newline at end of file
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"bearlysocial-backend/api/middleware"
+	"bearlysocial-backend/api/model"
+	"bearlysocial-backend/api/problem"
+	"bearlysocial-backend/util"
+)
+
+// Handles profile update.
+func (h *Handler) UpdateProfile(w http.ResponseWriter, r *http.Request) {
+	// Retrieve user data from context.
+	user_acc, ok := r.Context().Value(middleware.USER_ACCOUNT).(model.UserAccount)
+	if !ok {
+		problem.Write(w, problem.Internal, "Failed to retrieve user session.")
+		return
+	}
+
+	// Parse request body.
+	var req model.UpdateProfile
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		problem.Write(w, problem.InvalidRequest, "Invalid request format.")
+		return
+	}
+
+	// Collect only the fields that are present and differ from the stored profile.
+	changes := bson.M{}
+
+	if req.FirstName != nil {
+		firstName := strings.TrimSpace(*req.FirstName)
+		if !util.ValidName(firstName) {
+			problem.InvalidField.New("Invalid first name.").InField("first_name").Write(w)
+			return
+		}
+		if firstName != user_acc.FirstName {
+			changes["first_name"] = firstName
+		}
+	}
+
+	if req.LastName != nil {
+		lastName := strings.TrimSpace(*req.LastName)
+		if !util.ValidName(lastName) {
+			problem.InvalidField.New("Invalid last name.").InField("last_name").Write(w)
+			return
+		}
+		if lastName != user_acc.LastName {
+			changes["last_name"] = lastName
+		}
+	}
+
+	if req.Interests != nil {
+		interests := make([]string, len(req.Interests))
+		for i, interest := range req.Interests {
+			interests[i] = strings.TrimSpace(interest)
+		}
+		if !util.ValidInterests(interests) {
+			problem.InvalidField.New("Invalid interests.").InField("interests").Write(w)
+			return
+		}
+		if !slices.Equal(interests, user_acc.Interests) {
+			changes["interests"] = interests
+		}
+	}
+
+	if req.Langs != nil {
+		langs := make([]string, len(req.Langs))
+		for i, lang := range req.Langs {
+			langs[i] = strings.ToLower(strings.TrimSpace(lang))
+		}
+		if !util.ValidLangs(langs) {
+			problem.InvalidField.New("Invalid languages.").InField("langs").Write(w)
+			return
+		}
+		if !slices.Equal(langs, user_acc.Langs) {
+			changes["langs"] = langs
+		}
+	}
+
+	if req.InstaHandler != nil {
+		instaHandler := strings.TrimPrefix(strings.TrimSpace(*req.InstaHandler), "@")
+		if !util.ValidInstaHandler(instaHandler) {
+			problem.InvalidField.New("Invalid Instagram handle.").InField("insta_handler").Write(w)
+			return
+		}
+		if instaHandler != user_acc.InstaHandler {
+			changes["insta_handler"] = instaHandler
+		}
+	}
+
+	if req.FB_Handler != nil {
+		fbHandler := strings.TrimSpace(*req.FB_Handler)
+		if !util.ValidFB_Handler(fbHandler) {
+			problem.InvalidField.New("Invalid Facebook handle.").InField("fb_handler").Write(w)
+			return
+		}
+		if fbHandler != user_acc.FB_Handler {
+			changes["fb_handler"] = fbHandler
+		}
+	}
+
+	if req.LinkedinHandler != nil {
+		linkedinHandler := strings.TrimSpace(*req.LinkedinHandler)
+		if !util.ValidLinkedinHandler(linkedinHandler) {
+			problem.InvalidField.New("Invalid LinkedIn handle.").InField("linkedin_handler").Write(w)
+			return
+		}
+		if linkedinHandler != user_acc.LinkedinHandler {
+			changes["linkedin_handler"] = linkedinHandler
+		}
+	}
+
+	if req.Mood != nil {
+		mood := strings.TrimSpace(*req.Mood)
+		if !util.ValidMood(mood) {
+			problem.InvalidField.New("Invalid mood.").InField("mood").Write(w)
+			return
+		}
+		if mood != user_acc.Mood {
+			changes["mood"] = mood
+		}
+	}
+
+	if req.Schedule != nil {
+		if !util.ValidSchedule(req.Schedule) {
+			problem.InvalidField.New("Invalid schedule.").InField("schedule").Write(w)
+			return
+		}
+		if !reflect.DeepEqual(bson.M(req.Schedule), user_acc.Schedule) {
+			changes["schedule"] = bson.M(req.Schedule)
+		}
+	}
+
+	// Nothing to write; return the current profile as is.
+	if len(changes) == 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(user_acc.Profile())
+		return
+	}
+
+	// Create a context with a timeout to prevent long-running database operations.
+	ctx, cancel := context.WithTimeout(context.Background(), 8 * time.Second)
+	defer cancel()
+
+	// Only profile fields are ever written here, so OTP, token and cooldown fields stay untouched.
+	user_acc, err := h.Users.UpdateProfile(ctx, user_acc.ID, changes)
+	if err != nil {
+		log.Printf("DATABASE ERROR: %v\n", err)
+		problem.Write(w, problem.Internal, "Failed to update profile.")
+		return
+	}
+
+	// Return a success response with the updated public profile.
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(user_acc.Profile())
+}
@@ -1,42 +1,20 @@
 package handler
 
 import (
-	"context"
 	"net/http"
-	"time"
 
 	"bearlysocial-backend/api/middleware"
 	"bearlysocial-backend/api/model"
-	"bearlysocial-backend/util"
-
-	"go.mongodb.org/mongo-driver/bson"
+	"bearlysocial-backend/api/problem"
 )
 
-// Handles session update.
-func UpdateSession(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		util.ReturnMessage(w, http.StatusBadRequest, "Method not allowed.")
-		return
-	}
-
+// Handles session update. The middleware has already checked the access token and recorded that the session
+// was used, so answering 200 confirms the session is still valid; new tokens come from /refresh-token.
+func (h *Handler) UpdateSession(w http.ResponseWriter, r *http.Request) {
 	// Retrieve user data from context.
-	user_acc, ok := r.Context().Value(middleware.USER_ACCOUNT).(model.UserAccount)
+	_, ok := r.Context().Value(middleware.USER_ACCOUNT).(model.UserAccount)
 	if !ok {
-		util.ReturnMessage(w, http.StatusInternalServerError, "Failed to retrieve user session.")
-		return
-	}
-
-	// Create a MongoDB context with a timeout.
-	ctx, cancel := context.WithTimeout(context.Background(), 8 * time.Second)
-	defer cancel()
-
-	// Define the filter using the user's ID field.
-	filter := bson.M{"_id": user_acc.ID}
-
-	// Replace the existing document with the latest user data.
-	_, err := util.MongoCollection.ReplaceOne(ctx, filter, user_acc)
-	if err != nil {
-		util.ReturnMessage(w, http.StatusInternalServerError, "Failed to update session in database.")
+		problem.Write(w, problem.Internal, "Failed to retrieve user session.")
 		return
 	}
 
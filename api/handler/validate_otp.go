@@ -3,37 +3,39 @@ package handler
 import (
 	"context"
 	"encoding/json"
-	"fmt"
 	"log"
 	"net/http"
 	"strings"
 	"time"
 
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/mongo"
-
 	"bearlysocial-backend/api/model"
+	"bearlysocial-backend/api/problem"
+	"bearlysocial-backend/api/repository"
+	"bearlysocial-backend/emailaddr"
+	"bearlysocial-backend/emails"
+	"bearlysocial-backend/i18n"
 	"bearlysocial-backend/util"
 )
 
 // Handles OTP validation.
-func ValidateOTP(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		util.ReturnMessage(w, http.StatusBadRequest, "Method not allowed.")
-		return
-	}
-
+func (h *Handler) ValidateOTP(w http.ResponseWriter, r *http.Request) {
 	// Parse request body.
 	var req model.ValidateOTP
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		util.ReturnMessage(w, http.StatusBadRequest, "Invalid request format.")
+		problem.Write(w, problem.InvalidRequest, "Invalid request format.")
 		return
 	}
 
-	userEmail := strings.ToLower(strings.TrimSpace(req.EmailAddress))
+	userEmail, err := emailaddr.Normalize(req.EmailAddress)
 	userOTP := strings.TrimSpace(req.OTP)
-	if !util.ValidEmail(userEmail) || !util.ValidOTP(userOTP) {
-		util.ReturnMessage(w, http.StatusBadRequest, "Invalid email or OTP format.")
+	if err != nil || !h.OTPPolicy.Valid(userOTP) {
+		problem.Write(w, problem.InvalidField, "Invalid email or OTP format.")
+		return
+	}
+
+	deviceLabel := strings.TrimSpace(req.DeviceLabel)
+	if !util.ValidDeviceLabel(deviceLabel) {
+		problem.InvalidField.New("Invalid device label.").InField("device_label").Write(w)
 		return
 	}
 
@@ -41,109 +43,139 @@ func ValidateOTP(w http.ResponseWriter, r *http.Request) {
 	ctx, cancel := context.WithTimeout(context.Background(), 8 * time.Second)
 	defer cancel()
 
-	// Define a variable to store the retrieved user account.
-	var user_acc model.UserAccount
+	now := time.Now().UnixMilli()
 
-	// Define a filter to find the account by email.
-	filter := bson.M{"_id": userEmail}
-
-	// Attempt to find the user account in the database.
-	err := util.MongoCollection.FindOne(ctx, filter).Decode(&user_acc)
+	found, err := h.Users.FindByEmail(ctx, userEmail)
+	if err == repository.ErrNotFound {
+		problem.Write(w, problem.OTPNotRequested, "Please request an OTP first.")
+		return
+	}
+	if err != nil {
+		log.Printf("DATABASE ERROR: %v\n", err)
+		problem.Write(w, problem.Internal, "Database error.")
+		return
+	}
 
-	if err == mongo.ErrNoDocuments || user_acc.OTP == nil {
-		// If user not found or missing OTP, ask the user to request an OTP first.
-		util.ReturnMessage(w, http.StatusBadRequest, "Please request an OTP first.")
+	// Count the attempt before checking the code, in the same write that makes sure the OTP is still pending,
+	// unexpired and has attempts left. Concurrent guesses therefore each use up an attempt of their own, and
+	// the last one starts the cooldown right away.
+	policy := h.OTPPolicy
+	user_acc, err := h.Users.ReserveOTPAttempt(ctx, found.ID, now, policy.MaxAttempts, policy.CooldownMillis())
+	if err == repository.ErrNotFound {
+		h.rejectOTPAttempt(ctx, w, found.ID, now)
 		return
 	}
 	if err != nil {
 		// Handle any other database errors.
 		log.Printf("DATABASE ERROR: %v\n", err)
-		util.ReturnMessage(w, http.StatusInternalServerError, "Database error.")
+		problem.Write(w, problem.Internal, "Database error.")
 		return
 	}
 
-	currentTime := time.Now().UnixMilli()
-	if user_acc.OTP_AttemptCount < 4 {
-		if currentTime > *user_acc.OTP_ExpiryTime {
-			util.ReturnMessage(w, http.StatusBadRequest, "Your OTP has expired.")
-			return
-		} else {
-			if strings.EqualFold(*user_acc.OTP, req.OTP) {
-				token, err := util.GenerateToken(user_acc.ID)
-				if err != nil {
-					util.ReturnMessage(w, http.StatusInternalServerError, "Failed to generate token.")
-					return
-				}
-
-				// Update the database by resetting OTP fields and setting the new token.
-				update := bson.M{
-					"$set": bson.M{
-						"token": token,
-						"otp": nil,
-						"otp_attempt_count": 0,
-						"otp_expiry_time": nil,
-						"cooldown_time": nil,
-					},
-				}
-
-				_, err = util.MongoCollection.UpdateOne(ctx, filter, update)
-				if err != nil {
-					util.ReturnMessage(w, http.StatusInternalServerError, "Failed to update token.")
-					return
-				}
-
-				// Setting fields to reflect the update in the response after successful verification.
-				user_acc.OTP = nil
-				user_acc.OTP_AttemptCount = 0
-				user_acc.OTP_ExpiryTime = nil
-				user_acc.CooldownTime = nil
-				user_acc.Token = &token
-
-				// Return a success response with the updated user data.
-				w.Header().Set("Content-Type", "application/json")
-				w.WriteHeader(http.StatusOK)
-				json.NewEncoder(w).Encode(user_acc)
-			} else {
-				// If the OTP is incorrect, increment the attempt count.
-				update := bson.M{
-					"$inc": bson.M{"otp_attempt_count": 1},
-				}
-				var msg string
-
-				if user_acc.OTP_AttemptCount + 1 >= 4 {
-					cooldownTime := time.Now().Add(1 * time.Hour).UnixMilli()
-					msg = "Too many failed attempts. Please request a new OTP in an hour."
-
-					// Update the account with cooldown information and clear OTP fields.
-					update["$set"] = bson.M{
-						"cooldown_time":   cooldownTime,
-						"otp":             nil,
-						"otp_expiry_time": nil,
-					}
-				} else {
-					msg = "The OTP you provided is incorrect."
-				}
-
-				_, err = util.MongoCollection.UpdateOne(ctx, filter, update)
-				if err != nil {
-					util.ReturnMessage(w, http.StatusInternalServerError, "Failed to update attempt count.")
-					return
-				}
-
-				util.ReturnMessage(w, http.StatusBadRequest, msg)
+	if !util.MatchOTP(h.OTPSecret, user_acc.ID, *user_acc.OTP, userOTP) {
+		// That was the last attempt, so the account is in cooldown now and the OTP is of no further use.
+		if user_acc.OTP_AttemptCount >= policy.MaxAttempts {
+			if err := h.Users.DiscardOTP(ctx, user_acc.ID, *user_acc.OTP); err != nil {
+				log.Printf("DATABASE ERROR: %v\n", err)
+				problem.Write(w, problem.Internal, "Failed to update attempt count.")
 				return
 			}
+			remaining := time.Duration(*user_acc.CooldownTime - now) * time.Millisecond
+			problem.TooManyAttempts.New("Too many failed attempts. Please request a new OTP in %s.", i18n.Duration(remaining)).RetryAfter(remaining).Write(w)
+			return
 		}
-	} else {
-		remaining := time.Until(time.UnixMilli(*user_acc.CooldownTime))
 
-		// Construct message based on remaining time.
-		msg := "Please request a new OTP."
-		if remaining > 0 {
-			msg = fmt.Sprintf("Please request a new OTP in %s.", util.HumanReadableDuration(remaining))
+		problem.Write(w, problem.OTPIncorrect, "The OTP you provided is incorrect.")
+		return
+	}
+
+	// Reset OTP fields. Signing in again also cancels a pending account deletion.
+	user_acc, err = h.Users.CompleteOTP(ctx, user_acc.ID, *user_acc.OTP)
+	if err == repository.ErrNotFound {
+		// A concurrent request consumed or replaced the OTP after this attempt was counted.
+		problem.Write(w, problem.OTPExpired, "Please request a new OTP.")
+		return
+	}
+	if err != nil {
+		problem.Write(w, problem.Internal, "Failed to update account.")
+		return
+	}
+
+	h.completeFirstFactor(ctx, w, r, user_acc, deviceLabel, nil)
+}
+
+// Finishes a sign-in once every factor has been checked: starts a session for this device, while other devices stay
+// signed in, and responds with the account and the session tokens.
+func (h *Handler) signIn(ctx context.Context, w http.ResponseWriter, r *http.Request, user_acc model.UserAccount, deviceLabel string) {
+	// The sessions the account already has tell whether this device is new to it.
+	existing, err := h.Sessions.List(ctx, user_acc.ID)
+	if err != nil {
+		log.Printf("DATABASE ERROR: %v\n", err)
+	}
+
+	tokens, err := h.createSession(ctx, r, user_acc.ID, deviceLabel)
+	if err != nil {
+		log.Printf("ERROR CREATING SESSION: %v\n", err)
+		problem.Write(w, problem.Internal, "Failed to create session.")
+		return
+	}
+
+	if isNewDevice(existing, sessionUserAgent(r)) {
+		// The alert is for the owner of the account, who may not be the one signing in, so it is in their languages.
+		err := h.sendEmail(i18n.Negotiate("", user_acc.Langs), user_acc.Email, emails.NewDevice{
+			DeviceLabel: deviceLabel,
+			UserAgent: sessionUserAgent(r),
+			Time: time.Now().UTC(),
+		})
+		if err != nil {
+			log.Printf("ERROR SENDING EMAIL: %v\n", err)
 		}
+	}
 
-		util.ReturnMessage(w, http.StatusBadRequest, msg)
+	// Return a success response with the updated user data and the session tokens.
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(model.SignInResponse{
+		UserAccount: user_acc,
+		TokenResponse: tokens,
+	})
+}
+
+// Reports whether signing in with the user agent adds a device to an account that is already signed in
+// elsewhere. The first sign-in of an account, or the first after signing out everywhere, has nothing to compare
+// against, so it is not reported.
+func isNewDevice(existing []model.Session, userAgent string) bool {
+	if len(existing) == 0 {
+		return false
+	}
+	for _, session := range existing {
+		if session.UserAgent == userAgent {
+			return false
+		}
+	}
+	return true
+}
+
+// Explains why no attempt could be counted. Reading the account here is safe from races, since nothing is
+// granted based on it.
+func (h *Handler) rejectOTPAttempt(ctx context.Context, w http.ResponseWriter, uid string, now int64) {
+	user_acc, err := h.Users.Find(ctx, uid)
+	if err != nil && err != repository.ErrNotFound {
+		log.Printf("DATABASE ERROR: %v\n", err)
+		problem.Write(w, problem.Internal, "Database error.")
 		return
 	}
+
+	switch {
+	case err == nil && user_acc.CooldownTime != nil && *user_acc.CooldownTime > now:
+		remaining := time.Until(time.UnixMilli(*user_acc.CooldownTime))
+		problem.OTPCooldown.New("Please request a new OTP in %s.", i18n.Duration(remaining)).RetryAfter(remaining).Write(w)
+	case err == repository.ErrNotFound || user_acc.OTP == nil:
+		// If user not found or missing OTP, ask the user to request an OTP first.
+		problem.Write(w, problem.OTPNotRequested, "Please request an OTP first.")
+	case user_acc.OTP_ExpiryTime == nil || *user_acc.OTP_ExpiryTime <= now:
+		problem.Write(w, problem.OTPExpired, "Your OTP has expired.")
+	default:
+		problem.Write(w, problem.OTPExpired, "Please request a new OTP.")
+	}
 }
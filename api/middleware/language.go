@@ -0,0 +1,18 @@
+package middleware
+
+import (
+	"net/http"
+
+	"bearlysocial-backend/i18n"
+)
+
+// Picks the language of the response from the Accept-Language header and sets it as the Content-Language
+// header, which is where the problem package and util.ReturnMessage look for it. ValidateToken refines the choice
+// with the signed-in user's languages.
+func Language(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Language")
+		w.Header().Set(i18n.Header, i18n.Negotiate(r.Header.Get("Accept-Language"), nil).String())
+		next.ServeHTTP(w, r)
+	})
+}
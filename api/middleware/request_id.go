@@ -0,0 +1,37 @@
+package middleware
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"regexp"
+
+	"bearlysocial-backend/api/problem"
+	"bearlysocial-backend/util"
+)
+
+const REQUEST_ID contextKey = "request_id"
+
+// What a request ID from a proxy must look like to be passed on; anything else is replaced.
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{8,64}$`)
+
+// Gives every request an ID, which goes into the request context and the X-Request-ID response header, and from
+// there into every error response, so a report from a client can be matched with the server's logs. An ID set by a
+// proxy in front of the server is kept.
+func RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(problem.RequestIDHeader)
+		if !requestIDPattern.MatchString(id) {
+			var err error
+			if id, err = util.GenerateID(); err != nil {
+				log.Printf("ERROR GENERATING REQUEST ID: %v\n", err)
+				id = ""
+			}
+		}
+
+		if id != "" {
+			w.Header().Set(problem.RequestIDHeader, id)
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), REQUEST_ID, id)))
+	})
+}
@@ -0,0 +1,26 @@
+package middleware
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"net/http"
+
+	"bearlysocial-backend/api/problem"
+)
+
+// Returns a middleware that only lets through requests whose X-Admin-Key header matches the given key. Both are
+// hashed before comparing, so the comparison takes the same time whatever their lengths.
+func RequireAdminKey(key string) func(http.Handler) http.Handler {
+	want := sha256.Sum256([]byte(key))
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got := sha256.Sum256([]byte(r.Header.Get("X-Admin-Key")))
+			if key == "" || subtle.ConstantTimeCompare(got[:], want[:]) != 1 {
+				problem.Write(w, problem.AdminKeyInvalid, "Invalid admin key.")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
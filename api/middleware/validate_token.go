@@ -7,65 +7,77 @@ import (
 	"strings"
 	"time"
 
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
-
-	"bearlysocial-backend/api/model"
+	"bearlysocial-backend/api/problem"
+	"bearlysocial-backend/api/repository"
+	"bearlysocial-backend/i18n"
 	"bearlysocial-backend/util"
 )
 
 // Define a key type to avoid context key collisions.
 type contextKey string
 const USER_ACCOUNT contextKey = "user_acc"
+const SESSION contextKey = "session"
 
-// Verifies the token and injects user data into the request context.
-func ValidateToken(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {	
-		// Extract token from Authorization header.
-		reqToken := r.Header.Get("Authorization")
-		if !util.ValidToken(reqToken) {
-			util.ReturnMessage(w, http.StatusUnauthorized, "Invalid token format.")
-			return
-		}
-
-		// Create a context with a timeout to prevent long-running database operations.
-		ctx, cancel := context.WithTimeout(context.Background(), 8 * time.Second)
-		defer cancel()
-
-		uid := strings.Split(strings.ToLower(reqToken), "::")[0] // Extract uid (email) from request token.
-		updateToken, err := util.GenerateToken(uid) // Generate a new token for the user.
-		if err != nil {
-			util.ReturnMessage(w, http.StatusInternalServerError, "Token generation failed.")
-			return
-		  }
+// Returns a middleware that verifies the access token and injects user and session data into the request
+// context. Tokens are not rotated per request, so parallel requests from one device never race each other.
+// The previous access token of a session keeps working for the rotation grace period after a refresh.
+//
+// Failures carry a code so clients know what to do next: "token_expired" means the access token should be
+// refreshed, "session_expired" means the user has to sign in again, and "token_invalid" covers everything else.
+func ValidateToken(users repository.UserAccounts, sessions repository.Sessions, limits repository.SessionLimits) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Extract token from Authorization header.
+			reqToken := r.Header.Get("Authorization")
+			if !util.ValidToken(reqToken) {
+				problem.Write(w, problem.TokenInvalid, "Invalid token format.")
+				return
+			}
 
-	    filter := bson.M{"_id": uid, "token": reqToken}
-    	update := bson.M{"$set": bson.M{"token": updateToken}}
+			// Create a context with a timeout to prevent long-running database operations.
+			ctx, cancel := context.WithTimeout(context.Background(), 8 * time.Second)
+			defer cancel()
 
-		// Define a variable to store the retrieved user account.
-		var user_acc model.UserAccount
+			// Only digests are stored, so look the session up by the digest of the presented token. This also
+			// covers legacy "email::hashpass" tokens, which the startup migration moved into sessions.
+			reqTokenHash := util.HashToken(strings.ToLower(reqToken))
 
-		// Atomically validate token and set new token.
-		err = util.MongoCollection.FindOneAndUpdate(
-			ctx,
-			filter,
-			update,
-			options.FindOneAndUpdate().SetReturnDocument(options.After),
-		  ).Decode(&user_acc)
+			// Atomically find the live session with an unexpired access token and record that it was just used.
+			// Every request goes to the store and revoking a session removes it, so revoked tokens fail right away.
+			session, err := sessions.Touch(ctx, reqTokenHash, time.Now().UnixMilli(), limits)
+			if err != nil {
+				switch err {
+				case repository.ErrAccessTokenExpired:
+					problem.Write(w, problem.TokenExpired, "Access token expired.")
+				case repository.ErrSessionExpired:
+					problem.Write(w, problem.SessionExpired, "Session expired. Please sign in again.")
+				case repository.ErrNotFound:
+					problem.Write(w, problem.TokenInvalid, "Authorization failed.")
+				default:
+					log.Printf("DATABASE ERROR: %v\n", err)
+					problem.Write(w, problem.Internal, "Database error.")
+				}
+				return
+			}
 
-		if err != nil {
-			if err == mongo.ErrNoDocuments {
-				util.ReturnMessage(w, http.StatusUnauthorized, "Authorization failed.")
-			} else {
-				log.Printf("DATABASE ERROR: %v\n", err)
-				util.ReturnMessage(w, http.StatusInternalServerError, "Database error.")
+			user_acc, err := users.Find(ctx, session.UserID)
+			if err != nil {
+				if err == repository.ErrNotFound {
+					problem.Write(w, problem.TokenInvalid, "Authorization failed.")
+				} else {
+					log.Printf("DATABASE ERROR: %v\n", err)
+					problem.Write(w, problem.Internal, "Database error.")
+				}
+				return
 			}
-			return
-		}
 
-		// Inject updated user data into context.
-		ctx = context.WithValue(r.Context(), USER_ACCOUNT, user_acc)
-		next.ServeHTTP(w, r.WithContext(ctx))
-	})
+			// Users who did not ask for a language are answered in one of theirs.
+			w.Header().Set(i18n.Header, i18n.Negotiate(r.Header.Get("Accept-Language"), user_acc.Langs).String())
+
+			// Inject user and session data into context.
+			ctx = context.WithValue(r.Context(), USER_ACCOUNT, user_acc)
+			ctx = context.WithValue(ctx, SESSION, session)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
 }
@@ -0,0 +1,17 @@
+package model
+
+// Represents a single-use challenge issued for a sign-in ceremony, e.g. a passkey registration or login, an
+// OpenID Connect sign-in, or the second-factor step of a sign-in. Times are Unix milliseconds.
+type Challenge struct {
+	ID string `bson:"_id"` // The challenge itself, base64url encoded, or a token's digest.
+	Purpose string `bson:"purpose"`
+	UserID string `bson:"user_id,omitempty"` // Set when the ceremony is tied to an account.
+	DeviceLabel string `bson:"device_label,omitempty"` // Carried over to the session a second-factor step ends in.
+	// For OpenID Connect sign-ins: the provider, and the nonce and PKCE verifier the authorization request
+	// was made with.
+	Provider string `bson:"provider,omitempty"`
+	Nonce string `bson:"nonce,omitempty"`
+	CodeVerifier string `bson:"code_verifier,omitempty"`
+	Identity *Identity `bson:"identity,omitempty"` // The provider identity a second-factor step links once it passes.
+	ExpiryTime int64 `bson:"expiry_time"`
+}
@@ -0,0 +1,11 @@
+package model
+
+// Represents a pending change of the account's email address. A code goes to each address, and both codes are
+// stored as keyed hashes, like the sign-in OTP. Times are Unix milliseconds.
+type EmailChange struct {
+	NewEmail string `bson:"new_email" json:"new_email_address"`
+	OldOTP string `bson:"old_otp" json:"-"`
+	NewOTP string `bson:"new_otp" json:"-"`
+	AttemptCount int `bson:"attempt_count" json:"-"`
+	ExpiryTime int64 `bson:"expiry_time" json:"expiry_time"`
+}
@@ -0,0 +1,10 @@
+package model
+
+// Represents an account at an OpenID Connect provider linked to a user account. Times are Unix milliseconds.
+type Identity struct {
+	ID string `bson:"id" json:"-"` // "<provider>:<subject>", unique across all accounts.
+	Provider string `bson:"provider" json:"provider"`
+	Subject string `bson:"subject" json:"-"`
+	Email string `bson:"email" json:"email"` // As the provider reported it when the identity was linked.
+	LinkedAt int64 `bson:"linked_at" json:"linked_at"`
+}
@@ -0,0 +1,11 @@
+package model
+
+// Represents a passkey (WebAuthn credential) registered to a user account. Times are Unix milliseconds.
+type Passkey struct {
+	ID string `bson:"id" json:"id"` // Credential ID, base64url encoded.
+	PublicKey []byte `bson:"public_key" json:"-"` // COSE encoded.
+	SignCount int64 `bson:"sign_count" json:"-"`
+	Name string `bson:"name" json:"name"`
+	CreatedAt int64 `bson:"created_at" json:"created_at"`
+	LastUsedAt int64 `bson:"last_used_at" json:"last_used_at"`
+}
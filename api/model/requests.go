@@ -7,4 +7,80 @@ type RequestOTP struct {
 type ValidateOTP struct {
 	EmailAddress string `json:"email_address"`
 	OTP          string `json:"otp"`
+	DeviceLabel  string `json:"device_label"` // Optional, e.g. "Pixel 8"; shown in the session list.
+}
+
+type ConfirmMagicLink struct {
+	Token       string `json:"token"` // The token query parameter of the emailed link.
+	DeviceLabel string `json:"device_label"`
+}
+
+// Binary WebAuthn fields are base64url encoded, as in the browser's PublicKeyCredential.toJSON().
+type FinishPasskeyRegistration struct {
+	ClientDataJSON    string `json:"client_data_json"`
+	AttestationObject string `json:"attestation_object"`
+	Name              string `json:"name"` // Optional, e.g. "iCloud Keychain".
+}
+
+type BeginPasskeyLogin struct {
+	EmailAddress string `json:"email_address"` // Optional; limits the prompt to that account's passkeys.
+}
+
+type FinishPasskeyLogin struct {
+	CredentialID      string `json:"credential_id"`
+	ClientDataJSON    string `json:"client_data_json"`
+	AuthenticatorData string `json:"authenticator_data"`
+	Signature         string `json:"signature"`
+	DeviceLabel       string `json:"device_label"`
+}
+
+type BeginOIDCLogin struct {
+	Provider string `json:"provider"` // "google" or "apple".
+}
+
+// The code and state the provider redirected back with.
+type FinishOIDCLogin struct {
+	State       string `json:"state"`
+	Code        string `json:"code"`
+	DeviceLabel string `json:"device_label"`
+}
+
+type VerifyMFA struct {
+	MFAToken string `json:"mfa_token"`
+	Code     string `json:"code"` // A code from the authenticator app, or a recovery code.
+}
+
+type SecondFactorCode struct {
+	Code string `json:"code"`
+}
+
+type BeginEmailChange struct {
+	NewEmailAddress string `json:"new_email_address"`
+}
+
+// One code was sent to the current address and one to the new address.
+type ConfirmEmailChange struct {
+	OldOTP string `json:"old_otp"`
+	NewOTP string `json:"new_otp"`
+}
+
+type RefreshToken struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+type RevokeSession struct {
+	SessionID string `json:"session_id"`
+}
+
+// Partial profile update; fields left out of the request body (or sent as null) are not touched.
+type UpdateProfile struct {
+	FirstName       *string                `json:"first_name"`
+	LastName        *string                `json:"last_name"`
+	Interests       []string               `json:"interests"`
+	Langs           []string               `json:"langs"`
+	InstaHandler    *string                `json:"insta_handler"`
+	FB_Handler      *string                `json:"fb_handler"`
+	LinkedinHandler *string                `json:"linkedin_handler"`
+	Mood            *string                `json:"mood"`
+	Schedule        map[string]interface{} `json:"schedule"`
 }
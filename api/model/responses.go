@@ -0,0 +1,46 @@
+package model
+
+// A freshly issued access/refresh token pair. TokenExpiryTime (Unix milliseconds) is when the access token
+// stops working and has to be refreshed.
+type TokenResponse struct {
+	Token string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+	TokenExpiryTime int64 `json:"token_expiry_time"`
+	SessionID string `json:"session_id"`
+}
+
+// Returned when a sign-in completes. The account is embedded so clients keep seeing the same fields as before.
+type SignInResponse struct {
+	UserAccount
+	TokenResponse
+}
+
+// Where to send the user to sign in with an OpenID Connect provider.
+type OIDCAuthorization struct {
+	AuthorizationURL string `json:"authorization_url"`
+}
+
+// Returned by the first sign-in step of an account with an authenticator app, in place of a SignInResponse.
+// The sign-in is finished by posting the MFA token with a code to /verify-mfa before its expiry time.
+type MFARequiredResponse struct {
+	MFARequired bool `json:"mfa_required"`
+	MFAToken string `json:"mfa_token"`
+	MFATokenExpiryTime int64 `json:"mfa_token_expiry_time"`
+}
+
+// A new authenticator-app secret, both for typing in and as an otpauth:// URI to show as a QR code.
+type TOTPEnrollment struct {
+	Secret string `json:"secret"`
+	URI string `json:"uri"`
+}
+
+// Freshly issued one-time recovery codes. They are only ever shown this once.
+type RecoveryCodes struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+// One entry of the session list; Current marks the session that made the request.
+type SessionInfo struct {
+	Session
+	Current bool `json:"current"`
+}
@@ -0,0 +1,23 @@
+package model
+
+// Represents one signed-in device in MongoDB. Times are Unix milliseconds.
+//
+// A session holds a short-lived access token and a long-lived refresh token, both stored only as digests.
+// Rotating the pair keeps the previous digests around for a short grace window, and every refresh token the
+// session ever rotated out is remembered in RefreshHistory so that replaying one can be detected.
+type Session struct {
+	ID string `bson:"_id" json:"session_id"`
+	UserID string `bson:"user_id" json:"uid"`
+	AccessTokenHash string `bson:"access_token_hash" json:"-"`
+	AccessExpiryTime int64 `bson:"access_expiry_time" json:"-"`
+	RefreshTokenHash string `bson:"refresh_token_hash,omitempty" json:"-"`
+	PrevAccessTokenHash string `bson:"prev_access_token_hash,omitempty" json:"-"`
+	PrevRefreshTokenHash string `bson:"prev_refresh_token_hash,omitempty" json:"-"`
+	RotatedAt int64 `bson:"rotated_at,omitempty" json:"-"`
+	RefreshHistory []string `bson:"refresh_history,omitempty" json:"-"`
+	DeviceLabel string `bson:"device_label" json:"device_label"`
+	UserAgent string `bson:"user_agent" json:"user_agent"`
+	CreatedAt int64 `bson:"created_at" json:"created_at"`
+	LastSeenAt int64 `bson:"last_seen_at" json:"last_seen_at"`
+	ExpiryTime int64 `bson:"expiry_time" json:"expiry_time"`
+}
@@ -0,0 +1,26 @@
+package model
+
+// Represents an authenticator app enrolled as a second factor. Until the user proves the app works by entering
+// a code, the enrollment is pending and sign-in does not ask for it. Times are Unix milliseconds.
+type TOTP struct {
+	Secret string `bson:"secret" json:"-"` // Sealed with util.SealTOTPSecret.
+	Confirmed bool `bson:"confirmed" json:"confirmed"`
+	LastStep int64 `bson:"last_step" json:"-"` // Time step of the last code accepted; earlier codes are refused.
+	RecoveryCodes []string `bson:"recovery_codes" json:"-"` // Hashes of the unused recovery codes.
+	RecoveryCodesUID string `bson:"recovery_codes_uid,omitempty" json:"-"` // See RecoveryCodeUID.
+	CreatedAt int64 `bson:"created_at" json:"created_at"`
+}
+
+// Returns the ID the recovery codes are hashed under. Codes handed out before the account moved to a generated
+// ID stay hashed under the old one, since a hash cannot be moved without the code, until they are replaced.
+func (t *TOTP) RecoveryCodeUID(uid string) string {
+	if t.RecoveryCodesUID != "" {
+		return t.RecoveryCodesUID
+	}
+	return uid
+}
+
+// Whether sign-in has to be completed with a second factor.
+func (u UserAccount) MFAEnabled() bool {
+	return u.TOTP != nil && u.TOTP.Confirmed
+}
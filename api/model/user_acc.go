@@ -8,13 +8,14 @@ import (
 
 // Represents the user account structure in MongoDB with snake_case fields.
 type UserAccount struct {
-	ID string `bson:"_id" json:"uid"`
+	ID string `bson:"_id" json:"uid"` // Generated once and never changed; see util.GenerateUserID.
+	Email string `bson:"email" json:"email_address"`
 	OTP *string `bson:"otp" json:"otp"`
 	OTP_AttemptCount int `bson:"otp_attempt_count" json:"otp_attempt_count"`
 	OTP_ExpiryTime *int64 `bson:"otp_expiry_time" json:"otp_expiry_time"`
 	CooldownTime *int64 `bson:"cooldown_time" json:"cooldown_time"`
+	OTP_LockoutCount int `bson:"otp_lockout_count" json:"otp_lockout_count"`
 	CreatedAt time.Time `bson:"created_at" json:"created_at"`
-	Token *string `bson:"token" json:"token"`
 	FirstName string `bson:"first_name" json:"first_name"`
 	LastName string `bson:"last_name" json:"last_name"`
 	Interests []string `bson:"interests" json:"interests"`
@@ -24,4 +25,39 @@ type UserAccount struct {
 	LinkedinHandler string `bson:"linkedin_handler" json:"linkedin_handler"`
 	Mood string `bson:"mood" json:"mood"`
 	Schedule bson.M `bson:"schedule" json:"schedule"`
+	DeletionTime *int64 `bson:"deletion_time" json:"deletion_time"`
+	Passkeys []Passkey `bson:"passkeys,omitempty" json:"passkeys"`
+	TOTP *TOTP `bson:"totp,omitempty" json:"totp"`
+	Identities []Identity `bson:"identities,omitempty" json:"identities"`
+	EmailChange *EmailChange `bson:"email_change,omitempty" json:"email_change"`
+}
+
+// Represents the public part of a user account that is safe to return to clients.
+type Profile struct {
+	ID string `json:"uid"`
+	FirstName string `json:"first_name"`
+	LastName string `json:"last_name"`
+	Interests []string `json:"interests"`
+	Langs []string `json:"langs"`
+	InstaHandler string `json:"insta_handler"`
+	FB_Handler string `json:"fb_handler"`
+	LinkedinHandler string `json:"linkedin_handler"`
+	Mood string `json:"mood"`
+	Schedule bson.M `json:"schedule"`
+}
+
+// Strips OTP, token and cooldown fields from the account.
+func (u UserAccount) Profile() Profile {
+	return Profile{
+		ID: u.ID,
+		FirstName: u.FirstName,
+		LastName: u.LastName,
+		Interests: u.Interests,
+		Langs: u.Langs,
+		InstaHandler: u.InstaHandler,
+		FB_Handler: u.FB_Handler,
+		LinkedinHandler: u.LinkedinHandler,
+		Mood: u.Mood,
+		Schedule: u.Schedule,
+	}
 }
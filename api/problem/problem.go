@@ -0,0 +1,94 @@
+// Package problem writes API errors in the RFC 7807 problem details format, application/problem+json. Every
+// error carries a stable code that clients can branch on instead of parsing the human-readable detail, which may
+// change and is translated into the language of the response.
+package problem
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"bearlysocial-backend/i18n"
+)
+
+// The header the request ID travels in. The RequestID middleware sets it on every response before any handler
+// runs, so Write can copy it into the body without needing the request.
+const RequestIDHeader = "X-Request-ID"
+
+// A kind of failure. The code and status of a type never change once published; add a new type instead.
+type Type struct {
+	Code   string
+	Status int
+	Title  string
+}
+
+// One occurrence of a problem, as sent to clients.
+type Problem struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail"`
+
+	// Extension members.
+	Code              string `json:"code"`
+	Message           string `json:"message"` // Same as Detail, for clients from before this format.
+	RequestID         string `json:"request_id,omitempty"`
+	RetryAfterSeconds int64  `json:"retry_after_seconds,omitempty"`
+	Field             string `json:"field,omitempty"`
+
+	// The English detail and its arguments, translated when the problem is written.
+	format string
+	args   []interface{}
+}
+
+// Returns a problem of this type whose human-readable detail is the given English format and arguments, as for
+// i18n.Sprintf.
+func (t Type) New(format string, args ...interface{}) Problem {
+	return Problem{
+		Type:   "urn:bearlysocial:problem:" + t.Code,
+		Title:  t.Title,
+		Status: t.Status,
+		Code:   t.Code,
+		format: format,
+		args:   args,
+	}
+}
+
+// Returns the problem with the time after which the client may try again, rounded up to whole seconds so it
+// never retries early. Write also sends it as a Retry-After header.
+func (p Problem) RetryAfter(d time.Duration) Problem {
+	p.RetryAfterSeconds = max(int64((d+time.Second-1)/time.Second), 1)
+	return p
+}
+
+// Returns the problem with the name of the request field that caused it.
+func (p Problem) InField(name string) Problem {
+	p.Field = name
+	return p
+}
+
+func (p Problem) Error() string {
+	return p.Code + ": " + i18n.Sprintf(i18n.Supported[0], p.format, p.args...)
+}
+
+// Writes the problem as the response, in the language set in its Content-Language header.
+func (p Problem) Write(w http.ResponseWriter) {
+	tag := i18n.FromHeader(w.Header())
+	p.Title = i18n.Translate(tag, p.Title)
+	p.Detail = i18n.Sprintf(tag, p.format, p.args...)
+	p.Message = p.Detail
+	p.RequestID = w.Header().Get(RequestIDHeader)
+	if p.RetryAfterSeconds > 0 {
+		w.Header().Set("Retry-After", strconv.FormatInt(p.RetryAfterSeconds, 10))
+	}
+
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(p.Status)
+	json.NewEncoder(w).Encode(p)
+}
+
+// Writes a problem of the given type as the response, with the given English detail, as for New.
+func Write(w http.ResponseWriter, t Type, format string, args ...interface{}) {
+	t.New(format, args...).Write(w)
+}
@@ -0,0 +1,59 @@
+package problem
+
+import "net/http"
+
+// Problems any endpoint may return.
+var (
+	InvalidRequest      = Type{"invalid_request", http.StatusBadRequest, "The request body is malformed."}
+	InvalidField        = Type{"invalid_field", http.StatusBadRequest, "A request field is invalid."}
+	NotFound            = Type{"not_found", http.StatusNotFound, "No such endpoint."}
+	MethodNotAllowed    = Type{"method_not_allowed", http.StatusMethodNotAllowed, "The endpoint does not support this method."}
+	RateLimited         = Type{"rate_limited", http.StatusTooManyRequests, "Too many requests."}
+	Internal            = Type{"internal_error", http.StatusInternalServerError, "Something went wrong on the server."}
+	ProviderUnavailable = Type{"provider_unavailable", http.StatusBadGateway, "A service the server depends on is unavailable."}
+)
+
+// Problems with credentials. Each tells the client what to do next: refresh the access token on token_expired,
+// and sign in again on every other one.
+var (
+	TokenInvalid    = Type{"token_invalid", http.StatusUnauthorized, "The access token is invalid."}
+	TokenExpired    = Type{"token_expired", http.StatusUnauthorized, "The access token has expired."}
+	SessionExpired  = Type{"session_expired", http.StatusUnauthorized, "The session has expired."}
+	TokenReused     = Type{"token_reused", http.StatusUnauthorized, "The refresh token was already used."}
+	AdminKeyInvalid = Type{"admin_key_invalid", http.StatusUnauthorized, "The admin key is invalid."}
+	SessionNotFound = Type{"session_not_found", http.StatusNotFound, "No such session."}
+)
+
+// Problems with signing in by email.
+var (
+	EmailBlocked       = Type{"email_blocked", http.StatusBadRequest, "The email domain is not accepted."}
+	OTPCooldown        = Type{"otp_cooldown", http.StatusBadRequest, "No new OTP can be sent yet."}
+	OTPNotRequested    = Type{"otp_not_requested", http.StatusBadRequest, "No OTP was requested."}
+	OTPExpired         = Type{"otp_expired", http.StatusBadRequest, "The OTP is no longer valid."}
+	OTPIncorrect       = Type{"otp_incorrect", http.StatusBadRequest, "The OTP is incorrect."}
+	TooManyAttempts    = Type{"too_many_attempts", http.StatusBadRequest, "Too many failed attempts."}
+	LinkInvalid        = Type{"link_invalid", http.StatusBadRequest, "The sign-in link is invalid."}
+	LinkExpired        = Type{"link_expired", http.StatusBadRequest, "The sign-in link has expired."}
+	EmailInUse         = Type{"email_in_use", http.StatusBadRequest, "The email address belongs to another account."}
+	EmailUnchanged     = Type{"email_unchanged", http.StatusBadRequest, "The email address is already the account's."}
+	EmailChangeExpired = Type{"email_change_expired", http.StatusBadRequest, "No email change is pending."}
+	EmailUnverified    = Type{"email_unverified", http.StatusBadRequest, "The provider has no verified email address."}
+	ProviderUnknown    = Type{"provider_unknown", http.StatusBadRequest, "The sign-in provider is not supported."}
+	SignInExpired      = Type{"sign_in_expired", http.StatusBadRequest, "The sign-in attempt has expired."}
+	SignInUnverified   = Type{"sign_in_unverified", http.StatusBadRequest, "The provider's answer could not be verified."}
+)
+
+// Problems with second factors and passkeys.
+var (
+	CodeIncorrect            = Type{"code_incorrect", http.StatusBadRequest, "The code is incorrect."}
+	CodeReused               = Type{"code_reused", http.StatusBadRequest, "The code was already used."}
+	MFAExpired               = Type{"mfa_expired", http.StatusBadRequest, "The second sign-in step has expired."}
+	TOTPNotEnabled           = Type{"totp_not_enabled", http.StatusBadRequest, "No authenticator app is set up."}
+	TOTPAlreadyEnabled       = Type{"totp_already_enabled", http.StatusBadRequest, "An authenticator app is already set up."}
+	TOTPEnrollmentNotStarted = Type{"totp_enrollment_not_started", http.StatusBadRequest, "Authenticator app setup was not started."}
+	PasskeyFailed            = Type{"passkey_verification_failed", http.StatusBadRequest, "The passkey could not be verified."}
+	PasskeyChallengeExpired  = Type{"passkey_challenge_expired", http.StatusBadRequest, "The passkey ceremony has expired."}
+	PasskeyLimitReached      = Type{"passkey_limit_reached", http.StatusBadRequest, "The account has too many passkeys."}
+	PasskeyExists            = Type{"passkey_exists", http.StatusBadRequest, "The passkey is already registered."}
+	PasskeyNotFound          = Type{"passkey_not_found", http.StatusNotFound, "No such passkey."}
+)
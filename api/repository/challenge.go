@@ -0,0 +1,29 @@
+package repository
+
+import (
+	"context"
+
+	"bearlysocial-backend/api/model"
+)
+
+// Storage for single-use ceremony challenges.
+type Challenges interface {
+	// Stores a new challenge, or returns ErrDuplicate if its ID is taken.
+	Create(ctx context.Context, challenge model.Challenge) error
+
+	// Returns the unexpired challenge with the given ID and purpose without using it up, or ErrNotFound.
+	Find(ctx context.Context, id string, purpose string, now int64) (model.Challenge, error)
+
+	// Removes and returns the unexpired challenge with the given ID and purpose, or returns ErrNotFound. Only
+	// one caller can ever consume a challenge.
+	Consume(ctx context.Context, id string, purpose string, now int64) (model.Challenge, error)
+
+	// Removes every challenge that has expired as of now, returning how many were removed.
+	DeleteExpired(ctx context.Context, now int64) (int64, error)
+
+	// Removes every challenge tied to the user, returning how many were removed.
+	DeleteAll(ctx context.Context, userID string) (int64, error)
+
+	// Migration: hands every challenge tied to the user oldID to newID, returning how many were moved.
+	ChangeUserID(ctx context.Context, oldID, newID string) (int64, error)
+}
@@ -0,0 +1,584 @@
+package repository
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"bearlysocial-backend/api/model"
+	"bearlysocial-backend/util"
+)
+
+// Stores user accounts in process memory. A single mutex guards every operation, which gives the same
+// per-account atomicity as the MongoDB implementation. Meant for tests and local development.
+type MemoryUserAccounts struct {
+	mu       sync.Mutex
+	accounts map[string]model.UserAccount
+}
+
+func NewMemoryUserAccounts() *MemoryUserAccounts {
+	return &MemoryUserAccounts{accounts: make(map[string]model.UserAccount)}
+}
+
+func (m *MemoryUserAccounts) Find(ctx context.Context, id string) (model.UserAccount, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user_acc, ok := m.accounts[id]
+	if !ok {
+		return model.UserAccount{}, ErrNotFound
+	}
+	return clone(user_acc)
+}
+
+func (m *MemoryUserAccounts) FindByEmail(ctx context.Context, email string) (model.UserAccount, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, user_acc := range m.accounts {
+		if user_acc.Email == email {
+			return clone(user_acc)
+		}
+	}
+	return model.UserAccount{}, ErrNotFound
+}
+
+func (m *MemoryUserAccounts) Create(ctx context.Context, user_acc model.UserAccount) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.accounts[user_acc.ID]; ok || m.emailTaken(user_acc.Email, "") {
+		return ErrDuplicate
+	}
+
+	stored, err := clone(user_acc)
+	if err != nil {
+		return err
+	}
+	m.accounts[user_acc.ID] = stored
+	return nil
+}
+
+func (m *MemoryUserAccounts) IssueOTP(ctx context.Context, id string, otp string, expiryTime int64, now int64) (model.UserAccount, error) {
+	inCooldown := false
+	user_acc, err := m.update(id, func(user_acc *model.UserAccount) bool {
+		if user_acc.CooldownTime != nil {
+			if *user_acc.CooldownTime > now {
+				inCooldown = true
+				return false
+			}
+			user_acc.OTP_AttemptCount = 0
+			user_acc.CooldownTime = nil
+		}
+		user_acc.OTP = &otp
+		user_acc.OTP_ExpiryTime = &expiryTime
+		return true
+	})
+	if inCooldown {
+		user_acc, err := m.Find(ctx, id)
+		if err != nil {
+			return model.UserAccount{}, err
+		}
+		return user_acc, ErrCooldown
+	}
+	return user_acc, err
+}
+
+func (m *MemoryUserAccounts) ReserveOTPAttempt(ctx context.Context, id string, now int64, maxAttempts int, cooldowns []int64) (model.UserAccount, error) {
+	return m.update(id, func(user_acc *model.UserAccount) bool {
+		if user_acc.OTP == nil || user_acc.OTP_ExpiryTime == nil || *user_acc.OTP_ExpiryTime <= now ||
+			user_acc.OTP_AttemptCount >= maxAttempts {
+			return false
+		}
+		user_acc.OTP_AttemptCount++
+		if user_acc.OTP_AttemptCount >= maxAttempts {
+			cooldownTime := now + cooldowns[min(user_acc.OTP_LockoutCount, len(cooldowns)-1)]
+			user_acc.CooldownTime = &cooldownTime
+			user_acc.OTP_LockoutCount++
+		}
+		return true
+	})
+}
+
+func (m *MemoryUserAccounts) CompleteOTP(ctx context.Context, id string, otp string) (model.UserAccount, error) {
+	return m.update(id, func(user_acc *model.UserAccount) bool {
+		if user_acc.OTP == nil || *user_acc.OTP != otp {
+			return false
+		}
+		user_acc.OTP = nil
+		user_acc.OTP_AttemptCount = 0
+		user_acc.OTP_ExpiryTime = nil
+		user_acc.OTP_LockoutCount = 0
+		user_acc.CooldownTime = nil
+		user_acc.DeletionTime = nil
+		return true
+	})
+}
+
+func (m *MemoryUserAccounts) DiscardOTP(ctx context.Context, id string, otp string) error {
+	_, err := m.update(id, func(user_acc *model.UserAccount) bool {
+		if user_acc.OTP == nil || *user_acc.OTP != otp {
+			return false
+		}
+		user_acc.OTP = nil
+		user_acc.OTP_ExpiryTime = nil
+		return true
+	})
+	if err == ErrNotFound {
+		return nil // Like the MongoDB implementation, a replaced OTP is left alone without complaint.
+	}
+	return err
+}
+
+func (m *MemoryUserAccounts) AddPasskey(ctx context.Context, id string, passkey model.Passkey, limit int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user_acc, ok := m.accounts[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if len(user_acc.Passkeys) >= limit {
+		return ErrLimitReached
+	}
+	for _, other := range m.accounts {
+		for _, existing := range other.Passkeys {
+			if existing.ID == passkey.ID {
+				return ErrDuplicate
+			}
+		}
+	}
+
+	user_acc, err := clone(user_acc)
+	if err != nil {
+		return err
+	}
+	user_acc.Passkeys = append(user_acc.Passkeys, passkey)
+	m.accounts[id] = user_acc
+	return nil
+}
+
+func (m *MemoryUserAccounts) RemovePasskey(ctx context.Context, id string, credentialID string) error {
+	_, err := m.update(id, func(user_acc *model.UserAccount) bool {
+		for i, passkey := range user_acc.Passkeys {
+			if passkey.ID == credentialID {
+				user_acc.Passkeys = append(user_acc.Passkeys[:i], user_acc.Passkeys[i+1:]...)
+				return true
+			}
+		}
+		return false
+	})
+	return err
+}
+
+func (m *MemoryUserAccounts) FindByPasskey(ctx context.Context, credentialID string) (model.UserAccount, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, user_acc := range m.accounts {
+		for _, passkey := range user_acc.Passkeys {
+			if passkey.ID == credentialID {
+				return clone(user_acc)
+			}
+		}
+	}
+	return model.UserAccount{}, ErrNotFound
+}
+
+func (m *MemoryUserAccounts) UsePasskey(ctx context.Context, id string, credentialID string, prevSignCount, signCount int64, now int64) (model.UserAccount, error) {
+	return m.update(id, func(user_acc *model.UserAccount) bool {
+		for i := range user_acc.Passkeys {
+			passkey := &user_acc.Passkeys[i]
+			if passkey.ID == credentialID && passkey.SignCount == prevSignCount {
+				passkey.SignCount = signCount
+				passkey.LastUsedAt = now
+				user_acc.DeletionTime = nil
+				return true
+			}
+		}
+		return false
+	})
+}
+
+func (m *MemoryUserAccounts) BeginEmailChange(ctx context.Context, id string, change model.EmailChange) error {
+	_, err := m.update(id, func(user_acc *model.UserAccount) bool {
+		user_acc.EmailChange = &change
+		return true
+	})
+	return err
+}
+
+func (m *MemoryUserAccounts) ReserveEmailChangeAttempt(ctx context.Context, id string, now int64, maxAttempts int) (model.UserAccount, error) {
+	return m.update(id, func(user_acc *model.UserAccount) bool {
+		change := user_acc.EmailChange
+		if change == nil || change.ExpiryTime <= now || change.AttemptCount >= maxAttempts {
+			return false
+		}
+		change.AttemptCount++
+		return true
+	})
+}
+
+func (m *MemoryUserAccounts) ChangeEmail(ctx context.Context, id string, oldOTP string) (model.UserAccount, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored, ok := m.accounts[id]
+	if !ok || stored.EmailChange == nil || stored.EmailChange.OldOTP != oldOTP {
+		return model.UserAccount{}, ErrNotFound
+	}
+	if m.emailTaken(stored.EmailChange.NewEmail, id) {
+		return model.UserAccount{}, ErrDuplicate
+	}
+
+	user_acc, err := clone(stored)
+	if err != nil {
+		return model.UserAccount{}, err
+	}
+	user_acc.Email = user_acc.EmailChange.NewEmail
+	user_acc.EmailChange = nil
+	user_acc.OTP = nil
+	user_acc.OTP_ExpiryTime = nil
+	user_acc.OTP_AttemptCount = 0
+	m.accounts[id] = user_acc
+	return clone(user_acc)
+}
+
+func (m *MemoryUserAccounts) DiscardEmailChange(ctx context.Context, id string, oldOTP string) error {
+	_, err := m.update(id, func(user_acc *model.UserAccount) bool {
+		if user_acc.EmailChange == nil || user_acc.EmailChange.OldOTP != oldOTP {
+			return false
+		}
+		user_acc.EmailChange = nil
+		return true
+	})
+	if err == ErrNotFound {
+		return nil // Like the MongoDB implementation, a replaced change is left alone without complaint.
+	}
+	return err
+}
+
+func (m *MemoryUserAccounts) FindByIdentity(ctx context.Context, identityID string) (model.UserAccount, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, user_acc := range m.accounts {
+		for _, identity := range user_acc.Identities {
+			if identity.ID == identityID {
+				return clone(user_acc)
+			}
+		}
+	}
+	return model.UserAccount{}, ErrNotFound
+}
+
+func (m *MemoryUserAccounts) UseIdentity(ctx context.Context, id string, identity model.Identity) (model.UserAccount, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored, ok := m.accounts[id]
+	if !ok {
+		return model.UserAccount{}, ErrNotFound
+	}
+	linked := false
+	for otherID, other := range m.accounts {
+		for _, existing := range other.Identities {
+			if existing.ID == identity.ID {
+				if otherID != id {
+					return model.UserAccount{}, ErrDuplicate
+				}
+				linked = true
+			}
+		}
+	}
+
+	user_acc, err := clone(stored)
+	if err != nil {
+		return model.UserAccount{}, err
+	}
+	if !linked {
+		user_acc.Identities = append(user_acc.Identities, identity)
+	}
+	user_acc.DeletionTime = nil
+	m.accounts[id] = user_acc
+	return clone(user_acc)
+}
+
+func (m *MemoryUserAccounts) BeginTOTP(ctx context.Context, id string, totp model.TOTP) error {
+	_, err := m.update(id, func(user_acc *model.UserAccount) bool {
+		if user_acc.MFAEnabled() {
+			return false
+		}
+		user_acc.TOTP = &totp
+		return true
+	})
+	if err == ErrNotFound {
+		if _, err := m.Find(ctx, id); err != nil {
+			return err
+		}
+		return ErrDuplicate
+	}
+	return err
+}
+
+func (m *MemoryUserAccounts) ConfirmTOTP(ctx context.Context, id string, secret string, step int64, recoveryCodes []string) (model.UserAccount, error) {
+	return m.update(id, func(user_acc *model.UserAccount) bool {
+		if user_acc.TOTP == nil || user_acc.TOTP.Confirmed || user_acc.TOTP.Secret != secret {
+			return false
+		}
+		user_acc.TOTP.Confirmed = true
+		user_acc.TOTP.LastStep = step
+		user_acc.TOTP.RecoveryCodes = recoveryCodes
+		return true
+	})
+}
+
+func (m *MemoryUserAccounts) UseTOTP(ctx context.Context, id string, step int64) (model.UserAccount, error) {
+	return m.update(id, func(user_acc *model.UserAccount) bool {
+		if !user_acc.MFAEnabled() || user_acc.TOTP.LastStep >= step {
+			return false
+		}
+		user_acc.TOTP.LastStep = step
+		return true
+	})
+}
+
+func (m *MemoryUserAccounts) UseRecoveryCode(ctx context.Context, id string, codeHash string) (model.UserAccount, error) {
+	return m.update(id, func(user_acc *model.UserAccount) bool {
+		if !user_acc.MFAEnabled() {
+			return false
+		}
+		for i, hash := range user_acc.TOTP.RecoveryCodes {
+			if hash == codeHash {
+				user_acc.TOTP.RecoveryCodes = append(user_acc.TOTP.RecoveryCodes[:i], user_acc.TOTP.RecoveryCodes[i+1:]...)
+				return true
+			}
+		}
+		return false
+	})
+}
+
+func (m *MemoryUserAccounts) ReplaceRecoveryCodes(ctx context.Context, id string, codeHashes []string) error {
+	_, err := m.update(id, func(user_acc *model.UserAccount) bool {
+		if !user_acc.MFAEnabled() {
+			return false
+		}
+		user_acc.TOTP.RecoveryCodes = codeHashes
+		user_acc.TOTP.RecoveryCodesUID = ""
+		return true
+	})
+	return err
+}
+
+func (m *MemoryUserAccounts) RemoveTOTP(ctx context.Context, id string) error {
+	_, err := m.update(id, func(user_acc *model.UserAccount) bool {
+		if user_acc.TOTP == nil {
+			return false
+		}
+		user_acc.TOTP = nil
+		return true
+	})
+	return err
+}
+
+func (m *MemoryUserAccounts) UpdateProfile(ctx context.Context, id string, changes bson.M) (model.UserAccount, error) {
+	if err := checkProfileFields(changes); err != nil {
+		return model.UserAccount{}, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user_acc, ok := m.accounts[id]
+	if !ok {
+		return model.UserAccount{}, ErrNotFound
+	}
+
+	// Apply the changes through BSON so field names mean exactly what they mean to MongoDB.
+	raw, err := bson.Marshal(user_acc)
+	if err != nil {
+		return model.UserAccount{}, err
+	}
+	var doc bson.M
+	if err := bson.Unmarshal(raw, &doc); err != nil {
+		return model.UserAccount{}, err
+	}
+	for field, value := range changes {
+		doc[field] = value
+	}
+	if raw, err = bson.Marshal(doc); err != nil {
+		return model.UserAccount{}, err
+	}
+
+	var updated model.UserAccount
+	if err := bson.Unmarshal(raw, &updated); err != nil {
+		return model.UserAccount{}, err
+	}
+	m.accounts[id] = updated
+	return clone(updated)
+}
+
+func (m *MemoryUserAccounts) ScheduleDeletion(ctx context.Context, id string, deletionTime int64) error {
+	_, err := m.update(id, func(user_acc *model.UserAccount) bool {
+		user_acc.DeletionTime = &deletionTime
+		return true
+	})
+	return err
+}
+
+func (m *MemoryUserAccounts) DeleteIfDue(ctx context.Context, id string, now int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user_acc, ok := m.accounts[id]
+	if !ok || user_acc.DeletionTime == nil || *user_acc.DeletionTime > now {
+		return ErrNotFound
+	}
+	delete(m.accounts, id)
+	return nil
+}
+
+func (m *MemoryUserAccounts) ExpiredDeletions(ctx context.Context, now int64) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var ids []string
+	for id, user_acc := range m.accounts {
+		if user_acc.DeletionTime != nil && *user_acc.DeletionTime <= now {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+func (m *MemoryUserAccounts) HashPlaintextOTPs(ctx context.Context, hash func(id, otp string) string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var count int64
+	for id, user_acc := range m.accounts {
+		if user_acc.OTP != nil && !util.IsHashedOTP(*user_acc.OTP) {
+			hashed := hash(id, *user_acc.OTP)
+			user_acc.OTP = &hashed
+			m.accounts[id] = user_acc
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (m *MemoryUserAccounts) FillEmails(ctx context.Context) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var count int64
+	for id, user_acc := range m.accounts {
+		if user_acc.Email == "" {
+			user_acc.Email = id
+			m.accounts[id] = user_acc
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (m *MemoryUserAccounts) MoveToGeneratedIDs(ctx context.Context, newID func() (string, error), rebind func(oldID string, user_acc *model.UserAccount) error, move func(oldID, newID string) error) (int64, error) {
+	m.mu.Lock()
+	var legacyIDs []string
+	for id := range m.accounts {
+		if isLegacyID(id) {
+			legacyIDs = append(legacyIDs, id)
+		}
+	}
+	m.mu.Unlock()
+
+	var count int64
+	for _, oldID := range legacyIDs {
+		id, err := newID()
+		if err != nil {
+			return count, err
+		}
+		user_acc, err := m.Find(ctx, oldID)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return count, err
+		}
+		user_acc.ID = id
+		if err := rebind(oldID, &user_acc); err != nil {
+			return count, err
+		}
+
+		m.mu.Lock()
+		delete(m.accounts, oldID)
+		m.accounts[id] = user_acc
+		m.mu.Unlock()
+
+		if err := move(oldID, id); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+func (m *MemoryUserAccounts) MoveTokens(ctx context.Context, move func(id, token string) error) (int64, error) {
+	// The in-memory store starts empty on every run and never held tokens, so there is nothing to move.
+	return 0, nil
+}
+
+// Reports whether an ID is an email address, as IDs were before they were generated.
+func isLegacyID(id string) bool {
+	return strings.Contains(id, "@")
+}
+
+// Reports whether an account other than exceptID holds the email address. The caller must hold the lock.
+func (m *MemoryUserAccounts) emailTaken(email, exceptID string) bool {
+	if email == "" {
+		return false
+	}
+	for id, user_acc := range m.accounts {
+		if id != exceptID && user_acc.Email == email {
+			return true
+		}
+	}
+	return false
+}
+
+// Applies fn to the stored account under the lock. If fn returns false nothing is written and ErrNotFound
+// is returned, mirroring a MongoDB filter that matched no document.
+func (m *MemoryUserAccounts) update(id string, fn func(user_acc *model.UserAccount) bool) (model.UserAccount, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored, ok := m.accounts[id]
+	if !ok {
+		return model.UserAccount{}, ErrNotFound
+	}
+
+	user_acc, err := clone(stored)
+	if err != nil {
+		return model.UserAccount{}, err
+	}
+	if !fn(&user_acc) {
+		return model.UserAccount{}, ErrNotFound
+	}
+
+	m.accounts[id] = user_acc
+	return clone(user_acc)
+}
+
+// Deep-copies an account so callers never share slices, maps or pointers with the store.
+func clone(user_acc model.UserAccount) (model.UserAccount, error) {
+	raw, err := bson.Marshal(user_acc)
+	if err != nil {
+		return model.UserAccount{}, err
+	}
+
+	var copied model.UserAccount
+	err = bson.Unmarshal(raw, &copied)
+	return copied, err
+}
@@ -0,0 +1,95 @@
+package repository
+
+import (
+	"context"
+	"sync"
+
+	"bearlysocial-backend/api/model"
+)
+
+// Stores challenges in process memory under a single mutex. Meant for tests and local development.
+type MemoryChallenges struct {
+	mu         sync.Mutex
+	challenges map[string]model.Challenge
+}
+
+func NewMemoryChallenges() *MemoryChallenges {
+	return &MemoryChallenges{challenges: make(map[string]model.Challenge)}
+}
+
+func (m *MemoryChallenges) Create(ctx context.Context, challenge model.Challenge) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.challenges[challenge.ID]; ok {
+		return ErrDuplicate
+	}
+	m.challenges[challenge.ID] = challenge
+	return nil
+}
+
+func (m *MemoryChallenges) Find(ctx context.Context, id string, purpose string, now int64) (model.Challenge, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	challenge, ok := m.challenges[id]
+	if !ok || challenge.Purpose != purpose || challenge.ExpiryTime <= now {
+		return model.Challenge{}, ErrNotFound
+	}
+	return challenge, nil
+}
+
+func (m *MemoryChallenges) Consume(ctx context.Context, id string, purpose string, now int64) (model.Challenge, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	challenge, ok := m.challenges[id]
+	if !ok || challenge.Purpose != purpose || challenge.ExpiryTime <= now {
+		return model.Challenge{}, ErrNotFound
+	}
+	delete(m.challenges, id)
+	return challenge, nil
+}
+
+func (m *MemoryChallenges) DeleteExpired(ctx context.Context, now int64) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var count int64
+	for id, challenge := range m.challenges {
+		if challenge.ExpiryTime <= now {
+			delete(m.challenges, id)
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (m *MemoryChallenges) DeleteAll(ctx context.Context, userID string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var count int64
+	for id, challenge := range m.challenges {
+		if challenge.UserID == userID {
+			delete(m.challenges, id)
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (m *MemoryChallenges) ChangeUserID(ctx context.Context, oldID, newID string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var count int64
+	for id, challenge := range m.challenges {
+		if challenge.UserID == oldID {
+			challenge.UserID = newID
+			m.challenges[id] = challenge
+			count++
+		}
+	}
+	return count, nil
+}
@@ -0,0 +1,73 @@
+package repository
+
+import (
+	"context"
+	"sync"
+)
+
+type memoryBucket struct {
+	tokens    float64
+	updatedAt int64
+	fullAt    int64
+}
+
+// Stores token buckets in process memory under a single mutex. Limits only apply per process, so this is
+// meant for tests, local development and single-instance deployments.
+type MemoryRateLimits struct {
+	mu      sync.Mutex
+	buckets map[string]memoryBucket
+}
+
+func NewMemoryRateLimits() *MemoryRateLimits {
+	return &MemoryRateLimits{buckets: make(map[string]memoryBucket)}
+}
+
+func (m *MemoryRateLimits) Take(ctx context.Context, key string, bucket Bucket, now int64) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	state, ok := m.buckets[key]
+	if !ok {
+		state = memoryBucket{tokens: float64(bucket.Capacity), updatedAt: now}
+	}
+
+	tokens := bucket.refill(state.tokens, state.updatedAt, now)
+	allowed := tokens >= 1
+	if allowed {
+		tokens--
+	}
+	m.buckets[key] = memoryBucket{tokens: tokens, updatedAt: now, fullAt: bucket.fullAt(tokens, now)}
+
+	if !allowed {
+		return bucket.retryAfter(tokens), nil
+	}
+	return 0, nil
+}
+
+func (m *MemoryRateLimits) Refund(ctx context.Context, key string, bucket Bucket, now int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	state, ok := m.buckets[key]
+	if !ok {
+		return nil
+	}
+
+	tokens := min(bucket.refill(state.tokens, state.updatedAt, now)+1, float64(bucket.Capacity))
+	m.buckets[key] = memoryBucket{tokens: tokens, updatedAt: now, fullAt: bucket.fullAt(tokens, now)}
+	return nil
+}
+
+func (m *MemoryRateLimits) DeleteExpired(ctx context.Context, now int64) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var count int64
+	for key, state := range m.buckets {
+		if state.fullAt <= now {
+			delete(m.buckets, key)
+			count++
+		}
+	}
+	return count, nil
+}
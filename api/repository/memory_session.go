@@ -0,0 +1,179 @@
+package repository
+
+import (
+	"context"
+	"slices"
+	"sort"
+	"sync"
+
+	"bearlysocial-backend/api/model"
+)
+
+// Stores sessions in process memory under a single mutex. Meant for tests and local development.
+type MemorySessions struct {
+	mu       sync.Mutex
+	sessions map[string]model.Session
+}
+
+func NewMemorySessions() *MemorySessions {
+	return &MemorySessions{sessions: make(map[string]model.Session)}
+}
+
+func (m *MemorySessions) Create(ctx context.Context, session model.Session) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for id, existing := range m.sessions {
+		if id == session.ID ||
+			existing.AccessTokenHash == session.AccessTokenHash ||
+			(session.RefreshTokenHash != "" && existing.RefreshTokenHash == session.RefreshTokenHash) {
+			return ErrDuplicate
+		}
+	}
+	m.sessions[session.ID] = cloneSession(session)
+	return nil
+}
+
+func (m *MemorySessions) Touch(ctx context.Context, accessTokenHash string, now int64, limits SessionLimits) (model.Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for id, session := range m.sessions {
+		if session.AccessTokenHash != accessTokenHash && session.PrevAccessTokenHash != accessTokenHash {
+			continue
+		}
+		if err := limits.checkAccess(session, accessTokenHash, now); err != nil {
+			return model.Session{}, err
+		}
+		session.LastSeenAt = now
+		m.sessions[id] = session
+		return cloneSession(session), nil
+	}
+	return model.Session{}, ErrNotFound
+}
+
+func (m *MemorySessions) Refresh(ctx context.Context, refreshTokenHash string, rotation Rotation, now int64, limits SessionLimits) (model.Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for id, session := range m.sessions {
+		current := session.RefreshTokenHash == refreshTokenHash
+		retry := session.PrevRefreshTokenHash == refreshTokenHash && session.RotatedAt > now-limits.RotationGrace
+		if !current && !retry {
+			continue
+		}
+		if limits.expired(session, now) {
+			return model.Session{}, ErrSessionExpired
+		}
+
+		// Mirrors the MongoDB implementation: a regular rotation moves the current pair to the previous pair
+		// and starts the grace window, while a retry only replaces the pair the client never received.
+		if current {
+			session.PrevAccessTokenHash = session.AccessTokenHash
+			session.PrevRefreshTokenHash = session.RefreshTokenHash
+			session.RotatedAt = now
+		}
+		session.RefreshHistory = append(slices.Clone(session.RefreshHistory), session.RefreshTokenHash)
+		if len(session.RefreshHistory) > refreshHistoryLimit {
+			session.RefreshHistory = session.RefreshHistory[len(session.RefreshHistory)-refreshHistoryLimit:]
+		}
+		session.AccessTokenHash = rotation.AccessTokenHash
+		session.AccessExpiryTime = rotation.AccessExpiryTime
+		session.RefreshTokenHash = rotation.RefreshTokenHash
+		session.LastSeenAt = now
+
+		m.sessions[id] = session
+		return cloneSession(session), nil
+	}
+
+	// A rotated-out refresh token is being replayed: whoever holds it, the session can no longer be trusted.
+	for id, session := range m.sessions {
+		if slices.Contains(session.RefreshHistory, refreshTokenHash) {
+			delete(m.sessions, id)
+			return model.Session{}, ErrTokenReused
+		}
+	}
+	return model.Session{}, ErrNotFound
+}
+
+func (m *MemorySessions) List(ctx context.Context, userID string) ([]model.Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	sessions := []model.Session{}
+	for _, session := range m.sessions {
+		if session.UserID == userID {
+			sessions = append(sessions, cloneSession(session))
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].LastSeenAt > sessions[j].LastSeenAt
+	})
+	return sessions, nil
+}
+
+func (m *MemorySessions) Delete(ctx context.Context, userID string, sessionID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	session, ok := m.sessions[sessionID]
+	if !ok || session.UserID != userID {
+		return ErrNotFound
+	}
+	delete(m.sessions, sessionID)
+	return nil
+}
+
+func (m *MemorySessions) DeleteAll(ctx context.Context, userID string, exceptID string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var count int64
+	for id, session := range m.sessions {
+		if session.UserID == userID && id != exceptID {
+			delete(m.sessions, id)
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (m *MemorySessions) DeleteExpired(ctx context.Context, now int64, limits SessionLimits) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var count int64
+	for id, session := range m.sessions {
+		if limits.expired(session, now) {
+			delete(m.sessions, id)
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (m *MemorySessions) ChangeUserID(ctx context.Context, oldID, newID string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var count int64
+	for id, session := range m.sessions {
+		if session.UserID == oldID {
+			session.UserID = newID
+			m.sessions[id] = session
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (m *MemorySessions) MigrateSingleTokens(ctx context.Context) (int64, error) {
+	// The in-memory store starts empty on every run, so there are no single-token sessions to convert.
+	return 0, nil
+}
+
+// Copies a session so callers never share its history slice with the store.
+func cloneSession(session model.Session) model.Session {
+	session.RefreshHistory = slices.Clone(session.RefreshHistory)
+	return session
+}
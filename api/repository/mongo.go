@@ -0,0 +1,579 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"bearlysocial-backend/api/model"
+)
+
+// Stores user accounts in a MongoDB collection.
+type MongoUserAccounts struct {
+	coll *mongo.Collection
+}
+
+func NewMongoUserAccounts(coll *mongo.Collection) *MongoUserAccounts {
+	return &MongoUserAccounts{coll: coll}
+}
+
+// Prepares the collection's indexes. Safe to call on every start.
+func (m *MongoUserAccounts) EnsureIndexes(ctx context.Context) error {
+	// Tokens have moved to the sessions collection, so the index that served token lookups is obsolete.
+	_, err := m.coll.Indexes().DropOne(ctx, "token_unique")
+	if cmdErr, ok := err.(mongo.CommandError); err != nil && !(ok && cmdErr.Code == 27) { // IndexNotFound.
+		return err
+	}
+
+	// An email address, a credential ID and a provider identity each belong to exactly one account.
+	_, err = m.coll.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys: bson.D{{Key: "email", Value: 1}},
+			Options: options.Index().
+				SetName("email_unique").
+				SetUnique(true).
+				SetPartialFilterExpression(bson.M{"email": bson.M{"$type": "string"}}),
+		},
+		{
+			Keys: bson.D{{Key: "passkeys.id", Value: 1}},
+			Options: options.Index().
+				SetName("passkeys_id_unique").
+				SetUnique(true).
+				SetPartialFilterExpression(bson.M{"passkeys.id": bson.M{"$type": "string"}}),
+		},
+		{
+			Keys: bson.D{{Key: "identities.id", Value: 1}},
+			Options: options.Index().
+				SetName("identities_id_unique").
+				SetUnique(true).
+				SetPartialFilterExpression(bson.M{"identities.id": bson.M{"$type": "string"}}),
+		},
+	})
+	return err
+}
+
+func (m *MongoUserAccounts) Find(ctx context.Context, id string) (model.UserAccount, error) {
+	var user_acc model.UserAccount
+	err := m.coll.FindOne(ctx, bson.M{"_id": id}).Decode(&user_acc)
+	return user_acc, mongoErr(err)
+}
+
+func (m *MongoUserAccounts) FindByEmail(ctx context.Context, email string) (model.UserAccount, error) {
+	var user_acc model.UserAccount
+	err := m.coll.FindOne(ctx, bson.M{"email": email}).Decode(&user_acc)
+	return user_acc, mongoErr(err)
+}
+
+func (m *MongoUserAccounts) Create(ctx context.Context, user_acc model.UserAccount) error {
+	_, err := m.coll.InsertOne(ctx, user_acc)
+	return mongoErr(err)
+}
+
+func (m *MongoUserAccounts) IssueOTP(ctx context.Context, id string, otp string, expiryTime int64, now int64) (model.UserAccount, error) {
+	// An update pipeline lifts an expired cooldown and stores the OTP in a single write.
+	lifted := bson.M{"$ne": bson.A{bson.M{"$ifNull": bson.A{"$cooldown_time", nil}}, nil}}
+	update := bson.A{
+		bson.M{"$set": bson.M{
+			"otp":               otp,
+			"otp_expiry_time":   expiryTime,
+			"otp_attempt_count": bson.M{"$cond": bson.A{lifted, 0, "$otp_attempt_count"}},
+			"cooldown_time":     bson.M{"$cond": bson.A{lifted, nil, "$cooldown_time"}},
+		}},
+	}
+	filter := bson.M{"_id": id, "cooldown_time": bson.M{"$not": bson.M{"$gt": now}}}
+
+	user_acc, err := m.findOneAndUpdate(ctx, filter, update)
+	if err != ErrNotFound {
+		return user_acc, err
+	}
+
+	// Either there is no such account or it is in cooldown.
+	user_acc, err = m.Find(ctx, id)
+	if err != nil {
+		return model.UserAccount{}, err
+	}
+	return user_acc, ErrCooldown
+}
+
+func (m *MongoUserAccounts) ReserveOTPAttempt(ctx context.Context, id string, now int64, maxAttempts int, cooldowns []int64) (model.UserAccount, error) {
+	filter := bson.M{
+		"_id":               id,
+		"otp":               bson.M{"$type": "string"},
+		"otp_expiry_time":   bson.M{"$gt": now},
+		"otp_attempt_count": bson.M{"$lt": maxAttempts},
+	}
+	// An update pipeline lets the cooldown depend on the incremented count within a single write.
+	locked := bson.M{"$gte": bson.A{"$otp_attempt_count", maxAttempts}}
+	lockouts := bson.M{"$ifNull": bson.A{"$otp_lockout_count", 0}}
+	cooldown := bson.M{"$arrayElemAt": bson.A{cooldowns, bson.M{"$min": bson.A{lockouts, len(cooldowns) - 1}}}}
+	update := bson.A{
+		bson.M{"$set": bson.M{"otp_attempt_count": bson.M{"$add": bson.A{"$otp_attempt_count", 1}}}},
+		bson.M{"$set": bson.M{
+			"cooldown_time":     bson.M{"$cond": bson.A{locked, bson.M{"$add": bson.A{now, cooldown}}, "$cooldown_time"}},
+			"otp_lockout_count": bson.M{"$cond": bson.A{locked, bson.M{"$add": bson.A{lockouts, 1}}, lockouts}},
+		}},
+	}
+	return m.findOneAndUpdate(ctx, filter, update)
+}
+
+func (m *MongoUserAccounts) CompleteOTP(ctx context.Context, id string, otp string) (model.UserAccount, error) {
+	update := bson.M{
+		"$set": bson.M{
+			"otp":               nil,
+			"otp_attempt_count": 0,
+			"otp_expiry_time":   nil,
+			"otp_lockout_count": 0,
+			"cooldown_time":     nil,
+			"deletion_time":     nil,
+		},
+	}
+	return m.findOneAndUpdate(ctx, bson.M{"_id": id, "otp": otp}, update)
+}
+
+func (m *MongoUserAccounts) DiscardOTP(ctx context.Context, id string, otp string) error {
+	update := bson.M{
+		"$set": bson.M{
+			"otp":             nil,
+			"otp_expiry_time": nil,
+		},
+	}
+	_, err := m.coll.UpdateOne(ctx, bson.M{"_id": id, "otp": otp}, update)
+	return err
+}
+
+func (m *MongoUserAccounts) AddPasskey(ctx context.Context, id string, passkey model.Passkey, limit int) error {
+	// The unique index only keeps credential IDs apart across accounts, so the filter covers this account. It
+	// also checks the limit, so concurrent registrations cannot together push the account past it.
+	filter := bson.M{
+		"_id": id,
+		"passkeys.id": bson.M{"$ne": passkey.ID},
+		fmt.Sprintf("passkeys.%d", limit-1): bson.M{"$exists": false},
+	}
+	result, err := m.coll.UpdateOne(ctx, filter, bson.M{"$push": bson.M{"passkeys": passkey}})
+	if err != nil {
+		return mongoErr(err)
+	}
+	if result.MatchedCount == 0 {
+		user_acc, err := m.Find(ctx, id)
+		if err != nil {
+			return err
+		}
+		if len(user_acc.Passkeys) >= limit {
+			return ErrLimitReached
+		}
+		return ErrDuplicate
+	}
+	return nil
+}
+
+func (m *MongoUserAccounts) RemovePasskey(ctx context.Context, id string, credentialID string) error {
+	result, err := m.coll.UpdateOne(
+		ctx,
+		bson.M{"_id": id, "passkeys.id": credentialID},
+		bson.M{"$pull": bson.M{"passkeys": bson.M{"id": credentialID}}},
+	)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (m *MongoUserAccounts) FindByPasskey(ctx context.Context, credentialID string) (model.UserAccount, error) {
+	var user_acc model.UserAccount
+	err := m.coll.FindOne(ctx, bson.M{"passkeys.id": credentialID}).Decode(&user_acc)
+	return user_acc, mongoErr(err)
+}
+
+func (m *MongoUserAccounts) UsePasskey(ctx context.Context, id string, credentialID string, prevSignCount, signCount int64, now int64) (model.UserAccount, error) {
+	filter := bson.M{
+		"_id":      id,
+		"passkeys": bson.M{"$elemMatch": bson.M{"id": credentialID, "sign_count": prevSignCount}},
+	}
+	update := bson.M{
+		"$set": bson.M{
+			"passkeys.$.sign_count":   signCount,
+			"passkeys.$.last_used_at": now,
+			"deletion_time":           nil,
+		},
+	}
+	return m.findOneAndUpdate(ctx, filter, update)
+}
+
+func (m *MongoUserAccounts) BeginEmailChange(ctx context.Context, id string, change model.EmailChange) error {
+	result, err := m.coll.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{"email_change": change}})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (m *MongoUserAccounts) ReserveEmailChangeAttempt(ctx context.Context, id string, now int64, maxAttempts int) (model.UserAccount, error) {
+	filter := bson.M{
+		"_id":                        id,
+		"email_change.expiry_time":   bson.M{"$gt": now},
+		"email_change.attempt_count": bson.M{"$lt": maxAttempts},
+	}
+	return m.findOneAndUpdate(ctx, filter, bson.M{"$inc": bson.M{"email_change.attempt_count": 1}})
+}
+
+func (m *MongoUserAccounts) ChangeEmail(ctx context.Context, id string, oldOTP string) (model.UserAccount, error) {
+	// An update pipeline moves the new address into place and clears the change in a single write, which the
+	// unique index on email refuses if the address was taken in the meantime. The same write drops any sign-in
+	// OTP, which was sent to the old address.
+	update := bson.A{
+		bson.M{"$set": bson.M{
+			"email":             "$email_change.new_email",
+			"otp":               nil,
+			"otp_expiry_time":   nil,
+			"otp_attempt_count": 0,
+		}},
+		bson.M{"$unset": "email_change"},
+	}
+	return m.findOneAndUpdate(ctx, bson.M{"_id": id, "email_change.old_otp": oldOTP}, update)
+}
+
+func (m *MongoUserAccounts) DiscardEmailChange(ctx context.Context, id string, oldOTP string) error {
+	_, err := m.coll.UpdateOne(ctx, bson.M{"_id": id, "email_change.old_otp": oldOTP}, bson.M{"$unset": bson.M{"email_change": ""}})
+	return err
+}
+
+func (m *MongoUserAccounts) FindByIdentity(ctx context.Context, identityID string) (model.UserAccount, error) {
+	var user_acc model.UserAccount
+	err := m.coll.FindOne(ctx, bson.M{"identities.id": identityID}).Decode(&user_acc)
+	return user_acc, mongoErr(err)
+}
+
+func (m *MongoUserAccounts) UseIdentity(ctx context.Context, id string, identity model.Identity) (model.UserAccount, error) {
+	// The unique index keeps an identity on one account; the filter keeps it from being linked twice to this one.
+	_, err := m.coll.UpdateOne(
+		ctx,
+		bson.M{"_id": id, "identities.id": bson.M{"$ne": identity.ID}},
+		bson.M{"$push": bson.M{"identities": identity}},
+	)
+	if err != nil {
+		return model.UserAccount{}, mongoErr(err)
+	}
+	return m.findOneAndUpdate(ctx, bson.M{"_id": id, "identities.id": identity.ID}, bson.M{"$set": bson.M{"deletion_time": nil}})
+}
+
+func (m *MongoUserAccounts) BeginTOTP(ctx context.Context, id string, totp model.TOTP) error {
+	result, err := m.coll.UpdateOne(
+		ctx,
+		bson.M{"_id": id, "totp.confirmed": bson.M{"$ne": true}},
+		bson.M{"$set": bson.M{"totp": totp}},
+	)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		if _, err := m.Find(ctx, id); err != nil {
+			return err
+		}
+		return ErrDuplicate
+	}
+	return nil
+}
+
+func (m *MongoUserAccounts) ConfirmTOTP(ctx context.Context, id string, secret string, step int64, recoveryCodes []string) (model.UserAccount, error) {
+	filter := bson.M{"_id": id, "totp.secret": secret, "totp.confirmed": false}
+	update := bson.M{
+		"$set": bson.M{
+			"totp.confirmed":      true,
+			"totp.last_step":      step,
+			"totp.recovery_codes": recoveryCodes,
+		},
+	}
+	return m.findOneAndUpdate(ctx, filter, update)
+}
+
+func (m *MongoUserAccounts) UseTOTP(ctx context.Context, id string, step int64) (model.UserAccount, error) {
+	filter := bson.M{"_id": id, "totp.confirmed": true, "totp.last_step": bson.M{"$lt": step}}
+	return m.findOneAndUpdate(ctx, filter, bson.M{"$set": bson.M{"totp.last_step": step}})
+}
+
+func (m *MongoUserAccounts) UseRecoveryCode(ctx context.Context, id string, codeHash string) (model.UserAccount, error) {
+	filter := bson.M{"_id": id, "totp.confirmed": true, "totp.recovery_codes": codeHash}
+	return m.findOneAndUpdate(ctx, filter, bson.M{"$pull": bson.M{"totp.recovery_codes": codeHash}})
+}
+
+func (m *MongoUserAccounts) ReplaceRecoveryCodes(ctx context.Context, id string, codeHashes []string) error {
+	result, err := m.coll.UpdateOne(
+		ctx,
+		bson.M{"_id": id, "totp.confirmed": true},
+		bson.M{
+			"$set":   bson.M{"totp.recovery_codes": codeHashes},
+			"$unset": bson.M{"totp.recovery_codes_uid": ""},
+		},
+	)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (m *MongoUserAccounts) RemoveTOTP(ctx context.Context, id string) error {
+	result, err := m.coll.UpdateOne(
+		ctx,
+		bson.M{"_id": id, "totp": bson.M{"$exists": true}},
+		bson.M{"$unset": bson.M{"totp": ""}},
+	)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (m *MongoUserAccounts) UpdateProfile(ctx context.Context, id string, changes bson.M) (model.UserAccount, error) {
+	if err := checkProfileFields(changes); err != nil {
+		return model.UserAccount{}, err
+	}
+	return m.findOneAndUpdate(ctx, bson.M{"_id": id}, bson.M{"$set": changes})
+}
+
+func (m *MongoUserAccounts) ScheduleDeletion(ctx context.Context, id string, deletionTime int64) error {
+	update := bson.M{
+		"$set": bson.M{
+			"deletion_time": deletionTime,
+		},
+	}
+
+	result, err := m.coll.UpdateOne(ctx, bson.M{"_id": id}, update)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (m *MongoUserAccounts) DeleteIfDue(ctx context.Context, id string, now int64) error {
+	result, err := m.coll.DeleteOne(ctx, bson.M{"_id": id, "deletion_time": bson.M{"$lte": now}})
+	if err != nil {
+		return err
+	}
+	if result.DeletedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (m *MongoUserAccounts) ExpiredDeletions(ctx context.Context, now int64) ([]string, error) {
+	cursor, err := m.coll.Find(
+		ctx,
+		bson.M{"deletion_time": bson.M{"$lte": now}},
+		options.Find().SetProjection(bson.M{"_id": 1}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var ids []string
+	for cursor.Next(ctx) {
+		var doc struct {
+			ID string `bson:"_id"`
+		}
+		if err := cursor.Decode(&doc); err != nil {
+			return ids, err
+		}
+		ids = append(ids, doc.ID)
+	}
+	return ids, cursor.Err()
+}
+
+func (m *MongoUserAccounts) HashPlaintextOTPs(ctx context.Context, hash func(id, otp string) string) (int64, error) {
+	// Hashed OTPs are 64 lowercase hex characters; anything else is a legacy plaintext code.
+	filter := bson.M{"otp": bson.M{"$type": "string", "$not": primitive.Regex{Pattern: "^[a-f0-9]{64}$"}}}
+	cursor, err := m.coll.Find(ctx, filter, options.Find().SetProjection(bson.M{"otp": 1}))
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+
+	var count int64
+	for cursor.Next(ctx) {
+		var doc struct {
+			ID  string `bson:"_id"`
+			OTP string `bson:"otp"`
+		}
+		if err := cursor.Decode(&doc); err != nil {
+			return count, err
+		}
+
+		// Only rewrite the OTP if it has not been replaced since it was read.
+		result, err := m.coll.UpdateOne(
+			ctx,
+			bson.M{"_id": doc.ID, "otp": doc.OTP},
+			bson.M{"$set": bson.M{"otp": hash(doc.ID, doc.OTP)}},
+		)
+		if err != nil {
+			return count, err
+		}
+		count += result.ModifiedCount
+	}
+	return count, cursor.Err()
+}
+
+func (m *MongoUserAccounts) FillEmails(ctx context.Context) (int64, error) {
+	// Until addresses had a field of their own, the ID was the address. Accounts that MoveToGeneratedIDs took
+	// the address off are left alone.
+	filter := bson.M{"email": bson.M{"$exists": false}, "moved_to": bson.M{"$exists": false}}
+	update := bson.A{bson.M{"$set": bson.M{"email": "$_id"}}}
+	result, err := m.coll.UpdateMany(ctx, filter, update)
+	if err != nil {
+		return 0, err
+	}
+	return result.ModifiedCount, nil
+}
+
+// A legacy account part way through MoveToGeneratedIDs.
+type movingAccount struct {
+	model.UserAccount `bson:",inline"`
+	MovedTo string `bson:"moved_to"`
+	MovedEmail string `bson:"moved_email"`
+}
+
+func (m *MongoUserAccounts) MoveToGeneratedIDs(ctx context.Context, newID func() (string, error), rebind func(oldID string, user_acc *model.UserAccount) error, move func(oldID, newID string) error) (int64, error) {
+	// Generated IDs never contain "@", and addresses always do.
+	cursor, err := m.coll.Find(ctx, bson.M{"_id": primitive.Regex{Pattern: "@"}})
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+
+	var count int64
+	for cursor.Next(ctx) {
+		var doc movingAccount
+		if err := cursor.Decode(&doc); err != nil {
+			return count, err
+		}
+		oldID := doc.ID
+
+		if doc.MovedTo == "" {
+			id, err := newID()
+			if err != nil {
+				return count, err
+			}
+			// The unique index would refuse the address on the new document while the old one still has it, so
+			// it is set aside first, along with the new ID, so that an interrupted run can pick up from here.
+			update := bson.A{
+				bson.M{"$set": bson.M{"moved_to": id, "moved_email": "$email"}},
+				bson.M{"$unset": "email"},
+			}
+			err = m.coll.FindOneAndUpdate(
+				ctx,
+				bson.M{"_id": oldID, "moved_to": bson.M{"$exists": false}},
+				update,
+				options.FindOneAndUpdate().SetReturnDocument(options.After),
+			).Decode(&doc)
+			if err == mongo.ErrNoDocuments {
+				// Another instance started moving the account in the meantime.
+				err = m.coll.FindOne(ctx, bson.M{"_id": oldID}).Decode(&doc)
+			}
+			if err == mongo.ErrNoDocuments {
+				continue
+			}
+			if err != nil {
+				return count, err
+			}
+		}
+
+		user_acc := doc.UserAccount
+		user_acc.ID, user_acc.Email = doc.MovedTo, doc.MovedEmail
+		if err := rebind(oldID, &user_acc); err != nil {
+			return count, err
+		}
+
+		if _, err := m.coll.InsertOne(ctx, user_acc); err != nil {
+			if mongoErr(err) != ErrDuplicate {
+				return count, err
+			}
+			// Inserted by an earlier, interrupted run, unless another account has taken the address since.
+			if _, err := m.Find(ctx, user_acc.ID); err != nil {
+				return count, fmt.Errorf("moving %s to %s: %v", oldID, user_acc.ID, err)
+			}
+		}
+		if err := move(oldID, user_acc.ID); err != nil {
+			return count, err
+		}
+		if _, err := m.coll.DeleteOne(ctx, bson.M{"_id": oldID}); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, cursor.Err()
+}
+
+func (m *MongoUserAccounts) MoveTokens(ctx context.Context, move func(id, token string) error) (int64, error) {
+	cursor, err := m.coll.Find(
+		ctx,
+		bson.M{"token": bson.M{"$type": "string"}},
+		options.Find().SetProjection(bson.M{"token": 1}),
+	)
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+
+	var count int64
+	for cursor.Next(ctx) {
+		var doc struct {
+			ID    string `bson:"_id"`
+			Token string `bson:"token"`
+		}
+		if err := cursor.Decode(&doc); err != nil {
+			return count, err
+		}
+
+		if err := move(doc.ID, doc.Token); err != nil {
+			return count, err
+		}
+
+		// Only remove the token once it lives elsewhere, so an interrupted run can simply be repeated.
+		_, err = m.coll.UpdateOne(ctx, bson.M{"_id": doc.ID, "token": doc.Token}, bson.M{"$unset": bson.M{"token": ""}})
+		if err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, cursor.Err()
+}
+
+func (m *MongoUserAccounts) findOneAndUpdate(ctx context.Context, filter bson.M, update interface{}) (model.UserAccount, error) {
+	var user_acc model.UserAccount
+	err := m.coll.FindOneAndUpdate(
+		ctx,
+		filter,
+		update,
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&user_acc)
+	return user_acc, mongoErr(err)
+}
+
+// Maps driver errors onto the repository's sentinel errors.
+func mongoErr(err error) error {
+	if err == mongo.ErrNoDocuments {
+		return ErrNotFound
+	}
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrDuplicate
+	}
+	return err
+}
@@ -0,0 +1,72 @@
+package repository
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"bearlysocial-backend/api/model"
+)
+
+// Stores challenges in a MongoDB collection.
+type MongoChallenges struct {
+	coll *mongo.Collection
+}
+
+func NewMongoChallenges(coll *mongo.Collection) *MongoChallenges {
+	return &MongoChallenges{coll: coll}
+}
+
+// Creates the index the expiry sweep relies on. Safe to call on every start.
+func (m *MongoChallenges) EnsureIndexes(ctx context.Context) error {
+	_, err := m.coll.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "expiry_time", Value: 1}},
+		Options: options.Index().SetName("expiry_time"),
+	})
+	return err
+}
+
+func (m *MongoChallenges) Create(ctx context.Context, challenge model.Challenge) error {
+	_, err := m.coll.InsertOne(ctx, challenge)
+	return mongoErr(err)
+}
+
+func (m *MongoChallenges) Find(ctx context.Context, id string, purpose string, now int64) (model.Challenge, error) {
+	var challenge model.Challenge
+	filter := bson.M{"_id": id, "purpose": purpose, "expiry_time": bson.M{"$gt": now}}
+	err := m.coll.FindOne(ctx, filter).Decode(&challenge)
+	return challenge, mongoErr(err)
+}
+
+func (m *MongoChallenges) Consume(ctx context.Context, id string, purpose string, now int64) (model.Challenge, error) {
+	var challenge model.Challenge
+	filter := bson.M{"_id": id, "purpose": purpose, "expiry_time": bson.M{"$gt": now}}
+	err := m.coll.FindOneAndDelete(ctx, filter).Decode(&challenge)
+	return challenge, mongoErr(err)
+}
+
+func (m *MongoChallenges) DeleteExpired(ctx context.Context, now int64) (int64, error) {
+	result, err := m.coll.DeleteMany(ctx, bson.M{"expiry_time": bson.M{"$lte": now}})
+	if err != nil {
+		return 0, err
+	}
+	return result.DeletedCount, nil
+}
+
+func (m *MongoChallenges) DeleteAll(ctx context.Context, userID string) (int64, error) {
+	result, err := m.coll.DeleteMany(ctx, bson.M{"user_id": userID})
+	if err != nil {
+		return 0, err
+	}
+	return result.DeletedCount, nil
+}
+
+func (m *MongoChallenges) ChangeUserID(ctx context.Context, oldID, newID string) (int64, error) {
+	result, err := m.coll.UpdateMany(ctx, bson.M{"user_id": oldID}, bson.M{"$set": bson.M{"user_id": newID}})
+	if err != nil {
+		return 0, err
+	}
+	return result.ModifiedCount, nil
+}
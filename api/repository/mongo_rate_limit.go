@@ -0,0 +1,106 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Stores token buckets in a MongoDB collection, so every server instance draws from the same buckets.
+type MongoRateLimits struct {
+	coll *mongo.Collection
+}
+
+func NewMongoRateLimits(coll *mongo.Collection) *MongoRateLimits {
+	return &MongoRateLimits{coll: coll}
+}
+
+// Creates the TTL index that lets MongoDB drop buckets once they are full again. Safe to call on every start.
+func (m *MongoRateLimits) EnsureIndexes(ctx context.Context) error {
+	_, err := m.coll.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "full_at", Value: 1}},
+		Options: options.Index().SetName("full_at_ttl").SetExpireAfterSeconds(0),
+	})
+	return err
+}
+
+func (m *MongoRateLimits) Take(ctx context.Context, key string, bucket Bucket, now int64) (int64, error) {
+	capacity := float64(bucket.Capacity)
+	interval := float64(bucket.RefillInterval)
+
+	// The same arithmetic as Bucket.refill, evaluated inside a single upserting update so concurrent requests
+	// cannot both take the last token. A missing bucket starts out full.
+	elapsed := bson.M{"$max": bson.A{0, bson.M{"$subtract": bson.A{now, bson.M{"$ifNull": bson.A{"$updated_at", now}}}}}}
+	refilled := bson.M{"$min": bson.A{capacity, bson.M{"$add": bson.A{
+		bson.M{"$ifNull": bson.A{"$tokens", capacity}},
+		bson.M{"$divide": bson.A{elapsed, interval}},
+	}}}}
+	allowed := bson.M{"$gte": bson.A{"$tokens", 1}}
+	update := bson.A{
+		bson.M{"$set": bson.M{"tokens": refilled}},
+		bson.M{"$set": bson.M{
+			"allowed":    allowed,
+			"tokens":     bson.M{"$cond": bson.A{allowed, bson.M{"$subtract": bson.A{"$tokens", 1}}, "$tokens"}},
+			"updated_at": now,
+		}},
+		// A Date, so the TTL index can remove the bucket once it is full again.
+		bson.M{"$set": bson.M{"full_at": bson.M{"$toDate": bson.M{"$toLong": bson.M{"$ceil": bson.M{"$add": bson.A{
+			now,
+			bson.M{"$multiply": bson.A{bson.M{"$subtract": bson.A{capacity, "$tokens"}}, interval}},
+		}}}}}}},
+	}
+
+	var doc struct {
+		Tokens  float64 `bson:"tokens"`
+		Allowed bool    `bson:"allowed"`
+	}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+	err := m.coll.FindOneAndUpdate(ctx, bson.M{"_id": key}, update, opts).Decode(&doc)
+	if mongo.IsDuplicateKeyError(err) {
+		// Another request created the bucket at the same moment; it exists now, so the retry updates it.
+		err = m.coll.FindOneAndUpdate(ctx, bson.M{"_id": key}, update, opts).Decode(&doc)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if !doc.Allowed {
+		return bucket.retryAfter(doc.Tokens), nil
+	}
+	return 0, nil
+}
+
+func (m *MongoRateLimits) Refund(ctx context.Context, key string, bucket Bucket, now int64) error {
+	capacity := float64(bucket.Capacity)
+	interval := float64(bucket.RefillInterval)
+
+	// Refills the bucket as Take does, then adds the token back. No upsert: a missing bucket is already full.
+	elapsed := bson.M{"$max": bson.A{0, bson.M{"$subtract": bson.A{now, "$updated_at"}}}}
+	refunded := bson.M{"$min": bson.A{capacity, bson.M{"$add": bson.A{
+		"$tokens",
+		bson.M{"$divide": bson.A{elapsed, interval}},
+		1,
+	}}}}
+	update := bson.A{
+		bson.M{"$set": bson.M{"tokens": refunded, "updated_at": now}},
+		bson.M{"$set": bson.M{"full_at": bson.M{"$toDate": bson.M{"$toLong": bson.M{"$ceil": bson.M{"$add": bson.A{
+			now,
+			bson.M{"$multiply": bson.A{bson.M{"$subtract": bson.A{capacity, "$tokens"}}, interval}},
+		}}}}}}},
+	}
+
+	_, err := m.coll.UpdateOne(ctx, bson.M{"_id": key}, update)
+	return err
+}
+
+func (m *MongoRateLimits) DeleteExpired(ctx context.Context, now int64) (int64, error) {
+	// The TTL index does this on its own roughly once a minute; this only makes the sweep immediate.
+	result, err := m.coll.DeleteMany(ctx, bson.M{"full_at": bson.M{"$lte": time.UnixMilli(now)}})
+	if err != nil {
+		return 0, err
+	}
+	return result.DeletedCount, nil
+}
@@ -0,0 +1,270 @@
+package repository
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"bearlysocial-backend/api/model"
+)
+
+// Stores sessions in a MongoDB collection.
+type MongoSessions struct {
+	coll *mongo.Collection
+}
+
+func NewMongoSessions(coll *mongo.Collection) *MongoSessions {
+	return &MongoSessions{coll: coll}
+}
+
+// Creates the indexes the queries below rely on. Safe to call on every start.
+func (m *MongoSessions) EnsureIndexes(ctx context.Context) error {
+	// Sessions used to hold a single token; its index is obsolete now.
+	_, err := m.coll.Indexes().DropOne(ctx, "token_hash_unique")
+	if cmdErr, ok := err.(mongo.CommandError); err != nil && !(ok && cmdErr.Code == 27) { // IndexNotFound.
+		return err
+	}
+
+	isString := func(field string) bson.M {
+		return bson.M{field: bson.M{"$type": "string"}}
+	}
+
+	_, err = m.coll.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys: bson.D{{Key: "access_token_hash", Value: 1}},
+			Options: options.Index().
+				SetName("access_token_hash_unique").
+				SetUnique(true).
+				SetPartialFilterExpression(isString("access_token_hash")),
+		},
+		{
+			Keys: bson.D{{Key: "refresh_token_hash", Value: 1}},
+			Options: options.Index().
+				SetName("refresh_token_hash_unique").
+				SetUnique(true).
+				SetPartialFilterExpression(isString("refresh_token_hash")),
+		},
+		{
+			Keys:    bson.D{{Key: "prev_access_token_hash", Value: 1}},
+			Options: options.Index().SetName("prev_access_token_hash").SetSparse(true),
+		},
+		{
+			Keys:    bson.D{{Key: "prev_refresh_token_hash", Value: 1}},
+			Options: options.Index().SetName("prev_refresh_token_hash").SetSparse(true),
+		},
+		{
+			Keys:    bson.D{{Key: "refresh_history", Value: 1}},
+			Options: options.Index().SetName("refresh_history"),
+		},
+		{
+			Keys:    bson.D{{Key: "user_id", Value: 1}, {Key: "last_seen_at", Value: -1}},
+			Options: options.Index().SetName("user_id_last_seen_at"),
+		},
+		{
+			Keys:    bson.D{{Key: "expiry_time", Value: 1}},
+			Options: options.Index().SetName("expiry_time"),
+		},
+		{
+			Keys:    bson.D{{Key: "last_seen_at", Value: 1}},
+			Options: options.Index().SetName("last_seen_at"),
+		},
+	})
+	return err
+}
+
+func (m *MongoSessions) Create(ctx context.Context, session model.Session) error {
+	_, err := m.coll.InsertOne(ctx, session)
+	return mongoErr(err)
+}
+
+func (m *MongoSessions) Touch(ctx context.Context, accessTokenHash string, now int64, limits SessionLimits) (model.Session, error) {
+	filter := alive(now, limits)
+	filter["$or"] = bson.A{
+		bson.M{"access_token_hash": accessTokenHash, "access_expiry_time": bson.M{"$gt": now}},
+		bson.M{"prev_access_token_hash": accessTokenHash, "rotated_at": bson.M{"$gt": now - limits.RotationGrace}},
+	}
+	update := bson.M{"$set": bson.M{"last_seen_at": now}}
+
+	session, err := m.findOneAndUpdate(ctx, filter, update)
+	if err != ErrNotFound {
+		return session, err
+	}
+
+	// Tell an unknown token apart from one whose session or access token has expired.
+	err = m.coll.FindOne(ctx, bson.M{"$or": bson.A{
+		bson.M{"access_token_hash": accessTokenHash},
+		bson.M{"prev_access_token_hash": accessTokenHash},
+	}}).Decode(&session)
+	if err != nil {
+		return model.Session{}, mongoErr(err)
+	}
+	if err := limits.checkAccess(session, accessTokenHash, now); err != nil {
+		return model.Session{}, err
+	}
+	return model.Session{}, ErrNotFound // Became valid in between, e.g. through a concurrent refresh; just retry.
+}
+
+func (m *MongoSessions) Refresh(ctx context.Context, refreshTokenHash string, rotation Rotation, now int64, limits SessionLimits) (model.Session, error) {
+	// The refresh token being replaced always joins the history, capped to the most recent entries.
+	history := bson.M{"$slice": bson.A{
+		bson.M{"$concatArrays": bson.A{bson.M{"$ifNull": bson.A{"$refresh_history", bson.A{}}}, bson.A{"$refresh_token_hash"}}},
+		-refreshHistoryLimit,
+	}}
+	newPair := bson.M{
+		"access_token_hash":  rotation.AccessTokenHash,
+		"access_expiry_time": rotation.AccessExpiryTime,
+		"refresh_token_hash": rotation.RefreshTokenHash,
+		"refresh_history":    history,
+		"last_seen_at":       now,
+	}
+
+	// Regular rotation: the current pair becomes the previous pair and the grace window starts.
+	rotate := bson.M{
+		"prev_access_token_hash":  "$access_token_hash",
+		"prev_refresh_token_hash": "$refresh_token_hash",
+		"rotated_at":              now,
+	}
+	for field, value := range newPair {
+		rotate[field] = value
+	}
+	filter := alive(now, limits)
+	filter["refresh_token_hash"] = refreshTokenHash
+	session, err := m.findOneAndUpdate(ctx, filter, bson.A{bson.M{"$set": rotate}})
+	if err != ErrNotFound {
+		return session, err
+	}
+
+	// Retry within the grace window: the pair issued by the last rotation never reached the client, so it is
+	// replaced while the previous pair and the grace window stay as they are.
+	filter = alive(now, limits)
+	filter["prev_refresh_token_hash"] = refreshTokenHash
+	filter["rotated_at"] = bson.M{"$gt": now - limits.RotationGrace}
+	session, err = m.findOneAndUpdate(ctx, filter, bson.A{bson.M{"$set": newPair}})
+	if err != ErrNotFound {
+		return session, err
+	}
+
+	// A rotated-out refresh token is being replayed: whoever holds it, the session can no longer be trusted.
+	result, err := m.coll.DeleteOne(ctx, bson.M{"refresh_history": refreshTokenHash})
+	if err != nil {
+		return model.Session{}, err
+	}
+	if result.DeletedCount > 0 {
+		return model.Session{}, ErrTokenReused
+	}
+
+	// The token is still current (or within its grace window), so the session itself must have expired.
+	err = m.coll.FindOne(ctx, bson.M{"$or": bson.A{
+		bson.M{"refresh_token_hash": refreshTokenHash},
+		bson.M{"prev_refresh_token_hash": refreshTokenHash},
+	}}).Decode(&session)
+	if err != nil {
+		return model.Session{}, mongoErr(err)
+	}
+	if limits.expired(session, now) {
+		return model.Session{}, ErrSessionExpired
+	}
+	return model.Session{}, ErrNotFound
+}
+
+func (m *MongoSessions) List(ctx context.Context, userID string) ([]model.Session, error) {
+	cursor, err := m.coll.Find(
+		ctx,
+		bson.M{"user_id": userID},
+		options.Find().SetSort(bson.D{{Key: "last_seen_at", Value: -1}}),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	sessions := []model.Session{}
+	if err := cursor.All(ctx, &sessions); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+func (m *MongoSessions) Delete(ctx context.Context, userID string, sessionID string) error {
+	result, err := m.coll.DeleteOne(ctx, bson.M{"_id": sessionID, "user_id": userID})
+	if err != nil {
+		return err
+	}
+	if result.DeletedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (m *MongoSessions) DeleteAll(ctx context.Context, userID string, exceptID string) (int64, error) {
+	filter := bson.M{"user_id": userID}
+	if exceptID != "" {
+		filter["_id"] = bson.M{"$ne": exceptID}
+	}
+
+	result, err := m.coll.DeleteMany(ctx, filter)
+	if err != nil {
+		return 0, err
+	}
+	return result.DeletedCount, nil
+}
+
+func (m *MongoSessions) ChangeUserID(ctx context.Context, oldID, newID string) (int64, error) {
+	result, err := m.coll.UpdateMany(ctx, bson.M{"user_id": oldID}, bson.M{"$set": bson.M{"user_id": newID}})
+	if err != nil {
+		return 0, err
+	}
+	return result.ModifiedCount, nil
+}
+
+func (m *MongoSessions) DeleteExpired(ctx context.Context, now int64, limits SessionLimits) (int64, error) {
+	filter := bson.M{"expiry_time": bson.M{"$lte": now}}
+	if limits.IdleTimeout > 0 {
+		filter = bson.M{"$or": bson.A{filter, bson.M{"last_seen_at": bson.M{"$lte": now - limits.IdleTimeout}}}}
+	}
+
+	result, err := m.coll.DeleteMany(ctx, filter)
+	if err != nil {
+		return 0, err
+	}
+	return result.DeletedCount, nil
+}
+
+func (m *MongoSessions) MigrateSingleTokens(ctx context.Context) (int64, error) {
+	result, err := m.coll.UpdateMany(
+		ctx,
+		bson.M{"token_hash": bson.M{"$type": "string"}},
+		bson.A{
+			bson.M{"$set": bson.M{
+				"access_token_hash":  "$token_hash",
+				"access_expiry_time": "$expiry_time",
+			}},
+			bson.M{"$unset": "token_hash"},
+		},
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.ModifiedCount, nil
+}
+
+// Matches sessions that have neither passed their absolute lifetime nor sat idle for too long.
+func alive(now int64, limits SessionLimits) bson.M {
+	filter := bson.M{"expiry_time": bson.M{"$gt": now}}
+	if limits.IdleTimeout > 0 {
+		filter["last_seen_at"] = bson.M{"$gt": now - limits.IdleTimeout}
+	}
+	return filter
+}
+
+func (m *MongoSessions) findOneAndUpdate(ctx context.Context, filter bson.M, update interface{}) (model.Session, error) {
+	var session model.Session
+	err := m.coll.FindOneAndUpdate(
+		ctx,
+		filter,
+		update,
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&session)
+	return session, mongoErr(err)
+}
@@ -0,0 +1,46 @@
+package repository
+
+import (
+	"context"
+	"math"
+)
+
+// A token bucket: it holds up to Capacity tokens and gains one every RefillInterval milliseconds. Every
+// limited action takes one token, so Capacity is the burst allowed after a quiet period.
+type Bucket struct {
+	Capacity int64
+	RefillInterval int64
+}
+
+// Storage for token buckets, keyed by whatever is being limited. Every method is atomic with respect to a
+// single bucket, so concurrent requests across server instances share one budget.
+type RateLimits interface {
+	// Takes one token from the bucket under key, which starts out full. Returns 0 if a token was taken, or
+	// otherwise how many milliseconds remain until one will be available.
+	Take(ctx context.Context, key string, bucket Bucket, now int64) (int64, error)
+
+	// Gives back a token taken by Take, for when the action it was taken for did not happen after all. The
+	// bucket never grows past Capacity, and a bucket that has already expired is left alone.
+	Refund(ctx context.Context, key string, bucket Bucket, now int64) error
+
+	// Removes every bucket that has refilled completely by now, returning how many were removed. A full
+	// bucket is the same as a missing one, so this only frees space.
+	DeleteExpired(ctx context.Context, now int64) (int64, error)
+}
+
+// Tokens in the bucket at now, given the level it was left at updatedAt.
+func (b Bucket) refill(tokens float64, updatedAt int64, now int64) float64 {
+	// Clocks of different servers may disagree slightly; never let that drain the bucket.
+	elapsed := max(now-updatedAt, 0)
+	return math.Min(float64(b.Capacity), tokens+float64(elapsed)/float64(b.RefillInterval))
+}
+
+// Milliseconds until a bucket holding tokens has at least one.
+func (b Bucket) retryAfter(tokens float64) int64 {
+	return int64(math.Ceil((1 - tokens) * float64(b.RefillInterval)))
+}
+
+// Time at which a bucket holding tokens at now will be full again.
+func (b Bucket) fullAt(tokens float64, now int64) int64 {
+	return now + int64(math.Ceil((float64(b.Capacity)-tokens)*float64(b.RefillInterval)))
+}
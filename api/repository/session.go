@@ -0,0 +1,95 @@
+package repository
+
+import (
+	"context"
+	"errors"
+
+	"bearlysocial-backend/api/model"
+)
+
+var (
+	// Returned by Refresh when a refresh token that was already rotated out is presented again. The whole
+	// session has been revoked by the time this is returned.
+	ErrTokenReused = errors.New("refresh token reused")
+	// Returned when a token belongs to a session that passed its absolute lifetime or sat idle for too long.
+	ErrSessionExpired = errors.New("session expired")
+	// Returned by Touch when the session is fine but the access token is not; the client should refresh.
+	ErrAccessTokenExpired = errors.New("access token expired")
+)
+
+// How many rotated-out refresh token digests a session remembers for reuse detection.
+const refreshHistoryLimit = 16
+
+// The digests and access token expiry that replace a session's current pair.
+type Rotation struct {
+	AccessTokenHash string
+	AccessExpiryTime int64
+	RefreshTokenHash string
+}
+
+// Time limits applied whenever a session is used, in milliseconds. The absolute lifetime is the session's own
+// expiry time. A zero IdleTimeout disables the idle check.
+type SessionLimits struct {
+	// How long the previous token pair is still accepted after a rotation.
+	RotationGrace int64
+	// How long a session may go unused before it expires.
+	IdleTimeout int64
+}
+
+// Reports whether the session can no longer be used at all.
+func (l SessionLimits) expired(session model.Session, now int64) bool {
+	return session.ExpiryTime <= now || (l.IdleTimeout > 0 && session.LastSeenAt <= now-l.IdleTimeout)
+}
+
+// Works out why a session that holds accessTokenHash was not accepted by Touch, or returns nil if it should be.
+func (l SessionLimits) checkAccess(session model.Session, accessTokenHash string, now int64) error {
+	if l.expired(session, now) {
+		return ErrSessionExpired
+	}
+	if session.AccessTokenHash == accessTokenHash && session.AccessExpiryTime > now {
+		return nil
+	}
+	if session.PrevAccessTokenHash == accessTokenHash && session.RotatedAt > now-l.RotationGrace {
+		return nil
+	}
+	return ErrAccessTokenExpired
+}
+
+// Storage for sign-in sessions, one per device. Every method is atomic with respect to a single session.
+type Sessions interface {
+	// Inserts a new session, or returns ErrDuplicate if its ID or a token digest is taken.
+	Create(ctx context.Context, session model.Session) error
+
+	// Finds the unexpired session whose current access token has digest accessTokenHash, or whose previous
+	// access token has that digest and is still within the rotation grace window, and records now as its
+	// last-seen time. Returns ErrSessionExpired or ErrAccessTokenExpired if a session holds the digest but
+	// cannot accept it, and ErrNotFound if none does.
+	Touch(ctx context.Context, accessTokenHash string, now int64, limits SessionLimits) (model.Session, error)
+
+	// Swaps in a new token pair for the unexpired session whose current refresh token has digest
+	// refreshTokenHash. Within the rotation grace window the previous refresh token is accepted as well, so a
+	// client that lost the response can retry. A refresh token outside both cases that the session has
+	// rotated out before revokes the session and returns ErrTokenReused. Returns ErrSessionExpired if the
+	// session holding the token has expired, and ErrNotFound if no session holds it.
+	Refresh(ctx context.Context, refreshTokenHash string, rotation Rotation, now int64, limits SessionLimits) (model.Session, error)
+
+	// Returns every session of the user, most recently used first.
+	List(ctx context.Context, userID string) ([]model.Session, error)
+
+	// Removes one session of the user, or returns ErrNotFound if the user has no session with that ID.
+	Delete(ctx context.Context, userID string, sessionID string) error
+
+	// Removes every session of the user except the one with exceptID (pass "" to remove all), returning how
+	// many were removed.
+	DeleteAll(ctx context.Context, userID string, exceptID string) (int64, error)
+
+	// Removes every session that has expired under limits as of now, returning how many were removed.
+	DeleteExpired(ctx context.Context, now int64, limits SessionLimits) (int64, error)
+
+	// Migration: hands every session of the user oldID to newID, returning how many were moved.
+	ChangeUserID(ctx context.Context, oldID, newID string) (int64, error)
+
+	// Migration: turns sessions that still hold a single token_hash into access-token-only sessions whose
+	// access token lives as long as the session, returning how many were converted.
+	MigrateSingleTokens(ctx context.Context) (int64, error)
+}
@@ -0,0 +1,167 @@
+package repository
+
+import (
+	"context"
+	"errors"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"bearlysocial-backend/api/model"
+)
+
+var (
+	// Returned when no account matches the given ID (and, where applicable, token).
+	ErrNotFound = errors.New("user account not found")
+	// Returned when creating an account whose ID or email address is already taken.
+	ErrDuplicate = errors.New("user account already exists")
+	// Returned when a profile update touches a field that is not part of the public profile.
+	ErrNotProfileField = errors.New("field is not a profile field")
+	// Returned by IssueOTP while the account is locked out after too many wrong guesses.
+	ErrCooldown = errors.New("user account in cooldown")
+	// Returned by AddPasskey when the account already holds as many passkeys as it may.
+	ErrLimitReached = errors.New("user account limit reached")
+)
+
+// Fields that UpdateProfile is allowed to write; OTP, token and cooldown fields are never among them.
+var profileFields = map[string]bool{
+	"first_name":       true,
+	"last_name":        true,
+	"interests":        true,
+	"langs":            true,
+	"insta_handler":    true,
+	"fb_handler":       true,
+	"linkedin_handler": true,
+	"mood":             true,
+	"schedule":         true,
+}
+
+// Storage for user accounts. Every method is atomic with respect to a single account.
+type UserAccounts interface {
+	// Returns the account with the given ID, or ErrNotFound.
+	Find(ctx context.Context, id string) (model.UserAccount, error)
+
+	// Returns the account with the given email address, or ErrNotFound.
+	FindByEmail(ctx context.Context, email string) (model.UserAccount, error)
+
+	// Inserts a new account, or returns ErrDuplicate if the ID or the email address is taken.
+	Create(ctx context.Context, user_acc model.UserAccount) error
+
+	// Stores a freshly issued OTP unless the account is in cooldown, in which case the account is returned
+	// along with ErrCooldown. An expired cooldown is lifted, which also resets the attempt count.
+	IssueOTP(ctx context.Context, id string, otp string, expiryTime int64, now int64) (model.UserAccount, error)
+
+	// Counts a guess against the pending OTP before it is checked, so concurrent guesses can never exceed
+	// maxAttempts between them. The write that uses up the last attempt also counts a lockout and starts a
+	// cooldown, which CompleteOTP lifts again if that guess turns out right. The nth lockout in a row lasts
+	// cooldowns[n-1] milliseconds, with the last entry repeating. Returns the account with the OTP to check
+	// against, or ErrNotFound if there is no pending, unexpired OTP with attempts left.
+	ReserveOTPAttempt(ctx context.Context, id string, now int64, maxAttempts int, cooldowns []int64) (model.UserAccount, error)
+
+	// Consumes the pending OTP, which must still be otp, and clears attempts, lockouts, cooldown and any
+	// pending deletion. Returns ErrNotFound if the OTP was consumed or replaced in the meantime.
+	CompleteOTP(ctx context.Context, id string, otp string) (model.UserAccount, error)
+
+	// Clears the pending OTP if it is still otp. Used once the last attempt on it has been wasted.
+	DiscardOTP(ctx context.Context, id string, otp string) error
+
+	// Attaches a passkey to the account unless it already holds limit passkeys, in which case it returns
+	// ErrLimitReached. Returns ErrDuplicate if any account already holds its credential ID.
+	AddPasskey(ctx context.Context, id string, passkey model.Passkey, limit int) error
+
+	// Detaches the passkey with the given credential ID from the account. Returns ErrNotFound if the account
+	// holds no such passkey.
+	RemovePasskey(ctx context.Context, id string, credentialID string) error
+
+	// Returns the account holding the passkey with the given credential ID, or ErrNotFound.
+	FindByPasskey(ctx context.Context, credentialID string) (model.UserAccount, error)
+
+	// Records a sign-in with the passkey: stores its new signature counter and cancels any pending deletion,
+	// like a sign-in by OTP. The stored counter must still be prevSignCount, so concurrent sign-ins with a
+	// cloned authenticator cannot both succeed; otherwise ErrNotFound is returned.
+	UsePasskey(ctx context.Context, id string, credentialID string, prevSignCount, signCount int64, now int64) (model.UserAccount, error)
+
+	// Stores a pending change of email address, replacing any earlier one.
+	BeginEmailChange(ctx context.Context, id string, change model.EmailChange) error
+
+	// Counts a guess against the pending email change before its codes are checked, like ReserveOTPAttempt.
+	// Returns the account with the change to check against, or ErrNotFound if there is no pending, unexpired
+	// change with attempts left.
+	ReserveEmailChangeAttempt(ctx context.Context, id string, now int64, maxAttempts int) (model.UserAccount, error)
+
+	// Moves the account to the new address of the pending change, which must still be the one whose old-address
+	// code is oldOTP, and clears it along with any pending sign-in OTP, since that OTP and its magic link went to
+	// the old address. Returns ErrNotFound if the change was replaced or used in the meantime, and
+	// ErrDuplicate if another account has taken the new address.
+	ChangeEmail(ctx context.Context, id string, oldOTP string) (model.UserAccount, error)
+
+	// Clears the pending email change if it is still the one whose old-address code is oldOTP.
+	DiscardEmailChange(ctx context.Context, id string, oldOTP string) error
+
+	// Returns the account linked to the identity with the given ID ("<provider>:<subject>"), or ErrNotFound.
+	FindByIdentity(ctx context.Context, identityID string) (model.UserAccount, error)
+
+	// Records a sign-in with a provider identity: links it to the account unless it already is, and cancels any
+	// pending deletion, like any other sign-in. Returns ErrDuplicate if another account holds the identity.
+	UseIdentity(ctx context.Context, id string, identity model.Identity) (model.UserAccount, error)
+
+	// Stores a pending authenticator-app enrollment, replacing any earlier pending one. Returns ErrDuplicate if
+	// the account already has a confirmed one.
+	BeginTOTP(ctx context.Context, id string, totp model.TOTP) error
+
+	// Confirms the pending enrollment, which must still hold the sealed secret, recording the step of the code
+	// that confirmed it and the hashes of the recovery codes. Returns ErrNotFound if it was replaced meanwhile.
+	ConfirmTOTP(ctx context.Context, id string, secret string, step int64, recoveryCodes []string) (model.UserAccount, error)
+
+	// Records a code accepted for the given time step. Returns ErrNotFound unless the step is later than the
+	// last one used, so every code works at most once, even under concurrent requests.
+	UseTOTP(ctx context.Context, id string, step int64) (model.UserAccount, error)
+
+	// Removes the recovery code with the given hash. Returns ErrNotFound if it is not among the unused ones.
+	UseRecoveryCode(ctx context.Context, id string, codeHash string) (model.UserAccount, error)
+
+	// Replaces every recovery code of a confirmed enrollment with the given hashes, made under the current ID.
+	ReplaceRecoveryCodes(ctx context.Context, id string, codeHashes []string) error
+
+	// Removes the authenticator app, pending or confirmed, along with its recovery codes.
+	RemoveTOTP(ctx context.Context, id string) error
+
+	// Sets the given profile fields (keyed by their BSON names) and returns the updated account.
+	UpdateProfile(ctx context.Context, id string, changes bson.M) (model.UserAccount, error)
+
+	// Marks the account for deletion at deletionTime.
+	ScheduleDeletion(ctx context.Context, id string, deletionTime int64) error
+
+	// Removes the account if its deletion time is still set and at or before now, or returns ErrNotFound. Signing
+	// in clears the deletion time, so an account that was signed in to after ExpiredDeletions listed it is kept.
+	DeleteIfDue(ctx context.Context, id string, now int64) error
+
+	// Returns the IDs of accounts whose deletion time is at or before now.
+	ExpiredDeletions(ctx context.Context, now int64) ([]string, error)
+
+	// Migration: replaces pending OTPs that are still stored in plaintext with hash(id, otp), returning how
+	// many were rewritten.
+	HashPlaintextOTPs(ctx context.Context, hash func(id, otp string) string) (int64, error)
+
+	// Migration: stores the email address of accounts from before it was a field of its own, when the ID was
+	// the address, returning how many were updated.
+	FillEmails(ctx context.Context) (int64, error)
+
+	// Migration: gives every account whose ID is still its email address a generated ID from newID. rebind
+	// rewrites whatever on the account was bound to the old ID, and move carries over what refers to the
+	// account from elsewhere, such as sessions, before the old account is removed. Returns how many accounts
+	// were moved. An interrupted run is finished by the next one.
+	MoveToGeneratedIDs(ctx context.Context, newID func() (string, error), rebind func(oldID string, user_acc *model.UserAccount) error, move func(oldID, newID string) error) (int64, error)
+
+	// Migration: hands every token still stored on an account (a digest, or a raw "email::hashpass" token from
+	// before digests) to move and then removes it from the account, returning how many were moved.
+	MoveTokens(ctx context.Context, move func(id, token string) error) (int64, error)
+}
+
+func checkProfileFields(changes bson.M) error {
+	for field := range changes {
+		if !profileFields[field] {
+			return ErrNotProfileField
+		}
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package router
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+
+	"bearlysocial-backend/api/problem"
+)
+
+// Wraps a handler with work of its own, such as checking the access token, before passing the request on.
+type Middleware func(http.Handler) http.Handler
+
+// Combines middleware into one that runs them in the order given, so Chain(a, b)(h) runs a, then b, then h.
+func Chain(middleware ...Middleware) Middleware {
+	return func(next http.Handler) http.Handler {
+		for i := len(middleware) - 1; i >= 0; i-- {
+			next = middleware[i](next)
+		}
+		return next
+	}
+}
+
+// Dispatches requests by method and path using the patterns of http.ServeMux. A request for a known path with a
+// method it has no route for gets a 405 with an Allow header, and an OPTIONS request gets the Allow header alone.
+// Unknown paths get a JSON 404, like every other error response.
+type Router struct {
+	mux     *http.ServeMux
+	methods map[string][]string // Registered methods by path pattern, in the order they were added.
+	handler http.Handler
+}
+
+// A set of routes under a common path prefix that share middleware.
+type Group struct {
+	router     *Router
+	prefix     string
+	middleware []Middleware
+}
+
+// Returns a router that runs the given middleware on every request, including those that match no route.
+func New(middleware ...Middleware) *Router {
+	r := &Router{mux: http.NewServeMux(), methods: map[string][]string{}}
+	r.mux.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
+		problem.Write(w, problem.NotFound, "Not found.")
+	})
+	r.handler = Chain(middleware...)(r.mux)
+	return r
+}
+
+func (r *Router) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.handler.ServeHTTP(w, req)
+}
+
+// Returns a group whose routes live under prefix and run the given middleware, after the router's own.
+func (r *Router) Group(prefix string, middleware ...Middleware) *Group {
+	return &Group{router: r, prefix: prefix, middleware: middleware}
+}
+
+// Returns a group nested in this one. Its routes run this group's middleware first.
+func (g *Group) Group(prefix string, middleware ...Middleware) *Group {
+	return &Group{
+		router:     g.router,
+		prefix:     g.prefix + prefix,
+		middleware: append(slices.Clone(g.middleware), middleware...),
+	}
+}
+
+// Registers a handler for a method and path. The path may use the wildcards of http.ServeMux, and a GET route
+// also answers HEAD requests. Registering the same method and path twice panics.
+func (g *Group) Handle(method, path string, handler http.Handler) {
+	r := g.router
+	path = g.prefix + path
+	r.mux.Handle(method+" "+path, Chain(g.middleware...)(handler))
+
+	// Whatever the route's method, a catch-all for the path answers the others. It runs none of the group's
+	// middleware, so a preflight request needs no credentials.
+	if _, ok := r.methods[path]; !ok {
+		r.mux.HandleFunc(path, func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set("Allow", r.allow(path))
+			if req.Method == http.MethodOptions {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			problem.Write(w, problem.MethodNotAllowed, "Method not allowed.")
+		})
+	}
+	r.methods[path] = append(r.methods[path], method)
+}
+
+// Registers a handler function for a method and path, like Handle.
+func (g *Group) HandleFunc(method, path string, handler http.HandlerFunc) {
+	g.Handle(method, path, handler)
+}
+
+// Lists the methods a path answers, for the Allow header.
+func (r *Router) allow(path string) string {
+	methods := slices.Clone(r.methods[path])
+	if slices.Contains(methods, http.MethodGet) && !slices.Contains(methods, http.MethodHead) {
+		methods = append(methods, http.MethodHead)
+	}
+	if !slices.Contains(methods, http.MethodOptions) {
+		methods = append(methods, http.MethodOptions)
+	}
+	return strings.Join(methods, ", ")
+}
@@ -0,0 +1,151 @@
+// Renders every email with sample data to files, so changes to the templates can be checked in a browser and a
+// text editor before they reach anyone's inbox. Each email is written as <name>.<lang>.html and <name>.<lang>.txt,
+// with the subject on the first line of the text file, next to an index.html that links them all.
+//
+//	go run ./cmd/emailpreview -templates emails/templates -out email-preview
+//
+// Without -templates the templates built into the server are used.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"html/template"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"golang.org/x/text/language"
+
+	"bearlysocial-backend/emails"
+	"bearlysocial-backend/i18n"
+)
+
+// An email to render, under the file name it is written to.
+type sample struct {
+	name string
+	data emails.Data
+}
+
+func samples() []sample {
+	ttl := i18n.Duration(8 * time.Minute)
+	meetupTime := time.Date(2025, 6, 14, 18, 30, 0, 0, time.FixedZone("WIB", 7*60*60))
+	return []sample{
+		{"otp", emails.OTP{Code: "7KQ2XD", TTL: ttl, Link: "https://bearlysocial.com/sign-in?token=sample"}},
+		{"otp_no_link", emails.OTP{Code: "7KQ2XD", TTL: ttl}},
+		{"email_change_current", emails.EmailChange{Code: "M4TZ8P", TTL: ttl, NewAddress: "new@example.com", ToCurrent: true}},
+		{"email_change_new", emails.EmailChange{Code: "Q9WB3N", TTL: ttl, NewAddress: "new@example.com"}},
+		{"account_deletion", emails.AccountDeletion{GracePeriod: i18n.Duration(30 * 24 * time.Hour)}},
+		{"new_device", emails.NewDevice{
+			DeviceLabel: "Pixel 8",
+			UserAgent:   "BearlySocial/2.3 (Android 14)",
+			Time:        time.Date(2025, 6, 14, 9, 5, 0, 0, time.UTC),
+		}},
+		{"meetup", emails.Meetup{
+			With:  "Ayu",
+			Place: "Kopi Kenangan, Jl. Sudirman 12",
+			Time:  meetupTime,
+			Link:  "https://bearlysocial.com/meetups/sample",
+		}},
+	}
+}
+
+var index = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Email preview</title></head>
+<body style="font-family: Helvetica, Arial, sans-serif;">
+<h1>Email preview</h1>
+<table>
+{{- range .}}
+<tr><td>{{.Name}}</td><td>{{.Lang}}</td><td><a href="{{.HTML}}">{{.Subject}}</a></td><td><a href="{{.Text}}">text</a></td></tr>
+{{- end}}
+</table>
+</body>
+</html>
+`))
+
+type entry struct {
+	Name, Lang, Subject, HTML, Text string
+}
+
+func main() {
+	out := flag.String("out", "email-preview", "directory to write the rendered emails to")
+	dir := flag.String("templates", "", "template directory to render instead of the built-in templates")
+	langs := flag.String("lang", "", "comma-separated languages to render (default all supported)")
+	flag.Parse()
+
+	templates := emails.Default
+	if *dir != "" {
+		var err error
+		templates, err = emails.Parse(os.DirFS(*dir))
+		if err != nil {
+			fmt.Println("ERROR PARSING TEMPLATES:", err)
+			os.Exit(1)
+		}
+	}
+
+	tags := i18n.Supported
+	if *langs != "" {
+		tags = nil
+		for _, lang := range strings.Split(*langs, ",") {
+			tag, err := language.Parse(strings.TrimSpace(lang))
+			if err != nil {
+				fmt.Println("ERROR PARSING LANGUAGE:", err)
+				os.Exit(1)
+			}
+			if !slices.Contains(i18n.Supported, tag) {
+				fmt.Printf("ERROR: %s is not a supported language.\n", tag)
+				os.Exit(1)
+			}
+			tags = append(tags, tag)
+		}
+	}
+
+	if err := os.MkdirAll(*out, 0755); err != nil {
+		fmt.Println("ERROR CREATING OUTPUT DIRECTORY:", err)
+		os.Exit(1)
+	}
+
+	var entries []entry
+	for _, s := range samples() {
+		for _, tag := range tags {
+			msg, err := templates.Render(tag, s.data)
+			if err != nil {
+				fmt.Printf("ERROR RENDERING %s (%s): %v\n", s.name, tag, err)
+				os.Exit(1)
+			}
+
+			e := entry{
+				Name:    s.name,
+				Lang:    tag.String(),
+				Subject: msg.Subject,
+				HTML:    s.name + "." + tag.String() + ".html",
+				Text:    s.name + "." + tag.String() + ".txt",
+			}
+			text := "Subject: " + msg.Subject + "\n\n" + msg.Text
+			if err := os.WriteFile(filepath.Join(*out, e.HTML), []byte(msg.HTML), 0644); err != nil {
+				fmt.Println("ERROR WRITING PREVIEW:", err)
+				os.Exit(1)
+			}
+			if err := os.WriteFile(filepath.Join(*out, e.Text), []byte(text), 0644); err != nil {
+				fmt.Println("ERROR WRITING PREVIEW:", err)
+				os.Exit(1)
+			}
+			entries = append(entries, e)
+		}
+	}
+
+	f, err := os.Create(filepath.Join(*out, "index.html"))
+	if err != nil {
+		fmt.Println("ERROR WRITING PREVIEW:", err)
+		os.Exit(1)
+	}
+	defer f.Close()
+	if err := index.Execute(f, entries); err != nil {
+		fmt.Println("ERROR WRITING PREVIEW:", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Wrote %d emails to %s.\n", len(entries), filepath.Join(*out, "index.html"))
+}
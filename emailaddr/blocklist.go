@@ -0,0 +1,100 @@
+package emailaddr
+
+import (
+	"bufio"
+	_ "embed"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Well-known disposable mailbox services, one domain per line.
+//
+//go:embed disposable_domains.txt
+var disposableDomains string
+
+// A set of domains whose addresses are refused, together with their subdomains. A nil Blocklist refuses
+// nothing.
+type Blocklist struct {
+	domains map[string]bool
+}
+
+// Returns a blocklist of the given domains.
+func NewBlocklist(domains ...string) *Blocklist {
+	b := &Blocklist{domains: make(map[string]bool)}
+	for _, domain := range domains {
+		b.add(domain)
+	}
+	return b
+}
+
+// Returns a blocklist of well-known disposable mailbox services. Such lists are never complete; add to it with
+// Load as new services turn up.
+func DisposableDomains() *Blocklist {
+	b := NewBlocklist()
+	b.Load(strings.NewReader(disposableDomains))
+	return b
+}
+
+// Adds the domains listed in r, one per line. Blank lines and lines starting with "#" are skipped.
+func (b *Blocklist) Load(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !b.add(line) {
+			return fmt.Errorf("invalid domain %q", line)
+		}
+	}
+	return scanner.Err()
+}
+
+// Adds the domains listed in the file at path, like Load.
+func (b *Blocklist) LoadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return b.Load(f)
+}
+
+// Adds a domain in the same ASCII form addresses are parsed into, so "bücher.example" also matches
+// "xn--bcher-kva.example".
+func (b *Blocklist) add(domain string) bool {
+	ascii, err := parseDomain(domain)
+	if err != nil {
+		return false
+	}
+	b.domains[ascii] = true
+	return true
+}
+
+// Reports whether the address is at a listed domain or one of its subdomains.
+func (b *Blocklist) Blocked(addr Address) bool {
+	if b == nil {
+		return false
+	}
+	domain := addr.Domain
+	for {
+		if b.domains[domain] {
+			return true
+		}
+		dot := strings.IndexByte(domain, '.')
+		if dot < 0 {
+			return false
+		}
+		domain = domain[dot+1:]
+	}
+}
+
+// Returns the number of listed domains.
+func (b *Blocklist) Len() int {
+	if b == nil {
+		return 0
+	}
+	return len(b.domains)
+}
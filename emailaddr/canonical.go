@@ -0,0 +1,57 @@
+package emailaddr
+
+import "strings"
+
+// How a mail provider folds the different ways of writing one of its mailboxes.
+type providerRules struct {
+	// The domain all of the provider's domains are folded into.
+	domain string
+	// Whatever follows this separator in the local part is a tag the provider ignores.
+	tagSeparator string
+	// Whether dots in the local part are ignored.
+	ignoreDots bool
+}
+
+var (
+	gmail      = providerRules{domain: "gmail.com", tagSeparator: "+", ignoreDots: true}
+	outlook    = providerRules{domain: "outlook.com", tagSeparator: "+"}
+	icloud     = providerRules{domain: "icloud.com", tagSeparator: "+"}
+	fastmail   = providerRules{domain: "fastmail.com", tagSeparator: "+"}
+	proton     = providerRules{domain: "proton.me", tagSeparator: "+"}
+	yahoo      = providerRules{domain: "yahoo.com", tagSeparator: "-"}
+	knownRules = map[string]providerRules{
+		"gmail.com":      gmail,
+		"googlemail.com": gmail,
+		"outlook.com":    outlook,
+		"hotmail.com":    outlook,
+		"live.com":       outlook,
+		"icloud.com":     icloud,
+		"me.com":         icloud,
+		"mac.com":        icloud,
+		"fastmail.com":   fastmail,
+		"proton.me":      proton,
+		"protonmail.com": proton,
+		"pm.me":          proton,
+		"yahoo.com":      yahoo,
+	}
+)
+
+// Returns the form that all the ways of writing the same mailbox at a well-known provider share, such as
+// "ab@gmail.com" for "a.b+promo@googlemail.com". It is for spotting one person behind many addresses, e.g. in
+// rate limits, and never for storing or sending: other providers do not fold addresses like this, and mail
+// must go to the address the user gave. Addresses at other domains are returned unchanged.
+func Canonical(addr Address) string {
+	rules, ok := knownRules[addr.Domain]
+	if !ok {
+		return addr.String()
+	}
+
+	local := addr.Local
+	if i := strings.Index(local, rules.tagSeparator); i > 0 {
+		local = local[:i]
+	}
+	if rules.ignoreDots {
+		local = strings.ReplaceAll(local, ".", "")
+	}
+	return local + "@" + rules.domain
+}
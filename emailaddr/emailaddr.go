@@ -0,0 +1,162 @@
+// Package emailaddr parses and normalizes the email addresses accounts are keyed by. Addresses are accepted in
+// the dot-atom form people actually type, with internationalized local parts (RFC 6531) and domains (IDNA
+// 2008), and brought into one normal form so the same mailbox always maps to the same account.
+package emailaddr
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/net/idna"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Returned, wrapped with the reason, for anything that is not a usable address.
+var ErrInvalid = errors.New("invalid email address")
+
+const (
+	// Limits from RFC 5321, counted in octets of the normal form.
+	maxLocalLength   = 64
+	maxDomainLength  = 253
+	maxAddressLength = 254
+)
+
+// The characters RFC 5322 allows in a dot-atom besides letters and digits.
+const atextSpecials = "!#$%&'*+-/=?^_`{|}~"
+
+// Maps a domain to its ASCII form for lookup, as registrars and resolvers do: case folded, normalized, and
+// checked against the IDNA 2008 rules including bidi.
+var domainProfile = idna.New(
+	idna.MapForLookup(),
+	idna.BidiRule(),
+	idna.Transitional(false),
+	idna.StrictDomainName(true),
+	idna.VerifyDNSLength(true),
+)
+
+// A parsed address in normal form.
+type Address struct {
+	// Lowercased and in Unicode normalization form C.
+	Local string
+	// The ASCII (punycode) form of the domain, lowercased.
+	Domain string
+}
+
+// Returns the address in normal form, the form accounts are stored and looked up by.
+func (a Address) String() string {
+	return a.Local + "@" + a.Domain
+}
+
+// Returns the domain as people read it, with punycode labels decoded.
+func (a Address) UnicodeDomain() string {
+	domain, err := idna.ToUnicode(a.Domain)
+	if err != nil {
+		return a.Domain
+	}
+	return domain
+}
+
+// Parses an address as typed by a user, ignoring surrounding white space. Display names, comments, quoted local
+// parts and address literals such as user@[192.0.2.1] are refused; nobody signs up with them, and allowing them
+// would let one mailbox be written in several ways.
+//
+// The local part is lowercased. RFC 5321 leaves its case to the receiving server, but providers treat it
+// case-insensitively and accounts have always been matched that way.
+func Parse(s string) (Address, error) {
+	s = strings.TrimSpace(s)
+	if !utf8.ValidString(s) {
+		return Address{}, fmt.Errorf("%w: not UTF-8", ErrInvalid)
+	}
+
+	at := strings.LastIndexByte(s, '@')
+	if at < 0 {
+		return Address{}, fmt.Errorf("%w: no @", ErrInvalid)
+	}
+
+	local, err := parseLocal(s[:at])
+	if err != nil {
+		return Address{}, err
+	}
+	domain, err := parseDomain(s[at+1:])
+	if err != nil {
+		return Address{}, err
+	}
+
+	addr := Address{Local: local, Domain: domain}
+	if len(addr.String()) > maxAddressLength {
+		return Address{}, fmt.Errorf("%w: longer than %d octets", ErrInvalid, maxAddressLength)
+	}
+	return addr, nil
+}
+
+// Parses an address and returns it in normal form.
+func Normalize(s string) (string, error) {
+	addr, err := Parse(s)
+	if err != nil {
+		return "", err
+	}
+	return addr.String(), nil
+}
+
+// Reports whether s parses as an address.
+func Valid(s string) bool {
+	_, err := Parse(s)
+	return err == nil
+}
+
+func parseLocal(local string) (string, error) {
+	local = strings.ToLower(norm.NFC.String(local))
+	switch {
+	case local == "":
+		return "", fmt.Errorf("%w: empty local part", ErrInvalid)
+	case len(local) > maxLocalLength:
+		return "", fmt.Errorf("%w: local part longer than %d octets", ErrInvalid, maxLocalLength)
+	case local[0] == '.' || local[len(local)-1] == '.' || strings.Contains(local, ".."):
+		return "", fmt.Errorf("%w: misplaced dot in local part", ErrInvalid)
+	}
+
+	for _, r := range local {
+		if !isAtext(r) && r != '.' {
+			return "", fmt.Errorf("%w: %q in local part", ErrInvalid, r)
+		}
+	}
+	return local, nil
+}
+
+// Reports whether r may appear in a dot-atom. Beyond ASCII, RFC 6532 allows any UTF-8; only letters, marks and
+// digits are let through, which keeps out look-alike punctuation and invisible characters.
+func isAtext(r rune) bool {
+	switch {
+	case r < utf8.RuneSelf:
+		return 'a' <= r && r <= 'z' || '0' <= r && r <= '9' || strings.ContainsRune(atextSpecials, r)
+	default:
+		return unicode.IsLetter(r) || unicode.IsMark(r) || unicode.IsDigit(r)
+	}
+}
+
+func parseDomain(domain string) (string, error) {
+	if strings.HasPrefix(domain, "[") {
+		return "", fmt.Errorf("%w: address literal", ErrInvalid)
+	}
+
+	ascii, err := domainProfile.ToASCII(domain)
+	if err != nil {
+		return "", fmt.Errorf("%w: domain: %v", ErrInvalid, err)
+	}
+
+	labels := strings.Split(ascii, ".")
+	switch {
+	case len(ascii) > maxDomainLength:
+		return "", fmt.Errorf("%w: domain longer than %d octets", ErrInvalid, maxDomainLength)
+	case len(labels) < 2:
+		// Mail to a bare top-level domain or a local host name never reaches anyone who could sign up.
+		return "", fmt.Errorf("%w: domain without a dot", ErrInvalid)
+	case strings.Trim(labels[len(labels)-1], "0123456789") == "":
+		// No top-level domain is numeric, so this is an IP address written without brackets.
+		return "", fmt.Errorf("%w: numeric top-level domain", ErrInvalid)
+	}
+	return ascii, nil
+}
@@ -0,0 +1,25 @@
+package emailaddr
+
+import (
+	"fmt"
+	"os"
+)
+
+// Builds the blocklist new accounts are checked against from the environment: the built-in list of disposable
+// mailbox services unless EMAIL_ALLOW_DISPOSABLE is "true", plus the domains in EMAIL_BLOCKLIST_FILE, if set.
+// Returns nil if nothing is blocked.
+func BlocklistFromEnv() (*Blocklist, error) {
+	b := NewBlocklist()
+	if os.Getenv("EMAIL_ALLOW_DISPOSABLE") != "true" {
+		b = DisposableDomains()
+	}
+	if path := os.Getenv("EMAIL_BLOCKLIST_FILE"); path != "" {
+		if err := b.LoadFile(path); err != nil {
+			return nil, fmt.Errorf("EMAIL_BLOCKLIST_FILE: %v", err)
+		}
+	}
+	if b.Len() == 0 {
+		return nil, nil
+	}
+	return b, nil
+}
@@ -0,0 +1,58 @@
+package emails
+
+import (
+	"time"
+
+	"bearlysocial-backend/i18n"
+)
+
+// The one-time password that signs in, and the magic link that does the same in one tap.
+type OTP struct {
+	Code string
+	TTL  i18n.Duration
+
+	// Empty if magic links are disabled.
+	Link string
+}
+
+func (OTP) Template() string { return "otp" }
+
+// One of the two codes that confirm an email change. One goes to the current address and one to the new.
+type EmailChange struct {
+	Code string
+	TTL  i18n.Duration
+
+	// The address the account is moving to, and whether this email goes to the current address instead.
+	NewAddress string
+	ToCurrent  bool
+}
+
+func (EmailChange) Template() string { return "email_change" }
+
+// Confirms that the account is scheduled for deletion and how long the user has to cancel.
+type AccountDeletion struct {
+	GracePeriod i18n.Duration
+}
+
+func (AccountDeletion) Template() string { return "account_deletion" }
+
+// Tells the user that their account was signed in on a device it was not signed in on before.
+type NewDevice struct {
+	DeviceLabel string
+	UserAgent   string
+	Time        time.Time
+}
+
+func (NewDevice) Template() string { return "new_device" }
+
+// Tells the user about a meetup with another user.
+type Meetup struct {
+	With  string
+	Place string
+	Time  time.Time
+
+	// Where the meetup can be seen in the app, or empty.
+	Link string
+}
+
+func (Meetup) Template() string { return "meetup" }
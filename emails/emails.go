@@ -0,0 +1,195 @@
+// Package emails renders the transactional emails the server sends. Each email is a pair of templates, an
+// html/template for the HTML body and a text/template for the plain-text alternative and the subject, wrapped in
+// the shared layout of its kind.
+//
+// The files live in a template directory:
+//
+//	layout.html.tmpl     the HTML layout; it must define "layout", which executes "body"
+//	layout.txt.tmpl      the plain-text layout, likewise
+//	<name>.html.tmpl     defines "body"
+//	<name>.txt.tmpl      defines "subject" and "body"
+//	<lang>/<file>        replaces <file> in emails in that language, e.g. id/otp.html.tmpl
+//
+// Text in templates is English and goes through the i18n catalogs, so a locale directory is only needed when a
+// language calls for a different email rather than different words.
+package emails
+
+import (
+	"bytes"
+	"embed"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"io/fs"
+	"strings"
+	texttemplate "text/template"
+	"time"
+
+	"golang.org/x/text/language"
+
+	"bearlysocial-backend/i18n"
+	"bearlysocial-backend/mailer"
+)
+
+// What an email is about. Every kind of email has its own data type, which names the templates it is rendered with.
+type Data interface {
+	Template() string
+}
+
+// The names of every email, for tools that render all of them.
+var Names = []string{"otp", "email_change", "account_deletion", "new_device", "meetup"}
+
+//go:embed templates
+var files embed.FS
+
+// The templates built into the server.
+var Default = mustParse(files)
+
+func mustParse(fsys embed.FS) *Templates {
+	sub, err := fs.Sub(fsys, "templates")
+	if err != nil {
+		panic(err)
+	}
+	t, err := Parse(sub)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// The parsed emails of every supported language.
+type Templates struct {
+	html map[language.Tag]map[string]*htmltemplate.Template
+	text map[language.Tag]map[string]*texttemplate.Template
+}
+
+// Parses every email in Names, in every supported language, from a template directory.
+func Parse(fsys fs.FS) (*Templates, error) {
+	t := &Templates{
+		html: make(map[language.Tag]map[string]*htmltemplate.Template),
+		text: make(map[language.Tag]map[string]*texttemplate.Template),
+	}
+	for _, tag := range i18n.Supported {
+		t.html[tag] = make(map[string]*htmltemplate.Template)
+		t.text[tag] = make(map[string]*texttemplate.Template)
+		funcs := funcMap(tag)
+
+		for _, name := range Names {
+			html := htmltemplate.New(name).Funcs(htmltemplate.FuncMap(funcs))
+			for _, file := range []string{"layout.html.tmpl", name + ".html.tmpl"} {
+				src, path, err := readFile(fsys, tag, file)
+				if err != nil {
+					return nil, err
+				}
+				if _, err := html.Parse(src); err != nil {
+					return nil, fmt.Errorf("emails: %s: %v", path, err)
+				}
+			}
+
+			text := texttemplate.New(name).Funcs(texttemplate.FuncMap(funcs))
+			for _, file := range []string{"layout.txt.tmpl", name + ".txt.tmpl"} {
+				src, path, err := readFile(fsys, tag, file)
+				if err != nil {
+					return nil, err
+				}
+				if _, err := text.Parse(src); err != nil {
+					return nil, fmt.Errorf("emails: %s: %v", path, err)
+				}
+			}
+			if text.Lookup("subject") == nil {
+				return nil, fmt.Errorf("emails: %s.txt.tmpl does not define \"subject\"", name)
+			}
+
+			t.html[tag][name] = html
+			t.text[tag][name] = text
+		}
+	}
+	return t, nil
+}
+
+// Reads the variant of a template file for the language, or the file itself if the language has none, and
+// returns which of the two it read.
+func readFile(fsys fs.FS, tag language.Tag, file string) (string, string, error) {
+	path := tag.String() + "/" + file
+	data, err := fs.ReadFile(fsys, path)
+	if errors.Is(err, fs.ErrNotExist) {
+		path = file
+		data, err = fs.ReadFile(fsys, path)
+	}
+	if err != nil {
+		return "", "", fmt.Errorf("emails: %v", err)
+	}
+	return string(data), path, nil
+}
+
+// Renders an email in the given language. The message has no recipient yet.
+func (t *Templates) Render(tag language.Tag, data Data) (mailer.Message, error) {
+	if _, ok := t.html[tag]; !ok {
+		tag = i18n.Supported[0]
+	}
+	name := data.Template()
+	html, ok := t.html[tag][name]
+	if !ok {
+		return mailer.Message{}, fmt.Errorf("emails: no email named %q", name)
+	}
+	text := t.text[tag][name]
+
+	var subject, textBody, htmlBody bytes.Buffer
+	if err := text.ExecuteTemplate(&subject, "subject", data); err != nil {
+		return mailer.Message{}, err
+	}
+	if err := text.ExecuteTemplate(&textBody, "layout", data); err != nil {
+		return mailer.Message{}, err
+	}
+	if err := html.ExecuteTemplate(&htmlBody, "layout", data); err != nil {
+		return mailer.Message{}, err
+	}
+
+	return mailer.Message{
+		// Subjects are a single line, however the template is laid out.
+		Subject: strings.Join(strings.Fields(subject.String()), " "),
+		Text:    textBody.String(),
+		HTML:    htmlBody.String(),
+	}, nil
+}
+
+// Renders an email with the built-in templates.
+func Render(tag language.Tag, data Data) (mailer.Message, error) {
+	return Default.Render(tag, data)
+}
+
+// The functions templates can call. They are bound to the language being rendered.
+//
+//	t       translates an English format and formats the arguments into it, as i18n.Sprintf
+//	tbold   like t, but sets the arguments in bold; only for HTML, where the result is not escaped again
+//	button  pairs a link the server built with its label, for the "button" template of the HTML layout
+//	lang    the language, for the lang attribute
+//	time    formats a time the same way in every language, with its time zone
+func funcMap(tag language.Tag) map[string]interface{} {
+	return map[string]interface{}{
+		"t": func(format string, args ...interface{}) string {
+			return i18n.Sprintf(tag, format, args...)
+		},
+		"tbold": func(format string, args ...interface{}) htmltemplate.HTML {
+			bold := make([]interface{}, len(args))
+			for i, arg := range args {
+				s := fmt.Sprint(arg)
+				if l, ok := arg.(i18n.Localizable); ok {
+					s = l.Localize(tag)
+				}
+				bold[i] = `<span style="font-weight: bold;">` + htmltemplate.HTMLEscapeString(s) + `</span>`
+			}
+			return htmltemplate.HTML(fmt.Sprintf(htmltemplate.HTMLEscapeString(i18n.Translate(tag, format)), bold...))
+		},
+		"button": func(url, label string) map[string]interface{} {
+			// Links may use an app scheme, which html/template would otherwise reject as unsafe.
+			return map[string]interface{}{"URL": htmltemplate.URL(url), "Label": label}
+		},
+		"lang": func() string {
+			return tag.String()
+		},
+		"time": func(t time.Time) string {
+			return t.Format("2006-01-02 15:04 MST")
+		},
+	}
+}
@@ -2,7 +2,11 @@ module bearlysocial-backend
 
 go 1.22
 
-require go.mongodb.org/mongo-driver v1.17.1
+require (
+	go.mongodb.org/mongo-driver v1.17.1
+	golang.org/x/net v0.28.0
+	golang.org/x/text v0.17.0
+)
 
 require (
 	github.com/golang/snappy v0.0.4 // indirect
@@ -14,5 +18,4 @@ require (
 	github.com/youmark/pkcs8 v0.0.0-20240726163527-a2c0da244d78 // indirect
 	golang.org/x/crypto v0.26.0 // indirect
 	golang.org/x/sync v0.8.0 // indirect
-	golang.org/x/text v0.17.0 // indirect
 )
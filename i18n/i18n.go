@@ -0,0 +1,186 @@
+// Package i18n translates user-facing text. Messages are looked up by their English text, so English needs no
+// catalog of messages and untranslated text falls back to English on its own.
+package i18n
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/text/feature/plural"
+	"golang.org/x/text/language"
+)
+
+// The header that carries the language a response is written in. Middleware sets it before any handler runs,
+// so whatever writes the response can find the language without the request.
+const Header = "Content-Language"
+
+// The languages with a catalog. The first is the fallback.
+var Supported = []language.Tag{language.English, language.Indonesian}
+
+var matcher = language.NewMatcher(Supported)
+
+// The translations of one language.
+type catalog struct {
+	// Formats of a count of something by plural form, e.g. "hour" → "one" → "%d hour".
+	Plurals map[string]map[string]string `json:"plurals"`
+
+	// Translations by English text. Formatting verbs must appear in the same order as in the English.
+	Messages map[string]string `json:"messages"`
+}
+
+//go:embed locales/*.json
+var locales embed.FS
+
+var catalogs = loadCatalogs()
+
+func loadCatalogs() map[language.Tag]*catalog {
+	catalogs := make(map[language.Tag]*catalog, len(Supported))
+	for _, tag := range Supported {
+		data, err := locales.ReadFile("locales/" + tag.String() + ".json")
+		if err != nil {
+			panic(err)
+		}
+		c := new(catalog)
+		if err := json.Unmarshal(data, c); err != nil {
+			panic(fmt.Sprintf("i18n: locales/%s.json: %v", tag, err))
+		}
+		catalogs[tag] = c
+	}
+	return catalogs
+}
+
+// Picks the supported language to talk to a user in: the best match for the Accept-Language header, or, if it
+// matches nothing, the first of the user's languages (ISO 639 codes, as in UserAccount.Langs) that does.
+// Falls back to English.
+func Negotiate(acceptLanguage string, langs []string) language.Tag {
+	if prefs, _, err := language.ParseAcceptLanguage(acceptLanguage); err == nil && len(prefs) > 0 {
+		if _, i, confidence := matcher.Match(prefs...); confidence != language.No {
+			return Supported[i]
+		}
+	}
+	for _, lang := range langs {
+		if tag, err := language.Parse(lang); err == nil {
+			if _, i, confidence := matcher.Match(tag); confidence != language.No {
+				return Supported[i]
+			}
+		}
+	}
+	return Supported[0]
+}
+
+// Returns the language set in the Content-Language header, or English if there is none.
+func FromHeader(h http.Header) language.Tag {
+	if tag, err := language.Parse(h.Get(Header)); err == nil {
+		if _, ok := catalogs[tag]; ok {
+			return tag
+		}
+	}
+	return Supported[0]
+}
+
+// Returns the translation of an English message.
+func Translate(tag language.Tag, message string) string {
+	if c, ok := catalogs[tag]; ok {
+		if translated, ok := c.Messages[message]; ok {
+			return translated
+		}
+	}
+	return message
+}
+
+// Something that reads differently in each language, such as a Duration. Sprintf spells out arguments that
+// implement it in the language of the text.
+type Localizable interface {
+	Localize(tag language.Tag) string
+}
+
+// Translates an English format and formats the arguments into it.
+func Sprintf(tag language.Tag, format string, args ...interface{}) string {
+	format = Translate(tag, format)
+	if len(args) == 0 {
+		return format
+	}
+
+	localized := make([]interface{}, len(args))
+	for i, arg := range args {
+		if l, ok := arg.(Localizable); ok {
+			arg = l.Localize(tag)
+		}
+		localized[i] = arg
+	}
+	return fmt.Sprintf(format, localized...)
+}
+
+// Formats a count of something, such as "3 hours", in the plural form the language needs for it.
+func Count(tag language.Tag, n int, unit string) string {
+	c, ok := catalogs[tag]
+	if !ok {
+		c = catalogs[Supported[0]]
+	}
+	forms := c.Plurals[unit]
+
+	format, ok := forms[formNames[plural.Cardinal.MatchPlural(tag, n, 0, 0, 0, 0)]]
+	if !ok {
+		format = forms["other"]
+	}
+	return fmt.Sprintf(format, n)
+}
+
+var formNames = map[plural.Form]string{
+	plural.Other: "other",
+	plural.Zero:  "zero",
+	plural.One:   "one",
+	plural.Two:   "two",
+	plural.Few:   "few",
+	plural.Many:  "many",
+}
+
+// A length of time to show to a user, such as how long an OTP stays valid.
+type Duration time.Duration
+
+var durationUnits = []struct {
+	name string
+	size time.Duration
+}{
+	{"day", 24 * time.Hour},
+	{"hour", time.Hour},
+	{"minute", time.Minute},
+	{"second", time.Second},
+}
+
+// Spells out the duration in its largest unit and, if it is not a whole number of those, the next one, as in
+// "1 hour 30 minutes". It is rounded up to the smaller unit, so "please wait" times are never too short.
+func (d Duration) Localize(tag language.Tag) string {
+	t := max(time.Duration(d), time.Second)
+
+	i := len(durationUnits) - 1
+	for j, unit := range durationUnits {
+		if t >= unit.size {
+			i = j
+			break
+		}
+	}
+	precision := durationUnits[min(i+1, len(durationUnits)-1)].size
+	t = (t + precision - 1).Truncate(precision)
+	// Rounding up may have carried over into a larger unit, as 59.5 seconds does into a minute.
+	for i > 0 && t >= durationUnits[i-1].size {
+		i--
+	}
+
+	unit := durationUnits[i]
+	parts := []string{Count(tag, int(t/unit.size), unit.name)}
+	if rest := t % unit.size; rest > 0 && i+1 < len(durationUnits) {
+		next := durationUnits[i+1]
+		parts = append(parts, Count(tag, int(rest/next.size), next.name))
+	}
+	return strings.Join(parts, " ")
+}
+
+// Spells out the duration in English, for logs.
+func (d Duration) String() string {
+	return d.Localize(Supported[0])
+}
@@ -0,0 +1,41 @@
+package mailer
+
+import (
+	"context"
+	"sync"
+)
+
+// Keeps sent messages in memory instead of delivering them, so tests can inspect what would have been sent.
+type CaptureMailer struct {
+	mu       sync.Mutex
+	messages []Message
+}
+
+func (c *CaptureMailer) Send(ctx context.Context, msg Message) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.messages = append(c.messages, msg)
+	return nil
+}
+
+// Returns a copy of every message sent so far, oldest first.
+func (c *CaptureMailer) Messages() []Message {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return append([]Message(nil), c.messages...)
+}
+
+// Returns the most recent message sent to the given address.
+func (c *CaptureMailer) Last(to string) (Message, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i := len(c.messages) - 1; i >= 0; i-- {
+		if c.messages[i].To == to {
+			return c.messages[i], true
+		}
+	}
+	return Message{}, false
+}
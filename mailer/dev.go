@@ -0,0 +1,37 @@
+package mailer
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Development mailer that never talks to a mail server. With Dir set, every message is written there as an
+// .eml file that any mail client can open; otherwise it is printed to the log.
+type DevMailer struct {
+	From mail.Address
+	Dir  string
+}
+
+func (d *DevMailer) Send(ctx context.Context, msg Message) error {
+	now := time.Now()
+	data, err := compose(d.From, msg, now)
+	if err != nil {
+		return err
+	}
+
+	if d.Dir == "" {
+		log.Printf("DEV MAIL:\n%s\n", data)
+		return nil
+	}
+
+	if err := os.MkdirAll(d.Dir, 0755); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s_%d.eml", now.Format("2006-01-02_15-04-05"), now.UnixNano())
+	return os.WriteFile(filepath.Join(d.Dir, name), data, 0644)
+}
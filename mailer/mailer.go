@@ -0,0 +1,153 @@
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"strings"
+	"time"
+)
+
+// An outgoing email with a plain-text body and an optional HTML alternative.
+type Message struct {
+	To      string
+	Subject string
+	Text    string
+	HTML    string
+}
+
+// Delivers messages. Implementations must be safe for concurrent use.
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// Builds a mailer from environment variables. MAILER selects the implementation: "smtp" (default) or "dev".
+func NewFromEnv() (Mailer, error) {
+	from := mail.Address{Name: os.Getenv("SENDER_NAME"), Address: os.Getenv("SENDER_EMAIL")}
+	if from.Name == "" {
+		from.Name = "BearlySocial"
+	}
+
+	switch os.Getenv("MAILER") {
+	case "", "smtp":
+		host := os.Getenv("SMTP_HOST")
+		port := os.Getenv("SMTP_PORT")
+		if host == "" || port == "" || from.Address == "" {
+			return nil, fmt.Errorf("SMTP_HOST, SMTP_PORT and SENDER_EMAIL must be set")
+		}
+
+		mode := TLSMode(os.Getenv("SMTP_TLS"))
+		if mode == "" {
+			mode = StartTLS
+			if port == "465" {
+				mode = ImplicitTLS
+			}
+		}
+		if mode != StartTLS && mode != ImplicitTLS {
+			return nil, fmt.Errorf("unknown SMTP_TLS mode %q", mode)
+		}
+
+		return &SMTPMailer{
+			Host:     host,
+			Port:     port,
+			Username: from.Address,
+			Password: os.Getenv("EMAIL_PASSKEY"),
+			From:     from,
+			TLS:      mode,
+		}, nil
+	case "dev":
+		if from.Address == "" {
+			from.Address = "no-reply@localhost"
+		}
+		return &DevMailer{From: from, Dir: os.Getenv("MAIL_DIR")}, nil
+	default:
+		return nil, fmt.Errorf("unknown MAILER %q", os.Getenv("MAILER"))
+	}
+}
+
+// Renders msg as an RFC 5322 message with a multipart/alternative body.
+func compose(from mail.Address, msg Message, now time.Time) ([]byte, error) {
+	to, err := mail.ParseAddress(msg.To)
+	if err != nil {
+		return nil, fmt.Errorf("invalid recipient %q: %w", msg.To, err)
+	}
+
+	messageID, err := newMessageID(from.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	var body bytes.Buffer
+	parts := multipart.NewWriter(&body)
+
+	// Plain text goes first so clients that prefer the last alternative pick the HTML version.
+	if err := writePart(parts, "text/plain; charset=UTF-8", msg.Text); err != nil {
+		return nil, err
+	}
+	if msg.HTML != "" {
+		if err := writePart(parts, "text/html; charset=UTF-8", msg.HTML); err != nil {
+			return nil, err
+		}
+	}
+	if err := parts.Close(); err != nil {
+		return nil, err
+	}
+
+	// mail.Address.String and mime.QEncoding take care of RFC 2047 encoding non-ASCII names and subjects.
+	var out bytes.Buffer
+	headers := [][2]string{
+		{"From", from.String()},
+		{"To", to.String()},
+		{"Subject", mime.QEncoding.Encode("UTF-8", msg.Subject)},
+		{"Date", now.Format(time.RFC1123Z)},
+		{"Message-ID", messageID},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", mime.FormatMediaType("multipart/alternative", map[string]string{"boundary": parts.Boundary()})},
+	}
+	for _, header := range headers {
+		fmt.Fprintf(&out, "%s: %s\r\n", header[0], header[1])
+	}
+	out.WriteString("\r\n")
+	out.Write(body.Bytes())
+
+	return out.Bytes(), nil
+}
+
+func writePart(parts *multipart.Writer, contentType, content string) error {
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Type", contentType)
+	header.Set("Content-Transfer-Encoding", "quoted-printable")
+
+	part, err := parts.CreatePart(header)
+	if err != nil {
+		return err
+	}
+
+	qp := quotedprintable.NewWriter(part)
+	if _, err := qp.Write([]byte(content)); err != nil {
+		return err
+	}
+	return qp.Close()
+}
+
+// Generates a globally unique Message-ID under the sender's domain.
+func newMessageID(sender string) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	domain := "localhost"
+	if at := strings.LastIndex(sender, "@"); at >= 0 {
+		domain = sender[at+1:]
+	}
+	return fmt.Sprintf("<%d.%s@%s>", time.Now().UnixNano(), hex.EncodeToString(b), domain), nil
+}
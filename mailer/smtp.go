@@ -0,0 +1,102 @@
+package mailer
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"time"
+)
+
+// How the connection to the SMTP server is secured.
+type TLSMode string
+
+const (
+	// Connect in plain text and upgrade with STARTTLS (usually port 587). The upgrade is mandatory.
+	StartTLS TLSMode = "starttls"
+	// Speak TLS from the first byte (usually port 465).
+	ImplicitTLS TLSMode = "implicit"
+)
+
+// Sends mail through an authenticated SMTP server.
+type SMTPMailer struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	From     mail.Address
+	TLS      TLSMode
+}
+
+func (s *SMTPMailer) Send(ctx context.Context, msg Message) error {
+	data, err := compose(s.From, msg, time.Now())
+	if err != nil {
+		return err
+	}
+
+	conn, err := s.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// Bound the whole SMTP conversation by the caller's deadline.
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	client, err := smtp.NewClient(conn, s.Host)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	if s.TLS == StartTLS {
+		if err := client.StartTLS(&tls.Config{ServerName: s.Host}); err != nil {
+			return err
+		}
+	}
+
+	if s.Password != "" {
+		if err := client.Auth(smtp.PlainAuth("", s.Username, s.Password, s.Host)); err != nil {
+			return err
+		}
+	}
+
+	if err := client.Mail(s.From.Address); err != nil {
+		return err
+	}
+	to, err := mail.ParseAddress(msg.To)
+	if err != nil {
+		return err
+	}
+	if err := client.Rcpt(to.Address); err != nil {
+		return err
+	}
+
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	return client.Quit()
+}
+
+func (s *SMTPMailer) dial(ctx context.Context) (net.Conn, error) {
+	addr := net.JoinHostPort(s.Host, s.Port)
+
+	if s.TLS == ImplicitTLS {
+		dialer := &tls.Dialer{Config: &tls.Config{ServerName: s.Host}}
+		return dialer.DialContext(ctx, "tcp", addr)
+	}
+
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, "tcp", addr)
+}
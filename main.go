@@ -5,36 +5,319 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
 
 	"bearlysocial-backend/api/handler"
 	"bearlysocial-backend/api/middleware"
+	"bearlysocial-backend/api/model"
+	"bearlysocial-backend/api/repository"
+	"bearlysocial-backend/api/router"
+	"bearlysocial-backend/emailaddr"
+	"bearlysocial-backend/mailer"
+	"bearlysocial-backend/oidc"
 	"bearlysocial-backend/util"
+	"bearlysocial-backend/webauthn"
 )
 
 func main() {
 	// Initialize environment.
 	util.LoadEnv()
 
-	// Initialize MongoDB.
-	util.InitMongoDB()
-	defer func() {
-		if util.MongoClient != nil {
-			if err := util.MongoClient.Disconnect(context.Background()); err != nil {
-				fmt.Println("ERROR DISCONNECTING FROM MongoDB:", err)
+	// Initialize storage. STORAGE=memory keeps everything in process memory, which is handy for local development.
+	var users repository.UserAccounts
+	var sessions repository.Sessions
+	var rateLimits repository.RateLimits
+	var challenges repository.Challenges
+	if os.Getenv("STORAGE") == "memory" {
+		users = repository.NewMemoryUserAccounts()
+		sessions = repository.NewMemorySessions()
+		rateLimits = repository.NewMemoryRateLimits()
+		challenges = repository.NewMemoryChallenges()
+		fmt.Println("Using in-memory storage.")
+	} else {
+		util.InitMongoDB()
+		defer func() {
+			if util.MongoClient != nil {
+				if err := util.MongoClient.Disconnect(context.Background()); err != nil {
+					fmt.Println("ERROR DISCONNECTING FROM MongoDB:", err)
+				}
+			}
+		}()
+
+		// Collections other than the accounts collection can be renamed through the environment.
+		collection := func(key, fallback string) *mongo.Collection {
+			name := os.Getenv(key)
+			if name == "" {
+				name = fallback
 			}
+			return util.MongoDatabase.Collection(name)
+		}
+
+		mongoUsers := repository.NewMongoUserAccounts(util.MongoCollection)
+		mongoSessions := repository.NewMongoSessions(collection("MONGO_SESSIONS_COLLECTION", "sessions"))
+		mongoRateLimits := repository.NewMongoRateLimits(collection("MONGO_RATE_LIMITS_COLLECTION", "rate_limits"))
+		mongoChallenges := repository.NewMongoChallenges(collection("MONGO_CHALLENGES_COLLECTION", "challenges"))
+
+		indexCtx, cancelIndex := context.WithTimeout(context.Background(), time.Minute)
+		for _, repo := range []interface{ EnsureIndexes(context.Context) error }{
+			mongoUsers, mongoSessions, mongoRateLimits, mongoChallenges,
+		} {
+			if err := repo.EnsureIndexes(indexCtx); err != nil {
+				fmt.Println("ERROR CREATING MongoDB INDEXES:", err)
+				os.Exit(1)
+			}
+		}
+		cancelIndex()
+
+		users = mongoUsers
+		sessions = mongoSessions
+		rateLimits = mongoRateLimits
+		challenges = mongoChallenges
+	}
+
+	// Initialize mailer.
+	mail, err := mailer.NewFromEnv()
+	if err != nil {
+		fmt.Println("ERROR CONFIGURING MAILER:", err)
+		os.Exit(1)
+	}
+
+	// OTPs are stored as an HMAC under this secret.
+	otpSecret := []byte(os.Getenv("OTP_SECRET"))
+	if len(otpSecret) < 32 {
+		fmt.Println("OTP_SECRET must be set to at least 32 characters in .env file.")
+		os.Exit(1)
+	}
+
+	otpPolicy, err := util.OTPPolicyFromEnv()
+	if err != nil {
+		fmt.Println("ERROR CONFIGURING OTP POLICY:", err)
+		os.Exit(1)
+	}
+
+	oidcProviders, err := oidc.ProvidersFromEnv()
+	if err != nil {
+		fmt.Println("ERROR CONFIGURING SIGN-IN PROVIDERS:", err)
+		os.Exit(1)
+	}
+	oidcRedirectURL := os.Getenv("OIDC_REDIRECT_URL")
+	if len(oidcProviders) > 0 && oidcRedirectURL == "" {
+		fmt.Println("OIDC_REDIRECT_URL must be set in .env file when a sign-in provider is configured.")
+		os.Exit(1)
+	}
+
+	blockedDomains, err := emailaddr.BlocklistFromEnv()
+	if err != nil {
+		fmt.Println("ERROR LOADING EMAIL DOMAIN BLOCKLIST:", err)
+		os.Exit(1)
+	}
+
+	totpIssuer := os.Getenv("TOTP_ISSUER")
+	if totpIssuer == "" {
+		totpIssuer = "BearlySocial"
+	}
+
+	// Give accounts from before addresses were stored apart from the ID their address, which was the ID.
+	migrateCtx, cancelMigrate := context.WithTimeout(context.Background(), time.Minute)
+	migrated, err := users.FillEmails(migrateCtx)
+	cancelMigrate()
+	if err != nil {
+		fmt.Println("ERROR FILLING EMAIL ADDRESSES:", err)
+		os.Exit(1)
+	}
+	if migrated > 0 {
+		fmt.Printf("Filled %d email address(es).\n", migrated)
+	}
+
+	// Rewrite OTPs that were issued before hashing was introduced.
+	migrateCtx, cancelMigrate = context.WithTimeout(context.Background(), time.Minute)
+	migrated, err = users.HashPlaintextOTPs(migrateCtx, func(id, otp string) string {
+		return util.HashOTP(otpSecret, id, otp)
+	})
+	cancelMigrate()
+	if err != nil {
+		fmt.Println("ERROR HASHING PLAINTEXT OTPs:", err)
+		os.Exit(1)
+	}
+	if migrated > 0 {
+		fmt.Printf("Hashed %d plaintext OTP(s).\n", migrated)
+	}
+
+	sessionLifetime := util.GetEnvDuration("SESSION_LIFETIME", 90 * 24 * time.Hour)
+
+	// Move tokens that still live on accounts into the sessions collection, one session per account. Legacy
+	// "email::hashpass" tokens are stored by digest like every other token, so they keep working.
+	migrateCtx, cancelMigrate = context.WithTimeout(context.Background(), time.Minute)
+	migrated, err = users.MoveTokens(migrateCtx, func(id, token string) error {
+		tokenHash := token
+		if strings.Contains(token, "::") {
+			tokenHash = util.HashToken(strings.ToLower(token))
+		}
+
+		sessionID, err := util.GenerateID()
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		err = sessions.Create(migrateCtx, model.Session{
+			ID: sessionID,
+			UserID: id,
+			AccessTokenHash: tokenHash,
+			AccessExpiryTime: now.Add(sessionLifetime).UnixMilli(), // Legacy clients cannot refresh.
+			DeviceLabel: "Legacy session",
+			CreatedAt: now.UnixMilli(),
+			LastSeenAt: now.UnixMilli(),
+			ExpiryTime: now.Add(sessionLifetime).UnixMilli(),
+		})
+		if err == repository.ErrDuplicate {
+			return nil // Moved by an earlier, interrupted run.
 		}
-	}()
+		return err
+	})
+	cancelMigrate()
+	if err != nil {
+		fmt.Println("ERROR MOVING TOKENS TO SESSIONS:", err)
+		os.Exit(1)
+	}
+	if migrated > 0 {
+		fmt.Printf("Moved %d token(s) to sessions.\n", migrated)
+	}
+
+	// Sessions created before access/refresh pairs keep their single token as a long-lived access token.
+	migrateCtx, cancelMigrate = context.WithTimeout(context.Background(), time.Minute)
+	migrated, err = sessions.MigrateSingleTokens(migrateCtx)
+	cancelMigrate()
+	if err != nil {
+		fmt.Println("ERROR MIGRATING SESSIONS:", err)
+		os.Exit(1)
+	}
+	if migrated > 0 {
+		fmt.Printf("Migrated %d single-token session(s).\n", migrated)
+	}
+
+	// Give accounts whose ID is still their email address a generated one, so that addresses stay out of
+	// tokens and logs and can be changed. Sessions and challenges follow the account to its new ID.
+	migrateCtx, cancelMigrate = context.WithTimeout(context.Background(), 10 * time.Minute)
+	migrated, err = users.MoveToGeneratedIDs(
+		migrateCtx,
+		util.GenerateUserID,
+		func(oldID string, user_acc *model.UserAccount) error {
+			return handler.RebindAccount(otpSecret, oldID, user_acc)
+		},
+		func(oldID, newID string) error {
+			if _, err := sessions.ChangeUserID(migrateCtx, oldID, newID); err != nil {
+				return err
+			}
+			_, err := challenges.ChangeUserID(migrateCtx, oldID, newID)
+			return err
+		},
+	)
+	cancelMigrate()
+	if err != nil {
+		fmt.Println("ERROR MOVING ACCOUNTS TO GENERATED IDs:", err)
+		os.Exit(1)
+	}
+	if migrated > 0 {
+		fmt.Printf("Moved %d account(s) to generated IDs.\n", migrated)
+	}
+
+	h := &handler.Handler{
+		Users: users,
+		Sessions: sessions,
+		Mailer: mail,
+		RateLimits: rateLimits,
+		OTPRequestLimits: handler.OTPRequestLimits{
+			PerIP: bucketFromEnv("OTP_RATE_LIMIT_IP", 10, time.Hour),
+			PerEmail: bucketFromEnv("OTP_RATE_LIMIT_EMAIL", 5, time.Hour),
+			Global: bucketFromEnv("OTP_RATE_LIMIT_GLOBAL", 1000, time.Hour),
+		},
+		ClientIPHeader: os.Getenv("CLIENT_IP_HEADER"),
+		BlockedDomains: blockedDomains,
+		OTPSecret: otpSecret,
+		OTPPolicy: otpPolicy,
+		MagicLinkURL: os.Getenv("MAGIC_LINK_URL"),
+		TOTPIssuer: totpIssuer,
+		SecondFactorLimit: bucketFromEnv("MFA_RATE_LIMIT", 5, 15 * time.Minute),
+		SignInLimit: bucketFromEnv("SIGN_IN_RATE_LIMIT_IP", 30, time.Hour),
+		Challenges: challenges,
+		WebAuthn: webAuthnFromEnv(),
+		OIDCProviders: oidcProviders,
+		OIDCRedirectURL: oidcRedirectURL,
+		SessionLifetime: sessionLifetime,
+		IdleTimeout: util.GetEnvDuration("SESSION_IDLE_TIMEOUT", 14 * 24 * time.Hour),
+		AccessTokenLifetime: util.GetEnvDuration("ACCESS_TOKEN_LIFETIME", 15 * time.Minute),
+		RotationGrace: util.GetEnvDuration("TOKEN_ROTATION_GRACE", 30 * time.Second),
+		DeletionGracePeriod: util.GetEnvDuration("ACCOUNT_DELETION_GRACE_PERIOD", 30 * 24 * time.Hour),
+	}
+	auth := middleware.ValidateToken(users, sessions, h.SessionLimits())
+
+	// Hard-delete accounts whose deletion grace period has passed and purge expired sessions.
+	sweepCtx, stopSweep := context.WithCancel(context.Background())
+	defer stopSweep()
+	go h.Sweep(sweepCtx, util.GetEnvDuration("SWEEP_INTERVAL", time.Hour))
+
+	// Routes are grouped by the middleware they run; the router answers wrong methods and OPTIONS itself.
+	routes := router.New(middleware.RequestID, middleware.Language)
+	public := routes.Group("")
+	protected := routes.Group("", auth)
 
 	// Public endpoints for requesting and validating one-time passwords.
-	http.HandleFunc("/request-otp", handler.RequestOTP)
-	http.HandleFunc("/validate-otp", handler.ValidateOTP)
+	public.HandleFunc(http.MethodPost, "/request-otp", h.RequestOTP)
+	public.HandleFunc(http.MethodPost, "/validate-otp", h.ValidateOTP)
+	public.HandleFunc(http.MethodPost, "/confirm-magic-link", h.ConfirmMagicLink)
+
+	// Sign-in with Google, Apple and other OpenID Connect providers, available once one is configured.
+	if len(h.OIDCProviders) > 0 {
+		public.HandleFunc(http.MethodPost, "/begin-oidc-login", h.BeginOIDCLogin)
+		public.HandleFunc(http.MethodPost, "/finish-oidc-login", h.FinishOIDCLogin)
+	}
+
+	// Second sign-in step for accounts with an authenticator app.
+	public.HandleFunc(http.MethodPost, "/verify-mfa", h.VerifyMFA)
+
+	// Passkey endpoints, available once a relying party is configured.
+	if h.WebAuthn != nil {
+		public.HandleFunc(http.MethodPost, "/begin-passkey-login", h.BeginPasskeyLogin)
+		public.HandleFunc(http.MethodPost, "/finish-passkey-login", h.FinishPasskeyLogin)
+		protected.HandleFunc(http.MethodPost, "/begin-passkey-registration", h.BeginPasskeyRegistration)
+		protected.HandleFunc(http.MethodPost, "/finish-passkey-registration", h.FinishPasskeyRegistration)
+		protected.HandleFunc(http.MethodGet, "/passkeys", h.ListPasskeys)
+		protected.HandleFunc(http.MethodDelete, "/passkeys/{id}", h.RemovePasskey)
+	}
+
+	// Public endpoint for exchanging a refresh token for a new token pair.
+	public.HandleFunc(http.MethodPost, "/refresh-token", h.RefreshToken)
 
 	// Protected endpoints that require a valid token for access.
-	http.Handle("/update-session", middleware.ValidateToken(http.HandlerFunc(handler.UpdateSession)))
+	protected.HandleFunc(http.MethodGet, "/update-session", h.UpdateSession)
+	protected.HandleFunc(http.MethodPatch, "/update-profile", h.UpdateProfile)
+	protected.HandleFunc(http.MethodDelete, "/delete-account", h.DeleteAccount)
+	protected.HandleFunc(http.MethodGet, "/sessions", h.ListSessions)
+	protected.HandleFunc(http.MethodPost, "/revoke-session", h.RevokeSession)
+	protected.HandleFunc(http.MethodPost, "/revoke-other-sessions", h.RevokeOtherSessions)
+	protected.HandleFunc(http.MethodPost, "/begin-totp-enrollment", h.BeginTOTPEnrollment)
+	protected.HandleFunc(http.MethodPost, "/confirm-totp-enrollment", h.ConfirmTOTPEnrollment)
+	protected.HandleFunc(http.MethodPost, "/regenerate-recovery-codes", h.RegenerateRecoveryCodes)
+	protected.HandleFunc(http.MethodPost, "/disable-totp", h.DisableTOTP)
+	protected.HandleFunc(http.MethodPost, "/begin-email-change", h.BeginEmailChange)
+	protected.HandleFunc(http.MethodPost, "/confirm-email-change", h.ConfirmEmailChange)
+	protected.HandleFunc(http.MethodPost, "/logout", h.Logout)
+	protected.HandleFunc(http.MethodPost, "/logout-everywhere", h.LogoutEverywhere)
 	// Others...
 
-	// Benchmark endpoint for performance testing and diagnostics.
-	http.HandleFunc("/benchmark", handler.Benchmark)
+	// Operator endpoints under /admin, available once ADMIN_API_KEY is set. Requests carry it in X-Admin-Key.
+	if adminKey := os.Getenv("ADMIN_API_KEY"); adminKey != "" {
+		admin := routes.Group("/admin", middleware.RequireAdminKey(adminKey))
+
+		// Benchmark endpoint for performance testing and diagnostics; it exercises MongoDB directly.
+		if util.MongoCollection != nil {
+			admin.HandleFunc(http.MethodGet, "/benchmark", handler.Benchmark)
+		}
+	}
 
 	// Start server.
 	port := os.Getenv("PORT")
@@ -44,6 +327,7 @@ func main() {
 
 	server := &http.Server{
 		Addr: fmt.Sprintf(":%s", port),
+		Handler: routes,
 	}
 
 	fmt.Printf("Starting server on port %s.\n", port)
@@ -51,3 +335,36 @@ func main() {
 		fmt.Println("ERROR STARTING SERVER:", err)
 	}
 }
+
+// Reads a rate such as "5/1h" from the environment as a token bucket that allows a burst of 5 and then one
+// more every 12 minutes.
+func bucketFromEnv(key string, fallbackCount int64, fallbackPer time.Duration) repository.Bucket {
+	count, per := util.GetEnvRate(key, fallbackCount, fallbackPer)
+	return repository.Bucket{
+		Capacity: count,
+		RefillInterval: max(per.Milliseconds() / count, 1),
+	}
+}
+
+// Reads the passkey relying party from WEBAUTHN_RP_ID, WEBAUTHN_RP_NAME and WEBAUTHN_ORIGINS (comma-separated,
+// defaulting to the RP ID's https origin). Returns nil, which disables passkeys, if no RP ID is set.
+func webAuthnFromEnv() *webauthn.Config {
+	rpID := os.Getenv("WEBAUTHN_RP_ID")
+	if rpID == "" {
+		return nil
+	}
+
+	config := &webauthn.Config{RPID: rpID, RPName: os.Getenv("WEBAUTHN_RP_NAME")}
+	if config.RPName == "" {
+		config.RPName = "BearlySocial"
+	}
+	for _, origin := range strings.Split(os.Getenv("WEBAUTHN_ORIGINS"), ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			config.Origins = append(config.Origins, origin)
+		}
+	}
+	if len(config.Origins) == 0 {
+		config.Origins = []string{"https://" + rpID}
+	}
+	return config
+}
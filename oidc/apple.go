@@ -0,0 +1,47 @@
+package oidc
+
+import (
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"time"
+)
+
+const appleIssuer = "https://appleid.apple.com"
+
+// How long each Apple client secret is valid. Apple accepts up to six months; a fresh one per exchange keeps
+// a leaked secret short-lived.
+const appleClientSecretLifetime = 5 * time.Minute
+
+// Builds the client secret Apple's token endpoint expects: a JWT signed with a Sign in with Apple key of the
+// team, naming the Services ID as its subject.
+func AppleClientSecret(teamID, keyID, clientID string, key *ecdsa.PrivateKey) func() (string, error) {
+	return func() (string, error) {
+		now := time.Now()
+		return signJWT(key, keyID, map[string]interface{}{
+			"iss": teamID,
+			"iat": now.Unix(),
+			"exp": now.Add(appleClientSecretLifetime).Unix(),
+			"aud": appleIssuer,
+			"sub": clientID,
+		})
+	}
+}
+
+// Reads the .p8 key file Apple hands out for Sign in with Apple: a PKCS #8 P-256 key in PEM form.
+func ParseApplePrivateKey(data []byte) (*ecdsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data in Apple private key")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	ecKey, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("Apple private key is a %T, not an ECDSA key", key)
+	}
+	return ecKey, nil
+}
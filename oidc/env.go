@@ -0,0 +1,65 @@
+package oidc
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+)
+
+const googleIssuer = "https://accounts.google.com"
+
+// Builds the providers configured in the environment, keyed by name.
+//
+// Google is enabled by OIDC_GOOGLE_CLIENT_ID and OIDC_GOOGLE_CLIENT_SECRET. Apple is enabled by
+// OIDC_APPLE_CLIENT_ID (the Services ID), OIDC_APPLE_TEAM_ID, OIDC_APPLE_KEY_ID and OIDC_APPLE_PRIVATE_KEY_FILE
+// (the .p8 file). OIDC_GOOGLE_ISSUER and OIDC_APPLE_ISSUER point a provider elsewhere, e.g. at a MockProvider.
+func ProvidersFromEnv() (map[string]*Provider, error) {
+	providers := make(map[string]*Provider)
+
+	if clientID := os.Getenv("OIDC_GOOGLE_CLIENT_ID"); clientID != "" {
+		secret := os.Getenv("OIDC_GOOGLE_CLIENT_SECRET")
+		if secret == "" {
+			return nil, fmt.Errorf("OIDC_GOOGLE_CLIENT_SECRET must be set along with OIDC_GOOGLE_CLIENT_ID")
+		}
+		providers["google"] = &Provider{
+			Name:          "google",
+			Issuer:        envOr("OIDC_GOOGLE_ISSUER", googleIssuer),
+			IssuerAliases: []string{"accounts.google.com"}, // Google still issues some tokens without the scheme.
+			ClientID:      clientID,
+			ClientSecret:  StaticClientSecret(secret),
+		}
+	}
+
+	if clientID := os.Getenv("OIDC_APPLE_CLIENT_ID"); clientID != "" {
+		teamID, keyID, keyFile := os.Getenv("OIDC_APPLE_TEAM_ID"), os.Getenv("OIDC_APPLE_KEY_ID"), os.Getenv("OIDC_APPLE_PRIVATE_KEY_FILE")
+		if teamID == "" || keyID == "" || keyFile == "" {
+			return nil, fmt.Errorf("OIDC_APPLE_TEAM_ID, OIDC_APPLE_KEY_ID and OIDC_APPLE_PRIVATE_KEY_FILE must be set along with OIDC_APPLE_CLIENT_ID")
+		}
+		data, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		key, err := ParseApplePrivateKey(data)
+		if err != nil {
+			return nil, err
+		}
+
+		providers["apple"] = &Provider{
+			Name:         "apple",
+			Issuer:       envOr("OIDC_APPLE_ISSUER", appleIssuer),
+			ClientID:     clientID,
+			ClientSecret: AppleClientSecret(teamID, keyID, clientID, key),
+			// Apple only releases the email address to a form post, never to a query-string redirect.
+			AuthParams: url.Values{"response_mode": {"form_post"}},
+		}
+	}
+
+	return providers, nil
+}
+
+func envOr(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
@@ -0,0 +1,277 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	// How long fetched keys are used before they are fetched again.
+	keysTTL = time.Hour
+
+	// Least time between fetches caused by tokens naming a key that is not known. Providers publish new keys
+	// ahead of using them, so a miss is either a fresh rotation or a forged token, and the latter must not be
+	// able to make this service hammer the provider.
+	keysRefetchInterval = time.Minute
+
+	// Clock difference tolerated when checking token times.
+	clockSkew = time.Minute
+)
+
+// What this service learns from a verified ID token.
+type Claims struct {
+	// The user's stable identifier at the provider; unlike the email address it never changes.
+	Subject string
+	Email   string
+	// Whether the provider vouches that the user controls Email.
+	EmailVerified bool
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// An "aud" claim, which may be a single string or a list.
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*a = list
+	return nil
+}
+
+type idTokenClaims struct {
+	Issuer   string   `json:"iss"`
+	Audience audience `json:"aud"`
+	// Authorized party; when present it must be this client.
+	AuthorizedParty string  `json:"azp"`
+	Subject         string  `json:"sub"`
+	ExpiresAt       float64 `json:"exp"`
+	IssuedAt        float64 `json:"iat"`
+	Nonce           string  `json:"nonce"`
+	Email           string  `json:"email"`
+	// A boolean at Google, the string "true" or "false" at Apple.
+	EmailVerified interface{} `json:"email_verified"`
+}
+
+// One entry of a JSON Web Key Set (RFC 7517), limited to the key types providers sign ID tokens with.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// Checks an ID token's signature against the provider's keys, its issuer, audience and lifetime, and that it
+// carries the nonce the sign-in started with. Only RS256 and ES256 are accepted, so a token can never pick
+// "none" or a symmetric algorithm for itself.
+func (p *Provider) VerifyIDToken(ctx context.Context, rawIDToken, nonce string, now time.Time) (Claims, error) {
+	parts := strings.Split(rawIDToken, ".")
+	if len(parts) != 3 {
+		return Claims{}, fmt.Errorf("%w: %s: malformed ID token", ErrVerification, p.Name)
+	}
+	rawHeader, err1 := base64.RawURLEncoding.DecodeString(parts[0])
+	rawClaims, err2 := base64.RawURLEncoding.DecodeString(parts[1])
+	sig, err3 := base64.RawURLEncoding.DecodeString(parts[2])
+	if err1 != nil || err2 != nil || err3 != nil {
+		return Claims{}, fmt.Errorf("%w: %s: malformed ID token", ErrVerification, p.Name)
+	}
+
+	var header jwtHeader
+	if err := json.Unmarshal(rawHeader, &header); err != nil {
+		return Claims{}, fmt.Errorf("%w: %s: malformed ID token header", ErrVerification, p.Name)
+	}
+	if header.Alg != "RS256" && header.Alg != "ES256" {
+		return Claims{}, fmt.Errorf("%w: %s: unsupported algorithm %q", ErrVerification, p.Name, header.Alg)
+	}
+
+	key, err := p.key(ctx, header.Kid, now)
+	if err != nil {
+		return Claims{}, err
+	}
+	if !verifySignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), sig) {
+		return Claims{}, fmt.Errorf("%w: %s: bad signature", ErrVerification, p.Name)
+	}
+
+	// The claims are only looked at once the signature holds.
+	var claims idTokenClaims
+	if err := json.Unmarshal(rawClaims, &claims); err != nil {
+		return Claims{}, fmt.Errorf("%w: %s: malformed ID token claims", ErrVerification, p.Name)
+	}
+
+	switch {
+	case claims.Issuer != p.Issuer && !slices.Contains(p.IssuerAliases, claims.Issuer):
+		return Claims{}, fmt.Errorf("%w: %s: issuer %q", ErrVerification, p.Name, claims.Issuer)
+	case !slices.Contains(claims.Audience, p.ClientID):
+		return Claims{}, fmt.Errorf("%w: %s: token is for another client", ErrVerification, p.Name)
+	case claims.AuthorizedParty != "" && claims.AuthorizedParty != p.ClientID:
+		return Claims{}, fmt.Errorf("%w: %s: token was issued to another client", ErrVerification, p.Name)
+	case time.Unix(int64(claims.ExpiresAt), 0).Add(clockSkew).Before(now):
+		return Claims{}, fmt.Errorf("%w: %s: token expired", ErrVerification, p.Name)
+	case time.Unix(int64(claims.IssuedAt), 0).Add(-clockSkew).After(now):
+		return Claims{}, fmt.Errorf("%w: %s: token issued in the future", ErrVerification, p.Name)
+	case !hmac.Equal([]byte(claims.Nonce), []byte(nonce)) || nonce == "":
+		return Claims{}, fmt.Errorf("%w: %s: nonce mismatch", ErrVerification, p.Name)
+	case claims.Subject == "":
+		return Claims{}, fmt.Errorf("%w: %s: token without subject", ErrVerification, p.Name)
+	}
+
+	return Claims{
+		Subject:       claims.Subject,
+		Email:         claims.Email,
+		EmailVerified: claims.EmailVerified == true || claims.EmailVerified == "true",
+	}, nil
+}
+
+// Returns the provider's signing key with the given ID, fetching the key set when it is stale or, at most once
+// per keysRefetchInterval, when the key is not in it.
+func (p *Provider) key(ctx context.Context, kid string, now time.Time) (crypto.PublicKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	fresh := now.Sub(p.keysFetchedAt) < keysTTL
+	if key, ok := p.keys[kid]; ok && fresh {
+		return key, nil
+	}
+	if fresh && now.Sub(p.keysFetchedAt) < keysRefetchInterval {
+		return nil, fmt.Errorf("%w: %s: unknown key %q", ErrVerification, p.Name, kid)
+	}
+
+	md, err := p.discoverLocked(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := p.getJSON(ctx, md.JWKSURI, &set); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		// Keys of other types or on other curves are skipped rather than failing the whole set.
+		if key, err := parseJWK(k); err == nil {
+			keys[k.Kid] = key
+		}
+	}
+	p.keys = keys
+	p.keysFetchedAt = now
+
+	if key, ok := keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("%w: %s: unknown key %q", ErrVerification, p.Name, kid)
+}
+
+func parseJWK(k jwk) (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err1 := base64.RawURLEncoding.DecodeString(k.N)
+		e, err2 := base64.RawURLEncoding.DecodeString(k.E)
+		if err1 != nil || err2 != nil || len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return nil, fmt.Errorf("bad RSA key") // Fewer than 2048 bits, or odd exponent.
+		}
+		exp := int(new(big.Int).SetBytes(e).Int64())
+		if exp < 3 || exp%2 == 0 {
+			return nil, fmt.Errorf("bad RSA exponent")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: exp}, nil
+
+	case "EC":
+		x, err1 := base64.RawURLEncoding.DecodeString(k.X)
+		y, err2 := base64.RawURLEncoding.DecodeString(k.Y)
+		if k.Crv != "P-256" || err1 != nil || err2 != nil || len(x) != 32 || len(y) != 32 {
+			return nil, fmt.Errorf("bad EC key")
+		}
+		// Let crypto/ecdh reject points that are not on the curve before the key is ever used.
+		if _, err := ecdh.P256().NewPublicKey(append(append([]byte{4}, x...), y...)); err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+// Checks a JWS signature. ES256 signatures are the raw 64-byte r||s form JWS uses, not ASN.1.
+func verifySignature(alg string, key crypto.PublicKey, signed, sig []byte) bool {
+	digest := sha256.Sum256(signed)
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		return alg == "RS256" && rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig) == nil
+	case *ecdsa.PublicKey:
+		if alg != "ES256" || len(sig) != 64 {
+			return false
+		}
+		r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+		return ecdsa.Verify(key, digest[:], r, s)
+	}
+	return false
+}
+
+// Signs a JWT with an RSA (RS256) or P-256 (ES256) key. Used for Apple's client secret and by MockProvider.
+func signJWT(key crypto.Signer, kid string, claims interface{}) (string, error) {
+	alg := "RS256"
+	if _, ok := key.(*ecdsa.PrivateKey); ok {
+		alg = "ES256"
+	}
+
+	header, err := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+
+	var sig []byte
+	switch key := key.(type) {
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		if err != nil {
+			return "", err
+		}
+		sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	case *rsa.PrivateKey:
+		if sig, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:]); err != nil {
+			return "", err
+		}
+	default:
+		return "", fmt.Errorf("unsupported signing key %T", key)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
@@ -0,0 +1,215 @@
+package oidc
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// A signed-in user as MockProvider reports them.
+type MockUser struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+}
+
+// A minimal OpenID Connect provider for tests and local development. It serves discovery, keys, and token
+// endpoints like a real provider, checking client credentials and PKCE, but its authorization endpoint
+// approves every request straight away as the current user. Serve it at Issuer, e.g. with httptest.
+type MockProvider struct {
+	// Must be the base URL the provider is served at.
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+
+	mu     sync.Mutex
+	user   MockUser
+	key    *rsa.PrivateKey
+	keyID  string
+	grants map[string]mockGrant
+	tamper func(claims map[string]interface{})
+}
+
+// An authorization code waiting to be exchanged.
+type mockGrant struct {
+	user          MockUser
+	redirectURI   string
+	nonce         string
+	codeChallenge string
+}
+
+func NewMockProvider(clientID, clientSecret string) (*MockProvider, error) {
+	m := &MockProvider{ClientID: clientID, ClientSecret: clientSecret, grants: make(map[string]mockGrant)}
+	return m, m.RotateKey()
+}
+
+// Sets the user the next authorization signs in as.
+func (m *MockProvider) SetUser(user MockUser) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.user = user
+}
+
+// Lets the next ID tokens be altered before they are signed, to produce tokens a client must refuse. Nil stops
+// tampering.
+func (m *MockProvider) Tamper(fn func(claims map[string]interface{})) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tamper = fn
+}
+
+// Replaces the signing key, as providers regularly do. Only the new key is published afterwards.
+func (m *MockProvider) RotateKey() error {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return err
+	}
+	kid := make([]byte, 8)
+	if _, err := rand.Read(kid); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.key, m.keyID = key, hex.EncodeToString(kid)
+	return nil
+}
+
+func (m *MockProvider) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/.well-known/openid-configuration":
+		writeJSON(w, http.StatusOK, map[string]string{
+			"issuer":                 m.Issuer,
+			"authorization_endpoint": m.Issuer + "/authorize",
+			"token_endpoint":         m.Issuer + "/token",
+			"jwks_uri":               m.Issuer + "/jwks",
+		})
+	case "/jwks":
+		m.serveKeys(w)
+	case "/authorize":
+		m.authorize(w, r)
+	case "/token":
+		m.token(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (m *MockProvider) serveKeys(w http.ResponseWriter) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"keys": []map[string]string{{
+		"kty": "RSA",
+		"kid": m.keyID,
+		"use": "sig",
+		"alg": "RS256",
+		"n":   base64.RawURLEncoding.EncodeToString(m.key.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(m.key.E)).Bytes()),
+	}}})
+}
+
+// Approves the request as the current user and redirects back with a code, as a real provider would once the
+// user has signed in and consented.
+func (m *MockProvider) authorize(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	redirectURI, err := url.Parse(query.Get("redirect_uri"))
+	switch {
+	case query.Get("client_id") != m.ClientID:
+		http.Error(w, "unknown client", http.StatusBadRequest)
+		return
+	case err != nil || redirectURI.String() == "":
+		http.Error(w, "bad redirect_uri", http.StatusBadRequest)
+		return
+	case query.Get("response_type") != "code" || query.Get("code_challenge_method") != "S256" || query.Get("code_challenge") == "":
+		http.Error(w, "only the code flow with S256 PKCE is supported", http.StatusBadRequest)
+		return
+	}
+
+	code := make([]byte, 16)
+	if _, err := rand.Read(code); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	m.mu.Lock()
+	m.grants[hex.EncodeToString(code)] = mockGrant{
+		user:          m.user,
+		redirectURI:   redirectURI.String(),
+		nonce:         query.Get("nonce"),
+		codeChallenge: query.Get("code_challenge"),
+	}
+	m.mu.Unlock()
+
+	callback := redirectURI.Query()
+	callback.Set("code", hex.EncodeToString(code))
+	callback.Set("state", query.Get("state"))
+	redirectURI.RawQuery = callback.Encode()
+	http.Redirect(w, r, redirectURI.String(), http.StatusFound)
+}
+
+func (m *MockProvider) token(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.ParseForm() != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_request"})
+		return
+	}
+	if r.PostForm.Get("client_id") != m.ClientID ||
+		subtle.ConstantTimeCompare([]byte(r.PostForm.Get("client_secret")), []byte(m.ClientSecret)) != 1 {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Codes are single-use, whether or not the exchange works out.
+	code := r.PostForm.Get("code")
+	grant, ok := m.grants[code]
+	delete(m.grants, code)
+	if !ok || grant.redirectURI != r.PostForm.Get("redirect_uri") || pkceChallenge(r.PostForm.Get("code_verifier")) != grant.codeChallenge {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant", "error_description": "code, verifier or redirect_uri mismatch"})
+		return
+	}
+
+	now := time.Now()
+	claims := map[string]interface{}{
+		"iss":            m.Issuer,
+		"aud":            m.ClientID,
+		"sub":            grant.user.Subject,
+		"email":          grant.user.Email,
+		"email_verified": grant.user.EmailVerified,
+		"iat":            now.Unix(),
+		"exp":            now.Add(time.Hour).Unix(),
+		"nonce":          grant.nonce,
+	}
+	if m.tamper != nil {
+		m.tamper(claims)
+	}
+
+	idToken, err := signJWT(crypto.Signer(m.key), m.keyID, claims)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "server_error"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": "mock",
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     idToken,
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
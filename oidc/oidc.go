@@ -0,0 +1,234 @@
+// Package oidc signs users in with OpenID Connect providers such as Google and Apple, using the authorization
+// code flow with PKCE (RFC 7636). Endpoints come from the provider's discovery document and ID tokens are
+// checked against its published keys, so every compliant provider, including MockProvider, is handled alike.
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Returned, wrapped with the reason, when the provider turns down a code or an ID token does not check out.
+// Other errors mean the provider could not be reached or answered nonsense.
+var ErrVerification = errors.New("oidc verification failed")
+
+// Most of a provider response that is read; discovery documents and key sets are a few kilobytes.
+const maxResponseSize = 1 << 20
+
+// An OpenID Connect provider this service is registered with as a client.
+type Provider struct {
+	// Short name used in requests and stored with linked identities, e.g. "google".
+	Name string
+	// Issuer identifier; the discovery document is fetched from under it.
+	Issuer string
+	// Other "iss" values the provider is known to put in its ID tokens.
+	IssuerAliases []string
+	ClientID      string
+	// Returns the client secret sent to the token endpoint, or nil for a public client. Apple's secret is a
+	// short-lived JWT, see AppleClientSecret.
+	ClientSecret func() (string, error)
+	// Scopes to request; "openid" and "email" if empty.
+	Scopes []string
+	// Extra authorization request parameters, e.g. Apple's response_mode.
+	AuthParams url.Values
+	// Client for provider requests; a client with a 10-second timeout if nil.
+	HTTPClient *http.Client
+
+	mu            sync.Mutex
+	metadata      *metadata
+	keys          map[string]crypto.PublicKey
+	keysFetchedAt time.Time
+}
+
+// The parts of the discovery document that are used.
+type metadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+var defaultClient = &http.Client{Timeout: 10 * time.Second}
+
+// A client secret that never changes, as Google and most providers issue them.
+func StaticClientSecret(secret string) func() (string, error) {
+	return func() (string, error) { return secret, nil }
+}
+
+// Creates a PKCE code verifier and its S256 challenge. The verifier stays on the server until the code is
+// exchanged; the challenge goes out with the authorization request.
+func NewPKCE() (verifier, challenge string, err error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	verifier = base64.RawURLEncoding.EncodeToString(b)
+	return verifier, pkceChallenge(verifier), nil
+}
+
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func (p *Provider) client() *http.Client {
+	if p.HTTPClient != nil {
+		return p.HTTPClient
+	}
+	return defaultClient
+}
+
+// Decodes a JSON response, whatever its status, and returns the status.
+func (p *Provider) do(req *http.Request, out interface{}) (int, error) {
+	resp, err := p.client().Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxResponseSize)).Decode(out); err != nil {
+		return resp.StatusCode, fmt.Errorf("%s: %d response from %s: %v", p.Name, resp.StatusCode, req.URL.Redacted(), err)
+	}
+	return resp.StatusCode, nil
+}
+
+func (p *Provider) getJSON(ctx context.Context, url string, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	status, err := p.do(req, out)
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK {
+		return fmt.Errorf("%s: %s answered %d", p.Name, url, status)
+	}
+	return nil
+}
+
+// Fetches the discovery document once and keeps it; providers do not move their endpoints around.
+func (p *Provider) discover(ctx context.Context) (metadata, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.discoverLocked(ctx)
+}
+
+func (p *Provider) discoverLocked(ctx context.Context) (metadata, error) {
+	if p.metadata != nil {
+		return *p.metadata, nil
+	}
+
+	var md metadata
+	if err := p.getJSON(ctx, strings.TrimSuffix(p.Issuer, "/")+"/.well-known/openid-configuration", &md); err != nil {
+		return metadata{}, err
+	}
+	// OpenID Connect Discovery requires the document to name the issuer it was fetched for.
+	if md.Issuer != p.Issuer {
+		return metadata{}, fmt.Errorf("%s: discovery document is for issuer %q", p.Name, md.Issuer)
+	}
+	if md.AuthorizationEndpoint == "" || md.TokenEndpoint == "" || md.JWKSURI == "" {
+		return metadata{}, fmt.Errorf("%s: discovery document lacks endpoints", p.Name)
+	}
+
+	p.metadata = &md
+	return md, nil
+}
+
+// Builds the URL that sends the user to the provider to sign in. The state and nonce must be fresh random
+// values kept for the callback, along with the verifier behind codeChallenge.
+func (p *Provider) AuthCodeURL(ctx context.Context, redirectURI, state, nonce, codeChallenge string) (string, error) {
+	md, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	endpoint, err := url.Parse(md.AuthorizationEndpoint)
+	if err != nil {
+		return "", fmt.Errorf("%s: bad authorization endpoint: %v", p.Name, err)
+	}
+
+	scopes := p.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{"openid", "email"}
+	}
+
+	query := endpoint.Query()
+	for key, values := range p.AuthParams {
+		query[key] = values
+	}
+	query.Set("response_type", "code")
+	query.Set("client_id", p.ClientID)
+	query.Set("redirect_uri", redirectURI)
+	query.Set("scope", strings.Join(scopes, " "))
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+	query.Set("code_challenge", codeChallenge)
+	query.Set("code_challenge_method", "S256")
+	endpoint.RawQuery = query.Encode()
+	return endpoint.String(), nil
+}
+
+// Exchanges an authorization code for the ID token it was issued with. The token still has to go through
+// VerifyIDToken; nothing in it is trusted yet.
+func (p *Provider) Exchange(ctx context.Context, code, codeVerifier, redirectURI string) (string, error) {
+	md, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {redirectURI},
+		"client_id":     {p.ClientID},
+		"code_verifier": {codeVerifier},
+	}
+	if p.ClientSecret != nil {
+		secret, err := p.ClientSecret()
+		if err != nil {
+			return "", fmt.Errorf("%s: client secret: %v", p.Name, err)
+		}
+		form.Set("client_secret", secret)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, md.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	var res struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	status, err := p.do(req, &res)
+	if err != nil {
+		return "", err
+	}
+
+	switch {
+	case status == http.StatusOK && res.IDToken != "":
+		return res.IDToken, nil
+	case status == http.StatusBadRequest && res.Error == "invalid_grant":
+		// The code was used, expired, or does not go with this verifier or redirect URI.
+		return "", fmt.Errorf("%w: %s: code refused: %s", ErrVerification, p.Name, res.ErrorDescription)
+	case status == http.StatusOK:
+		return "", fmt.Errorf("%s: token response without an ID token", p.Name)
+	}
+	return "", fmt.Errorf("%s: token endpoint answered %d: %s %s", p.Name, status, res.Error, res.ErrorDescription)
+}
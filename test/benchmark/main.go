@@ -24,11 +24,17 @@ type stats struct {
 	mu            sync.Mutex
 }
 
+// The benchmark endpoint is an admin endpoint, so requests carry the server's admin key.
+var adminKey = os.Getenv("ADMIN_API_KEY")
+
 func worker(wg *sync.WaitGroup, url string, stat *stats) {
 	defer wg.Done()
 
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	req.Header.Set("X-Admin-Key", adminKey)
+
 	start := time.Now()
-	resp, err := http.Get(url)
+	resp, err := http.DefaultClient.Do(req)
 	duration := time.Since(start)
 	durationMs := duration.Milliseconds()
 
@@ -159,7 +165,7 @@ func main() {
 	const defaultTotalRequests = 1024
 	const defaultConcurrency = 128
 	const defaultSleepDuration = 256
-	defaultURL := "http://localhost:80/benchmark"
+	defaultURL := "http://localhost:80/admin/benchmark"
 
 	// Define flags for automatic defaults.
 	autoYes := flag.Bool("yes", false, "use default values (long)")
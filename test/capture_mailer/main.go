@@ -0,0 +1,129 @@
+// Checks that CaptureMailer records what the server would have sent, by signing in with the OTP read back from
+// it, and that Last and Messages find the right messages when several addresses get mail.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"bearlysocial-backend/api/handler"
+	"bearlysocial-backend/api/repository"
+	"bearlysocial-backend/mailer"
+	"bearlysocial-backend/util"
+)
+
+var failed bool
+
+func check(ok bool, format string, args ...interface{}) {
+	if ok {
+		fmt.Printf("PASS: "+format+"\n", args...)
+	} else {
+		fmt.Printf("FAIL: "+format+"\n", args...)
+		failed = true
+	}
+}
+
+var otpPattern = regexp.MustCompile(`is: (\S+)`)
+
+func main() {
+	mail := &mailer.CaptureMailer{}
+	unlimited := repository.Bucket{Capacity: 1 << 20, RefillInterval: 1}
+	h := &handler.Handler{
+		Users:               repository.NewMemoryUserAccounts(),
+		Sessions:            repository.NewMemorySessions(),
+		Mailer:              mail,
+		RateLimits:          repository.NewMemoryRateLimits(),
+		OTPRequestLimits:    handler.OTPRequestLimits{PerIP: unlimited, PerEmail: unlimited, Global: unlimited},
+		OTPSecret:           []byte("capture-mailer-test-secret-capture"),
+		OTPPolicy:           util.DefaultOTPPolicy(),
+		SessionLifetime:     time.Hour,
+		AccessTokenLifetime: time.Minute,
+		RotationGrace:       time.Second,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/request-otp", h.RequestOTP)
+	mux.HandleFunc("/validate-otp", h.ValidateOTP)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	post := func(path string, body map[string]string, out interface{}) int {
+		raw, _ := json.Marshal(body)
+		resp, err := http.Post(server.URL+path, "application/json", bytes.NewReader(raw))
+		if err != nil {
+			return 0
+		}
+		defer resp.Body.Close()
+		if out != nil {
+			json.NewDecoder(resp.Body).Decode(out)
+		}
+		return resp.StatusCode
+	}
+	otpFor := func(email string) string {
+		msg, ok := mail.Last(email)
+		if m := otpPattern.FindStringSubmatch(msg.Text); ok && m != nil {
+			return m[1]
+		}
+		return ""
+	}
+
+	_, ok := mail.Last("first@example.com")
+	check(!ok && len(mail.Messages()) == 0, "nothing is captured before anything is sent")
+
+	post("/request-otp", map[string]string{"email_address": "first@example.com"}, nil)
+	post("/request-otp", map[string]string{"email_address": "second@example.com"}, nil)
+	msg, ok := mail.Last("first@example.com")
+	check(ok && msg.To == "first@example.com" && msg.Subject != "" && msg.HTML != "", "the OTP email is captured whole (%q)", msg.Subject)
+	first, second := otpFor("first@example.com"), otpFor("second@example.com")
+	check(first != "" && second != "" && first != second, "each address gets its own OTP (%s %s)", first, second)
+	check(strings.Contains(msg.HTML, first), "the HTML part carries the same OTP")
+
+	// A new request replaces the OTP, and Last returns the newest one.
+	post("/request-otp", map[string]string{"email_address": "first@example.com"}, nil)
+	replaced := otpFor("first@example.com")
+	check(replaced != "" && replaced != first, "Last returns the most recent message (%s %s)", first, replaced)
+
+	messages := mail.Messages()
+	check(len(messages) == 3 && messages[0].To == "first@example.com" && messages[1].To == "second@example.com",
+		"Messages returns every message, oldest first (%d)", len(messages))
+	messages[0].To = "tampered@example.com"
+	check(mail.Messages()[0].To == "first@example.com", "Messages returns a copy")
+
+	var res struct {
+		Email string `json:"email_address"`
+		Token string `json:"token"`
+	}
+	status := post("/validate-otp", map[string]string{"email_address": "first@example.com", "otp": first}, nil)
+	check(status == http.StatusBadRequest, "the replaced OTP no longer signs in (%d)", status)
+	status = post("/validate-otp", map[string]string{"email_address": "first@example.com", "otp": replaced}, &res)
+	check(status == http.StatusOK && res.Email == "first@example.com" && res.Token != "", "the captured OTP signs in (%d %s)", status, res.Email)
+	status = post("/validate-otp", map[string]string{"email_address": "second@example.com", "otp": second}, nil)
+	check(status == http.StatusOK, "so does the other address's (%d)", status)
+
+	// Handlers send from many goroutines at once.
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			mail.Send(context.Background(), mailer.Message{To: fmt.Sprintf("bulk-%d@example.com", i)})
+		}(i)
+	}
+	wg.Wait()
+	check(len(mail.Messages()) == 53, "concurrent sends are all captured (%d)", len(mail.Messages()))
+
+	if failed {
+		fmt.Println("CAPTURE MAILER TEST FAILED.")
+		os.Exit(1)
+	}
+	fmt.Println("CAPTURE MAILER TEST PASSED.")
+}
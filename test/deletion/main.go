@@ -0,0 +1,92 @@
+// Checks that the sweep hard-deletes only accounts whose deletion is still due when it gets to them, and that it
+// removes their sessions and challenges along with them but leaves those of every other account alone.
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"bearlysocial-backend/api/handler"
+	"bearlysocial-backend/api/model"
+	"bearlysocial-backend/api/repository"
+)
+
+var failed bool
+
+func check(ok bool, format string, args ...interface{}) {
+	if ok {
+		fmt.Printf("PASS: "+format+"\n", args...)
+	} else {
+		fmt.Printf("FAIL: "+format+"\n", args...)
+		failed = true
+	}
+}
+
+func main() {
+	ctx := context.Background()
+	users := repository.NewMemoryUserAccounts()
+	sessions := repository.NewMemorySessions()
+	challenges := repository.NewMemoryChallenges()
+	h := &handler.Handler{
+		Users:      users,
+		Sessions:   sessions,
+		Challenges: challenges,
+		RateLimits: repository.NewMemoryRateLimits(),
+	}
+
+	now := time.Now()
+	past := now.Add(-time.Minute).UnixMilli()
+	later := now.Add(time.Hour).UnixMilli()
+	for _, id := range []string{"due", "cancelled", "pending", "kept"} {
+		users.Create(ctx, model.UserAccount{ID: id, Email: id + "@example.com"})
+		sessions.Create(ctx, model.Session{ID: "session-" + id, UserID: id, AccessTokenHash: "a-" + id, RefreshTokenHash: "r-" + id, ExpiryTime: later, AccessExpiryTime: later})
+		challenges.Create(ctx, model.Challenge{ID: "challenge-" + id, Purpose: "test", UserID: id, ExpiryTime: later})
+	}
+	users.ScheduleDeletion(ctx, "due", past)
+	users.ScheduleDeletion(ctx, "cancelled", past)
+	users.ScheduleDeletion(ctx, "pending", later)
+
+	ids, _ := users.ExpiredDeletions(ctx, now.UnixMilli())
+	check(len(ids) == 2, "accounts past their deletion time are listed (%v)", ids)
+
+	// Signing in after the list was made cancels the deletion.
+	users.IssueOTP(ctx, "cancelled", "otp-hash", later, now.UnixMilli())
+	_, err := users.CompleteOTP(ctx, "cancelled", "otp-hash")
+	check(err == nil, "signed in (%v)", err)
+	err = users.DeleteIfDue(ctx, "cancelled", now.UnixMilli())
+	check(err == repository.ErrNotFound, "an account whose deletion was cancelled is not deleted (%v)", err)
+	err = users.DeleteIfDue(ctx, "pending", now.UnixMilli())
+	check(err == repository.ErrNotFound, "an account whose deletion is not yet due is not deleted (%v)", err)
+
+	sweep, cancel := context.WithCancel(ctx)
+	cancel()
+	h.Sweep(sweep, time.Hour)
+
+	for _, c := range []struct {
+		id   string
+		gone bool
+	}{
+		{"due", true},
+		{"cancelled", false},
+		{"pending", false},
+		{"kept", false},
+	} {
+		_, err := users.Find(ctx, c.id)
+		list, _ := sessions.List(ctx, c.id)
+		_, chErr := challenges.Find(ctx, "challenge-"+c.id, "test", now.UnixMilli())
+		if c.gone {
+			check(err == repository.ErrNotFound && len(list) == 0 && chErr == repository.ErrNotFound,
+				"%s: the account, its sessions and its challenges are removed", c.id)
+		} else {
+			check(err == nil && len(list) == 1 && chErr == nil, "%s: the account, its sessions and its challenges are kept", c.id)
+		}
+	}
+
+	if failed {
+		fmt.Println("DELETION TEST FAILED.")
+		os.Exit(1)
+	}
+	fmt.Println("DELETION TEST PASSED.")
+}
@@ -0,0 +1,226 @@
+// Drives the email change flow through the real handlers on in-memory storage: both addresses must confirm,
+// the account keeps its ID, other sessions are signed out, and a legacy account whose ID is its address gets
+// the address filled in.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"bearlysocial-backend/api/handler"
+	"bearlysocial-backend/api/middleware"
+	"bearlysocial-backend/api/model"
+	"bearlysocial-backend/api/repository"
+	"bearlysocial-backend/mailer"
+	"bearlysocial-backend/util"
+)
+
+// Delivers nothing to bounce addresses, like a mail server that is down for them.
+type bouncingMailer struct {
+	mailer.CaptureMailer
+}
+
+func (b *bouncingMailer) Send(ctx context.Context, msg mailer.Message) error {
+	if strings.HasPrefix(msg.To, "bounce") {
+		return errors.New("mailbox unavailable")
+	}
+	return b.CaptureMailer.Send(ctx, msg)
+}
+
+type harness struct {
+	server *httptest.Server
+	mail   *mailer.CaptureMailer
+	failed bool
+}
+
+// Sends a JSON request, decoding a JSON response into out if it is not nil.
+func (t *harness) call(path, token string, body, out interface{}) (int, string) {
+	method := http.MethodPost
+	if path == "/sessions" {
+		method = http.MethodGet
+	}
+	raw, _ := json.Marshal(body)
+	req, _ := http.NewRequest(method, t.server.URL+path, bytes.NewReader(raw))
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err.Error()
+	}
+	defer resp.Body.Close()
+
+	data, _ := io.ReadAll(resp.Body)
+	if out != nil {
+		json.Unmarshal(data, out)
+	}
+	var res struct {
+		Message string `json:"message"`
+	}
+	json.Unmarshal(data, &res)
+	return resp.StatusCode, res.Message
+}
+
+func (t *harness) check(ok bool, format string, args ...interface{}) {
+	if ok {
+		fmt.Printf("PASS: "+format+"\n", args...)
+	} else {
+		fmt.Printf("FAIL: "+format+"\n", args...)
+		t.failed = true
+	}
+}
+
+var codePattern = regexp.MustCompile(`is: (\S+)`)
+
+// Returns the code in the last email sent to the address.
+func (t *harness) code(to string) string {
+	msg, ok := t.mail.Last(to)
+	if !ok {
+		return ""
+	}
+	if m := codePattern.FindStringSubmatch(msg.Text); m != nil {
+		return m[1]
+	}
+	return ""
+}
+
+type account struct {
+	UID   string `json:"uid"`
+	Email string `json:"email_address"`
+	Token string `json:"token"`
+}
+
+func (t *harness) signIn(email string) account {
+	t.call("/request-otp", "", map[string]string{"email_address": email}, nil)
+	var res account
+	t.call("/validate-otp", "", map[string]string{"email_address": email, "otp": t.code(email)}, &res)
+	return res
+}
+
+func main() {
+	if !run() {
+		fmt.Println("EMAIL CHANGE TEST FAILED.")
+		os.Exit(1)
+	}
+	fmt.Println("EMAIL CHANGE TEST PASSED.")
+}
+
+func run() bool {
+	users := repository.NewMemoryUserAccounts()
+	sessions := repository.NewMemorySessions()
+	unlimited := repository.Bucket{Capacity: 1 << 20, RefillInterval: 1}
+
+	h := &handler.Handler{
+		Users:               users,
+		Sessions:            sessions,
+		Mailer:              &bouncingMailer{},
+		RateLimits:          repository.NewMemoryRateLimits(),
+		OTPRequestLimits:    handler.OTPRequestLimits{PerIP: unlimited, PerEmail: unlimited, Global: unlimited},
+		Challenges:          repository.NewMemoryChallenges(),
+		OTPSecret:           []byte("email-change-test-secret-email-change"),
+		OTPPolicy:           util.DefaultOTPPolicy(),
+		SessionLifetime:     time.Hour,
+		AccessTokenLifetime: time.Minute,
+		RotationGrace:       time.Second,
+	}
+	auth := middleware.ValidateToken(users, sessions, h.SessionLimits())
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/request-otp", h.RequestOTP)
+	mux.HandleFunc("/validate-otp", h.ValidateOTP)
+	mux.Handle("/begin-email-change", auth(http.HandlerFunc(h.BeginEmailChange)))
+	mux.Handle("/confirm-email-change", auth(http.HandlerFunc(h.ConfirmEmailChange)))
+	mux.Handle("/sessions", auth(http.HandlerFunc(h.ListSessions)))
+
+	t := &harness{server: httptest.NewServer(mux), mail: &h.Mailer.(*bouncingMailer).CaptureMailer}
+	defer t.server.Close()
+	ctx := context.Background()
+
+	// New accounts get a generated ID, not their address.
+	first := t.signIn("old@example.com")
+	other := t.signIn("old@example.com")
+	t.check(first.Token != "" && first.UID != "" && first.UID != first.Email && first.Email == "old@example.com",
+		"a new account has a generated ID (%s %s)", first.UID, first.Email)
+	t.signIn("taken@example.com")
+
+	status, msg := t.call("/begin-email-change", first.Token, map[string]string{"new_email_address": "old@example.com"}, nil)
+	t.check(status == http.StatusBadRequest, "the current address is refused (%d %s)", status, msg)
+	status, msg = t.call("/begin-email-change", first.Token, map[string]string{"new_email_address": "Taken@Example.com"}, nil)
+	t.check(status == http.StatusBadRequest, "an address in use is refused (%d %s)", status, msg)
+
+	status, msg = t.call("/begin-email-change", first.Token, map[string]string{"new_email_address": "New@Example.com"}, nil)
+	oldCode, newCode := t.code("old@example.com"), t.code("new@example.com")
+	t.check(status == http.StatusOK && oldCode != "" && newCode != "", "codes go to both addresses (%d %s)", status, msg)
+
+	// Each code only counts for the address it was sent to.
+	status, msg = t.call("/confirm-email-change", first.Token, map[string]string{"old_otp": newCode, "new_otp": oldCode}, nil)
+	t.check(status == http.StatusBadRequest, "swapped codes are refused (%d %s)", status, msg)
+	status, msg = t.call("/confirm-email-change", first.Token, map[string]string{"old_otp": oldCode, "new_otp": oldCode}, nil)
+	t.check(status == http.StatusBadRequest, "the old address's code alone is refused (%d %s)", status, msg)
+
+	// A sign-in OTP sent to the old address before the move.
+	t.call("/request-otp", "", map[string]string{"email_address": "old@example.com"}, nil)
+	staleOTP := t.code("old@example.com")
+
+	var res account
+	status, msg = t.call("/confirm-email-change", first.Token, map[string]string{"old_otp": oldCode, "new_otp": newCode}, &res)
+	t.check(status == http.StatusOK && res.UID == first.UID && res.Email == "new@example.com", "both codes move the account (%d %s %s)", status, msg, res.Email)
+
+	status, msg = t.call("/confirm-email-change", first.Token, map[string]string{"old_otp": oldCode, "new_otp": newCode}, nil)
+	t.check(status == http.StatusBadRequest, "the codes are single-use (%d %s)", status, msg)
+
+	status, msg = t.call("/validate-otp", "", map[string]string{"email_address": "new@example.com", "otp": staleOTP}, nil)
+	t.check(status != http.StatusOK, "a sign-in OTP sent to the old address no longer works (%d %s)", status, msg)
+
+	status, _ = t.call("/sessions", first.Token, nil, nil)
+	t.check(status == http.StatusOK, "the session that made the change stays signed in")
+	status, _ = t.call("/sessions", other.Token, nil, nil)
+	t.check(status == http.StatusUnauthorized, "other sessions are signed out (%d)", status)
+
+	again := t.signIn("new@example.com")
+	t.check(again.UID == first.UID, "the new address signs in to the same account")
+	fresh := t.signIn("old@example.com")
+	t.check(fresh.UID != "" && fresh.UID != first.UID, "the old address is free for a new account")
+
+	// Too many wrong guesses discard the change.
+	t.call("/begin-email-change", again.Token, map[string]string{"new_email_address": "third@example.com"}, nil)
+	oldCode, newCode = t.code("new@example.com"), t.code("third@example.com")
+	for i := 0; i < h.OTPPolicy.MaxAttempts; i++ {
+		status, msg = t.call("/confirm-email-change", again.Token, map[string]string{"old_otp": oldCode, "new_otp": oldCode}, nil)
+	}
+	t.check(status == http.StatusBadRequest && msg == "Too many failed attempts. Please start again.", "the last wrong guess ends the change (%d %s)", status, msg)
+	status, msg = t.call("/confirm-email-change", again.Token, map[string]string{"old_otp": oldCode, "new_otp": newCode}, nil)
+	t.check(status == http.StatusBadRequest, "the right codes are refused afterwards (%d %s)", status, msg)
+
+	// A change whose second email could not be sent is dropped, and its tokens are given back.
+	bounced := t.signIn("sender@example.com")
+	h.OTPRequestLimits.PerEmail = repository.Bucket{Capacity: 1, RefillInterval: time.Hour.Milliseconds()}
+	status, msg = t.call("/begin-email-change", bounced.Token, map[string]string{"new_email_address": "bounce@example.com"}, nil)
+	sentCode := t.code("sender@example.com")
+	t.check(status == http.StatusInternalServerError && sentCode != "", "the change fails after the first email (%d %s)", status, msg)
+	bounced_acc, _ := users.Find(ctx, bounced.UID)
+	t.check(bounced_acc.EmailChange == nil, "the failed change is not left pending")
+	status, msg = t.call("/begin-email-change", bounced.Token, map[string]string{"new_email_address": "retry@example.com"}, nil)
+	t.check(status == http.StatusOK, "the failed change did not use up the limits (%d %s)", status, msg)
+	status, msg = t.call("/confirm-email-change", bounced.Token, map[string]string{"old_otp": sentCode, "new_otp": t.code("retry@example.com")}, nil)
+	t.check(status == http.StatusBadRequest, "the code sent for the failed change is no good (%d %s)", status, msg)
+
+	// Accounts from before generated IDs have their address as the ID and no address field.
+	users.Create(ctx, model.UserAccount{ID: "legacy@example.com", CreatedAt: time.Now()})
+	filled, err := users.FillEmails(ctx)
+	t.check(err == nil && filled == 1, "the legacy account gets its address (%d %v)", filled, err)
+	legacy := t.signIn("legacy@example.com")
+	t.check(legacy.UID == "legacy@example.com" && legacy.Token != "", "the legacy account still signs in (%s)", legacy.UID)
+
+	return !t.failed
+}
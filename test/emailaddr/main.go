@@ -0,0 +1,193 @@
+// Checks email address parsing, normalization, canonicalization and the disposable-domain blocklist against a
+// table of addresses, then that RequestOTP refuses blocked domains for new accounts only.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"time"
+
+	"bearlysocial-backend/api/handler"
+	"bearlysocial-backend/api/model"
+	"bearlysocial-backend/api/repository"
+	"bearlysocial-backend/emailaddr"
+	"bearlysocial-backend/mailer"
+	"bearlysocial-backend/util"
+)
+
+var failed bool
+
+func check(ok bool, format string, args ...interface{}) {
+	if ok {
+		fmt.Printf("PASS: "+format+"\n", args...)
+	} else {
+		fmt.Printf("FAIL: "+format+"\n", args...)
+		failed = true
+	}
+}
+
+func main() {
+	// Addresses that must parse, with their normal form.
+	for in, want := range map[string]string{
+		"user@example.com":               "user@example.com",
+		"  User@Example.COM ":            "user@example.com",
+		"first.last@example.photography": "first.last@example.photography",
+		"someone@my.community":           "someone@my.community",
+		"user+tag@example.com":           "user+tag@example.com",
+		"user+tag+more@example.com":      "user+tag+more@example.com",
+		"o'brien@example.ie":             "o'brien@example.ie",
+		"x@a.io":                         "x@a.io",
+		"user@sub.domain.example.co.uk":  "user@sub.domain.example.co.uk",
+		"user@bücher.de":                 "user@xn--bcher-kva.de",
+		"user@BÜCHER.de":                 "user@xn--bcher-kva.de",
+		"user@xn--bcher-kva.de":          "user@xn--bcher-kva.de",
+		"用户@例子.广告":                       "用户@xn--fsqu00a.xn--4rr70v",
+		"JOSÉ@example.com":               "josé@example.com",
+		"josé@example.com":              "josé@example.com", // Decomposed accent, composed by NFC.
+		"user@example-domain.com":        "user@example-domain.com",
+		"a_b-c=d@example.com":            "a_b-c=d@example.com",
+	} {
+		got, err := emailaddr.Normalize(in)
+		check(err == nil && got == want, "%q normalizes to %q (%q %v)", in, want, got, err)
+	}
+
+	// Addresses that must be refused.
+	for _, in := range []string{
+		"",
+		"plainaddress",
+		"@example.com",
+		"user@",
+		"user@localhost",
+		"user@example",
+		".user@example.com",
+		"user.@example.com",
+		"us..er@example.com",
+		"user name@example.com",
+		"\"quoted\"@example.com",
+		"Name <user@example.com>",
+		"user@[192.0.2.1]",
+		"user@192.0.2.1",
+		"user@-example.com",
+		"user@example-.com",
+		"user@exa_mple.com",
+		"user@example..com",
+		"user@example.com.",
+		"user​@example.com", // Zero-width space.
+		"user@@example.com",
+		strings.Repeat("a", 65) + "@example.com",
+		"user@" + strings.Repeat("a", 64) + ".com",
+		strings.Repeat("a", 64) + "@" + strings.Repeat(strings.Repeat("b", 60)+".", 3) + "community", // 257 bytes in all.
+		"user@example.com\xff",
+	} {
+		got, err := emailaddr.Normalize(in)
+		check(err != nil, "%q is refused (%q %v)", in, got, err)
+	}
+
+	// Canonical forms fold the spellings of one mailbox at well-known providers, and nothing else.
+	for in, want := range map[string]string{
+		"A.B.C+promo@gmail.com":      "abc@gmail.com",
+		"abc@googlemail.com":         "abc@gmail.com",
+		"first.last+x@outlook.com":   "first.last@outlook.com",
+		"someone+x@hotmail.com":      "someone@outlook.com",
+		"someone-shopping@yahoo.com": "someone@yahoo.com",
+		"first.last+x@example.com":   "first.last+x@example.com",
+		"+only@gmail.com":            "+only@gmail.com",
+	} {
+		addr, err := emailaddr.Parse(in)
+		got := emailaddr.Canonical(addr)
+		check(err == nil && got == want, "%q canonicalizes to %q (%q %v)", in, want, got, err)
+	}
+
+	blocked := emailaddr.DisposableDomains()
+	check(blocked.Len() > 20, "the built-in disposable list is loaded (%d domains)", blocked.Len())
+	for in, want := range map[string]bool{
+		"a@mailinator.com":      true,
+		"a@MAILINATOR.com":      true,
+		"a@sub.mailinator.com":  true,
+		"a@notmailinator.com":   false,
+		"a@gmail.com":           false,
+		"a@yopmail.fr":          true,
+		"a@mailinator.com.evil": false,
+	} {
+		addr, _ := emailaddr.Parse(in)
+		check(blocked.Blocked(addr) == want, "%q blocked: %v", in, want)
+	}
+	custom := emailaddr.NewBlocklist("bücher.example")
+	addr, _ := emailaddr.Parse("a@xn--bcher-kva.example")
+	check(custom.Blocked(addr), "internationalized domains are listed in ASCII form")
+	var none *emailaddr.Blocklist
+	check(!none.Blocked(addr), "a nil blocklist blocks nothing")
+	check(custom.Load(strings.NewReader("# comment\n\nok.example\nnot a domain\n")) != nil, "a malformed list is refused")
+
+	check(util.ValidToken("legacy@example.photography::"+strings.Repeat("a", 64)), "legacy tokens accept long top-level domains")
+	check(!util.ValidToken("legacy@@example.com::"+strings.Repeat("a", 64)), "legacy tokens with a malformed address are refused")
+
+	requestOTP()
+
+	if failed {
+		fmt.Println("EMAIL ADDRESS TEST FAILED.")
+		os.Exit(1)
+	}
+	fmt.Println("EMAIL ADDRESS TEST PASSED.")
+}
+
+// Blocked domains stop new accounts, not existing ones.
+func requestOTP() {
+	users := repository.NewMemoryUserAccounts()
+	unlimited := repository.Bucket{Capacity: 1 << 20, RefillInterval: 1}
+	h := &handler.Handler{
+		Users:      users,
+		Sessions:   repository.NewMemorySessions(),
+		Mailer:     &mailer.CaptureMailer{},
+		RateLimits: repository.NewMemoryRateLimits(),
+		OTPRequestLimits: handler.OTPRequestLimits{
+			PerIP:    unlimited,
+			PerEmail: repository.Bucket{Capacity: 2, RefillInterval: time.Hour.Milliseconds()},
+			Global:   unlimited,
+		},
+		BlockedDomains: emailaddr.DisposableDomains(),
+		OTPSecret:      []byte("emailaddr-test-secret-emailaddr-test"),
+		OTPPolicy:      util.DefaultOTPPolicy(),
+	}
+	server := httptest.NewServer(http.HandlerFunc(h.RequestOTP))
+	defer server.Close()
+
+	request := func(email string) (int, string) {
+		raw, _ := json.Marshal(map[string]string{"email_address": email})
+		req, _ := http.NewRequest(http.MethodPost, server.URL, bytes.NewReader(raw))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return 0, err.Error()
+		}
+		defer resp.Body.Close()
+		var res struct {
+			Message string `json:"message"`
+		}
+		json.NewDecoder(resp.Body).Decode(&res)
+		return resp.StatusCode, res.Message
+	}
+
+	status, msg := request("newcomer@mailinator.com")
+	check(status == http.StatusBadRequest, "a new account at a disposable domain is refused (%d %s)", status, msg)
+
+	ctx := context.Background()
+	users.Create(ctx, model.UserAccount{ID: "01", Email: "oldtimer@mailinator.com", CreatedAt: time.Now()})
+	status, msg = request("oldtimer@mailinator.com")
+	check(status == http.StatusOK, "an existing account at a blocked domain still gets its OTP (%d %s)", status, msg)
+
+	status, msg = request("Person@Example.Photography")
+	user_acc, err := users.FindByEmail(ctx, "person@example.photography")
+	check(status == http.StatusOK && err == nil, "long top-level domains sign up in normal form (%d %s %v)", status, msg, err)
+	check(user_acc.ID != user_acc.Email, "the account is keyed by a generated ID")
+
+	request("a.b+1@gmail.com")
+	request("ab+2@gmail.com")
+	status, msg = request("A.B@googlemail.com")
+	check(status == http.StatusTooManyRequests, "spellings of one Gmail mailbox share a rate limit (%d %s)", status, msg)
+}
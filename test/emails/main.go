@@ -0,0 +1,240 @@
+// Checks that every email renders in every language with its layout, that user data is escaped in HTML and left
+// alone in plain text, that locale directories replace templates for their language only, that broken template
+// directories are rejected, and that the server sends the OTP, deletion and new-device emails from the
+// templates. Run from the repository root.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"strings"
+	"testing/fstest"
+	"time"
+
+	"golang.org/x/text/language"
+
+	"bearlysocial-backend/api/handler"
+	"bearlysocial-backend/api/middleware"
+	"bearlysocial-backend/api/repository"
+	"bearlysocial-backend/api/router"
+	"bearlysocial-backend/emails"
+	"bearlysocial-backend/i18n"
+	"bearlysocial-backend/mailer"
+	"bearlysocial-backend/util"
+)
+
+var failed bool
+
+func check(ok bool, format string, args ...interface{}) {
+	if ok {
+		fmt.Printf("PASS: "+format+"\n", args...)
+	} else {
+		fmt.Printf("FAIL: "+format+"\n", args...)
+		failed = true
+	}
+}
+
+var (
+	en = language.English
+	id = language.Indonesian
+)
+
+// Reads the built-in template directory into a map file system that tests can add files to.
+func templateFiles() fstest.MapFS {
+	fsys := fstest.MapFS{}
+	root := os.DirFS("emails/templates")
+	fs.WalkDir(root, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := fs.ReadFile(root, path)
+		fsys[path] = &fstest.MapFile{Data: data}
+		return err
+	})
+	return fsys
+}
+
+func main() {
+	ttl := i18n.Duration(8 * time.Minute)
+	at := time.Date(2025, 6, 14, 18, 30, 0, 0, time.UTC)
+	all := []emails.Data{
+		emails.OTP{Code: "7KQ2XD", TTL: ttl, Link: "https://example.com/sign-in?token=t"},
+		emails.EmailChange{Code: "M4TZ8P", TTL: ttl, NewAddress: "new@example.com", ToCurrent: true},
+		emails.AccountDeletion{GracePeriod: i18n.Duration(30 * 24 * time.Hour)},
+		emails.NewDevice{DeviceLabel: "Pixel 8", UserAgent: "Test/1.0", Time: at},
+		emails.Meetup{With: "Ayu", Place: "Kopi", Time: at},
+	}
+	check(len(all) == len(emails.Names), "every email is checked (%d of %d)", len(all), len(emails.Names))
+
+	for _, data := range all {
+		for _, tag := range i18n.Supported {
+			msg, err := emails.Render(tag, data)
+			check(err == nil && msg.Subject != "" && msg.To == "", "%s renders in %s (%v, %q)", data.Template(), tag, err, msg.Subject)
+			check(strings.Contains(msg.HTML, `<html lang="`+tag.String()+`">`) && strings.Contains(msg.HTML, "</html>"),
+				"the HTML of %s in %s is wrapped in the layout", data.Template(), tag)
+			check(strings.Contains(msg.Text, "\n-- \n") && !strings.Contains(msg.Text, "<"),
+				"the text of %s in %s has the signature and no markup", data.Template(), tag)
+			check(!strings.Contains(msg.Subject, "\n"), "the subject of %s in %s is one line", data.Template(), tag)
+		}
+	}
+
+	msg, _ := emails.Render(id, emails.AccountDeletion{GracePeriod: i18n.Duration(30 * 24 * time.Hour)})
+	check(msg.Subject == "Akun Anda dijadwalkan untuk dihapus" && strings.Contains(msg.Text, "dihapus dalam 30 hari."),
+		"emails are translated, with localized durations (%q)", msg.Text)
+	check(strings.Contains(msg.HTML, `<span style="font-weight: bold;">30 hari</span>`), "tbold sets the arguments in bold")
+	msg, _ = emails.Render(language.MustParse("de"), emails.AccountDeletion{GracePeriod: i18n.Duration(time.Hour)})
+	check(msg.Subject == "Your account is scheduled for deletion", "unsupported languages get English (%q)", msg.Subject)
+
+	// User data is escaped in HTML, whether it is set in bold or not, and left as it is in plain text.
+	evil := `<script>alert("x")</script>`
+	msg, _ = emails.Render(en, emails.Meetup{With: evil, Place: evil, Time: at})
+	check(!strings.Contains(msg.HTML, "<script>") && strings.Count(msg.HTML, "&lt;script&gt;") == 2,
+		"user data is escaped in HTML")
+	check(strings.Contains(msg.Text, "You are meeting "+evil+".") && msg.Subject == "Meetup with "+evil,
+		"user data is left alone in plain text (%q)", msg.Subject)
+	msg, _ = emails.Render(en, emails.NewDevice{DeviceLabel: evil, Time: at})
+	check(!strings.Contains(msg.HTML, "<script>") && !strings.Contains(msg.Text, "Browser or app"),
+		"device labels are escaped and a missing user agent is left out")
+	msg, _ = emails.Render(id, emails.NewDevice{Time: at})
+	check(strings.Contains(msg.Text, "Perangkat: Perangkat tidak dikenal"), "devices without a label are named as unknown (%q)", msg.Text)
+
+	// Magic links may use an app scheme, which must survive html/template's URL filtering.
+	msg, _ = emails.Render(en, emails.OTP{Code: "7KQ2XD", TTL: ttl, Link: "bearlysocial://sign-in?token=a&b=c"})
+	check(strings.Contains(msg.HTML, `href="bearlysocial://sign-in?token=a&amp;b=c"`) && strings.Contains(msg.Text, "\nbearlysocial://sign-in?token=a&b=c\n"),
+		"magic links keep their scheme (%q)", regexp.MustCompile(`href="[^"]*"`).FindString(msg.HTML))
+	msg, _ = emails.Render(en, emails.OTP{Code: "7KQ2XD", TTL: ttl})
+	check(!strings.Contains(msg.HTML, "href") && !strings.Contains(msg.Text, "link"), "OTP emails leave out the magic link when there is none")
+
+	msg, _ = emails.Render(en, emails.EmailChange{Code: "Q9WB3N", TTL: ttl, NewAddress: "new@example.com"})
+	check(strings.HasPrefix(msg.Text, "You asked to use this email address") && !strings.Contains(msg.Text, "new@example.com"),
+		"the email to the new address does not repeat it (%q)", msg.Text)
+
+	// A locale directory replaces a template for its language and nothing else.
+	fsys := templateFiles()
+	fsys["id/otp.txt.tmpl"] = &fstest.MapFile{Data: []byte(`{{define "subject"}}Kode masuk: {{.Code}}{{end}}{{define "body"}}{{.Code}}{{end}}`)}
+	fsys["id/layout.html.tmpl"] = &fstest.MapFile{Data: []byte(`{{define "layout"}}<main>{{template "body" .}}</main>{{end}}{{define "button"}}{{end}}`)}
+	templates, err := emails.Parse(fsys)
+	check(err == nil, "templates with locale directories parse (%v)", err)
+	if err == nil {
+		msg, _ = templates.Render(id, emails.OTP{Code: "7KQ2XD", TTL: ttl})
+		check(msg.Subject == "Kode masuk: 7KQ2XD" && strings.HasPrefix(msg.HTML, "<main>"), "locale variants are used for their language (%q)", msg.Subject)
+		msg, _ = templates.Render(id, emails.AccountDeletion{GracePeriod: i18n.Duration(time.Hour)})
+		check(strings.HasPrefix(msg.HTML, "<main>") && !strings.Contains(msg.Text, "<main>"), "a locale layout applies to every email of its kind")
+		msg, _ = templates.Render(en, emails.OTP{Code: "7KQ2XD", TTL: ttl})
+		check(msg.Subject == "Your One-Time Password (OTP)" && strings.HasPrefix(msg.HTML, "<!DOCTYPE html>"), "other languages keep the default templates")
+	}
+
+	broken := templateFiles()
+	broken["meetup.txt.tmpl"] = &fstest.MapFile{Data: []byte(`{{define "body"}}no subject{{end}}`)}
+	_, err = emails.Parse(broken)
+	check(err != nil, "an email without a subject is rejected (%v)", err)
+	broken = templateFiles()
+	delete(broken, "new_device.html.tmpl")
+	_, err = emails.Parse(broken)
+	check(err != nil, "a missing template is rejected (%v)", err)
+	broken = templateFiles()
+	broken["id/otp.html.tmpl"] = &fstest.MapFile{Data: []byte(`{{define "body"}}{{.Code}`)}
+	_, err = emails.Parse(broken)
+	check(err != nil && strings.Contains(err.Error(), "id/otp.html.tmpl"), "syntax errors name the file (%v)", err)
+
+	endToEnd()
+
+	if failed {
+		fmt.Println("EMAILS TEST FAILED.")
+		os.Exit(1)
+	}
+	fmt.Println("EMAILS TEST PASSED.")
+}
+
+func endToEnd() {
+	users := repository.NewMemoryUserAccounts()
+	sessions := repository.NewMemorySessions()
+	unlimited := repository.Bucket{Capacity: 1 << 20, RefillInterval: 1}
+	mail := &mailer.CaptureMailer{}
+	h := &handler.Handler{
+		Users:               users,
+		Sessions:            sessions,
+		Mailer:              mail,
+		RateLimits:          repository.NewMemoryRateLimits(),
+		OTPRequestLimits:    handler.OTPRequestLimits{PerIP: unlimited, PerEmail: unlimited, Global: unlimited},
+		OTPSecret:           []byte("emails-test-secret-emails-test-secret"),
+		OTPPolicy:           util.DefaultOTPPolicy(),
+		MagicLinkURL:        "bearlysocial://sign-in",
+		SessionLifetime:     time.Hour,
+		AccessTokenLifetime: time.Hour,
+		RotationGrace:       time.Second,
+		DeletionGracePeriod: 30 * 24 * time.Hour,
+	}
+
+	routes := router.New(middleware.RequestID, middleware.Language)
+	public := routes.Group("")
+	protected := routes.Group("", middleware.ValidateToken(users, sessions, h.SessionLimits()))
+	public.HandleFunc(http.MethodPost, "/request-otp", h.RequestOTP)
+	public.HandleFunc(http.MethodPost, "/validate-otp", h.ValidateOTP)
+	protected.HandleFunc(http.MethodPatch, "/update-profile", h.UpdateProfile)
+	protected.HandleFunc(http.MethodDelete, "/delete-account", h.DeleteAccount)
+	server := httptest.NewServer(routes)
+	defer server.Close()
+
+	call := func(method, path, token, userAgent string, body interface{}, out interface{}) int {
+		raw, _ := json.Marshal(body)
+		req, _ := http.NewRequest(method, server.URL+path, bytes.NewReader(raw))
+		if token != "" {
+			req.Header.Set("Authorization", token)
+		}
+		req.Header.Set("User-Agent", userAgent)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return 0
+		}
+		defer resp.Body.Close()
+		if out != nil {
+			json.NewDecoder(resp.Body).Decode(out)
+		}
+		return resp.StatusCode
+	}
+
+	email := "mail@example.com"
+	signIn := func(userAgent string) string {
+		call(http.MethodPost, "/request-otp", "", userAgent, map[string]string{"email_address": email}, nil)
+		msg, _ := mail.Last(email)
+		otp := regexp.MustCompile(`: (\S+)\n`).FindStringSubmatch(msg.Text)
+		if otp == nil {
+			return ""
+		}
+		var signedIn struct {
+			Token string `json:"token"`
+		}
+		call(http.MethodPost, "/validate-otp", "", userAgent, map[string]string{"email_address": email, "otp": otp[1], "device_label": "Test device"}, &signedIn)
+		return signedIn.Token
+	}
+
+	call(http.MethodPost, "/request-otp", "", "Phone/1.0", map[string]string{"email_address": email}, nil)
+	msg, _ := mail.Last(email)
+	check(msg.Subject == "Your One-Time Password (OTP)" && strings.Contains(msg.HTML, `href="bearlysocial://sign-in?token=`) && strings.Contains(msg.HTML, "<!DOCTYPE html>"),
+		"OTP emails are rendered from the templates, with the magic link")
+
+	token := signIn("Phone/1.0")
+	check(token != "", "signed in")
+	count := len(mail.Messages())
+	signIn("Phone/1.0")
+	check(len(mail.Messages()) == count+1, "signing in on the first device, or again on a known one, sends no alert")
+
+	call(http.MethodPatch, "/update-profile", token, "Phone/1.0", map[string]interface{}{"langs": []string{"id"}}, nil)
+	signIn("Laptop/2.0")
+	msg, _ = mail.Last(email)
+	check(msg.Subject == "Aktivitas masuk baru ke akun Anda" && strings.Contains(msg.Text, "Laptop/2.0") && strings.Contains(msg.Text, "Test device"),
+		"signing in on a new device alerts the owner, in their languages (%q)", msg.Subject)
+
+	count = len(mail.Messages())
+	status := call(http.MethodDelete, "/delete-account", token, "Phone/1.0", nil, nil)
+	msg, _ = mail.Last(email)
+	check(status == http.StatusOK && len(mail.Messages()) == count+1 && msg.Subject == "Akun Anda dijadwalkan untuk dihapus" && strings.Contains(msg.Text, "30 hari"),
+		"scheduling deletion sends a confirmation with the grace period (%d %q)", status, msg.Subject)
+}
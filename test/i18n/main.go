@@ -0,0 +1,302 @@
+// Checks that every user-facing English string in the API and the email templates has a translation in each
+// catalog, that languages are negotiated from Accept-Language and then the user's languages, that durations are
+// pluralized, and that errors, messages and OTP emails come out in the negotiated language. Run from the
+// repository root.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/text/language"
+
+	"bearlysocial-backend/api/handler"
+	"bearlysocial-backend/api/middleware"
+	"bearlysocial-backend/api/repository"
+	"bearlysocial-backend/api/router"
+	"bearlysocial-backend/i18n"
+	"bearlysocial-backend/mailer"
+	"bearlysocial-backend/util"
+)
+
+var failed bool
+
+func check(ok bool, format string, args ...interface{}) {
+	if ok {
+		fmt.Printf("PASS: "+format+"\n", args...)
+	} else {
+		fmt.Printf("FAIL: "+format+"\n", args...)
+		failed = true
+	}
+}
+
+// Which argument of a call is translated, by the name of the function called.
+var translatedArg = map[string]int{
+	"problem.Write":      2,
+	"util.ReturnMessage": 2,
+	"i18n.Sprintf":       1,
+	"i18n.Translate":     1,
+}
+
+// Calls of the translating functions of email templates, as in {{t "..."}} or (tbold "..." .TTL).
+var templateCall = regexp.MustCompile(`(?:\{\{-?\s*|\()(?:t|tbold)\s+("(?:[^"\\]|\\.)*")`)
+
+// Returns every English string in the API and the email templates that is shown to users, with where it is.
+func sourceStrings() map[string]string {
+	found := make(map[string]string)
+	fset := token.NewFileSet()
+	add := func(expr ast.Expr) {
+		if lit, ok := expr.(*ast.BasicLit); ok && lit.Kind == token.STRING {
+			s, _ := strconv.Unquote(lit.Value)
+			found[s] = fset.Position(lit.Pos()).String()
+		}
+	}
+
+	filepath.WalkDir("api", func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !strings.HasSuffix(path, ".go") {
+			return err
+		}
+		file, err := parser.ParseFile(fset, path, nil, 0)
+		if err != nil {
+			return err
+		}
+		ast.Inspect(file, func(n ast.Node) bool {
+			switch n := n.(type) {
+			case *ast.CallExpr:
+				name := ""
+				switch fun := n.Fun.(type) {
+				case *ast.Ident:
+					name = fun.Name
+				case *ast.SelectorExpr:
+					name = fun.Sel.Name
+					if x, ok := fun.X.(*ast.Ident); ok && x.Name != "h" {
+						name = x.Name + "." + name
+					}
+					// problem.SomeType.New(format, ...)
+					if inner, ok := fun.X.(*ast.SelectorExpr); ok && fun.Sel.Name == "New" {
+						if x, ok := inner.X.(*ast.Ident); ok && x.Name == "problem" && len(n.Args) > 0 {
+							add(n.Args[0])
+						}
+					}
+				}
+				if i, ok := translatedArg[name]; ok && i < len(n.Args) {
+					add(n.Args[i])
+				}
+			case *ast.CompositeLit:
+				// The titles of problem types.
+				if t, ok := n.Type.(*ast.Ident); ok && t.Name == "Type" && len(n.Elts) == 3 {
+					add(n.Elts[2])
+				}
+			}
+			return true
+		})
+		return nil
+	})
+
+	filepath.WalkDir("emails/templates", func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		for _, m := range templateCall.FindAllSubmatch(data, -1) {
+			s, _ := strconv.Unquote(string(m[1]))
+			found[s] = path
+		}
+		return nil
+	})
+	return found
+}
+
+func verbs(s string) string {
+	return strings.Join(regexp.MustCompile(`%[a-z]`).FindAllString(s, -1), "")
+}
+
+type response struct {
+	status   int
+	language string
+	message  string
+	code     string
+}
+
+func main() {
+	strs := sourceStrings()
+	check(len(strs) > 100, "found the user-facing strings (%d)", len(strs))
+	for _, tag := range i18n.Supported[1:] {
+		missing := 0
+		for s, pos := range strs {
+			translated := i18n.Translate(tag, s)
+			if translated == s {
+				fmt.Printf("MISSING %s: %q (%s)\n", tag, s, pos)
+				missing++
+			} else if verbs(translated) != verbs(s) {
+				fmt.Printf("VERBS DIFFER %s: %q → %q\n", tag, s, translated)
+				missing++
+			}
+		}
+		check(missing == 0, "every string has a %s translation with the same verbs (%d missing)", tag, missing)
+	}
+
+	en, id := language.English, language.Indonesian
+	for _, c := range []struct {
+		accept string
+		langs  []string
+		want   language.Tag
+	}{
+		{"", nil, en},
+		{"id-ID,id;q=0.9,en;q=0.8", nil, id},
+		{"en-US,en;q=0.9,id;q=0.8", []string{"id"}, en},
+		{"fr-FR,fr;q=0.9", []string{"de", "id"}, id},
+		{"fr-FR", nil, en},
+		{"", []string{"id", "en"}, id},
+		{"garbage;;q=x", []string{"id"}, id},
+		{"en-GB", nil, en},
+		{"*", []string{"id"}, id},
+	} {
+		got := i18n.Negotiate(c.accept, c.langs)
+		check(got == c.want, "Negotiate(%q, %v) = %s (got %s)", c.accept, c.langs, c.want, got)
+	}
+
+	for _, c := range []struct {
+		d      time.Duration
+		en, id string
+	}{
+		{time.Second, "1 second", "1 detik"},
+		{0, "1 second", "1 detik"},
+		{45 * time.Second, "45 seconds", "45 detik"},
+		{59500 * time.Millisecond, "1 minute", "1 menit"},
+		{time.Minute, "1 minute", "1 menit"},
+		{90 * time.Second, "1 minute 30 seconds", "1 menit 30 detik"},
+		{5 * time.Minute, "5 minutes", "5 menit"},
+		{time.Hour, "1 hour", "1 jam"},
+		{time.Hour + 30*time.Minute, "1 hour 30 minutes", "1 jam 30 menit"},
+		{time.Hour + 10*time.Second, "1 hour 1 minute", "1 jam 1 menit"},
+		{2 * time.Hour, "2 hours", "2 jam"},
+		{24 * time.Hour, "1 day", "1 hari"},
+		{30 * 24 * time.Hour, "30 days", "30 hari"},
+		{36 * time.Hour, "1 day 12 hours", "1 hari 12 jam"},
+	} {
+		gotEN, gotID := i18n.Duration(c.d).Localize(en), i18n.Duration(c.d).Localize(id)
+		check(gotEN == c.en && gotID == c.id, "%v reads %q / %q (%q / %q)", c.d, c.en, c.id, gotEN, gotID)
+	}
+	check(i18n.Sprintf(id, "Please wait %s before trying again.", i18n.Duration(time.Hour)) == "Harap tunggu 1 jam sebelum mencoba lagi.",
+		"durations are spelled out in the language of the text (%q)", i18n.Sprintf(id, "Please wait %s before trying again.", i18n.Duration(time.Hour)))
+	check(i18n.Translate(language.MustParse("de"), "Invalid request format.") == "Invalid request format.", "unsupported languages get English")
+
+	endToEnd()
+
+	if failed {
+		fmt.Println("I18N TEST FAILED.")
+		os.Exit(1)
+	}
+	fmt.Println("I18N TEST PASSED.")
+}
+
+func endToEnd() {
+	users := repository.NewMemoryUserAccounts()
+	sessions := repository.NewMemorySessions()
+	unlimited := repository.Bucket{Capacity: 1 << 20, RefillInterval: 1}
+	mail := &mailer.CaptureMailer{}
+	h := &handler.Handler{
+		Users:               users,
+		Sessions:            sessions,
+		Mailer:              mail,
+		RateLimits:          repository.NewMemoryRateLimits(),
+		OTPRequestLimits:    handler.OTPRequestLimits{PerIP: unlimited, PerEmail: unlimited, Global: unlimited},
+		OTPSecret:           []byte("i18n-test-secret-i18n-test-secret-i18n"),
+		OTPPolicy:           util.DefaultOTPPolicy(),
+		SessionLifetime:     time.Hour,
+		AccessTokenLifetime: time.Hour,
+		RotationGrace:       time.Second,
+	}
+
+	routes := router.New(middleware.RequestID, middleware.Language)
+	public := routes.Group("")
+	protected := routes.Group("", middleware.ValidateToken(users, sessions, h.SessionLimits()))
+	public.HandleFunc(http.MethodPost, "/request-otp", h.RequestOTP)
+	public.HandleFunc(http.MethodPost, "/validate-otp", h.ValidateOTP)
+	protected.HandleFunc(http.MethodPatch, "/update-profile", h.UpdateProfile)
+	protected.HandleFunc(http.MethodPost, "/logout", h.Logout)
+	server := httptest.NewServer(routes)
+	defer server.Close()
+
+	call := func(method, path, token, acceptLanguage string, body interface{}, out interface{}) response {
+		raw, _ := json.Marshal(body)
+		req, _ := http.NewRequest(method, server.URL+path, bytes.NewReader(raw))
+		if token != "" {
+			req.Header.Set("Authorization", token)
+		}
+		if acceptLanguage != "" {
+			req.Header.Set("Accept-Language", acceptLanguage)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return response{message: err.Error()}
+		}
+		defer resp.Body.Close()
+		var buf bytes.Buffer
+		buf.ReadFrom(resp.Body)
+		if out != nil {
+			json.Unmarshal(buf.Bytes(), out)
+		}
+		var res struct {
+			Message string `json:"message"`
+			Code    string `json:"code"`
+		}
+		json.Unmarshal(buf.Bytes(), &res)
+		return response{resp.StatusCode, resp.Header.Get("Content-Language"), res.Message, res.Code}
+	}
+
+	res := call(http.MethodPost, "/request-otp", "", "id-ID,id;q=0.9", map[string]string{"email_address": "nope"}, nil)
+	check(res.language == "id" && res.code == "invalid_field" && res.message == "Format email tidak valid.", "errors follow Accept-Language (%s %q)", res.language, res.message)
+	res = call(http.MethodPost, "/request-otp", "", "", map[string]string{"email_address": "nope"}, nil)
+	check(res.language == "en" && res.message == "Invalid email format.", "English is the default (%s %q)", res.language, res.message)
+
+	email := "pengguna@example.com"
+	res = call(http.MethodPost, "/request-otp", "", "id", map[string]string{"email_address": email}, nil)
+	msg, _ := mail.Last(email)
+	check(res.status == http.StatusOK && msg.Subject == "Kata Sandi Sekali Pakai (OTP) Anda", "the OTP email subject is in Indonesian (%q)", msg.Subject)
+	check(strings.Contains(msg.Text, "berlaku hanya selama 8 menit") && strings.Contains(msg.HTML, `<span style="font-weight: bold;">8 menit</span>`),
+		"the OTP email body is in Indonesian, with a pluralized validity (%q)", msg.Text)
+
+	otp := regexp.MustCompile(`: (\S+)`).FindStringSubmatch(msg.Text)[1]
+	var signedIn struct {
+		Token string `json:"token"`
+	}
+	call(http.MethodPost, "/validate-otp", "", "", map[string]string{"email_address": email, "otp": otp}, &signedIn)
+
+	// Without Accept-Language, signed-in users are answered in their own languages.
+	res = call(http.MethodPatch, "/update-profile", signedIn.Token, "", map[string]interface{}{"langs": []string{"id"}}, nil)
+	check(res.status == http.StatusOK, "set the account's languages (%d %s)", res.status, res.message)
+	res = call(http.MethodPatch, "/update-profile", signedIn.Token, "", map[string]interface{}{"mood": strings.Repeat("x", 1000)}, nil)
+	check(res.language == "id" && res.code == "invalid_field" && res.message == "Suasana hati tidak valid.", "the account's languages are the fallback (%s %q)", res.language, res.message)
+	res = call(http.MethodPatch, "/update-profile", signedIn.Token, "en-US", map[string]interface{}{"mood": strings.Repeat("x", 1000)}, nil)
+	check(res.language == "en" && res.message == "Invalid mood.", "Accept-Language wins over the account's languages (%s %q)", res.language, res.message)
+
+	// The next OTP email goes out in the account's language even without Accept-Language.
+	call(http.MethodPost, "/request-otp", "", "", map[string]string{"email_address": email}, nil)
+	msg, _ = mail.Last(email)
+	check(strings.HasPrefix(msg.Text, "Kata Sandi Sekali Pakai (OTP) Anda adalah:"), "emails fall back to the account's languages (%q)", msg.Text)
+
+	res = call(http.MethodPost, "/logout", signedIn.Token, "", nil, nil)
+	check(res.status == http.StatusOK && res.message == "Berhasil keluar.", "success messages are translated too (%q)", res.message)
+
+	user_acc, _ := users.FindByEmail(context.Background(), email)
+	check(len(user_acc.Langs) == 1 && user_acc.Langs[0] == "id", "the account kept its languages")
+}
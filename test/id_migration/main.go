@@ -0,0 +1,221 @@
+// Moves an account whose ID is its email address to a generated ID, the way main does at startup, and checks
+// that its session, pending MFA token, authenticator app and recovery codes all come along.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base32"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"bearlysocial-backend/api/handler"
+	"bearlysocial-backend/api/middleware"
+	"bearlysocial-backend/api/model"
+	"bearlysocial-backend/api/repository"
+	"bearlysocial-backend/mailer"
+	"bearlysocial-backend/util"
+)
+
+type harness struct {
+	server *httptest.Server
+	mail   *mailer.CaptureMailer
+	failed bool
+}
+
+// Sends a JSON request, decoding a JSON response into out if it is not nil.
+func (t *harness) call(path, token string, body, out interface{}) (int, string) {
+	method := http.MethodPost
+	if path == "/sessions" {
+		method = http.MethodGet
+	}
+	raw, _ := json.Marshal(body)
+	req, _ := http.NewRequest(method, t.server.URL+path, bytes.NewReader(raw))
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err.Error()
+	}
+	defer resp.Body.Close()
+
+	data, _ := io.ReadAll(resp.Body)
+	if out != nil {
+		json.Unmarshal(data, out)
+	}
+	var res struct {
+		Message string `json:"message"`
+	}
+	json.Unmarshal(data, &res)
+	return resp.StatusCode, res.Message
+}
+
+func (t *harness) check(ok bool, format string, args ...interface{}) {
+	if ok {
+		fmt.Printf("PASS: "+format+"\n", args...)
+	} else {
+		fmt.Printf("FAIL: "+format+"\n", args...)
+		t.failed = true
+	}
+}
+
+type signInResult struct {
+	UID      string `json:"uid"`
+	Email    string `json:"email_address"`
+	Token    string `json:"token"`
+	MFAToken string `json:"mfa_token"`
+}
+
+// Completes the emailed-OTP step of a sign-in.
+func (t *harness) firstFactor(email string) signInResult {
+	t.call("/request-otp", "", map[string]string{"email_address": email}, nil)
+	msg, _ := t.mail.Last(email)
+	otp := regexp.MustCompile(`is: (\S+)`).FindStringSubmatch(msg.Text)[1]
+
+	var res signInResult
+	t.call("/validate-otp", "", map[string]string{"email_address": email, "otp": otp}, &res)
+	return res
+}
+
+func (t *harness) verify(mfaToken, code string) (int, string, signInResult) {
+	var res signInResult
+	status, msg := t.call("/verify-mfa", "", map[string]string{"mfa_token": mfaToken, "code": code}, &res)
+	return status, msg, res
+}
+
+func main() {
+	if !run() {
+		fmt.Println("ID MIGRATION TEST FAILED.")
+		os.Exit(1)
+	}
+	fmt.Println("ID MIGRATION TEST PASSED.")
+}
+
+func run() bool {
+	users := repository.NewMemoryUserAccounts()
+	sessions := repository.NewMemorySessions()
+	challenges := repository.NewMemoryChallenges()
+	unlimited := repository.Bucket{Capacity: 1 << 20, RefillInterval: 1}
+
+	h := &handler.Handler{
+		Users:               users,
+		Sessions:            sessions,
+		Mailer:              &mailer.CaptureMailer{},
+		RateLimits:          repository.NewMemoryRateLimits(),
+		OTPRequestLimits:    handler.OTPRequestLimits{PerIP: unlimited, PerEmail: unlimited, Global: unlimited},
+		Challenges:          challenges,
+		OTPSecret:           []byte("id-migration-test-secret-id-migration"),
+		OTPPolicy:           util.DefaultOTPPolicy(),
+		TOTPIssuer:          "BearlySocial",
+		SecondFactorLimit:   unlimited,
+		SessionLifetime:     time.Hour,
+		AccessTokenLifetime: time.Hour,
+		RotationGrace:       time.Second,
+	}
+	auth := middleware.ValidateToken(users, sessions, h.SessionLimits())
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/request-otp", h.RequestOTP)
+	mux.HandleFunc("/validate-otp", h.ValidateOTP)
+	mux.HandleFunc("/verify-mfa", h.VerifyMFA)
+	mux.Handle("/begin-totp-enrollment", auth(http.HandlerFunc(h.BeginTOTPEnrollment)))
+	mux.Handle("/confirm-totp-enrollment", auth(http.HandlerFunc(h.ConfirmTOTPEnrollment)))
+	mux.Handle("/regenerate-recovery-codes", auth(http.HandlerFunc(h.RegenerateRecoveryCodes)))
+	mux.Handle("/sessions", auth(http.HandlerFunc(h.ListSessions)))
+
+	t := &harness{server: httptest.NewServer(mux), mail: h.Mailer.(*mailer.CaptureMailer)}
+	defer t.server.Close()
+	ctx := context.Background()
+
+	// An account as it was before IDs were generated, with its address filled in by FillEmails.
+	email := "legacy@example.com"
+	users.Create(ctx, model.UserAccount{ID: email, Email: email, CreatedAt: time.Now()})
+
+	res := t.firstFactor(email)
+	t.check(res.UID == email && res.Token != "", "the legacy account signs in under its old ID (%s)", res.UID)
+	token := res.Token
+
+	var enrollment struct {
+		Secret string `json:"secret"`
+	}
+	t.call("/begin-totp-enrollment", token, nil, &enrollment)
+	key, _ := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(enrollment.Secret)
+	code := func(offset int64) string {
+		return util.TOTPCode(key, util.TOTPStep(time.Now())+offset)
+	}
+	var recovery struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	status, msg := t.call("/confirm-totp-enrollment", token, map[string]string{"code": code(-1)}, &recovery)
+	t.check(status == http.StatusOK && len(recovery.RecoveryCodes) > 3, "enroll an authenticator app under the old ID (%d %s)", status, msg)
+
+	pending := t.firstFactor(email)
+	t.check(pending.MFAToken != "", "an MFA token is outstanding during the migration")
+
+	// A pending OTP cannot be carried over, so it is expected to stop working.
+	t.call("/request-otp", "", map[string]string{"email_address": email}, nil)
+	mail, _ := t.mail.Last(email)
+	staleOTP := regexp.MustCompile(`is: (\S+)`).FindStringSubmatch(mail.Text)[1]
+
+	moved, err := users.MoveToGeneratedIDs(
+		ctx,
+		util.GenerateUserID,
+		func(oldID string, user_acc *model.UserAccount) error {
+			return handler.RebindAccount(h.OTPSecret, oldID, user_acc)
+		},
+		func(oldID, newID string) error {
+			if _, err := sessions.ChangeUserID(ctx, oldID, newID); err != nil {
+				return err
+			}
+			_, err := challenges.ChangeUserID(ctx, oldID, newID)
+			return err
+		},
+	)
+	t.check(err == nil && moved == 1, "one account is moved (%d %v)", moved, err)
+
+	user_acc, err := users.FindByEmail(ctx, email)
+	t.check(err == nil && user_acc.ID != email && !strings.Contains(user_acc.ID, "@"), "the account has a generated ID (%s %v)", user_acc.ID, err)
+	_, err = users.Find(ctx, email)
+	t.check(err == repository.ErrNotFound, "nothing is left under the old ID (%v)", err)
+
+	moved, err = users.MoveToGeneratedIDs(ctx, util.GenerateUserID, nil, nil)
+	t.check(err == nil && moved == 0, "running the migration again moves nothing (%d %v)", moved, err)
+
+	var list []model.Session
+	status, _ = t.call("/sessions", token, nil, &list)
+	t.check(status == http.StatusOK && len(list) == 1 && list[0].UserID == user_acc.ID, "the existing session follows the account (%d)", status)
+
+	status, msg, signedIn := t.verify(pending.MFAToken, code(0))
+	t.check(status == http.StatusOK && signedIn.UID == user_acc.ID, "the outstanding MFA token and the resealed app sign in (%d %s)", status, msg)
+
+	status, msg = t.call("/validate-otp", "", map[string]string{"email_address": email, "otp": staleOTP}, nil)
+	t.check(status == http.StatusBadRequest, "the OTP from before the move is dropped (%d %s)", status, msg)
+
+	res = t.firstFactor(email)
+	status, msg, signedIn = t.verify(res.MFAToken, recovery.RecoveryCodes[0])
+	t.check(status == http.StatusOK && signedIn.Token != "", "recovery codes from before the move still work (%d %s)", status, msg)
+
+	var regenerated struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	status, msg = t.call("/regenerate-recovery-codes", token, map[string]string{"code": recovery.RecoveryCodes[1]}, &regenerated)
+	t.check(status == http.StatusOK, "regenerate recovery codes (%d %s)", status, msg)
+	user_acc, _ = users.Find(ctx, user_acc.ID)
+	t.check(user_acc.TOTP.RecoveryCodesUID == "", "new recovery codes are hashed under the new ID")
+
+	res = t.firstFactor(email)
+	status, msg, _ = t.verify(res.MFAToken, recovery.RecoveryCodes[2])
+	t.check(status == http.StatusBadRequest, "the old recovery codes stop working (%d %s)", status, msg)
+	status, msg, signedIn = t.verify(res.MFAToken, regenerated.RecoveryCodes[0])
+	t.check(status == http.StatusOK && signedIn.Token != "", "the new recovery codes work (%d %s)", status, msg)
+
+	return !t.failed
+}
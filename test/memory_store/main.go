@@ -0,0 +1,122 @@
+// Signs in by OTP through the real handlers with the in-memory account store, as STORAGE=memory runs the server,
+// and checks what the store holds at each step: the account created on request, the OTP kept only as a digest,
+// and the OTP cleared once it has been used.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"bearlysocial-backend/api/handler"
+	"bearlysocial-backend/api/repository"
+	"bearlysocial-backend/mailer"
+	"bearlysocial-backend/util"
+)
+
+var failed bool
+
+func check(ok bool, format string, args ...interface{}) {
+	if ok {
+		fmt.Printf("PASS: "+format+"\n", args...)
+	} else {
+		fmt.Printf("FAIL: "+format+"\n", args...)
+		failed = true
+	}
+}
+
+func main() {
+	ctx := context.Background()
+	users := repository.NewMemoryUserAccounts()
+	mail := &mailer.CaptureMailer{}
+	unlimited := repository.Bucket{Capacity: 1 << 20, RefillInterval: 1}
+	h := &handler.Handler{
+		Users:               users,
+		Sessions:            repository.NewMemorySessions(),
+		Mailer:              mail,
+		RateLimits:          repository.NewMemoryRateLimits(),
+		OTPRequestLimits:    handler.OTPRequestLimits{PerIP: unlimited, PerEmail: unlimited, Global: unlimited},
+		OTPSecret:           []byte("memory-store-test-secret-memory-store"),
+		OTPPolicy:           util.DefaultOTPPolicy(),
+		SessionLifetime:     time.Hour,
+		AccessTokenLifetime: time.Minute,
+		RotationGrace:       time.Second,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/request-otp", h.RequestOTP)
+	mux.HandleFunc("/validate-otp", h.ValidateOTP)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	post := func(path string, body map[string]string, out interface{}) int {
+		raw, _ := json.Marshal(body)
+		resp, err := http.Post(server.URL+path, "application/json", bytes.NewReader(raw))
+		if err != nil {
+			return 0
+		}
+		defer resp.Body.Close()
+		if out != nil {
+			json.NewDecoder(resp.Body).Decode(out)
+		}
+		return resp.StatusCode
+	}
+
+	email := "memory@example.com"
+	_, err := users.FindByEmail(ctx, email)
+	check(err == repository.ErrNotFound, "the store starts out empty (%v)", err)
+
+	status := post("/request-otp", map[string]string{"email_address": email}, nil)
+	check(status == http.StatusOK, "request an OTP (%d)", status)
+	user_acc, err := users.FindByEmail(ctx, email)
+	check(err == nil && user_acc.ID != "" && user_acc.Email == email, "the account is created in the store (%v)", err)
+	check(user_acc.OTP != nil && user_acc.OTP_ExpiryTime != nil, "the store holds a pending OTP")
+
+	msg, ok := mail.Last(email)
+	match := regexp.MustCompile(`is: (\S+)`).FindStringSubmatch(msg.Text)
+	check(ok && match != nil, "the OTP is emailed to the address")
+	if match == nil {
+		fmt.Println("MEMORY STORE TEST FAILED.")
+		os.Exit(1)
+	}
+	otp := match[1]
+	check(*user_acc.OTP != otp, "the store keeps a digest, not the OTP itself")
+
+	// Accounts handed out by the store are copies, so changing one changes nothing stored.
+	user_acc.Email = "changed@example.com"
+	stored, _ := users.Find(ctx, user_acc.ID)
+	check(stored.Email == email, "the store hands out copies (%s)", stored.Email)
+
+	// A well-formed guess that differs from the OTP in its first character.
+	alphabet := h.OTPPolicy.Alphabet
+	wrong := string(alphabet[(strings.IndexByte(alphabet, otp[0])+1)%len(alphabet)]) + otp[1:]
+	status = post("/validate-otp", map[string]string{"email_address": email, "otp": wrong}, nil)
+	check(status == http.StatusBadRequest, "a wrong OTP is refused (%d)", status)
+	stored, _ = users.Find(ctx, user_acc.ID)
+	check(stored.OTP_AttemptCount == 1, "the store counts the failed attempt (%d)", stored.OTP_AttemptCount)
+
+	var res struct {
+		UID   string `json:"uid"`
+		Token string `json:"token"`
+	}
+	status = post("/validate-otp", map[string]string{"email_address": email, "otp": otp}, &res)
+	check(status == http.StatusOK && res.UID == user_acc.ID && res.Token != "", "the emailed OTP signs in (%d %s)", status, res.UID)
+	stored, _ = users.Find(ctx, user_acc.ID)
+	check(stored.OTP == nil && stored.OTP_AttemptCount == 0, "the store clears the used OTP and its attempts")
+
+	status = post("/validate-otp", map[string]string{"email_address": email, "otp": otp}, nil)
+	check(status == http.StatusBadRequest, "the OTP cannot be used twice (%d)", status)
+
+	if failed {
+		fmt.Println("MEMORY STORE TEST FAILED.")
+		os.Exit(1)
+	}
+	fmt.Println("MEMORY STORE TEST PASSED.")
+}
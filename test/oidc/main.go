@@ -0,0 +1,318 @@
+// Signs in through the OpenID Connect endpoints against a local MockProvider and checks that forged, replayed
+// and misdirected sign-ins are refused. With -serve it runs the mock provider on its own instead, for trying
+// the flow against a local server started with OIDC_GOOGLE_ISSUER pointing at it.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"bearlysocial-backend/api/handler"
+	"bearlysocial-backend/api/model"
+	"bearlysocial-backend/api/repository"
+	"bearlysocial-backend/mailer"
+	"bearlysocial-backend/oidc"
+	"bearlysocial-backend/util"
+)
+
+const (
+	clientID     = "bearlysocial-test"
+	clientSecret = "mock-client-secret"
+	redirectURL  = "https://app.bearlysocial.test/oidc-callback"
+)
+
+type harness struct {
+	server *httptest.Server
+	h      *handler.Handler
+	mail   *mailer.CaptureMailer
+	failed bool
+}
+
+func (t *harness) check(ok bool, format string, args ...interface{}) {
+	if ok {
+		fmt.Printf("PASS: "+format+"\n", args...)
+	} else {
+		fmt.Printf("FAIL: "+format+"\n", args...)
+		t.failed = true
+	}
+}
+
+// Sends a JSON request, decoding a JSON response into out if it is not nil.
+func (t *harness) call(method, path string, body, out interface{}) (int, string) {
+	raw, _ := json.Marshal(body)
+	req, _ := http.NewRequest(method, t.server.URL+path, bytes.NewReader(raw))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err.Error()
+	}
+	defer resp.Body.Close()
+
+	data, _ := io.ReadAll(resp.Body)
+	if out != nil {
+		json.Unmarshal(data, out)
+	}
+	var res struct {
+		Message string `json:"message"`
+	}
+	json.Unmarshal(data, &res)
+	return resp.StatusCode, res.Message
+}
+
+type signInResult struct {
+	UID   string `json:"uid"`
+	Email string `json:"email_address"`
+	Token string `json:"token"`
+}
+
+// Starts a sign-in, lets the mock provider approve it, and returns the state and code it redirected back with.
+func (t *harness) authorize(provider string) (string, string) {
+	var auth struct {
+		AuthorizationURL string `json:"authorization_url"`
+	}
+	t.call(http.MethodPost, "/begin-oidc-login", map[string]string{"provider": provider}, &auth)
+
+	noRedirect := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := noRedirect.Get(auth.AuthorizationURL)
+	if err != nil {
+		return "", ""
+	}
+	resp.Body.Close()
+
+	callback, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil || !strings.HasPrefix(callback.String(), redirectURL) {
+		return "", ""
+	}
+	return callback.Query().Get("state"), callback.Query().Get("code")
+}
+
+func (t *harness) finish(state, code string) (int, string, signInResult) {
+	var res signInResult
+	status, msg := t.call(http.MethodPost, "/finish-oidc-login", map[string]string{"state": state, "code": code, "device_label": "Browser"}, &res)
+	return status, msg, res
+}
+
+func (t *harness) signIn(provider string) (int, string, signInResult) {
+	state, code := t.authorize(provider)
+	return t.finish(state, code)
+}
+
+func main() {
+	serve := flag.String("serve", "", "run only the mock provider on this address, e.g. localhost:9000")
+	email := flag.String("email", "mock.user@example.com", "with -serve, the verified address the mock provider signs in as")
+	flag.Parse()
+
+	if *serve != "" {
+		mock, err := oidc.NewMockProvider(clientID, clientSecret)
+		if err != nil {
+			fmt.Println("ERROR:", err)
+			os.Exit(1)
+		}
+		mock.Issuer = "http://" + *serve
+		mock.SetUser(oidc.MockUser{Subject: "mock-" + util.HashToken(*email)[:16], Email: *email, EmailVerified: true})
+		fmt.Printf("Mock provider for client %q (secret %q) at %s.\n", clientID, clientSecret, mock.Issuer)
+		if err := http.ListenAndServe(*serve, mock); err != nil {
+			fmt.Println("ERROR:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if !run() {
+		fmt.Println("OIDC TEST FAILED.")
+		os.Exit(1)
+	}
+	fmt.Println("OIDC TEST PASSED.")
+}
+
+func run() bool {
+	google, err := oidc.NewMockProvider(clientID, clientSecret)
+	apple, err2 := oidc.NewMockProvider(clientID, clientSecret)
+	if err != nil || err2 != nil {
+		fmt.Println("ERROR:", err, err2)
+		return false
+	}
+	googleServer := httptest.NewServer(google)
+	defer googleServer.Close()
+	appleServer := httptest.NewServer(apple)
+	defer appleServer.Close()
+	google.Issuer, apple.Issuer = googleServer.URL, appleServer.URL
+
+	googleProvider := &oidc.Provider{Name: "google", Issuer: google.Issuer, ClientID: clientID, ClientSecret: oidc.StaticClientSecret(clientSecret)}
+	unlimited := repository.Bucket{Capacity: 1 << 20, RefillInterval: 1}
+
+	h := &handler.Handler{
+		Users:            repository.NewMemoryUserAccounts(),
+		Sessions:         repository.NewMemorySessions(),
+		Mailer:           &mailer.CaptureMailer{},
+		RateLimits:       repository.NewMemoryRateLimits(),
+		OTPRequestLimits: handler.OTPRequestLimits{PerIP: unlimited, PerEmail: unlimited, Global: unlimited},
+		Challenges:       repository.NewMemoryChallenges(),
+		OIDCProviders: map[string]*oidc.Provider{
+			"google": googleProvider,
+			"apple":  {Name: "apple", Issuer: apple.Issuer, ClientID: clientID, ClientSecret: oidc.StaticClientSecret(clientSecret)},
+		},
+		OIDCRedirectURL:     redirectURL,
+		OTPSecret:           []byte("oidc-test-secret-oidc-test-secret"),
+		OTPPolicy:           util.DefaultOTPPolicy(),
+		SecondFactorLimit:   unlimited,
+		SignInLimit:         unlimited,
+		SessionLifetime:     time.Hour,
+		AccessTokenLifetime: time.Minute,
+		RotationGrace:       time.Second,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/request-otp", h.RequestOTP)
+	mux.HandleFunc("/begin-oidc-login", h.BeginOIDCLogin)
+	mux.HandleFunc("/finish-oidc-login", h.FinishOIDCLogin)
+	mux.HandleFunc("/verify-mfa", h.VerifyMFA)
+
+	t := &harness{server: httptest.NewServer(mux), h: h, mail: h.Mailer.(*mailer.CaptureMailer)}
+	defer t.server.Close()
+	ctx := context.Background()
+
+	// Sign-in creates the account of a verified address, and later finds it again by subject.
+	google.SetUser(oidc.MockUser{Subject: "g-1", Email: "New.User@Example.com", EmailVerified: true})
+	status, msg, res := t.signIn("google")
+	t.check(status == http.StatusOK && res.Email == "new.user@example.com" && res.Token != "", "sign in and create an account (%d %s %s)", status, msg, res.Email)
+
+	user_acc, _ := h.Users.FindByEmail(ctx, "new.user@example.com")
+	t.check(len(user_acc.Identities) == 1 && user_acc.Identities[0].ID == "google:g-1", "the identity is linked to the account")
+
+	google.SetUser(oidc.MockUser{Subject: "g-1", Email: "renamed@example.com", EmailVerified: true})
+	status, msg, res = t.signIn("google")
+	t.check(status == http.StatusOK && res.Email == "new.user@example.com", "a changed address at the provider keeps the account (%d %s %s)", status, msg, res.Email)
+
+	// An account made through the emailed OTP is linked by its verified address.
+	t.call(http.MethodPost, "/request-otp", map[string]string{"email_address": "otp.user@example.com"}, nil)
+	apple.SetUser(oidc.MockUser{Subject: "a-1", Email: "otp.user@example.com", EmailVerified: true})
+	apple.Tamper(func(claims map[string]interface{}) { claims["email_verified"] = "true" }) // As Apple sends it.
+	status, msg, res = t.signIn("apple")
+	t.check(status == http.StatusOK && res.Email == "otp.user@example.com", "link an existing account by verified address (%d %s %s)", status, msg, res.Email)
+	apple.Tamper(nil)
+
+	google.SetUser(oidc.MockUser{Subject: "g-2", Email: "otp.user@example.com", EmailVerified: false})
+	status, msg, _ = t.signIn("google")
+	t.check(status == http.StatusBadRequest, "an unverified address links nothing (%d %s)", status, msg)
+
+	// On an account with an authenticator app, the provider alone changes nothing until the code is checked.
+	t.call(http.MethodPost, "/request-otp", map[string]string{"email_address": "mfa.user@example.com"}, nil)
+	mfaUser, _ := h.Users.FindByEmail(ctx, "mfa.user@example.com")
+	recoveryCodes, _ := util.GenerateRecoveryCodes(1)
+	h.Users.BeginTOTP(ctx, mfaUser.ID, model.TOTP{Secret: "sealed"})
+	h.Users.ConfirmTOTP(ctx, mfaUser.ID, "sealed", 0, []string{util.HashRecoveryCode(h.OTPSecret, mfaUser.ID, recoveryCodes[0])})
+	h.Users.ScheduleDeletion(ctx, mfaUser.ID, time.Now().Add(time.Hour).UnixMilli())
+
+	google.SetUser(oidc.MockUser{Subject: "g-3", Email: "mfa.user@example.com", EmailVerified: true})
+	var mfa model.MFARequiredResponse
+	state, code := t.authorize("google")
+	status, msg = t.call(http.MethodPost, "/finish-oidc-login", map[string]string{"state": state, "code": code}, &mfa)
+	mfaUser, _ = h.Users.Find(ctx, mfaUser.ID)
+	t.check(status == http.StatusOK && mfa.MFARequired && mfa.MFAToken != "", "the second factor is asked for (%d %s)", status, msg)
+	t.check(len(mfaUser.Identities) == 0 && mfaUser.DeletionTime != nil, "before it is checked, the identity is not linked and the deletion stands")
+
+	status, msg = t.call(http.MethodPost, "/verify-mfa", map[string]string{"mfa_token": mfa.MFAToken, "code": recoveryCodes[0]}, &res)
+	mfaUser, _ = h.Users.Find(ctx, mfaUser.ID)
+	t.check(status == http.StatusOK && res.Token != "", "the second factor finishes the sign-in (%d %s)", status, msg)
+	t.check(len(mfaUser.Identities) == 1 && mfaUser.Identities[0].ID == "google:g-3" && mfaUser.DeletionTime == nil,
+		"after it is checked, the identity is linked and the deletion cancelled")
+
+	// Replayed and made-up callbacks.
+	google.SetUser(oidc.MockUser{Subject: "g-1", Email: "new.user@example.com", EmailVerified: true})
+	state, code = t.authorize("google")
+	status, msg, _ = t.finish(state, code)
+	t.check(status == http.StatusOK, "sign in once more (%d %s)", status, msg)
+	status, msg, _ = t.finish(state, code)
+	t.check(status == http.StatusBadRequest, "the same callback cannot be replayed (%d %s)", status, msg)
+
+	state, _ = t.authorize("google")
+	status, msg, _ = t.finish(state, "made-up-code")
+	t.check(status == http.StatusBadRequest, "a made-up code is refused (%d %s)", status, msg)
+
+	_, code = t.authorize("google")
+	forged, _ := util.GenerateToken()
+	status, msg, _ = t.finish(forged, code)
+	t.check(status == http.StatusBadRequest, "a made-up state is refused (%d %s)", status, msg)
+
+	status, msg = t.call(http.MethodPost, "/begin-oidc-login", map[string]string{"provider": "myspace"}, nil)
+	t.check(status == http.StatusBadRequest, "an unknown provider is refused (%d %s)", status, msg)
+
+	// ID tokens that must not be trusted.
+	for name, tamper := range map[string]func(map[string]interface{}){
+		"another client's token":      func(c map[string]interface{}) { c["aud"] = "someone-else" },
+		"another issuer's token":      func(c map[string]interface{}) { c["iss"] = "https://evil.test" },
+		"a token for another sign-in": func(c map[string]interface{}) { c["nonce"] = "stolen" },
+		"an expired token":            func(c map[string]interface{}) { c["exp"] = time.Now().Add(-time.Hour).Unix() },
+		"a token without subject":     func(c map[string]interface{}) { c["sub"] = "" },
+	} {
+		google.Tamper(tamper)
+		status, msg, _ = t.signIn("google")
+		t.check(status == http.StatusBadRequest, "%s is refused (%d %s)", name, status, msg)
+	}
+	google.Tamper(nil)
+
+	// The same checks through the library, where tokens can be taken apart.
+	verifier, challenge, _ := oidc.NewPKCE()
+	authURL, _ := googleProvider.AuthCodeURL(ctx, redirectURL, "state", "nonce", challenge)
+	exchange := func(verifier string) (string, error) {
+		noRedirect := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+		resp, err := noRedirect.Get(authURL)
+		if err != nil {
+			return "", err
+		}
+		resp.Body.Close()
+		callback, _ := url.Parse(resp.Header.Get("Location"))
+		return googleProvider.Exchange(ctx, callback.Query().Get("code"), verifier, redirectURL)
+	}
+
+	_, err = exchange("wrong-verifier")
+	t.check(errors.Is(err, oidc.ErrVerification), "a code is useless without its PKCE verifier (%v)", err)
+
+	idToken, err := exchange(verifier)
+	_, err = googleProvider.VerifyIDToken(ctx, idToken, "nonce", time.Now())
+	t.check(err == nil, "a genuine token verifies (%v)", err)
+
+	parts := strings.Split(idToken, ".")
+	payload, _ := base64.RawURLEncoding.DecodeString(parts[1])
+	payload = bytes.Replace(payload, []byte(`"g-1"`), []byte(`"g-9"`), 1)
+	altered := parts[0] + "." + base64.RawURLEncoding.EncodeToString(payload) + "." + parts[2]
+	_, err = googleProvider.VerifyIDToken(ctx, altered, "nonce", time.Now())
+	t.check(errors.Is(err, oidc.ErrVerification), "an altered token is refused (%v)", err)
+
+	for _, alg := range []string{"none", "HS256"} {
+		header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"` + alg + `","typ":"JWT"}`))
+		unsigned := header + "." + parts[1] + "."
+		_, err = googleProvider.VerifyIDToken(ctx, unsigned, "nonce", time.Now())
+		t.check(errors.Is(err, oidc.ErrVerification), "a token choosing alg %s is refused (%v)", alg, err)
+	}
+
+	// After a key rotation, tokens under the new key verify once the key set may be fetched again.
+	google.RotateKey()
+	verifier, challenge, _ = oidc.NewPKCE()
+	authURL, _ = googleProvider.AuthCodeURL(ctx, redirectURL, "state", "nonce", challenge)
+	idToken, _ = exchange(verifier)
+	_, err = googleProvider.VerifyIDToken(ctx, idToken, "nonce", time.Now())
+	t.check(errors.Is(err, oidc.ErrVerification), "unknown keys do not trigger a fetch right after the last one (%v)", err)
+	_, err = googleProvider.VerifyIDToken(ctx, idToken, "nonce", time.Now().Add(2*time.Minute))
+	t.check(err == nil, "a rotated key is picked up a minute later (%v)", err)
+
+	h.SignInLimit = repository.Bucket{Capacity: 1, RefillInterval: time.Hour.Milliseconds()}
+	status, msg = t.call(http.MethodPost, "/begin-oidc-login", map[string]string{"provider": "google"}, nil)
+	t.check(status == http.StatusOK, "starting a sign-in is allowed (%d %s)", status, msg)
+	status, msg = t.call(http.MethodPost, "/begin-oidc-login", map[string]string{"provider": "google"}, nil)
+	t.check(status == http.StatusTooManyRequests, "starting sign-ins is rate limited per client (%d %s)", status, msg)
+
+	return !t.failed
+}
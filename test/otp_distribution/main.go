@@ -0,0 +1,160 @@
+// Checks that generated OTPs are uniformly distributed. Draws many codes under the configured policy and runs
+// chi-squared tests on the characters at each position and on pairs of adjacent characters. The same tests
+// are run on the old modulo mapping, which they must reject, to show they are sensitive enough to catch bias.
+package main
+
+import (
+	"crypto/rand"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+
+	"bearlysocial-backend/util"
+)
+
+// One-sided standard normal quantile for a false alarm rate of 0.1% per test.
+const z = 3.09
+
+// Upper critical value of the chi-squared distribution with df degrees of freedom, using the Wilson-Hilferty
+// approximation, which is accurate to well under 1% for the degrees of freedom used here.
+func chiSquaredCritical(df int) float64 {
+	k := float64(df)
+	return k * math.Pow(1-2/(9*k)+z*math.Sqrt(2/(9*k)), 3)
+}
+
+// Chi-squared statistic of observed counts against a uniform expectation.
+func chiSquared(counts []int, total int) float64 {
+	expected := float64(total) / float64(len(counts))
+	var stat float64
+	for _, c := range counts {
+		d := float64(c) - expected
+		stat += d * d / expected
+	}
+	return stat
+}
+
+type result struct {
+	name     string
+	stat     float64
+	critical float64
+}
+
+func (r result) passed() bool {
+	return r.stat <= r.critical
+}
+
+// Runs the per-position and adjacent-pair tests on codes drawn from generate.
+func analyze(policy util.OTPPolicy, samples int, generate func() (string, error)) ([]result, error) {
+	n := len(policy.Alphabet)
+	positions := make([][]int, policy.Length)
+	for i := range positions {
+		positions[i] = make([]int, n)
+	}
+	pairs := make([]int, n*n)
+
+	for s := 0; s < samples; s++ {
+		otp, err := generate()
+		if err != nil {
+			return nil, err
+		}
+		if !policy.Valid(otp) {
+			return nil, fmt.Errorf("generated code %q does not match the policy", otp)
+		}
+
+		prev := -1
+		for i := 0; i < len(otp); i++ {
+			idx := strings.IndexByte(policy.Alphabet, otp[i])
+			positions[i][idx]++
+			if prev >= 0 {
+				pairs[prev*n+idx]++
+			}
+			prev = idx
+		}
+	}
+
+	var results []result
+	for i, counts := range positions {
+		results = append(results, result{
+			name:     fmt.Sprintf("position %d", i+1),
+			stat:     chiSquared(counts, samples),
+			critical: chiSquaredCritical(n - 1),
+		})
+	}
+	results = append(results, result{
+		name:     "adjacent pairs",
+		stat:     chiSquared(pairs, samples*(policy.Length-1)),
+		critical: chiSquaredCritical(n*n - 1),
+	})
+	return results, nil
+}
+
+// The mapping used before rejection sampling: every random byte taken modulo the alphabet size.
+func moduloGenerate(policy util.OTPPolicy) func() (string, error) {
+	return func() (string, error) {
+		b := make([]byte, policy.Length)
+		if _, err := rand.Read(b); err != nil {
+			return "", err
+		}
+		for i, v := range b {
+			b[i] = policy.Alphabet[int(v)%len(policy.Alphabet)]
+		}
+		return string(b), nil
+	}
+}
+
+func report(title string, results []result) bool {
+	fmt.Println(title)
+	ok := true
+	for _, r := range results {
+		status := "PASS"
+		if !r.passed() {
+			status = "FAIL"
+			ok = false
+		}
+		fmt.Printf("  %s: %-15s chi2 = %10.1f, critical = %8.1f\n", status, r.name, r.stat, r.critical)
+	}
+	return ok
+}
+
+func main() {
+	samples := flag.Int("n", 200000, "number of codes to draw")
+	flag.Parse()
+
+	// Honour OTP_LENGTH, OTP_ALPHABET and friends so any configured policy can be checked.
+	policy, err := util.OTPPolicyFromEnv()
+	if err != nil {
+		fmt.Println("ERROR CONFIGURING OTP POLICY:", err)
+		os.Exit(1)
+	}
+	fmt.Printf("POLICY: %d characters from %q, %d samples.\n", policy.Length, policy.Alphabet, *samples)
+
+	results, err := analyze(policy, *samples, policy.Generate)
+	if err != nil {
+		fmt.Println("ERROR GENERATING OTP:", err)
+		os.Exit(1)
+	}
+	uniform := report("REJECTION SAMPLING:", results)
+
+	// Alphabets whose size divides 256 have no modulo bias, so the control only applies to the others.
+	controlRejected := true
+	if 256%len(policy.Alphabet) != 0 {
+		results, err = analyze(policy, *samples, moduloGenerate(policy))
+		if err != nil {
+			fmt.Println("ERROR GENERATING OTP:", err)
+			os.Exit(1)
+		}
+		controlRejected = !report("MODULO MAPPING (CONTROL, EXPECTED TO FAIL):", results)
+	}
+
+	switch {
+	case !uniform:
+		fmt.Println("OTP DISTRIBUTION TEST FAILED: generated codes are not uniform.")
+		os.Exit(1)
+	case !controlRejected:
+		fmt.Println("OTP DISTRIBUTION TEST INCONCLUSIVE: the biased control passed; increase -n.")
+		os.Exit(1)
+	}
+	fmt.Println("OTP DISTRIBUTION TEST PASSED.")
+}
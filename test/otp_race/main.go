@@ -0,0 +1,230 @@
+// Fires parallel OTP requests and guesses at the real handlers to check that the attempt limit holds and that
+// concurrent sign-ups for one address do not fail. Runs against in-memory storage by default; pass -mongo to
+// use the MongoDB configured in .env, in throwaway collections that are dropped afterwards.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"bearlysocial-backend/api/handler"
+	"bearlysocial-backend/api/repository"
+	"bearlysocial-backend/mailer"
+	"bearlysocial-backend/util"
+)
+
+var otpPattern = regexp.MustCompile(`is: (\S+)`)
+
+type harness struct {
+	policy util.OTPPolicy
+	server *httptest.Server
+	mail   *mailer.CaptureMailer
+	failed bool
+}
+
+// Sends a request with a JSON body and returns the status code and the response's message.
+func (t *harness) call(method, path string, body interface{}) (int, string) {
+	raw, _ := json.Marshal(body)
+	req, _ := http.NewRequest(method, t.server.URL+path, bytes.NewReader(raw))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err.Error()
+	}
+	defer resp.Body.Close()
+
+	var res struct {
+		Message string `json:"message"`
+	}
+	data, _ := io.ReadAll(resp.Body)
+	json.Unmarshal(data, &res)
+	return resp.StatusCode, res.Message
+}
+
+func (t *harness) requestOTP(email string) (int, string) {
+	return t.call(http.MethodPost, "/request-otp", map[string]string{"email_address": email})
+}
+
+func (t *harness) validateOTP(email, otp string) (int, string) {
+	return t.call(http.MethodPost, "/validate-otp", map[string]string{"email_address": email, "otp": otp})
+}
+
+// Returns the code from the most recent OTP email sent to the address.
+func (t *harness) lastOTP(email string) string {
+	msg, ok := t.mail.Last(email)
+	if !ok {
+		return ""
+	}
+	match := otpPattern.FindStringSubmatch(msg.Text)
+	if match == nil {
+		return ""
+	}
+	return match[1]
+}
+
+// Runs fn n times in parallel, releasing all goroutines at once.
+func parallel(n int, fn func(i int)) {
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			fn(i)
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+}
+
+func (t *harness) check(ok bool, format string, args ...interface{}) {
+	if ok {
+		fmt.Printf("PASS: "+format+"\n", args...)
+	} else {
+		fmt.Printf("FAIL: "+format+"\n", args...)
+		t.failed = true
+	}
+}
+
+// Concurrent requests for a new address must all succeed; the losers of the insert race reuse the account.
+func (t *harness) signupRace(n int) {
+	email := fmt.Sprintf("signup-%d@example.com", time.Now().UnixNano())
+
+	var mu sync.Mutex
+	statuses := map[int]int{}
+	parallel(n, func(int) {
+		status, _ := t.requestOTP(email)
+		mu.Lock()
+		statuses[status]++
+		mu.Unlock()
+	})
+
+	t.check(statuses[http.StatusOK] == n, "%d parallel OTP requests for a new address all succeed (got %v)", n, statuses)
+}
+
+// Concurrent guesses, optionally including the right code, must never be checked more than maxAttempts times.
+func (t *harness) guessRace(n int, includeCorrect bool) {
+	email := fmt.Sprintf("guess-%d@example.com", time.Now().UnixNano())
+	if status, msg := t.requestOTP(email); status != http.StatusOK {
+		t.check(false, "requesting an OTP (%d %s)", status, msg)
+		return
+	}
+	otp := t.lastOTP(email)
+
+	// A wrong code that still passes format validation.
+	wrong := strings.Repeat(t.policy.Alphabet[:1], t.policy.Length)
+	if otp == wrong {
+		wrong = t.policy.Alphabet[1:2] + wrong[1:]
+	}
+
+	var mu sync.Mutex
+	checked, succeeded := 0, 0
+	parallel(n, func(i int) {
+		guess := wrong
+		if includeCorrect && i == n/2 {
+			guess = otp
+		}
+		status, msg := t.validateOTP(email, guess)
+
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case status == http.StatusOK:
+			checked++
+			succeeded++
+		case strings.Contains(msg, "incorrect") || strings.Contains(msg, "Too many failed attempts"):
+			checked++
+		}
+	})
+
+	t.check(checked <= t.policy.MaxAttempts, "%d parallel guesses (correct code included: %v) were checked %d time(s), at most %d allowed",
+		n, includeCorrect, checked, t.policy.MaxAttempts)
+	if !includeCorrect {
+		t.check(checked == t.policy.MaxAttempts, "every one of the %d attempts was used", t.policy.MaxAttempts)
+	}
+	if succeeded == 0 {
+		status, msg := t.validateOTP(email, otp)
+		t.check(status != http.StatusOK, "the right code is refused once the attempts are used up (%d %s)", status, msg)
+	}
+}
+
+func main() {
+	if !run() {
+		fmt.Println("OTP RACE TEST FAILED.")
+		os.Exit(1)
+	}
+	fmt.Println("OTP RACE TEST PASSED.")
+}
+
+// Runs every scenario and reports whether all of them passed. Kept apart from main so deferred cleanup runs
+// before the process exits.
+func run() bool {
+	useMongo := flag.Bool("mongo", false, "run against the MongoDB configured in .env instead of in-memory storage")
+	n := flag.Int("n", 64, "number of parallel requests per scenario")
+	flag.Parse()
+
+	h := &handler.Handler{
+		Mailer: &mailer.CaptureMailer{},
+		OTPSecret: []byte("otp-race-secret-otp-race-secret!"),
+		OTPPolicy: util.DefaultOTPPolicy(),
+		SessionLifetime: time.Hour,
+		AccessTokenLifetime: time.Minute,
+		RotationGrace: time.Second,
+	}
+
+	// Rate limits are not what is being tested here, so make them generous.
+	unlimited := repository.Bucket{Capacity: 1 << 20, RefillInterval: 1}
+	h.OTPRequestLimits = handler.OTPRequestLimits{PerIP: unlimited, PerEmail: unlimited, Global: unlimited}
+
+	if *useMongo {
+		util.LoadEnv()
+		util.InitMongoDB()
+		defer util.MongoClient.Disconnect(context.Background())
+
+		suffix := fmt.Sprintf("_otp_race_%d", time.Now().UnixNano())
+		colls := []*mongo.Collection{
+			util.MongoDatabase.Collection("users" + suffix),
+			util.MongoDatabase.Collection("sessions" + suffix),
+			util.MongoDatabase.Collection("rate_limits" + suffix),
+		}
+		defer func() {
+			for _, coll := range colls {
+				coll.Drop(context.Background())
+			}
+		}()
+
+		h.Users = repository.NewMongoUserAccounts(colls[0])
+		h.Sessions = repository.NewMongoSessions(colls[1])
+		h.RateLimits = repository.NewMongoRateLimits(colls[2])
+	} else {
+		h.Users = repository.NewMemoryUserAccounts()
+		h.Sessions = repository.NewMemorySessions()
+		h.RateLimits = repository.NewMemoryRateLimits()
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/request-otp", h.RequestOTP)
+	mux.HandleFunc("/validate-otp", h.ValidateOTP)
+
+	t := &harness{policy: h.OTPPolicy, server: httptest.NewServer(mux), mail: h.Mailer.(*mailer.CaptureMailer)}
+	defer t.server.Close()
+
+	t.signupRace(*n)
+	t.guessRace(*n, false)
+	t.guessRace(*n, true)
+
+	return !t.failed
+}
@@ -0,0 +1,415 @@
+// Drives the passkey endpoints with a software authenticator: registers ES256 and Ed25519 passkeys, signs in
+// with them, and checks that replayed, forged and otherwise tampered ceremonies are refused. Runs against
+// in-memory storage and the real handlers.
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"sort"
+	"time"
+
+	"bearlysocial-backend/api/handler"
+	"bearlysocial-backend/api/middleware"
+	"bearlysocial-backend/api/model"
+	"bearlysocial-backend/api/repository"
+	"bearlysocial-backend/mailer"
+	"bearlysocial-backend/util"
+	"bearlysocial-backend/webauthn"
+)
+
+const (
+	rpID   = "bearlysocial.test"
+	origin = "https://bearlysocial.test"
+)
+
+var b64 = base64.RawURLEncoding
+
+// Encodes the few CBOR shapes an authenticator produces: integers, byte and text strings, and maps with
+// integer or text keys, in canonical key order.
+func cbor(v interface{}) []byte {
+	head := func(major byte, n uint64) []byte {
+		switch {
+		case n < 24:
+			return []byte{major<<5 | byte(n)}
+		case n < 1<<8:
+			return []byte{major<<5 | 24, byte(n)}
+		case n < 1<<16:
+			return []byte{major<<5 | 25, byte(n >> 8), byte(n)}
+		default:
+			b := []byte{major<<5 | 26, 0, 0, 0, 0}
+			binary.BigEndian.PutUint32(b[1:], uint32(n))
+			return b
+		}
+	}
+
+	switch v := v.(type) {
+	case int:
+		if v < 0 {
+			return head(1, uint64(-1-v))
+		}
+		return head(0, uint64(v))
+	case []byte:
+		return append(head(2, uint64(len(v))), v...)
+	case string:
+		return append(head(3, uint64(len(v))), v...)
+	case map[interface{}]interface{}:
+		var entries [][2][]byte
+		for k, val := range v {
+			entries = append(entries, [2][]byte{cbor(k), cbor(val)})
+		}
+		// Canonical CBOR orders keys by their encoding, shortest first.
+		sort.Slice(entries, func(i, j int) bool {
+			a, b := entries[i][0], entries[j][0]
+			if len(a) != len(b) {
+				return len(a) < len(b)
+			}
+			return bytes.Compare(a, b) < 0
+		})
+		out := head(5, uint64(len(v)))
+		for _, e := range entries {
+			out = append(append(out, e[0]...), e[1]...)
+		}
+		return out
+	}
+	panic(fmt.Sprintf("cbor: unsupported type %T", v))
+}
+
+// A software authenticator holding one credential.
+type authenticator struct {
+	id        []byte
+	ecKey     *ecdsa.PrivateKey
+	edKey     ed25519.PrivateKey
+	signCount uint32
+
+	// Knobs for producing broken responses.
+	rpID   string
+	origin string
+	flags  byte
+	tamper bool
+}
+
+func newAuthenticator(alg int64) *authenticator {
+	a := &authenticator{id: make([]byte, 16), rpID: rpID, origin: origin, flags: 0x01 | 0x04}
+	rand.Read(a.id)
+	if alg == webauthn.AlgEdDSA {
+		_, a.edKey, _ = ed25519.GenerateKey(rand.Reader)
+	} else {
+		a.ecKey, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	}
+	return a
+}
+
+func (a *authenticator) coseKey() []byte {
+	if a.edKey != nil {
+		return cbor(map[interface{}]interface{}{1: 1, 3: -8, -1: 6, -2: []byte(a.edKey.Public().(ed25519.PublicKey))})
+	}
+	x := a.ecKey.PublicKey.X.FillBytes(make([]byte, 32))
+	y := a.ecKey.PublicKey.Y.FillBytes(make([]byte, 32))
+	return cbor(map[interface{}]interface{}{1: 2, 3: -7, -1: 1, -2: x, -3: y})
+}
+
+func (a *authenticator) authData(attested bool) []byte {
+	rpIDHash := sha256.Sum256([]byte(a.rpID))
+	data := append([]byte(nil), rpIDHash[:]...)
+	flags := a.flags
+	if attested {
+		flags |= 0x40
+	}
+	data = append(data, flags)
+	data = binary.BigEndian.AppendUint32(data, a.signCount)
+	if attested {
+		data = append(data, make([]byte, 16)...) // AAGUID.
+		data = binary.BigEndian.AppendUint16(data, uint16(len(a.id)))
+		data = append(data, a.id...)
+		data = append(data, a.coseKey()...)
+	}
+	return data
+}
+
+func (a *authenticator) clientData(ceremony, challenge string) []byte {
+	cd, _ := json.Marshal(map[string]interface{}{"type": ceremony, "challenge": challenge, "origin": a.origin})
+	return cd
+}
+
+// Answers navigator.credentials.create().
+func (a *authenticator) create(options webauthn.CreationOptions) map[string]string {
+	attestation := cbor(map[interface{}]interface{}{
+		"fmt":      "none",
+		"attStmt":  map[interface{}]interface{}{},
+		"authData": a.authData(true),
+	})
+	return map[string]string{
+		"client_data_json":   b64.EncodeToString(a.clientData("webauthn.create", options.Challenge)),
+		"attestation_object": b64.EncodeToString(attestation),
+	}
+}
+
+// Answers navigator.credentials.get().
+func (a *authenticator) get(options webauthn.RequestOptions) map[string]string {
+	if a.signCount > 0 {
+		a.signCount++
+	}
+	clientData := a.clientData("webauthn.get", options.Challenge)
+	authData := a.authData(false)
+
+	clientDataHash := sha256.Sum256(clientData)
+	signed := append(append([]byte(nil), authData...), clientDataHash[:]...)
+	var sig []byte
+	if a.edKey != nil {
+		sig = ed25519.Sign(a.edKey, signed)
+	} else {
+		digest := sha256.Sum256(signed)
+		sig, _ = ecdsa.SignASN1(rand.Reader, a.ecKey, digest[:])
+	}
+	if a.tamper {
+		sig[len(sig)-1] ^= 1
+	}
+
+	return map[string]string{
+		"credential_id":      b64.EncodeToString(a.id),
+		"client_data_json":   b64.EncodeToString(clientData),
+		"authenticator_data": b64.EncodeToString(authData),
+		"signature":          b64.EncodeToString(sig),
+		"device_label":       "Test device",
+	}
+}
+
+type harness struct {
+	server *httptest.Server
+	mail   *mailer.CaptureMailer
+	failed bool
+}
+
+// Sends a JSON request, decoding a JSON response into out if it is not nil.
+func (t *harness) call(method, path, token string, body, out interface{}) (int, string) {
+	raw, _ := json.Marshal(body)
+	req, _ := http.NewRequest(method, t.server.URL+path, bytes.NewReader(raw))
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err.Error()
+	}
+	defer resp.Body.Close()
+
+	data, _ := io.ReadAll(resp.Body)
+	if out != nil {
+		json.Unmarshal(data, out)
+	}
+	var res struct {
+		Message string `json:"message"`
+	}
+	json.Unmarshal(data, &res)
+	return resp.StatusCode, res.Message
+}
+
+func (t *harness) check(ok bool, format string, args ...interface{}) {
+	if ok {
+		fmt.Printf("PASS: "+format+"\n", args...)
+	} else {
+		fmt.Printf("FAIL: "+format+"\n", args...)
+		t.failed = true
+	}
+}
+
+// Signs in by OTP and returns the access token.
+func (t *harness) signInByOTP(email string) string {
+	t.call(http.MethodPost, "/request-otp", "", map[string]string{"email_address": email}, nil)
+	msg, _ := t.mail.Last(email)
+	otp := regexp.MustCompile(`is: (\S+)`).FindStringSubmatch(msg.Text)[1]
+
+	var res struct {
+		Token string `json:"token"`
+	}
+	t.call(http.MethodPost, "/validate-otp", "", map[string]string{"email_address": email, "otp": otp}, &res)
+	return res.Token
+}
+
+func (t *harness) register(token string, a *authenticator) (int, string) {
+	var options webauthn.CreationOptions
+	t.call(http.MethodPost, "/begin-passkey-registration", token, nil, &options)
+	body := a.create(options)
+	body["name"] = "Software authenticator"
+	return t.call(http.MethodPost, "/finish-passkey-registration", token, body, nil)
+}
+
+// Runs a passkey sign-in and returns the status, message and the request that was sent, for replaying.
+func (t *harness) login(email string, a *authenticator) (int, string, map[string]string) {
+	var options webauthn.RequestOptions
+	t.call(http.MethodPost, "/begin-passkey-login", "", map[string]string{"email_address": email}, &options)
+	body := a.get(options)
+
+	var res struct {
+		Email string `json:"email_address"`
+		Token string `json:"token"`
+	}
+	status, msg := t.call(http.MethodPost, "/finish-passkey-login", "", body, &res)
+	if status == http.StatusOK && (res.Email != email && email != "" || res.Token == "") {
+		return 0, "signed in to the wrong account or without a token", body
+	}
+	return status, msg, body
+}
+
+func main() {
+	if !run() {
+		fmt.Println("PASSKEY TEST FAILED.")
+		os.Exit(1)
+	}
+	fmt.Println("PASSKEY TEST PASSED.")
+}
+
+func run() bool {
+	users := repository.NewMemoryUserAccounts()
+	sessions := repository.NewMemorySessions()
+	unlimited := repository.Bucket{Capacity: 1 << 20, RefillInterval: 1}
+
+	h := &handler.Handler{
+		Users:               users,
+		Sessions:            sessions,
+		Mailer:              &mailer.CaptureMailer{},
+		RateLimits:          repository.NewMemoryRateLimits(),
+		OTPRequestLimits:    handler.OTPRequestLimits{PerIP: unlimited, PerEmail: unlimited, Global: unlimited},
+		SignInLimit:         unlimited,
+		Challenges:          repository.NewMemoryChallenges(),
+		WebAuthn:            &webauthn.Config{RPID: rpID, RPName: "BearlySocial", Origins: []string{origin}},
+		OTPSecret:           []byte("passkey-test-secret-passkey-test"),
+		OTPPolicy:           util.DefaultOTPPolicy(),
+		SessionLifetime:     time.Hour,
+		AccessTokenLifetime: time.Minute,
+		RotationGrace:       time.Second,
+	}
+	auth := middleware.ValidateToken(users, sessions, h.SessionLimits())
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/request-otp", h.RequestOTP)
+	mux.HandleFunc("/validate-otp", h.ValidateOTP)
+	mux.HandleFunc("/begin-passkey-login", h.BeginPasskeyLogin)
+	mux.HandleFunc("/finish-passkey-login", h.FinishPasskeyLogin)
+	mux.Handle("/begin-passkey-registration", auth(http.HandlerFunc(h.BeginPasskeyRegistration)))
+	mux.Handle("/finish-passkey-registration", auth(http.HandlerFunc(h.FinishPasskeyRegistration)))
+	mux.Handle("GET /passkeys", auth(http.HandlerFunc(h.ListPasskeys)))
+	mux.Handle("DELETE /passkeys/{id}", auth(http.HandlerFunc(h.RemovePasskey)))
+
+	t := &harness{server: httptest.NewServer(mux), mail: h.Mailer.(*mailer.CaptureMailer)}
+	defer t.server.Close()
+
+	email := "passkey@example.com"
+	token := t.signInByOTP(email)
+
+	es256 := newAuthenticator(webauthn.AlgES256)
+	es256.signCount = 1 // Counts signatures, so regressions can be tested.
+	status, msg := t.register(token, es256)
+	t.check(status == http.StatusOK, "register an ES256 passkey (%d %s)", status, msg)
+
+	eddsa := newAuthenticator(webauthn.AlgEdDSA) // Never counts, like synced passkeys.
+	status, msg = t.register(token, eddsa)
+	t.check(status == http.StatusOK, "register an Ed25519 passkey (%d %s)", status, msg)
+
+	status, msg = t.register(token, eddsa)
+	t.check(status == http.StatusBadRequest, "registering the same passkey again is refused (%d %s)", status, msg)
+
+	status, msg, replay := t.login(email, es256)
+	t.check(status == http.StatusOK, "sign in with the ES256 passkey (%d %s)", status, msg)
+	status, msg = t.call(http.MethodPost, "/finish-passkey-login", "", replay, nil)
+	t.check(status == http.StatusBadRequest, "replaying the same assertion is refused (%d %s)", status, msg)
+
+	status, msg, _ = t.login("", eddsa)
+	t.check(status == http.StatusOK, "sign in with the Ed25519 passkey without naming the account (%d %s)", status, msg)
+	status, msg, _ = t.login("", eddsa)
+	t.check(status == http.StatusOK, "a passkey that never counts signs in repeatedly (%d %s)", status, msg)
+
+	es256.signCount -= 2 // Answers with a counter no higher than the stored one, as a clone would.
+	status, msg, _ = t.login(email, es256)
+	t.check(status == http.StatusBadRequest, "a signature counter that goes backwards is refused (%d %s)", status, msg)
+	es256.signCount += 8
+
+	es256.tamper = true
+	status, msg, _ = t.login(email, es256)
+	t.check(status == http.StatusBadRequest, "a bad signature is refused (%d %s)", status, msg)
+	es256.tamper = false
+
+	es256.origin = "https://evil.test"
+	status, msg, _ = t.login(email, es256)
+	t.check(status == http.StatusBadRequest, "a foreign origin is refused (%d %s)", status, msg)
+	es256.origin = origin
+
+	es256.rpID = "evil.test"
+	status, msg, _ = t.login(email, es256)
+	t.check(status == http.StatusBadRequest, "a foreign relying party is refused (%d %s)", status, msg)
+	es256.rpID = rpID
+
+	es256.flags = 0x01 // Present but not verified.
+	status, msg, _ = t.login(email, es256)
+	t.check(status == http.StatusBadRequest, "an unverified user is refused (%d %s)", status, msg)
+	es256.flags = 0x01 | 0x04
+
+	stranger := newAuthenticator(webauthn.AlgES256)
+	status, msg, _ = t.login("", stranger)
+	t.check(status == http.StatusBadRequest, "an unregistered passkey is refused (%d %s)", status, msg)
+
+	status, msg, _ = t.login(email, es256)
+	t.check(status == http.StatusOK, "the ES256 passkey still works after the refusals (%d %s)", status, msg)
+
+	// Registrations begun while the account had room are checked again when they finish.
+	full := t.signInByOTP("full@example.com")
+	full_acc, _ := users.FindByEmail(context.Background(), "full@example.com")
+	for i := 1; i < 16; i++ {
+		users.AddPasskey(context.Background(), full_acc.ID, model.Passkey{ID: fmt.Sprintf("filler-%d", i)}, 16)
+	}
+	var first, second webauthn.CreationOptions
+	t.call(http.MethodPost, "/begin-passkey-registration", full, nil, &first)
+	t.call(http.MethodPost, "/begin-passkey-registration", full, nil, &second)
+	status, msg = t.call(http.MethodPost, "/finish-passkey-registration", full, newAuthenticator(webauthn.AlgES256).create(first), nil)
+	t.check(status == http.StatusOK, "the last free place is taken (%d %s)", status, msg)
+	status, msg = t.call(http.MethodPost, "/finish-passkey-registration", full, newAuthenticator(webauthn.AlgES256).create(second), nil)
+	t.check(status == http.StatusBadRequest, "a registration that finishes after the limit was reached is refused (%d %s)", status, msg)
+	full_acc, _ = users.FindByEmail(context.Background(), "full@example.com")
+	t.check(len(full_acc.Passkeys) == 16, "the account holds no more than the limit (%d)", len(full_acc.Passkeys))
+
+	// Removing a passkey makes room for another, and a removed passkey no longer signs in.
+	status, msg = t.call(http.MethodDelete, "/passkeys/filler-1", full, nil, nil)
+	t.check(status == http.StatusOK, "remove a passkey (%d %s)", status, msg)
+	status, msg = t.register(full, newAuthenticator(webauthn.AlgES256))
+	t.check(status == http.StatusOK, "a passkey can be added once one was removed (%d %s)", status, msg)
+
+	var listed []model.Passkey
+	status, msg = t.call(http.MethodGet, "/passkeys", token, nil, &listed)
+	t.check(status == http.StatusOK && len(listed) == 2 && listed[1].Name == "Software authenticator", "list the account's passkeys (%d %s %d)", status, msg, len(listed))
+	eddsaID := b64.EncodeToString(eddsa.id)
+	status, msg = t.call(http.MethodDelete, "/passkeys/"+eddsaID, token, nil, nil)
+	t.check(status == http.StatusOK, "remove the Ed25519 passkey (%d %s)", status, msg)
+	status, msg = t.call(http.MethodGet, "/passkeys", token, nil, &listed)
+	t.check(status == http.StatusOK && len(listed) == 1 && listed[0].ID != eddsaID, "the removed passkey is no longer listed (%d %s %d)", status, msg, len(listed))
+	status, msg, _ = t.login(email, eddsa)
+	t.check(status == http.StatusBadRequest, "a removed passkey no longer signs in (%d %s)", status, msg)
+	status, msg = t.call(http.MethodDelete, "/passkeys/"+eddsaID, token, nil, nil)
+	t.check(status == http.StatusNotFound, "removing it again is not found (%d %s)", status, msg)
+	status, msg = t.call(http.MethodDelete, "/passkeys/"+b64.EncodeToString(es256.id), full, nil, nil)
+	t.check(status == http.StatusNotFound, "another account's passkey cannot be removed (%d %s)", status, msg)
+	status, msg, _ = t.login(email, es256)
+	t.check(status == http.StatusOK, "and it still signs in (%d %s)", status, msg)
+
+	h.SignInLimit = repository.Bucket{Capacity: 1, RefillInterval: time.Hour.Milliseconds()}
+	status, msg = t.call(http.MethodPost, "/begin-passkey-login", "", map[string]string{}, nil)
+	t.check(status == http.StatusOK, "starting a sign-in is allowed (%d %s)", status, msg)
+	status, msg = t.call(http.MethodPost, "/begin-passkey-login", "", map[string]string{}, nil)
+	t.check(status == http.StatusTooManyRequests, "starting sign-ins is rate limited per client (%d %s)", status, msg)
+
+	return !t.failed
+}
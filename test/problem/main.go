@@ -0,0 +1,150 @@
+// Checks the error envelope through the real router, middleware and handlers: problem+json bodies with stable
+// codes, request IDs that match the response header, retry hints on rate limits and cooldowns, and field names
+// on validation errors.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"time"
+
+	"bearlysocial-backend/api/handler"
+	"bearlysocial-backend/api/middleware"
+	"bearlysocial-backend/api/repository"
+	"bearlysocial-backend/api/router"
+	"bearlysocial-backend/mailer"
+	"bearlysocial-backend/util"
+)
+
+var failed bool
+
+func check(ok bool, format string, args ...interface{}) {
+	if ok {
+		fmt.Printf("PASS: "+format+"\n", args...)
+	} else {
+		fmt.Printf("FAIL: "+format+"\n", args...)
+		failed = true
+	}
+}
+
+type problem struct {
+	Type              string `json:"type"`
+	Title             string `json:"title"`
+	Status            int    `json:"status"`
+	Detail            string `json:"detail"`
+	Code              string `json:"code"`
+	Message           string `json:"message"`
+	RequestID         string `json:"request_id"`
+	RetryAfterSeconds int64  `json:"retry_after_seconds"`
+	Field             string `json:"field"`
+
+	status      int
+	contentType string
+	headerID    string
+	retryAfter  string
+}
+
+func main() {
+	users := repository.NewMemoryUserAccounts()
+	sessions := repository.NewMemorySessions()
+	unlimited := repository.Bucket{Capacity: 1 << 20, RefillInterval: 1}
+	h := &handler.Handler{
+		Users:      users,
+		Sessions:   sessions,
+		Mailer:     &mailer.CaptureMailer{},
+		RateLimits: repository.NewMemoryRateLimits(),
+		OTPRequestLimits: handler.OTPRequestLimits{
+			PerIP:    unlimited,
+			PerEmail: repository.Bucket{Capacity: 1, RefillInterval: time.Hour.Milliseconds()},
+			Global:   unlimited,
+		},
+		OTPSecret:           []byte("problem-test-secret-problem-test-secret"),
+		OTPPolicy:           util.DefaultOTPPolicy(),
+		SessionLifetime:     time.Hour,
+		AccessTokenLifetime: time.Minute,
+		RotationGrace:       time.Second,
+	}
+
+	routes := router.New(middleware.RequestID)
+	public := routes.Group("")
+	protected := routes.Group("", middleware.ValidateToken(users, sessions, h.SessionLimits()))
+	public.HandleFunc(http.MethodPost, "/request-otp", h.RequestOTP)
+	public.HandleFunc(http.MethodPost, "/validate-otp", h.ValidateOTP)
+	protected.HandleFunc(http.MethodGet, "/sessions", h.ListSessions)
+
+	server := httptest.NewServer(routes)
+	defer server.Close()
+
+	do := func(method, path, body string, header ...string) problem {
+		req, _ := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return problem{Detail: err.Error()}
+		}
+		defer resp.Body.Close()
+		var p problem
+		json.NewDecoder(resp.Body).Decode(&p)
+		p.status = resp.StatusCode
+		p.contentType = resp.Header.Get("Content-Type")
+		p.headerID = resp.Header.Get("X-Request-ID")
+		p.retryAfter = resp.Header.Get("Retry-After")
+		return p
+	}
+
+	p := do(http.MethodPost, "/request-otp", "{not json")
+	check(p.status == http.StatusBadRequest && p.Status == p.status && p.Code == "invalid_request", "a malformed body is invalid_request (%d %s)", p.status, p.Code)
+	check(p.contentType == "application/problem+json", "errors are problem+json (%s)", p.contentType)
+	check(p.Type == "urn:bearlysocial:problem:invalid_request" && p.Title != "" && p.Detail != "", "the RFC 7807 members are set (%q %q %q)", p.Type, p.Title, p.Detail)
+	check(p.Message == p.Detail, "message repeats the detail for older clients")
+	check(p.RequestID != "" && p.RequestID == p.headerID, "the body carries the request ID from the header (%q %q)", p.RequestID, p.headerID)
+	other := do(http.MethodPost, "/request-otp", "{not json")
+	check(other.RequestID != p.RequestID, "every request gets its own ID")
+
+	p = do(http.MethodPost, "/request-otp", "{not json", "X-Request-ID", "proxy-1234.abc")
+	check(p.RequestID == "proxy-1234.abc" && p.headerID == "proxy-1234.abc", "an ID from a proxy is kept (%q)", p.RequestID)
+	p = do(http.MethodPost, "/request-otp", "{not json", "X-Request-ID", "bad id; <script>")
+	check(p.RequestID != "" && !strings.Contains(p.RequestID, " "), "a malformed ID is replaced (%q)", p.RequestID)
+
+	p = do(http.MethodPost, "/request-otp", `{"email_address":"nope"}`)
+	check(p.Code == "invalid_field" && p.Field == "email_address", "validation errors name the field (%s %s)", p.Code, p.Field)
+
+	p = do(http.MethodPost, "/validate-otp", `{"email_address":"nobody@example.com","otp":"123456"}`)
+	check(p.Code == "otp_not_requested", "validating without an OTP is otp_not_requested (%s)", p.Code)
+
+	do(http.MethodPost, "/request-otp", `{"email_address":"limited@example.com"}`)
+	p = do(http.MethodPost, "/request-otp", `{"email_address":"limited@example.com"}`)
+	check(p.status == http.StatusTooManyRequests && p.Code == "rate_limited", "the second request is rate_limited (%d %s)", p.status, p.Code)
+	check(p.RetryAfterSeconds > 3500 && p.RetryAfterSeconds <= 3600 && p.retryAfter == fmt.Sprint(p.RetryAfterSeconds),
+		"rate limits say when to retry, in the body and the header (%d %q)", p.RetryAfterSeconds, p.retryAfter)
+
+	do(http.MethodPost, "/request-otp", `{"email_address":"guess@example.com"}`)
+	wrong := `{"email_address":"guess@example.com","otp":"000000"}`
+	p = do(http.MethodPost, "/validate-otp", wrong)
+	check(p.Code == "otp_incorrect", "a wrong guess is otp_incorrect (%s)", p.Code)
+	for i := 1; i < h.OTPPolicy.MaxAttempts; i++ {
+		p = do(http.MethodPost, "/validate-otp", wrong)
+	}
+	check(p.Code == "too_many_attempts" && p.RetryAfterSeconds > 0 && p.retryAfter != "", "the last guess says when to retry (%s %d)", p.Code, p.RetryAfterSeconds)
+	p = do(http.MethodPost, "/validate-otp", wrong)
+	check(p.Code == "otp_cooldown" && p.RetryAfterSeconds > 0, "guesses during the cooldown say when to retry (%s %d)", p.Code, p.RetryAfterSeconds)
+
+	p = do(http.MethodGet, "/sessions", "")
+	check(p.status == http.StatusUnauthorized && p.Code == "token_invalid" && p.RequestID != "", "middleware errors use the envelope too (%d %s)", p.status, p.Code)
+	p = do(http.MethodDelete, "/sessions", "")
+	check(p.status == http.StatusMethodNotAllowed && p.Code == "method_not_allowed", "router errors use the envelope too (%d %s)", p.status, p.Code)
+	p = do(http.MethodGet, "/missing", "")
+	check(p.status == http.StatusNotFound && p.Code == "not_found" && p.RequestID != "", "unknown paths are not_found (%d %s)", p.status, p.Code)
+
+	if failed {
+		fmt.Println("PROBLEM TEST FAILED.")
+		os.Exit(1)
+	}
+	fmt.Println("PROBLEM TEST PASSED.")
+}
@@ -0,0 +1,125 @@
+// Checks that a request refused by one rate limit does not use up the others it was checked against, that
+// refunds never grow a bucket past its capacity, that a request whose email could not be sent is not counted,
+// and that clients cannot choose the address they are limited by.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"time"
+
+	"bearlysocial-backend/api/handler"
+	"bearlysocial-backend/api/repository"
+	"bearlysocial-backend/mailer"
+	"bearlysocial-backend/util"
+)
+
+var failed bool
+
+// Delivers nothing to bounce addresses, like a mail server that is down for them.
+type bouncingMailer struct {
+	mailer.CaptureMailer
+}
+
+func (b *bouncingMailer) Send(ctx context.Context, msg mailer.Message) error {
+	if strings.HasPrefix(msg.To, "bounce") {
+		return errors.New("mailbox unavailable")
+	}
+	return b.CaptureMailer.Send(ctx, msg)
+}
+
+func check(ok bool, format string, args ...interface{}) {
+	if ok {
+		fmt.Printf("PASS: "+format+"\n", args...)
+	} else {
+		fmt.Printf("FAIL: "+format+"\n", args...)
+		failed = true
+	}
+}
+
+func main() {
+	ctx := context.Background()
+	hour := time.Hour.Milliseconds()
+	now := time.Now().UnixMilli()
+
+	limits := repository.NewMemoryRateLimits()
+	bucket := repository.Bucket{Capacity: 1, RefillInterval: hour}
+	limits.Refund(ctx, "untouched", bucket, now)
+	limits.Take(ctx, "untouched", bucket, now)
+	wait, _ := limits.Take(ctx, "untouched", bucket, now)
+	check(wait > 0, "a refund to a full bucket does not add a token (%d)", wait)
+	limits.Refund(ctx, "untouched", bucket, now)
+	wait, _ = limits.Take(ctx, "untouched", bucket, now)
+	check(wait == 0, "a refunded token can be taken again (%d)", wait)
+
+	// Behind a proxy, only the entry it appended counts, however the client splits the header into lines.
+	r := httptest.NewRequest(http.MethodPost, "/", nil)
+	r.RemoteAddr = "10.0.0.1:4321"
+	r.Header.Add("X-Forwarded-For", "203.0.113.7")
+	r.Header.Add("X-Forwarded-For", "198.51.100.2, 192.0.2.9")
+	ip := util.ClientIP(r, "X-Forwarded-For")
+	check(ip == "192.0.2.9", "the last entry of the last line is the client (%s)", ip)
+	r.Header.Set("X-Forwarded-For", "")
+	ip = util.ClientIP(r, "X-Forwarded-For")
+	check(ip == "10.0.0.1", "an empty header falls back to the connection (%s)", ip)
+	ip = util.ClientIP(r, "")
+	check(ip == "10.0.0.1", "without a proxy the header is ignored (%s)", ip)
+
+	unlimited := repository.Bucket{Capacity: 1 << 20, RefillInterval: 1}
+	h := &handler.Handler{
+		Users:      repository.NewMemoryUserAccounts(),
+		Sessions:   repository.NewMemorySessions(),
+		Mailer:     &bouncingMailer{},
+		RateLimits: repository.NewMemoryRateLimits(),
+		OTPRequestLimits: handler.OTPRequestLimits{
+			PerIP:    repository.Bucket{Capacity: 2, RefillInterval: hour},
+			PerEmail: repository.Bucket{Capacity: 1, RefillInterval: hour},
+			Global:   unlimited,
+		},
+		OTPSecret: []byte("rate-limit-test-secret-rate-limit-test"),
+		OTPPolicy: util.DefaultOTPPolicy(),
+	}
+	server := httptest.NewServer(http.HandlerFunc(h.RequestOTP))
+	defer server.Close()
+
+	request := func(email string) int {
+		raw, _ := json.Marshal(map[string]string{"email_address": email})
+		resp, err := http.Post(server.URL, "application/json", bytes.NewReader(raw))
+		if err != nil {
+			return 0
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	check(request("first@example.com") == http.StatusOK, "the first request is allowed")
+	for i := 0; i < 3; i++ {
+		status := request("first@example.com")
+		check(status == http.StatusTooManyRequests, "repeats for the same address are refused (%d)", status)
+	}
+	status := request("second@example.com")
+	check(status == http.StatusOK, "refused requests did not use up the per-IP limit (%d)", status)
+	status = request("third@example.com")
+	check(status == http.StatusTooManyRequests, "the per-IP limit still applies (%d)", status)
+
+	// A request whose email could not be sent gives its tokens back.
+	h.RateLimits = repository.NewMemoryRateLimits()
+	h.OTPRequestLimits.PerIP = repository.Bucket{Capacity: 1, RefillInterval: hour}
+	status = request("bounce@example.com")
+	check(status == http.StatusInternalServerError, "an email that cannot be sent fails the request (%d)", status)
+	status = request("fourth@example.com")
+	check(status == http.StatusOK, "the failed request did not use up the per-IP limit (%d)", status)
+
+	if failed {
+		fmt.Println("RATE LIMIT TEST FAILED.")
+		os.Exit(1)
+	}
+	fmt.Println("RATE LIMIT TEST PASSED.")
+}
@@ -0,0 +1,149 @@
+// Checks the router: method matching, 405 responses with an Allow header, OPTIONS and HEAD requests, JSON 404s,
+// the order middleware runs in across nested groups, and the admin key guard.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+
+	"bearlysocial-backend/api/middleware"
+	"bearlysocial-backend/api/router"
+)
+
+var failed bool
+
+func check(ok bool, format string, args ...interface{}) {
+	if ok {
+		fmt.Printf("PASS: "+format+"\n", args...)
+	} else {
+		fmt.Printf("FAIL: "+format+"\n", args...)
+		failed = true
+	}
+}
+
+// Returns middleware that appends name to the X-Trace header of the response.
+func trace(name string) router.Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("X-Trace", name)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func reply(body string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, body)
+	}
+}
+
+type response struct {
+	status  int
+	allow   string
+	trace   string
+	body    string
+	message string
+}
+
+func main() {
+	routes := router.New(trace("global"))
+	public := routes.Group("")
+	protected := routes.Group("", trace("auth"))
+	admin := routes.Group("/admin", middleware.RequireAdminKey("s3cret"))
+	nested := protected.Group("/v2", trace("nested"))
+
+	public.HandleFunc(http.MethodPost, "/request-otp", reply("otp"))
+	public.HandleFunc(http.MethodGet, "/profile", reply("get profile"))
+	protected.HandleFunc(http.MethodPatch, "/profile", reply("patch profile"))
+	protected.HandleFunc(http.MethodDelete, "/items/{id}", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "deleted "+r.PathValue("id"))
+	})
+	nested.HandleFunc(http.MethodGet, "/sessions", reply("v2 sessions"))
+	admin.HandleFunc(http.MethodGet, "/benchmark", reply("benchmark"))
+
+	server := httptest.NewServer(routes)
+	defer server.Close()
+
+	do := func(method, path string, header ...string) response {
+		req, _ := http.NewRequest(method, server.URL+path, strings.NewReader("{}"))
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return response{body: err.Error()}
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		var res struct {
+			Message string `json:"message"`
+		}
+		json.Unmarshal(data, &res)
+		return response{
+			status:  resp.StatusCode,
+			allow:   resp.Header.Get("Allow"),
+			trace:   strings.Join(resp.Header.Values("X-Trace"), ","),
+			body:    string(data),
+			message: res.Message,
+		}
+	}
+
+	res := do(http.MethodPost, "/request-otp")
+	check(res.status == http.StatusOK && res.body == "otp", "POST reaches its route (%d %s)", res.status, res.body)
+
+	res = do(http.MethodGet, "/request-otp")
+	check(res.status == http.StatusMethodNotAllowed && res.allow == "POST, OPTIONS" && res.message == "Method not allowed.",
+		"GET on a POST route is a 405 with an Allow header (%d %q %q)", res.status, res.allow, res.message)
+
+	res = do(http.MethodOptions, "/request-otp")
+	check(res.status == http.StatusNoContent && res.allow == "POST, OPTIONS" && res.body == "", "OPTIONS answers with the Allow header (%d %q)", res.status, res.allow)
+
+	res = do(http.MethodGet, "/profile")
+	check(res.status == http.StatusOK && res.body == "get profile" && res.trace == "global", "one path can have routes in different groups (%d %s %s)", res.status, res.body, res.trace)
+	res = do(http.MethodPatch, "/profile")
+	check(res.status == http.StatusOK && res.body == "patch profile" && res.trace == "global,auth", "each method runs the middleware of its own group (%d %s %s)", res.status, res.body, res.trace)
+	res = do(http.MethodPut, "/profile")
+	check(res.status == http.StatusMethodNotAllowed && res.allow == "GET, PATCH, HEAD, OPTIONS", "the Allow header lists every method of the path (%q)", res.allow)
+	res = do(http.MethodHead, "/profile")
+	check(res.status == http.StatusOK, "GET routes answer HEAD (%d)", res.status)
+
+	res = do(http.MethodOptions, "/v2/sessions")
+	check(res.status == http.StatusNoContent && res.trace == "global", "OPTIONS skips the group's middleware, so preflights need no credentials (%q)", res.trace)
+	res = do(http.MethodGet, "/v2/sessions")
+	check(res.status == http.StatusOK && res.body == "v2 sessions" && res.trace == "global,auth,nested", "nested groups join prefixes and run outer middleware first (%d %s %s)", res.status, res.body, res.trace)
+	res = do(http.MethodGet, "/sessions")
+	check(res.status == http.StatusNotFound, "the nested route has no unprefixed path (%d)", res.status)
+
+	res = do(http.MethodDelete, "/items/42")
+	check(res.status == http.StatusOK && res.body == "deleted 42", "wildcards reach the handler (%d %s)", res.status, res.body)
+	res = do(http.MethodGet, "/items/42")
+	check(res.status == http.StatusMethodNotAllowed && res.allow == "DELETE, OPTIONS", "wildcard paths get 405s too (%d %q)", res.status, res.allow)
+
+	res = do(http.MethodGet, "/nowhere")
+	check(res.status == http.StatusNotFound && res.message == "Not found." && res.trace == "global", "unknown paths get a JSON 404 (%d %s)", res.status, res.body)
+
+	res = do(http.MethodGet, "/admin/benchmark")
+	check(res.status == http.StatusUnauthorized, "admin routes need the key (%d %s)", res.status, res.message)
+	res = do(http.MethodGet, "/admin/benchmark", "X-Admin-Key", "s3cre")
+	check(res.status == http.StatusUnauthorized, "a wrong key is refused (%d)", res.status)
+	res = do(http.MethodGet, "/admin/benchmark", "X-Admin-Key", "s3cret")
+	check(res.status == http.StatusOK && res.body == "benchmark", "the right key gets through (%d %s)", res.status, res.body)
+
+	func() {
+		defer func() {
+			check(recover() != nil, "registering a route twice panics")
+		}()
+		public.HandleFunc(http.MethodPost, "/request-otp", reply("again"))
+	}()
+
+	if failed {
+		fmt.Println("ROUTER TEST FAILED.")
+		os.Exit(1)
+	}
+	fmt.Println("ROUTER TEST PASSED.")
+}
@@ -0,0 +1,51 @@
+// Checks that schedules are refused when any key, at any depth, could be read by MongoDB as an operator or a path.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"bearlysocial-backend/util"
+)
+
+var failed bool
+
+func check(ok bool, format string, args ...interface{}) {
+	if ok {
+		fmt.Printf("PASS: "+format+"\n", args...)
+	} else {
+		fmt.Printf("FAIL: "+format+"\n", args...)
+		failed = true
+	}
+}
+
+func main() {
+	for raw, want := range map[string]bool{
+		`{}`: true,
+		`{"mon": ["09:00-12:00", "14:00-17:00"]}`:     true,
+		`{"mon": {"from": "09:00", "to": "12:00"}}`:   true,
+		`{"mon": [{"from": "09:00", "to": "12:00"}]}`: true,
+		`{"$where": 1}`:                     false,
+		`{"a.b": 1}`:                        false,
+		`{"": 1}`:                           false,
+		`{"mon": {"$where": 1}}`:            false,
+		`{"mon": {"a.b": 2}}`:               false,
+		`{"mon": [{"ok": 1}, {"$set": 1}]}`: false,
+		`{"mon": [[{"deep": {"deeper": {"x.y": 1}}}]]}`:        false,
+		`{"mon": {"aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa": true}}`: false,
+	} {
+		var schedule map[string]interface{}
+		if err := json.Unmarshal([]byte(raw), &schedule); err != nil {
+			check(false, "%s parses (%v)", raw, err)
+			continue
+		}
+		check(util.ValidSchedule(schedule) == want, "%s valid: %v", raw, want)
+	}
+
+	if failed {
+		fmt.Println("SCHEDULE TEST FAILED.")
+		os.Exit(1)
+	}
+	fmt.Println("SCHEDULE TEST PASSED.")
+}
@@ -0,0 +1,237 @@
+// Checks TOTP codes against the RFC 6238 test vectors, then drives enrollment, second-factor sign-in,
+// recovery codes and removal through the real handlers on in-memory storage.
+package main
+
+import (
+	"bytes"
+	"encoding/base32"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"bearlysocial-backend/api/handler"
+	"bearlysocial-backend/api/middleware"
+	"bearlysocial-backend/api/repository"
+	"bearlysocial-backend/mailer"
+	"bearlysocial-backend/util"
+)
+
+type harness struct {
+	server *httptest.Server
+	mail   *mailer.CaptureMailer
+	failed bool
+}
+
+// Sends a JSON request, decoding a JSON response into out if it is not nil.
+func (t *harness) call(path, token string, body, out interface{}) (int, string) {
+	method := http.MethodPost
+	raw, _ := json.Marshal(body)
+	req, _ := http.NewRequest(method, t.server.URL+path, bytes.NewReader(raw))
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err.Error()
+	}
+	defer resp.Body.Close()
+
+	data, _ := io.ReadAll(resp.Body)
+	if out != nil {
+		json.Unmarshal(data, out)
+	}
+	var res struct {
+		Message string `json:"message"`
+	}
+	json.Unmarshal(data, &res)
+	return resp.StatusCode, res.Message
+}
+
+func (t *harness) check(ok bool, format string, args ...interface{}) {
+	if ok {
+		fmt.Printf("PASS: "+format+"\n", args...)
+	} else {
+		fmt.Printf("FAIL: "+format+"\n", args...)
+		t.failed = true
+	}
+}
+
+type signInResult struct {
+	Token       string `json:"token"`
+	MFARequired bool   `json:"mfa_required"`
+	MFAToken    string `json:"mfa_token"`
+}
+
+// Completes the emailed-OTP step of a sign-in.
+func (t *harness) firstFactor(email string) signInResult {
+	t.call("/request-otp", "", map[string]string{"email_address": email}, nil)
+	msg, _ := t.mail.Last(email)
+	otp := regexp.MustCompile(`is: (\S+)`).FindStringSubmatch(msg.Text)[1]
+
+	var res signInResult
+	t.call("/validate-otp", "", map[string]string{"email_address": email, "otp": otp, "device_label": "Phone"}, &res)
+	return res
+}
+
+func (t *harness) verify(mfaToken, code string) (int, string, signInResult) {
+	var res signInResult
+	status, msg := t.call("/verify-mfa", "", map[string]string{"mfa_token": mfaToken, "code": code}, &res)
+	return status, msg, res
+}
+
+func main() {
+	if !run() {
+		fmt.Println("TOTP TEST FAILED.")
+		os.Exit(1)
+	}
+	fmt.Println("TOTP TEST PASSED.")
+}
+
+func run() bool {
+	t := &harness{}
+
+	// RFC 6238 appendix B, SHA-1, cut to the 6 digits authenticator apps show.
+	secret := []byte("12345678901234567890")
+	for unix, want := range map[int64]string{
+		59:          "287082",
+		1111111109:  "081804",
+		1111111111:  "050471",
+		1234567890:  "005924",
+		2000000000:  "279037",
+		20000000000: "353130",
+	} {
+		got := util.TOTPCode(secret, util.TOTPStep(time.Unix(unix, 0)))
+		t.check(got == want, "RFC 6238 vector at %d: %s", unix, got)
+	}
+	step, ok := util.MatchTOTP(secret, "081804", time.Unix(1111111109+30, 0))
+	t.check(ok && step == util.TOTPStep(time.Unix(1111111109, 0)), "the previous step's code is still accepted")
+	_, ok = util.MatchTOTP(secret, "081804", time.Unix(1111111109+90, 0))
+	t.check(!ok, "a code three steps old is refused")
+
+	users := repository.NewMemoryUserAccounts()
+	sessions := repository.NewMemorySessions()
+	unlimited := repository.Bucket{Capacity: 1 << 20, RefillInterval: 1}
+
+	h := &handler.Handler{
+		Users: users,
+		Sessions: sessions,
+		Mailer: &mailer.CaptureMailer{},
+		RateLimits: repository.NewMemoryRateLimits(),
+		OTPRequestLimits: handler.OTPRequestLimits{PerIP: unlimited, PerEmail: unlimited, Global: unlimited},
+		Challenges: repository.NewMemoryChallenges(),
+		OTPSecret: []byte("totp-test-secret-totp-test-secret"),
+		OTPPolicy: util.DefaultOTPPolicy(),
+		TOTPIssuer: "BearlySocial",
+		// Exactly the attempts below before the one that is expected to be limited.
+		SecondFactorLimit: repository.Bucket{Capacity: 9, RefillInterval: time.Hour.Milliseconds()},
+		SessionLifetime: time.Hour,
+		AccessTokenLifetime: time.Minute,
+		RotationGrace: time.Second,
+	}
+	auth := middleware.ValidateToken(users, sessions, h.SessionLimits())
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/request-otp", h.RequestOTP)
+	mux.HandleFunc("/validate-otp", h.ValidateOTP)
+	mux.HandleFunc("/verify-mfa", h.VerifyMFA)
+	mux.Handle("/begin-totp-enrollment", auth(http.HandlerFunc(h.BeginTOTPEnrollment)))
+	mux.Handle("/confirm-totp-enrollment", auth(http.HandlerFunc(h.ConfirmTOTPEnrollment)))
+	mux.Handle("/regenerate-recovery-codes", auth(http.HandlerFunc(h.RegenerateRecoveryCodes)))
+	mux.Handle("/disable-totp", auth(http.HandlerFunc(h.DisableTOTP)))
+
+	t.server = httptest.NewServer(mux)
+	t.mail = h.Mailer.(*mailer.CaptureMailer)
+	defer t.server.Close()
+
+	email := "totp@example.com"
+	res := t.firstFactor(email)
+	t.check(res.Token != "" && !res.MFARequired, "without an authenticator app, the emailed OTP signs in directly")
+	token := res.Token
+
+	var enrollment struct {
+		Secret string `json:"secret"`
+		URI    string `json:"uri"`
+	}
+	status, msg := t.call("/begin-totp-enrollment", token, nil, &enrollment)
+	uri, _ := url.Parse(enrollment.URI)
+	t.check(status == http.StatusOK && uri != nil && uri.Scheme == "otpauth" && uri.Host == "totp" &&
+		uri.Query().Get("secret") == enrollment.Secret && uri.Query().Get("issuer") == "BearlySocial" &&
+		strings.HasSuffix(uri.Path, ":"+email), "begin enrollment (%d %s %s)", status, msg, enrollment.URI)
+
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(enrollment.Secret)
+	t.check(err == nil && len(key) == 20, "the secret is 160 bits of unpadded base32")
+	code := func(offset int64) string {
+		return util.TOTPCode(key, util.TOTPStep(time.Now())+offset)
+	}
+
+	res = t.firstFactor(email)
+	t.check(res.Token != "" && !res.MFARequired, "a pending enrollment does not change sign-in yet")
+
+	status, msg = t.call("/confirm-totp-enrollment", token, map[string]string{"code": "000000"}, nil)
+	t.check(status == http.StatusBadRequest, "a wrong code does not confirm enrollment (%d %s)", status, msg)
+
+	var recovery struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	status, msg = t.call("/confirm-totp-enrollment", token, map[string]string{"code": code(-1)}, &recovery)
+	t.check(status == http.StatusOK && len(recovery.RecoveryCodes) == 10, "confirm enrollment (%d %s)", status, msg)
+
+	res = t.firstFactor(email)
+	t.check(res.Token == "" && res.MFARequired && res.MFAToken != "", "the emailed OTP now only yields an MFA token")
+
+	status, msg, _ = t.verify(res.MFAToken, code(-1))
+	t.check(status == http.StatusBadRequest, "the code that confirmed enrollment cannot be used again (%d %s)", status, msg)
+
+	status, msg, _ = t.verify(res.MFAToken, "123456")
+	t.check(status == http.StatusBadRequest, "a wrong code is refused (%d %s)", status, msg)
+
+	status, msg, signedIn := t.verify(res.MFAToken, code(0))
+	t.check(status == http.StatusOK && signedIn.Token != "", "the MFA token and a fresh code sign in (%d %s)", status, msg)
+
+	status, msg, _ = t.verify(res.MFAToken, code(1))
+	t.check(status == http.StatusBadRequest, "the MFA token works only once (%d %s)", status, msg)
+
+	res = t.firstFactor(email)
+	status, msg, signedIn = t.verify(res.MFAToken, strings.ToLower(recovery.RecoveryCodes[0]))
+	t.check(status == http.StatusOK && signedIn.Token != "", "a recovery code signs in, whatever its case (%d %s)", status, msg)
+
+	res = t.firstFactor(email)
+	status, msg, _ = t.verify(res.MFAToken, recovery.RecoveryCodes[0])
+	t.check(status == http.StatusBadRequest, "a recovery code works only once (%d %s)", status, msg)
+
+	var regenerated struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	status, msg = t.call("/regenerate-recovery-codes", token, map[string]string{"code": recovery.RecoveryCodes[1]}, &regenerated)
+	t.check(status == http.StatusOK && len(regenerated.RecoveryCodes) == 10, "regenerate recovery codes (%d %s)", status, msg)
+
+	status, msg, _ = t.verify(res.MFAToken, recovery.RecoveryCodes[2])
+	t.check(status == http.StatusBadRequest, "old recovery codes stop working (%d %s)", status, msg)
+
+	status, msg, _ = t.verify(res.MFAToken, "654321")
+	t.check(status == http.StatusTooManyRequests, "guessing is rate limited per account (%d %s)", status, msg)
+
+	// Start over with full buckets for the rest of the run.
+	h.RateLimits = repository.NewMemoryRateLimits()
+
+	status, msg = t.call("/disable-totp", token, map[string]string{"code": ""}, nil)
+	t.check(status == http.StatusBadRequest, "removing the app takes a code (%d %s)", status, msg)
+
+	status, msg = t.call("/disable-totp", token, map[string]string{"code": regenerated.RecoveryCodes[0]}, nil)
+	t.check(status == http.StatusOK, "remove the app with a recovery code (%d %s)", status, msg)
+
+	status, msg, _ = t.verify(res.MFAToken, code(1))
+	t.check(status == http.StatusBadRequest, "outstanding MFA tokens die with the app (%d %s)", status, msg)
+
+	res = t.firstFactor(email)
+	t.check(res.Token != "" && !res.MFARequired, "the emailed OTP signs in directly again")
+
+	return !t.failed
+}
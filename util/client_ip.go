@@ -0,0 +1,37 @@
+package util
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Returns the address of the client that sent the request, for use as a rate-limiting key. If the server runs
+// behind a proxy, header names the header that proxy puts the client address in (e.g. "X-Forwarded-For").
+// This is only safe when every request passes through that trusted proxy: the last entry, across every line of
+// a repeated header, is the one it appended, while earlier entries and lines come from the client and can be
+// forged. IPv6 clients usually control a whole /64, so their addresses are reduced to that prefix.
+func ClientIP(r *http.Request, header string) string {
+	addr := r.RemoteAddr
+	if header != "" {
+		if values := r.Header.Values(header); len(values) > 0 {
+			entries := strings.Split(strings.Join(values, ","), ",")
+			if last := strings.TrimSpace(entries[len(entries)-1]); last != "" {
+				addr = last
+			}
+		}
+	}
+
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return addr
+	}
+	if ip.To4() != nil {
+		return ip.To4().String()
+	}
+	return ip.Mask(net.CIDRMask(64, 128)).String() + "/64"
+}
@@ -4,11 +4,12 @@ import (
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/hex"
-	"fmt"
+	"time"
 )
 
-// Creates a secure random token using crypto/rand.
-func GenerateToken(uid string) (string, error) {
+// Creates a secure random token using crypto/rand. The token is an opaque 64-character hex string that
+// carries no user data; only its HashToken digest is ever stored.
+func GenerateToken() (string, error) {
 	b := make([]byte, 32)
 
 	// Fill the byte slice with cryptographically random bytes.
@@ -16,12 +17,40 @@ func GenerateToken(uid string) (string, error) {
 		return "", err
 	}
 
-	// Create a new SHA-256 hash instance with random bytes written into the hash function.
-	hasher := sha256.New()
-	hasher.Write(b)
+	return hex.EncodeToString(b), nil
+}
+
+// Computes the SHA-256 digest under which a token is stored and looked up.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Creates a random 32-character hex identifier for records that are not secrets themselves, such as sessions.
+func GenerateID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Creates a user ID: a UUIDv7 (RFC 9562), whose leading timestamp keeps IDs roughly in creation order, so new
+// accounts land together at the end of the _id index. Unlike the email address it identifies the account
+// forever.
+func GenerateUserID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[6:]); err != nil {
+		return "", err
+	}
 
-	// Compute the hash and return its hexadecimal representation.
-	hashpass := hex.EncodeToString(hasher.Sum(nil))
+	ms := uint64(time.Now().UnixMilli())
+	for i := 0; i < 6; i++ {
+		b[i] = byte(ms >> (40 - 8*i))
+	}
+	b[6] = b[6]&0x0f | 0x70 // Version 7.
+	b[8] = b[8]&0x3f | 0x80 // RFC 9562 variant.
 
-	return fmt.Sprintf("%s::%s", uid, hashpass), nil // A token is made of a uid (email) and a 'hashpass'.
+	h := hex.EncodeToString(b[:])
+	return h[:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:], nil
 }
@@ -4,7 +4,9 @@ import (
 	"bufio"
 	"fmt"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 )
 
 // Load environment variables from a .env file.
@@ -47,3 +49,53 @@ func LoadEnv() {
 		os.Exit(1)
 	}
 }
+
+// Reads a duration (e.g. "720h") from an environment variable, falling back to a default when unset or malformed.
+func GetEnvDuration(key string, fallback time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		fmt.Printf("INVALID DURATION FOR %s: %q, USING DEFAULT %s.\n", key, value, fallback)
+		return fallback
+	}
+	return d
+}
+
+// Reads an integer from an environment variable, falling back to a default when unset or malformed.
+func GetEnvInt(key string, fallback int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		fmt.Printf("INVALID INTEGER FOR %s: %q, USING DEFAULT %d.\n", key, value, fallback)
+		return fallback
+	}
+	return n
+}
+
+// Reads a rate such as "5/1h" (at most 5 per hour) from an environment variable, falling back to a default when
+// unset or malformed.
+func GetEnvRate(key string, fallbackCount int64, fallbackPer time.Duration) (int64, time.Duration) {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallbackCount, fallbackPer
+	}
+
+	countStr, perStr, ok := strings.Cut(value, "/")
+	count, err := strconv.ParseInt(strings.TrimSpace(countStr), 10, 64)
+	if ok && err == nil && count > 0 {
+		if per, err := time.ParseDuration(strings.TrimSpace(perStr)); err == nil && per > 0 {
+			return count, per
+		}
+	}
+
+	fmt.Printf("INVALID RATE FOR %s: %q, USING DEFAULT %d/%s.\n", key, value, fallbackCount, fallbackPer)
+	return fallbackCount, fallbackPer
+}
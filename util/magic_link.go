@@ -0,0 +1,57 @@
+package util
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"strconv"
+	"strings"
+)
+
+// Signs a magic-link token for the OTP stored as otpHash on account uid. The signature covers the stored OTP
+// and its expiry, so the link dies with the OTP: once the code is used, replaced or expired, so is the link.
+// Nothing extra is stored; the token is "<base64url uid>.<expiry>.<hex signature>".
+func SignMagicLink(secret []byte, uid, otpHash string, expiryTime int64) string {
+	expiry := strconv.FormatInt(expiryTime, 10)
+	sig := magicLinkMAC(secret, uid, otpHash, expiry)
+	return base64.RawURLEncoding.EncodeToString([]byte(uid)) + "." + expiry + "." + hex.EncodeToString(sig)
+}
+
+// Splits a magic-link token into the account it was issued for, the expiry it claims and its signature.
+// Nothing is verified yet; see MatchMagicLink.
+func ParseMagicLink(token string) (uid string, expiryTime int64, sig []byte, ok bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", 0, nil, false
+	}
+
+	rawUID, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", 0, nil, false
+	}
+	expiryTime, err = strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return "", 0, nil, false
+	}
+	sig, err = hex.DecodeString(parts[2])
+	if err != nil || len(sig) != sha256.Size {
+		return "", 0, nil, false
+	}
+	return string(rawUID), expiryTime, sig, true
+}
+
+// Checks in constant time that sig was made by SignMagicLink for this account's current OTP and expiry.
+func MatchMagicLink(secret []byte, uid, otpHash string, expiryTime int64, sig []byte) bool {
+	return hmac.Equal(sig, magicLinkMAC(secret, uid, otpHash, strconv.FormatInt(expiryTime, 10)))
+}
+
+func magicLinkMAC(secret []byte, uid, otpHash, expiry string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("magic-link")) // Keeps these signatures apart from OTP hashes made with the same secret.
+	for _, part := range []string{uid, otpHash, expiry} {
+		mac.Write([]byte{0})
+		mac.Write([]byte(part))
+	}
+	return mac.Sum(nil)
+}
@@ -10,6 +10,7 @@ import (
 )
 
 var MongoClient *mongo.Client
+var MongoDatabase *mongo.Database
 var MongoCollection *mongo.Collection
 
 // Initialize MongoDB connection.
@@ -25,7 +26,8 @@ func InitMongoDB() {
 	}
 
 	// Connect to MongoDB.
-	MongoClient, err := mongo.Connect(context.Background(), options.Client().ApplyURI(mongoURI))
+	var err error
+	MongoClient, err = mongo.Connect(context.Background(), options.Client().ApplyURI(mongoURI))
 	if err != nil {
 		fmt.Println("ERROR CONNECTING TO MongoDB:", err)
 		os.Exit(1)
@@ -38,6 +40,7 @@ func InitMongoDB() {
 		os.Exit(1)
 	}
 
-	MongoCollection = MongoClient.Database(dbName).Collection(collectionName)
+	MongoDatabase = MongoClient.Database(dbName)
+	MongoCollection = MongoDatabase.Collection(collectionName)
 	fmt.Println("Connected to MongoDB.")
 }
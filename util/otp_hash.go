@@ -0,0 +1,36 @@
+package util
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"regexp"
+	"strings"
+)
+
+var otpHashPattern = regexp.MustCompile(`^[a-f0-9]{64}$`)
+
+// Computes the keyed hash that is stored in place of an OTP. The uid is mixed in so equal codes issued to
+// different users never produce equal hashes.
+func HashOTP(secret []byte, uid, otp string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(uid))
+	mac.Write([]byte{0})
+	mac.Write([]byte(strings.ToUpper(otp))) // OTPs are case-insensitive.
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Reports whether a stored OTP value is a hash produced by HashOTP rather than a legacy plaintext code.
+func IsHashedOTP(stored string) bool {
+	return otpHashPattern.MatchString(stored)
+}
+
+// Checks a user-supplied OTP against the stored value in constant time. Accounts that still hold a
+// plaintext OTP from before hashing was introduced are compared directly.
+func MatchOTP(secret []byte, uid, stored, otp string) bool {
+	if !IsHashedOTP(stored) {
+		return subtle.ConstantTimeCompare([]byte(strings.ToUpper(stored)), []byte(strings.ToUpper(otp))) == 1
+	}
+	return hmac.Equal([]byte(stored), []byte(HashOTP(secret, uid, otp)))
+}
@@ -0,0 +1,147 @@
+package util
+
+import (
+	"crypto/rand"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Named alphabets that OTP_ALPHABET accepts in place of a literal list of characters.
+var otpAlphabets = map[string]string{
+	"numeric":      "0123456789",
+	"alphanumeric": "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZ",
+}
+
+// Everything that shapes a one-time password: how it looks, how long it lives and how guessing is limited.
+type OTPPolicy struct {
+	// Number of characters in a code.
+	Length int
+	// Characters a code is drawn from. Codes are case-insensitive, so the alphabet holds no lowercase letters.
+	Alphabet string
+	// How long a code stays valid after it is sent.
+	TTL time.Duration
+	// Wrong guesses allowed on one code before the account is locked out.
+	MaxAttempts int
+	// How long each lockout lasts: the first lockout waits Cooldowns[0], the second Cooldowns[1] and so on,
+	// with the last entry repeating. A successful sign-in starts the sequence over.
+	Cooldowns []time.Duration
+}
+
+// The policy in use before it became configurable: 6 characters from 0-9A-Z, valid for 8 minutes, 4 attempts
+// and a 1-hour cooldown, escalating on repeated lockouts.
+func DefaultOTPPolicy() OTPPolicy {
+	return OTPPolicy{
+		Length:      6,
+		Alphabet:    otpAlphabets["alphanumeric"],
+		TTL:         8 * time.Minute,
+		MaxAttempts: 4,
+		Cooldowns:   []time.Duration{time.Hour, 6 * time.Hour, 24 * time.Hour},
+	}
+}
+
+// Reads the OTP policy from OTP_LENGTH, OTP_ALPHABET ("numeric", "alphanumeric" or the characters themselves),
+// OTP_TTL, OTP_MAX_ATTEMPTS and OTP_COOLDOWNS (e.g. "1h,6h,24h"). Unset variables keep their default.
+func OTPPolicyFromEnv() (OTPPolicy, error) {
+	policy := DefaultOTPPolicy()
+	policy.Length = GetEnvInt("OTP_LENGTH", policy.Length)
+	policy.TTL = GetEnvDuration("OTP_TTL", policy.TTL)
+	policy.MaxAttempts = GetEnvInt("OTP_MAX_ATTEMPTS", policy.MaxAttempts)
+
+	if alphabet := os.Getenv("OTP_ALPHABET"); alphabet != "" {
+		if named, ok := otpAlphabets[strings.ToLower(alphabet)]; ok {
+			alphabet = named
+		}
+		policy.Alphabet = alphabet
+	}
+
+	if value := os.Getenv("OTP_COOLDOWNS"); value != "" {
+		policy.Cooldowns = nil
+		for _, part := range strings.Split(value, ",") {
+			d, err := time.ParseDuration(strings.TrimSpace(part))
+			if err != nil || d <= 0 {
+				return OTPPolicy{}, fmt.Errorf("invalid OTP_COOLDOWNS entry %q", part)
+			}
+			policy.Cooldowns = append(policy.Cooldowns, d)
+		}
+	}
+
+	return policy, policy.Check()
+}
+
+// Reports why the policy cannot be used, or returns nil.
+func (p OTPPolicy) Check() error {
+	if p.Length < 4 || p.Length > 16 {
+		return fmt.Errorf("OTP length must be between 4 and 16, got %d", p.Length)
+	}
+	if len(p.Alphabet) < 2 || len(p.Alphabet) > 256 {
+		return fmt.Errorf("OTP alphabet must hold between 2 and 256 characters, got %d", len(p.Alphabet))
+	}
+	for i := 0; i < len(p.Alphabet); i++ {
+		c := p.Alphabet[i]
+		if c <= ' ' || c > '~' || (c >= 'a' && c <= 'z') {
+			return fmt.Errorf("OTP alphabet may only hold printable ASCII without lowercase letters, got %q", c)
+		}
+		if strings.IndexByte(p.Alphabet[:i], c) >= 0 {
+			return fmt.Errorf("OTP alphabet holds %q twice", c)
+		}
+	}
+	if p.TTL <= 0 {
+		return fmt.Errorf("OTP TTL must be positive")
+	}
+	if p.MaxAttempts < 1 {
+		return fmt.Errorf("OTP attempts must be at least 1, got %d", p.MaxAttempts)
+	}
+	if len(p.Cooldowns) == 0 {
+		return fmt.Errorf("at least one OTP cooldown is required")
+	}
+	return nil
+}
+
+// Generates a code under the policy, with every character drawn uniformly from the alphabet. Fails only if
+// the system's secure random generator does; there is deliberately no weaker fallback.
+func (p OTPPolicy) Generate() (string, error) {
+	n := len(p.Alphabet)
+
+	// Random bytes at or above the largest multiple of n would favour the first characters of the alphabet,
+	// so they are rejected and drawn again.
+	limit := 256 - 256%n
+
+	otp := make([]byte, 0, p.Length)
+	buf := make([]byte, p.Length*2)
+	for len(otp) < p.Length {
+		if _, err := rand.Read(buf); err != nil {
+			return "", fmt.Errorf("reading random bytes: %w", err)
+		}
+		for _, v := range buf {
+			if int(v) < limit && len(otp) < p.Length {
+				otp = append(otp, p.Alphabet[int(v)%n])
+			}
+		}
+	}
+	return string(otp), nil
+}
+
+// Reports whether a user-supplied code has the policy's shape. Codes are case-insensitive.
+func (p OTPPolicy) Valid(otp string) bool {
+	otp = strings.ToUpper(strings.TrimSpace(otp))
+	if len(otp) != p.Length {
+		return false
+	}
+	for i := 0; i < len(otp); i++ {
+		if strings.IndexByte(p.Alphabet, otp[i]) < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// The cooldown durations in milliseconds, the unit they are stored in.
+func (p OTPPolicy) CooldownMillis() []int64 {
+	millis := make([]int64, len(p.Cooldowns))
+	for i, d := range p.Cooldowns {
+		millis[i] = d.Milliseconds()
+	}
+	return millis
+}
@@ -3,12 +3,17 @@ package util
 import (
 	"encoding/json"
 	"net/http"
+
+	"bearlysocial-backend/i18n"
 )
 
-func ReturnMessage(w http.ResponseWriter, statusCode int, message string) {
+// Responds with a plain message, for successful requests that have nothing else to return. The message is an
+// English format and arguments, as for i18n.Sprintf, translated into the language set in the Content-Language
+// header. Errors are written with the problem package instead.
+func ReturnMessage(w http.ResponseWriter, statusCode int, message string, args ...interface{}) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(statusCode)
 	json.NewEncoder(w).Encode(map[string]interface{}{
-		"message": message,
+		"message": i18n.Sprintf(i18n.FromHeader(w.Header()), message, args...),
 	})
 }
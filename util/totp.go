@@ -0,0 +1,181 @@
+package util
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// TOTP parameters as in RFC 6238 and as every authenticator app supports them: HMAC-SHA1, 30-second steps
+	// and 6 digits.
+	totpPeriod = 30
+	totpDigits = 6
+
+	// Steps either side of the current one that are still accepted, to allow for clock drift and typing time.
+	totpSkew = 1
+
+	// Recovery codes are 10 characters, shown as two groups of 5, from an alphabet without look-alikes.
+	recoveryCodeLength   = 10
+	recoveryCodeAlphabet = "23456789ABCDEFGHJKMNPQRSTUVWXYZ"
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// Creates a new 160-bit TOTP secret, the size RFC 4226 recommends for HMAC-SHA1.
+func GenerateTOTPSecret() ([]byte, error) {
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
+
+// Encodes a TOTP secret the way authenticator apps expect it to be typed in: unpadded base32.
+func EncodeTOTPSecret(secret []byte) string {
+	return totpEncoding.EncodeToString(secret)
+}
+
+// Builds the otpauth:// URI that authenticator apps read from a QR code.
+func TOTPProvisioningURI(issuer, account string, secret []byte) string {
+	query := url.Values{}
+	query.Set("secret", EncodeTOTPSecret(secret))
+	query.Set("issuer", issuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprint(totpDigits))
+	query.Set("period", fmt.Sprint(totpPeriod))
+
+	uri := url.URL{
+		Scheme: "otpauth",
+		Host: "totp",
+		Path: "/" + issuer + ":" + account,
+		RawQuery: query.Encode(),
+	}
+	return uri.String()
+}
+
+// The time step a moment falls in.
+func TOTPStep(t time.Time) int64 {
+	return t.Unix() / totpPeriod
+}
+
+// Computes the code for a time step, as in RFC 4226 section 5.3.
+func TOTPCode(secret []byte, step int64) string {
+	mac := hmac.New(sha1.New, secret)
+	binary.Write(mac, binary.BigEndian, step)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value % 1000000)
+}
+
+// Reports whether a string looks like a TOTP code, so it can be told apart from a recovery code.
+func ValidTOTPCode(code string) bool {
+	if len(code) != totpDigits {
+		return false
+	}
+	for _, c := range code {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// Checks a code against the steps around now and returns the step it matched. Callers must refuse steps at
+// or before the last one used, since a code stays valid for the whole window and could otherwise be replayed.
+func MatchTOTP(secret []byte, code string, now time.Time) (int64, bool) {
+	if !ValidTOTPCode(code) {
+		return 0, false
+	}
+
+	// Every step is checked, so the time taken does not reveal which one matched.
+	current := TOTPStep(now)
+	var matched int64
+	ok := false
+	for step := current - totpSkew; step <= current + totpSkew; step++ {
+		if hmac.Equal([]byte(TOTPCode(secret, step)), []byte(code)) {
+			matched, ok = step, true
+		}
+	}
+	return matched, ok
+}
+
+// Encrypts a TOTP secret for storage. Unlike OTPs it cannot be hashed, since codes are computed from it, so it
+// is sealed with AES-GCM under a key derived from the server secret and bound to the account it belongs to.
+func SealTOTPSecret(serverSecret []byte, uid string, secret []byte) (string, error) {
+	aead, err := totpAEAD(serverSecret)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, secret, []byte(uid))
+	return base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypts a TOTP secret sealed by SealTOTPSecret for the same account.
+func OpenTOTPSecret(serverSecret []byte, uid string, sealed string) ([]byte, error) {
+	aead, err := totpAEAD(serverSecret)
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := base64.RawStdEncoding.DecodeString(sealed)
+	if err != nil || len(raw) < aead.NonceSize() {
+		return nil, errors.New("malformed sealed TOTP secret")
+	}
+	return aead.Open(nil, raw[:aead.NonceSize()], raw[aead.NonceSize():], []byte(uid))
+}
+
+func totpAEAD(serverSecret []byte) (cipher.AEAD, error) {
+	mac := hmac.New(sha256.New, serverSecret)
+	mac.Write([]byte("totp-secret")) // Keeps this key apart from OTP hashes made with the same secret.
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Creates n one-time recovery codes, formatted for display as "XXXXX-XXXXX".
+func GenerateRecoveryCodes(n int) ([]string, error) {
+	policy := OTPPolicy{Length: recoveryCodeLength, Alphabet: recoveryCodeAlphabet}
+
+	codes := make([]string, n)
+	for i := range codes {
+		code, err := policy.Generate()
+		if err != nil {
+			return nil, err
+		}
+		codes[i] = code[:recoveryCodeLength/2] + "-" + code[recoveryCodeLength/2:]
+	}
+	return codes, nil
+}
+
+// Brings a recovery code as typed by the user into the form it was hashed in: upper case, without the dash
+// or any spaces.
+func NormalizeRecoveryCode(code string) string {
+	code = strings.ToUpper(code)
+	return strings.NewReplacer("-", "", " ", "").Replace(code)
+}
+
+// Computes the keyed hash that is stored in place of a recovery code.
+func HashRecoveryCode(secret []byte, uid, code string) string {
+	return HashOTP(secret, uid, "recovery:" + NormalizeRecoveryCode(code))
+}
@@ -1,16 +1,14 @@
 package util
 
 import (
+	"encoding/json"
 	"regexp"
 	"strings"
-)
+	"unicode"
+	"unicode/utf8"
 
-func ValidEmail(email string) bool {
-	email = strings.TrimSpace(email) // Trim spaces.
-	pattern := `^[\w-\.]+@([\w-]+\.)+[\w-]{2,4}$`
-	re := regexp.MustCompile(pattern)
-	return re.MatchString(email)
-}
+	"bearlysocial-backend/emailaddr"
+)
 
 func ValidHashpass(hashpass string) bool {
     if len(hashpass) != 64 {
@@ -21,25 +19,136 @@ func ValidHashpass(hashpass string) bool {
     return match
 }
 
-func ValidOTP(otp string) bool {
-	otp = strings.TrimSpace(otp)
-	pattern := `^[A-Za-z0-9]{6}$` // Matches exactly 6 alphanumeric characters
-	re := regexp.MustCompile(pattern)
-	return re.MatchString(otp)
-}
+func ValidToken(token string) bool {
+	token = strings.ToLower(token)
+
+	// Current tokens are a bare 64-character 'hashpass'.
+	if !strings.Contains(token, "::") {
+		return ValidHashpass(token)
+	}
 
-func ValidToken(token string) (bool) {
-	// Split the token into uid and 'hashpass'.
-	parts := strings.Split(strings.ToLower(token), "::")
+	// Legacy tokens are made of a uid and a 'hashpass'; they are still accepted until they are rotated.
+	parts := strings.Split(token, "::")
 	if len(parts) != 2 {
 		return false
 	}
 	uid, hashpass := parts[0], parts[1]
 
 	// Validate the uid (assuming it's an email) and check if 'hashpass' is a 64-char lowercase alphanumeric string.
-	if !ValidEmail(uid) || !ValidHashpass(hashpass) {
+	if !emailaddr.Valid(uid) || !ValidHashpass(hashpass) {
+		return false
+	}
+
+	return true
+}
+
+var (
+	namePattern     = regexp.MustCompile(`^[\p{L}\p{M}' .-]*$`)
+	interestPattern = regexp.MustCompile(`^[\p{L}\p{M}\p{N} &'-]+$`)
+	langPattern     = regexp.MustCompile(`^[a-z]{2,3}$`)
+	instaPattern    = regexp.MustCompile(`^[A-Za-z0-9._]{1,30}$`)
+	fbPattern       = regexp.MustCompile(`^[A-Za-z0-9.]{5,50}$`)
+	linkedinPattern = regexp.MustCompile(`^[A-Za-z0-9-]{3,100}$`)
+)
+
+// Validates a first or last name; an empty name is allowed so users can clear it.
+func ValidName(name string) bool {
+	return utf8.RuneCountInString(name) <= 50 && namePattern.MatchString(name)
+}
+
+// Validates a list of up to 10 distinct interests of at most 30 characters each.
+func ValidInterests(interests []string) bool {
+	if len(interests) > 10 {
+		return false
+	}
+	seen := make(map[string]bool, len(interests))
+	for _, interest := range interests {
+		key := strings.ToLower(interest)
+		if seen[key] || utf8.RuneCountInString(interest) > 30 || !interestPattern.MatchString(interest) {
+			return false
+		}
+		seen[key] = true
+	}
+	return true
+}
+
+// Validates a list of up to 10 distinct ISO 639 language codes (e.g. "en", "id").
+func ValidLangs(langs []string) bool {
+	if len(langs) > 10 {
 		return false
 	}
+	seen := make(map[string]bool, len(langs))
+	for _, lang := range langs {
+		if seen[lang] || !langPattern.MatchString(lang) {
+			return false
+		}
+		seen[lang] = true
+	}
+	return true
+}
+
+// Validates an Instagram username; an empty handle is allowed so users can clear it.
+func ValidInstaHandler(handler string) bool {
+	return handler == "" || instaPattern.MatchString(handler)
+}
 
+// Validates a Facebook username; an empty handle is allowed so users can clear it.
+func ValidFB_Handler(handler string) bool {
+	return handler == "" || fbPattern.MatchString(handler)
+}
+
+// Validates a LinkedIn profile slug; an empty handle is allowed so users can clear it.
+func ValidLinkedinHandler(handler string) bool {
+	return handler == "" || linkedinPattern.MatchString(handler)
+}
+
+// Validates a free-text mood of at most 100 printable characters.
+func ValidMood(mood string) bool {
+	return utf8.RuneCountInString(mood) <= 100 && isPrintable(mood)
+}
+
+// Validates a schedule object, limiting the number of keys and its encoded size. Keys are checked at every depth,
+// since MongoDB would read a "$" prefix or a "." in any of them as an operator or a path.
+func ValidSchedule(schedule map[string]interface{}) bool {
+	encoded, err := json.Marshal(schedule)
+	return err == nil && len(encoded) <= 8*1024 && validScheduleValue(schedule)
+}
+
+// Checks the keys of every object within a schedule value.
+func validScheduleValue(value interface{}) bool {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		if len(value) > 64 {
+			return false
+		}
+		for key, nested := range value {
+			if key == "" || len(key) > 32 || strings.HasPrefix(key, "$") || strings.Contains(key, ".") {
+				return false
+			}
+			if !validScheduleValue(nested) {
+				return false
+			}
+		}
+	case []interface{}:
+		for _, nested := range value {
+			if !validScheduleValue(nested) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Validates a device label of at most 64 printable characters.
+func ValidDeviceLabel(label string) bool {
+	return utf8.RuneCountInString(label) <= 64 && isPrintable(label)
+}
+
+func isPrintable(s string) bool {
+	for _, r := range s {
+		if !unicode.IsPrint(r) {
+			return false
+		}
+	}
 	return true
 }
@@ -0,0 +1,193 @@
+package webauthn
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// The subset of CBOR (RFC 8949) that WebAuthn uses. Authenticators emit the CTAP2 canonical form, so
+// indefinite lengths are rejected rather than supported. Values decode to int64, []byte, string,
+// []interface{}, map[interface{}]interface{}, bool, float64 or nil; tags are dropped in favour of the value
+// they wrap.
+
+var errCBOR = errors.New("malformed CBOR")
+
+// Deepest nesting accepted, so hostile input cannot exhaust the stack.
+const maxCBORDepth = 16
+
+// Decodes the first CBOR item in data and returns it along with the bytes that follow it. Authenticator data
+// carries a COSE key followed by extensions, so trailing bytes are not an error here.
+func decodeCBOR(data []byte) (interface{}, []byte, error) {
+	return decodeCBORItem(data, 0)
+}
+
+func decodeCBORItem(data []byte, depth int) (interface{}, []byte, error) {
+	if depth > maxCBORDepth {
+		return nil, nil, fmt.Errorf("%w: nested too deeply", errCBOR)
+	}
+	if len(data) == 0 {
+		return nil, nil, fmt.Errorf("%w: unexpected end of input", errCBOR)
+	}
+
+	major := data[0] >> 5
+	info := data[0] & 0x1f
+
+	// Simple values and floats keep their payload in the additional information, so handle them first.
+	if major == 7 {
+		return decodeCBORSimple(data, info)
+	}
+
+	arg, rest, err := cborArgument(data, info)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch major {
+	case 0: // Unsigned integer.
+		if arg > math.MaxInt64 {
+			return nil, nil, fmt.Errorf("%w: integer out of range", errCBOR)
+		}
+		return int64(arg), rest, nil
+
+	case 1: // Negative integer, encoded as -1 - arg.
+		if arg > math.MaxInt64 {
+			return nil, nil, fmt.Errorf("%w: integer out of range", errCBOR)
+		}
+		return -1 - int64(arg), rest, nil
+
+	case 2, 3: // Byte string, text string.
+		if arg > uint64(len(rest)) {
+			return nil, nil, fmt.Errorf("%w: string longer than input", errCBOR)
+		}
+		if major == 2 {
+			return append([]byte(nil), rest[:arg]...), rest[arg:], nil
+		}
+		return string(rest[:arg]), rest[arg:], nil
+
+	case 4: // Array.
+		if arg > uint64(len(rest)) { // Every item takes at least one byte.
+			return nil, nil, fmt.Errorf("%w: array longer than input", errCBOR)
+		}
+		items := make([]interface{}, 0, arg)
+		for i := uint64(0); i < arg; i++ {
+			var item interface{}
+			if item, rest, err = decodeCBORItem(rest, depth+1); err != nil {
+				return nil, nil, err
+			}
+			items = append(items, item)
+		}
+		return items, rest, nil
+
+	case 5: // Map.
+		if arg > uint64(len(rest))/2 { // Every entry takes at least two bytes.
+			return nil, nil, fmt.Errorf("%w: map longer than input", errCBOR)
+		}
+		m := make(map[interface{}]interface{}, arg)
+		for i := uint64(0); i < arg; i++ {
+			var key, value interface{}
+			if key, rest, err = decodeCBORItem(rest, depth+1); err != nil {
+				return nil, nil, err
+			}
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, nil, fmt.Errorf("%w: unsupported map key type %T", errCBOR, key)
+			}
+			if _, dup := m[key]; dup {
+				return nil, nil, fmt.Errorf("%w: duplicate map key %v", errCBOR, key)
+			}
+			if value, rest, err = decodeCBORItem(rest, depth+1); err != nil {
+				return nil, nil, err
+			}
+			m[key] = value
+		}
+		return m, rest, nil
+
+	default: // 6: tag. The tag number carries no meaning for WebAuthn.
+		return decodeCBORItem(rest, depth+1)
+	}
+}
+
+// Reads the argument that follows the initial byte: the length of strings and containers, or an integer's value.
+func cborArgument(data []byte, info byte) (uint64, []byte, error) {
+	rest := data[1:]
+	var size int
+	switch {
+	case info < 24:
+		return uint64(info), rest, nil
+	case info == 24:
+		size = 1
+	case info == 25:
+		size = 2
+	case info == 26:
+		size = 4
+	case info == 27:
+		size = 8
+	default:
+		return 0, nil, fmt.Errorf("%w: indefinite or reserved length", errCBOR)
+	}
+	if len(rest) < size {
+		return 0, nil, fmt.Errorf("%w: unexpected end of input", errCBOR)
+	}
+
+	var arg uint64
+	for _, b := range rest[:size] {
+		arg = arg<<8 | uint64(b)
+	}
+	return arg, rest[size:], nil
+}
+
+func decodeCBORSimple(data []byte, info byte) (interface{}, []byte, error) {
+	rest := data[1:]
+	switch info {
+	case 20:
+		return false, rest, nil
+	case 21:
+		return true, rest, nil
+	case 22, 23: // Null, undefined.
+		return nil, rest, nil
+	case 25:
+		if len(rest) < 2 {
+			break
+		}
+		return halfToFloat(binary.BigEndian.Uint16(rest)), rest[2:], nil
+	case 26:
+		if len(rest) < 4 {
+			break
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(rest))), rest[4:], nil
+	case 27:
+		if len(rest) < 8 {
+			break
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(rest)), rest[8:], nil
+	default:
+		return nil, nil, fmt.Errorf("%w: unsupported simple value %d", errCBOR, info)
+	}
+	return nil, nil, fmt.Errorf("%w: unexpected end of input", errCBOR)
+}
+
+// Converts an IEEE 754 half-precision float.
+func halfToFloat(h uint16) float64 {
+	exp := int(h>>10) & 0x1f
+	frac := float64(h & 0x3ff)
+	var f float64
+	switch exp {
+	case 0:
+		f = math.Ldexp(frac, -24)
+	case 31:
+		if frac == 0 {
+			f = math.Inf(1)
+		} else {
+			f = math.NaN()
+		}
+	default:
+		f = math.Ldexp(frac+1024, exp-25)
+	}
+	if h&0x8000 != 0 {
+		f = -f
+	}
+	return f
+}
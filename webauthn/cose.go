@@ -0,0 +1,121 @@
+package webauthn
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// COSE algorithm identifiers (RFC 9053) accepted for passkeys, in order of preference.
+const (
+	AlgES256 int64 = -7
+	AlgEdDSA int64 = -8
+	AlgRS256 int64 = -257
+)
+
+// The algorithms offered to authenticators during registration.
+var SupportedAlgs = []int64{AlgES256, AlgEdDSA, AlgRS256}
+
+// COSE key parameters.
+const (
+	coseKty = 1
+	coseAlg = 3
+	coseCrv = -1 // Curve for EC2 and OKP keys; modulus n for RSA keys.
+	coseX   = -2 // x coordinate; exponent e for RSA keys.
+	coseY   = -3
+
+	ktyOKP = 1
+	ktyEC2 = 2
+	ktyRSA = 3
+
+	crvP256    = 1
+	crvEd25519 = 6
+)
+
+var errCOSE = errors.New("unsupported or malformed COSE key")
+
+// A credential public key decoded from its COSE form.
+type publicKey struct {
+	alg int64
+	key crypto.PublicKey
+}
+
+// Decodes a COSE_Key (RFC 9052, section 7) and returns the key along with any bytes that follow it.
+func parseCOSEKey(data []byte) (publicKey, []byte, error) {
+	item, rest, err := decodeCBOR(data)
+	if err != nil {
+		return publicKey{}, nil, err
+	}
+	m, ok := item.(map[interface{}]interface{})
+	if !ok {
+		return publicKey{}, nil, fmt.Errorf("%w: not a map", errCOSE)
+	}
+
+	kty, _ := m[int64(coseKty)].(int64)
+	alg, _ := m[int64(coseAlg)].(int64)
+	param := func(label int64) []byte {
+		b, _ := m[label].([]byte)
+		return b
+	}
+
+	switch {
+	case kty == ktyEC2 && alg == AlgES256:
+		if crv, _ := m[int64(coseCrv)].(int64); crv != crvP256 {
+			return publicKey{}, nil, fmt.Errorf("%w: ES256 key not on P-256", errCOSE)
+		}
+		x, y := param(coseX), param(coseY)
+		if len(x) != 32 || len(y) != 32 {
+			return publicKey{}, nil, fmt.Errorf("%w: bad P-256 coordinates", errCOSE)
+		}
+		// Let crypto/ecdh reject points that are not on the curve before the key is ever used.
+		if _, err := ecdh.P256().NewPublicKey(append(append([]byte{4}, x...), y...)); err != nil {
+			return publicKey{}, nil, fmt.Errorf("%w: %v", errCOSE, err)
+		}
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		return publicKey{alg: alg, key: key}, rest, nil
+
+	case kty == ktyOKP && alg == AlgEdDSA:
+		if crv, _ := m[int64(coseCrv)].(int64); crv != crvEd25519 {
+			return publicKey{}, nil, fmt.Errorf("%w: EdDSA key not on Ed25519", errCOSE)
+		}
+		x := param(coseX)
+		if len(x) != ed25519.PublicKeySize {
+			return publicKey{}, nil, fmt.Errorf("%w: bad Ed25519 key", errCOSE)
+		}
+		return publicKey{alg: alg, key: ed25519.PublicKey(x)}, rest, nil
+
+	case kty == ktyRSA && alg == AlgRS256:
+		n, e := param(coseCrv), param(coseX)
+		if len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return publicKey{}, nil, fmt.Errorf("%w: bad RSA key", errCOSE) // Fewer than 2048 bits, or odd exponent.
+		}
+		exp := int(new(big.Int).SetBytes(e).Int64())
+		if exp < 3 || exp%2 == 0 {
+			return publicKey{}, nil, fmt.Errorf("%w: bad RSA exponent", errCOSE)
+		}
+		return publicKey{alg: alg, key: &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: exp}}, rest, nil
+	}
+	return publicKey{}, nil, fmt.Errorf("%w: key type %d with algorithm %d", errCOSE, kty, alg)
+}
+
+// Checks sig over message. For ES256 the signature is ASN.1 DER encoded, as WebAuthn specifies.
+func (k publicKey) verify(message, sig []byte) bool {
+	switch key := k.key.(type) {
+	case *ecdsa.PublicKey:
+		digest := sha256.Sum256(message)
+		return ecdsa.VerifyASN1(key, digest[:], sig)
+	case ed25519.PublicKey:
+		return ed25519.Verify(key, message, sig)
+	case *rsa.PublicKey:
+		digest := sha256.Sum256(message)
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig) == nil
+	}
+	return false
+}
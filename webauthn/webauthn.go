@@ -0,0 +1,315 @@
+// Package webauthn verifies passkey registrations and assertions (WebAuthn Level 2) for a single relying
+// party. Attestation is not requested and not checked: a passkey proves possession of its key, which is all
+// sign-in needs, whatever device holds it.
+package webauthn
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// Returned, wrapped with the reason, whenever a registration or assertion does not check out.
+var ErrVerification = errors.New("webauthn verification failed")
+
+// Authenticator data flags.
+const (
+	flagUserPresent  = 0x01
+	flagUserVerified = 0x04
+	flagAttested     = 0x40
+	flagExtensions   = 0x80
+)
+
+// How long the browser or app lets the user take to complete a ceremony.
+const ceremonyTimeout = 5 * time.Minute
+
+// The relying party, i.e. this service as authenticators see it.
+type Config struct {
+	// Domain the passkeys are bound to, e.g. "bearlysocial.com".
+	RPID string
+	// Name shown by authenticators.
+	RPName string
+	// Origins ceremonies may come from: "https://" web origins under RPID, and the origins of native apps
+	// (e.g. "android:apk-key-hash:...").
+	Origins []string
+}
+
+// A verified credential, as stored for later assertions.
+type Credential struct {
+	ID []byte
+	// The credential's public key in its COSE encoding, exactly as the authenticator sent it.
+	PublicKey []byte
+	SignCount uint32
+}
+
+type rpEntity struct {
+	ID   string `json:"id,omitempty"`
+	Name string `json:"name"`
+}
+
+type userEntity struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName"`
+}
+
+type credentialParam struct {
+	Type string `json:"type"`
+	Alg  int64  `json:"alg"`
+}
+
+type credentialDescriptor struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+}
+
+type authenticatorSelection struct {
+	ResidentKey        string `json:"residentKey"`
+	RequireResidentKey bool   `json:"requireResidentKey"`
+	UserVerification   string `json:"userVerification"`
+}
+
+// PublicKeyCredentialCreationOptionsJSON, ready to hand to navigator.credentials.create() or a native
+// passkey API. Binary fields are base64url encoded.
+type CreationOptions struct {
+	RP                     rpEntity               `json:"rp"`
+	User                   userEntity             `json:"user"`
+	Challenge              string                 `json:"challenge"`
+	PubKeyCredParams       []credentialParam      `json:"pubKeyCredParams"`
+	Timeout                int64                  `json:"timeout"`
+	ExcludeCredentials     []credentialDescriptor `json:"excludeCredentials"`
+	AuthenticatorSelection authenticatorSelection `json:"authenticatorSelection"`
+	Attestation            string                 `json:"attestation"`
+}
+
+// PublicKeyCredentialRequestOptionsJSON, ready to hand to navigator.credentials.get() or a native passkey API.
+// An empty AllowCredentials lets the user pick any passkey they hold for this relying party.
+type RequestOptions struct {
+	Challenge        string                 `json:"challenge"`
+	Timeout          int64                  `json:"timeout"`
+	RPID             string                 `json:"rpId"`
+	AllowCredentials []credentialDescriptor `json:"allowCredentials"`
+	UserVerification string                 `json:"userVerification"`
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func descriptors(ids [][]byte) []credentialDescriptor {
+	list := make([]credentialDescriptor, 0, len(ids))
+	for _, id := range ids {
+		list = append(list, credentialDescriptor{Type: "public-key", ID: b64(id)})
+	}
+	return list
+}
+
+// Options for registering a discoverable passkey. exclude lists the user's existing credentials, so an
+// authenticator that already holds one does not register a second.
+func (c *Config) CreationOptions(challenge, userHandle []byte, userName string, exclude [][]byte) CreationOptions {
+	params := make([]credentialParam, 0, len(SupportedAlgs))
+	for _, alg := range SupportedAlgs {
+		params = append(params, credentialParam{Type: "public-key", Alg: alg})
+	}
+
+	return CreationOptions{
+		RP:                 rpEntity{ID: c.RPID, Name: c.RPName},
+		User:               userEntity{ID: b64(userHandle), Name: userName, DisplayName: userName},
+		Challenge:          b64(challenge),
+		PubKeyCredParams:   params,
+		Timeout:            ceremonyTimeout.Milliseconds(),
+		ExcludeCredentials: descriptors(exclude),
+		AuthenticatorSelection: authenticatorSelection{
+			ResidentKey:        "required",
+			RequireResidentKey: true,
+			UserVerification:   "required",
+		},
+		Attestation: "none",
+	}
+}
+
+// Options for signing in with a passkey, limited to the credentials in allow if there are any.
+func (c *Config) RequestOptions(challenge []byte, allow [][]byte) RequestOptions {
+	return RequestOptions{
+		Challenge:        b64(challenge),
+		Timeout:          ceremonyTimeout.Milliseconds(),
+		RPID:             c.RPID,
+		AllowCredentials: descriptors(allow),
+		UserVerification: "required",
+	}
+}
+
+type clientData struct {
+	Type        string `json:"type"`
+	Challenge   string `json:"challenge"`
+	Origin      string `json:"origin"`
+	CrossOrigin bool   `json:"crossOrigin"`
+}
+
+// Returns the challenge a client answered, so the server can look up what it issued. Nothing is verified yet.
+func ClientChallenge(clientDataJSON []byte) ([]byte, error) {
+	var cd clientData
+	if err := json.Unmarshal(clientDataJSON, &cd); err != nil {
+		return nil, fmt.Errorf("%w: client data: %v", ErrVerification, err)
+	}
+	challenge, err := base64.RawURLEncoding.DecodeString(cd.Challenge)
+	if err != nil || len(challenge) == 0 {
+		return nil, fmt.Errorf("%w: client data challenge is not base64url", ErrVerification)
+	}
+	return challenge, nil
+}
+
+// Checks the client data of a ceremony of the given type against the challenge that was issued for it.
+func (c *Config) verifyClientData(clientDataJSON []byte, ceremony string, challenge []byte) error {
+	var cd clientData
+	if err := json.Unmarshal(clientDataJSON, &cd); err != nil {
+		return fmt.Errorf("%w: client data: %v", ErrVerification, err)
+	}
+	if cd.Type != ceremony {
+		return fmt.Errorf("%w: client data type %q, want %q", ErrVerification, cd.Type, ceremony)
+	}
+	if cd.Challenge != b64(challenge) {
+		return fmt.Errorf("%w: challenge mismatch", ErrVerification)
+	}
+	if !slices.Contains(c.Origins, cd.Origin) {
+		return fmt.Errorf("%w: origin %q not allowed", ErrVerification, cd.Origin)
+	}
+	if cd.CrossOrigin {
+		return fmt.Errorf("%w: cross-origin ceremony", ErrVerification)
+	}
+	return nil
+}
+
+type authenticatorData struct {
+	flags     byte
+	signCount uint32
+
+	// Only present in registrations.
+	credentialID []byte
+	publicKey    []byte
+	key          publicKey
+}
+
+// Parses authenticator data and checks what every ceremony requires: the right relying party, and a user who
+// was both present and verified.
+func (c *Config) parseAuthenticatorData(data []byte) (authenticatorData, error) {
+	if len(data) < 37 {
+		return authenticatorData{}, fmt.Errorf("%w: authenticator data too short", ErrVerification)
+	}
+
+	rpIDHash := sha256.Sum256([]byte(c.RPID))
+	if !bytes.Equal(data[:32], rpIDHash[:]) {
+		return authenticatorData{}, fmt.Errorf("%w: relying party ID mismatch", ErrVerification)
+	}
+
+	ad := authenticatorData{flags: data[32], signCount: binary.BigEndian.Uint32(data[33:37])}
+	if ad.flags&flagUserPresent == 0 {
+		return authenticatorData{}, fmt.Errorf("%w: user not present", ErrVerification)
+	}
+	if ad.flags&flagUserVerified == 0 {
+		return authenticatorData{}, fmt.Errorf("%w: user not verified", ErrVerification)
+	}
+
+	rest := data[37:]
+	if ad.flags&flagAttested != 0 {
+		// AAGUID, credential ID length and credential ID, followed by the COSE key.
+		if len(rest) < 18 {
+			return authenticatorData{}, fmt.Errorf("%w: attested credential data too short", ErrVerification)
+		}
+		idLen := int(binary.BigEndian.Uint16(rest[16:18]))
+		rest = rest[18:]
+		if idLen == 0 || idLen > 1023 || len(rest) < idLen {
+			return authenticatorData{}, fmt.Errorf("%w: bad credential ID length", ErrVerification)
+		}
+		ad.credentialID = append([]byte(nil), rest[:idLen]...)
+		rest = rest[idLen:]
+
+		key, after, err := parseCOSEKey(rest)
+		if err != nil {
+			return authenticatorData{}, fmt.Errorf("%w: %v", ErrVerification, err)
+		}
+		ad.key = key
+		ad.publicKey = append([]byte(nil), rest[:len(rest)-len(after)]...)
+		rest = after
+	}
+	if ad.flags&flagExtensions != 0 {
+		ext, after, err := decodeCBOR(rest)
+		if _, ok := ext.(map[interface{}]interface{}); err != nil || !ok {
+			return authenticatorData{}, fmt.Errorf("%w: malformed extensions", ErrVerification)
+		}
+		rest = after
+	}
+	if len(rest) != 0 {
+		return authenticatorData{}, fmt.Errorf("%w: trailing bytes in authenticator data", ErrVerification)
+	}
+	return ad, nil
+}
+
+// Verifies the response to navigator.credentials.create() for the given challenge and returns the new
+// credential.
+func (c *Config) VerifyRegistration(challenge, clientDataJSON, attestationObject []byte) (Credential, error) {
+	if err := c.verifyClientData(clientDataJSON, "webauthn.create", challenge); err != nil {
+		return Credential{}, err
+	}
+
+	item, rest, err := decodeCBOR(attestationObject)
+	if err != nil || len(rest) != 0 {
+		return Credential{}, fmt.Errorf("%w: malformed attestation object", ErrVerification)
+	}
+	obj, ok := item.(map[interface{}]interface{})
+	if !ok {
+		return Credential{}, fmt.Errorf("%w: attestation object is not a map", ErrVerification)
+	}
+	// The attestation statement is deliberately ignored; see the package comment.
+	rawAuthData, ok := obj["authData"].([]byte)
+	if !ok {
+		return Credential{}, fmt.Errorf("%w: attestation object lacks authData", ErrVerification)
+	}
+
+	ad, err := c.parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return Credential{}, err
+	}
+	if ad.credentialID == nil {
+		return Credential{}, fmt.Errorf("%w: no attested credential data", ErrVerification)
+	}
+
+	return Credential{ID: ad.credentialID, PublicKey: ad.publicKey, SignCount: ad.signCount}, nil
+}
+
+// Verifies the response to navigator.credentials.get() for the given challenge against a stored credential
+// and returns the authenticator's new signature counter.
+func (c *Config) VerifyAssertion(challenge []byte, cred Credential, clientDataJSON, rawAuthData, signature []byte) (uint32, error) {
+	if err := c.verifyClientData(clientDataJSON, "webauthn.get", challenge); err != nil {
+		return 0, err
+	}
+
+	ad, err := c.parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return 0, err
+	}
+
+	key, rest, err := parseCOSEKey(cred.PublicKey)
+	if err != nil || len(rest) != 0 {
+		return 0, fmt.Errorf("%w: stored public key: %v", ErrVerification, err)
+	}
+
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	signed := append(append([]byte(nil), rawAuthData...), clientDataHash[:]...)
+	if !key.verify(signed, signature) {
+		return 0, fmt.Errorf("%w: bad signature", ErrVerification)
+	}
+
+	// Authenticators that count signatures never go backwards; one that does has likely been cloned. Synced
+	// passkeys always report zero, which is fine.
+	if (ad.signCount != 0 || cred.SignCount != 0) && ad.signCount <= cred.SignCount {
+		return 0, fmt.Errorf("%w: signature counter went from %d to %d", ErrVerification, cred.SignCount, ad.signCount)
+	}
+	return ad.signCount, nil
+}